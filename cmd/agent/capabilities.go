@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"personal_ai/internal/api"
+)
+
+// capabilities is the GET /capabilities body: what the agent will run and
+// the limits it enforces, so callers can check a command before sending it.
+type capabilities struct {
+	APIVersion      int              `json:"api_version"`
+	Commands        []string         `json:"commands"`
+	DynamicCommands []string         `json:"dynamic_commands"`
+	Limits          capabilityLimits `json:"limits"`
+}
+
+type capabilityLimits struct {
+	DefaultTimeoutSec int  `json:"default_timeout_sec"`
+	MaxOutputKB       int  `json:"max_output_kb"`
+	MaxArgs           int  `json:"max_args"`
+	MaxArgBytes       int  `json:"max_arg_bytes"`
+	ReadOnly          bool `json:"read_only"`
+}
+
+// agentCapabilities lists the allowlisted and dynamic command names, sorted
+// and without blocklisted entries. Glob keys are listed as written.
+func agentCapabilities(cfg *AgentConfig) capabilities {
+	commands := []string{}
+	for name := range cfg.Execution.CommandAllowlist {
+		if !isBlocked(name, cfg.Execution.CommandBlocklist) {
+			commands = append(commands, name)
+		}
+	}
+	if len(cfg.Execution.ManagedServices) > 0 && !isBlocked(serviceCommand, cfg.Execution.CommandBlocklist) {
+		commands = append(commands, serviceCommand)
+	}
+	sort.Strings(commands)
+	dynamic := []string{}
+	for _, name := range cfg.Execution.DynamicAllowlist {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" && !isBlocked(name, cfg.Execution.CommandBlocklist) && !isBlocked(name, cfg.Execution.DynamicBlocklist) {
+			dynamic = append(dynamic, name)
+		}
+	}
+	sort.Strings(dynamic)
+	return capabilities{
+		APIVersion:      apiVersion,
+		Commands:        commands,
+		DynamicCommands: dynamic,
+		Limits: capabilityLimits{
+			DefaultTimeoutSec: cfg.Execution.DefaultTimeoutSec,
+			MaxOutputKB:       cfg.Execution.MaxOutputKB,
+			MaxArgs:           cfg.Execution.MaxArgs,
+			MaxArgBytes:       cfg.Execution.MaxArgBytes,
+			ReadOnly:          cfg.Execution.ReadOnly,
+		},
+	}
+}
+
+// newCapabilitiesHandler serves GET /capabilities behind the same auth token
+// as /command.
+func newCapabilitiesHandler(cfg *AgentConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w, closeBody := gzipResponse(w, r)
+		defer closeBody()
+		if r.Method != http.MethodGet {
+			writeCommandResponse(w, rejected(api.ReasonMethodNotAllowed, "method not allowed"))
+			return
+		}
+		if cfg.AuthToken != "" && r.Header.Get("X-Auth-Token") != cfg.AuthToken {
+			writeCommandResponse(w, rejected(api.ReasonUnauthorized, "unauthorized"))
+			return
+		}
+		w.Header().Set("X-API-Version", strconv.Itoa(apiVersion))
+		writeJSON(w, http.StatusOK, agentCapabilities(cfg))
+	}
+}
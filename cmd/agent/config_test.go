@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"personal_ai/internal/api"
 )
 
 func TestLoadConfigDefaults(t *testing.T) {
@@ -32,3 +35,84 @@ func TestLoadConfigDefaults(t *testing.T) {
 		t.Fatalf("expected default max output 8, got %d", cfg.Execution.MaxOutputKB)
 	}
 }
+
+func TestLoadConfigValidatesAllowedLsFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.json")
+	if err := os.WriteFile(path, []byte(`{"execution":{"allowed_ls_flags":[" -S ","-S","-l"]}}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := strings.Join(cfg.Execution.AllowedLsFlags, ","); got != "-S,-l" {
+		t.Fatalf("expected normalized flags, got %q", got)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"execution":{"allowed_ls_flags":["--color=always"]}}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := loadConfig(path); err == nil {
+		t.Fatalf("expected long option to be rejected")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"execution":{"default_ls_flags":["-R"]}}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "default_ls_flags") {
+		t.Fatalf("expected a default flag outside the allowed set to be rejected, got %v", err)
+	}
+}
+
+func TestLoadConfigChecksExecPaths(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.json")
+	write := func(strict bool) {
+		b, err := json.Marshal(AgentConfig{StrictConfig: strict, Execution: AgentExecConfig{
+			CommandAllowlist: map[string]api.AllowedCommand{
+				"ok":       {Exec: "/bin/sh"},
+				"typo":     {Exec: "/bin/ehco-missing"},
+				"relative": {Exec: "echo"},
+			},
+		}})
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	write(true)
+	_, err := loadConfig(path)
+	if err == nil {
+		t.Fatalf("expected strict mode to reject a missing exec path")
+	}
+	for _, want := range []string{"command_allowlist.typo: /bin/ehco-missing does not exist", "command_allowlist.relative: echo is not an absolute path"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in error, got %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "command_allowlist.ok") {
+		t.Fatalf("valid exec path reported: %v", err)
+	}
+
+	write(false)
+	if _, err := loadConfig(path); err != nil {
+		t.Fatalf("expected only a warning without strict_config, got %v", err)
+	}
+}
+
+func TestLoadConfigExpandsAuthTokenFromEnv(t *testing.T) {
+	t.Setenv("TEST_TOKEN", "shared-secret")
+	path := filepath.Join(t.TempDir(), "agent.json")
+	if err := os.WriteFile(path, []byte(`{"auth_token":"${TEST_TOKEN}"}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.AuthToken != "shared-secret" {
+		t.Fatalf("expected auth_token from env, got %q", cfg.AuthToken)
+	}
+}
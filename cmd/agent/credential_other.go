@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// resolveRunAs is a no-op where process credentials are unsupported.
+func resolveRunAs(userSpec, groupSpec string) (string, string, error) {
+	return userSpec, groupSpec, nil
+}
+
+// applyRunAs is a no-op where process credentials are unsupported.
+func applyRunAs(cmd *exec.Cmd, uid, gid string) error {
+	return nil
+}
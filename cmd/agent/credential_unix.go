@@ -0,0 +1,80 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// resolveRunAs turns a user and group spec (name or numeric ID) into numeric
+// IDs. When only a user is given, its primary group is used.
+func resolveRunAs(userSpec, groupSpec string) (string, string, error) {
+	uid, gid := "", ""
+	if userSpec != "" {
+		u, err := lookupUser(userSpec)
+		if err != nil {
+			return "", "", fmt.Errorf("run_as_user %q: %v", userSpec, err)
+		}
+		uid, gid = u.Uid, u.Gid
+	}
+	if groupSpec != "" {
+		g, err := lookupGroup(groupSpec)
+		if err != nil {
+			return "", "", fmt.Errorf("run_as_group %q: %v", groupSpec, err)
+		}
+		gid = g.Gid
+	}
+	return uid, gid, nil
+}
+
+func lookupUser(spec string) (*user.User, error) {
+	if _, err := strconv.ParseUint(spec, 10, 32); err == nil {
+		u, err := user.LookupId(spec)
+		if err != nil {
+			// Allow numeric IDs without a passwd entry, e.g. in containers.
+			return &user.User{Uid: spec, Gid: spec}, nil
+		}
+		return u, nil
+	}
+	return user.Lookup(spec)
+}
+
+func lookupGroup(spec string) (*user.Group, error) {
+	if _, err := strconv.ParseUint(spec, 10, 32); err == nil {
+		return &user.Group{Gid: spec}, nil
+	}
+	return user.LookupGroup(spec)
+}
+
+// applyRunAs sets the process credential for resolved numeric IDs. A missing
+// uid keeps the agent's own user, a missing gid its own group.
+func applyRunAs(cmd *exec.Cmd, uid, gid string) error {
+	if uid == "" && gid == "" {
+		return nil
+	}
+	cred := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if uid != "" {
+		n, err := strconv.ParseUint(uid, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid uid %q", uid)
+		}
+		cred.Uid = uint32(n)
+	}
+	if gid != "" {
+		n, err := strconv.ParseUint(gid, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid gid %q", gid)
+		}
+		cred.Gid = uint32(n)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = cred
+	return nil
+}
@@ -0,0 +1,70 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"os/user"
+	"testing"
+
+	"personal_ai/internal/api"
+)
+
+func TestApplyRunAsSetsCredential(t *testing.T) {
+	cmd := exec.Command("/bin/true")
+	if err := applyRunAs(cmd, "1234", "5678"); err != nil {
+		t.Fatalf("applyRunAs: %v", err)
+	}
+	if cmd.SysProcAttr == nil || cmd.SysProcAttr.Credential == nil {
+		t.Fatalf("expected credential to be set")
+	}
+	if cred := cmd.SysProcAttr.Credential; cred.Uid != 1234 || cred.Gid != 5678 {
+		t.Fatalf("unexpected credential: %+v", cred)
+	}
+
+	plain := exec.Command("/bin/true")
+	if err := applyRunAs(plain, "", ""); err != nil || plain.SysProcAttr != nil {
+		t.Fatalf("expected no credential without run_as, got %+v err=%v", plain.SysProcAttr, err)
+	}
+}
+
+func TestResolveRunAsConfigUsesNumericIDs(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("current user: %v", err)
+	}
+	cfg := &AgentExecConfig{
+		RunAsUser: u.Username,
+		CommandAllowlist: map[string]api.AllowedCommand{
+			"status": {Exec: "/bin/true", RunAsGroup: u.Gid},
+		},
+	}
+	if err := resolveRunAsConfig(cfg); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if cfg.RunAsUser != u.Uid || cfg.RunAsGroup != u.Gid {
+		t.Fatalf("expected uid=%s gid=%s, got uid=%s gid=%s", u.Uid, u.Gid, cfg.RunAsUser, cfg.RunAsGroup)
+	}
+	if c := cfg.CommandAllowlist["status"]; c.RunAsUser != u.Uid || c.RunAsGroup != u.Gid {
+		t.Fatalf("unexpected per-command credential: %+v", c)
+	}
+
+	// A user-only entry keeps the execution-level group, not its primary one.
+	grouped := &AgentExecConfig{
+		RunAsGroup: "4242",
+		CommandAllowlist: map[string]api.AllowedCommand{
+			"status": {Exec: "/bin/true", RunAsUser: u.Uid},
+		},
+	}
+	if err := resolveRunAsConfig(grouped); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if c := grouped.CommandAllowlist["status"]; c.RunAsUser != u.Uid || c.RunAsGroup != "4242" {
+		t.Fatalf("expected execution-level group 4242, got %+v", c)
+	}
+
+	bad := &AgentExecConfig{RunAsUser: "no-such-user-shelly"}
+	if err := resolveRunAsConfig(bad); err == nil {
+		t.Fatalf("expected unknown user to be rejected")
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"personal_ai/internal/api"
 )
@@ -54,3 +58,494 @@ func TestAgentExecutorDynamicCommands(t *testing.T) {
 		t.Fatalf("append failed: %+v", resp)
 	}
 }
+
+func TestAgentExecutorDynamicEcho(t *testing.T) {
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           t.TempDir(),
+			DynamicAllowlist:  []string{"echo"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "echo", Args: []string{"hello", "big", "world"}})
+	if !resp.Ok {
+		t.Fatalf("echo failed: %+v", resp)
+	}
+	if got := strings.TrimSpace(resp.Stdout); got != "hello big world" {
+		t.Fatalf("expected joined args, got %q", got)
+	}
+}
+
+func TestAgentExecutorDynamicWhoami(t *testing.T) {
+	base := t.TempDir()
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"whoami"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "whoami", UserID: 11, ChatID: 22})
+	if !resp.Ok {
+		t.Fatalf("whoami failed: %+v", resp)
+	}
+	for _, want := range []string{"user: 11", "chat: 22", "cwd: " + base, "base_dir: " + base} {
+		if !strings.Contains(resp.Stdout, want) {
+			t.Fatalf("expected %q in output, got %q", want, resp.Stdout)
+		}
+	}
+}
+
+func TestAgentPingCountIsCapped(t *testing.T) {
+	cfg := &AgentConfig{Execution: AgentExecConfig{
+		DefaultTimeoutSec: 2,
+		MaxOutputKB:       8,
+		BaseDir:           t.TempDir(),
+		DynamicAllowlist:  []string{"ping"},
+		PingMaxCount:      3,
+	}}
+	resp := newAgentExecutor(cfg).Execute(context.Background(), api.CommandRequest{Command: "ping", Args: []string{"-c", "4", "-6", "::1"}})
+	if resp.Ok || !strings.Contains(resp.Error, "exceeds the maximum of 3") {
+		t.Fatalf("expected count over the cap to be rejected, got %+v", resp)
+	}
+	if req, err := parsePingArgs([]string{"-6", "-c", "3", "::1"}, 0, 3); err != nil || !req.ipv6 || req.count != 3 {
+		t.Fatalf("unexpected parse %+v err=%v", req, err)
+	}
+}
+
+func TestAgentExecutorDu(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "a"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "a", "x.bin"), make([]byte, 2048), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "top.txt"), make([]byte, 10), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"du"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "du", ChatID: 1})
+	if !resp.Ok {
+		t.Fatalf("du failed: %+v", resp)
+	}
+	if want := "total: 2.0K\n  a: 2.0K\n"; resp.Stdout != want {
+		t.Fatalf("unexpected du output %q, want %q", resp.Stdout, want)
+	}
+}
+
+func TestAgentExecutorDateAndUptime(t *testing.T) {
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           t.TempDir(),
+			DynamicAllowlist:  []string{"date", "uptime"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "date"})
+	if _, err := time.Parse(time.RFC3339, strings.TrimSpace(resp.Stdout)); err != nil {
+		t.Fatalf("date output not RFC3339: %q", resp.Stdout)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "uptime"})
+	fields := strings.Fields(resp.Stdout)
+	if len(fields) == 0 {
+		t.Fatalf("empty uptime output")
+	}
+	if _, err := time.Parse(time.RFC3339, fields[len(fields)-1]); err != nil {
+		t.Fatalf("uptime start not RFC3339: %q", resp.Stdout)
+	}
+}
+
+func TestAgentExecutorTree(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "a", "b"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "a", "b", "c.txt"), nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"tree"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "tree", Args: []string{"a"}, ChatID: 1})
+	if !resp.Ok {
+		t.Fatalf("tree failed: %+v", resp)
+	}
+	if want := "a/\n  b/\n    c.txt\n"; resp.Stdout != want {
+		t.Fatalf("unexpected tree output %q, want %q", resp.Stdout, want)
+	}
+}
+
+func TestAgentExecutorPagedLs(t *testing.T) {
+	base := t.TempDir()
+	for _, name := range []string{"c.txt", "a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(base, name), nil, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(base, "d"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"ls"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "ls", Args: []string{"--page", "2", "--per-page", "3"}, ChatID: 1})
+	if !resp.Ok || resp.Stdout != "page 2/2 (4 entries)\nd/\n" {
+		t.Fatalf("unexpected second page %+v", resp)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "ls", Args: []string{"-t", "--page", "1"}, ChatID: 1})
+	if resp.Ok || resp.Error != "ls flag not supported with --page: -t" {
+		t.Fatalf("expected -t to be refused when paging, got %+v", resp)
+	}
+}
+
+func TestAgentWalksAbortOnTimeout(t *testing.T) {
+	base := t.TempDir()
+	for i := 0; i < 50; i++ {
+		if err := os.MkdirAll(filepath.Join(base, strings.Repeat("x", i+1), "sub"), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if resp := runSafeFind(ctx, base, base, []string{"sub"}, 0, 0); resp.Ok || resp.Error != errWalkTimeout.Error() {
+		t.Fatalf("expected find timeout, got %+v", resp)
+	}
+}
+
+func TestAgentExecutorWriteBase64(t *testing.T) {
+	base := t.TempDir()
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"write"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	content := "line one\nline  two\n"
+	encoded := base64.StdEncoding.EncodeToString([]byte(content))
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "write", Args: []string{"--base64", "notes.txt", encoded}, ChatID: 1})
+	if !resp.Ok {
+		t.Fatalf("write failed: %+v", resp)
+	}
+	got, err := os.ReadFile(filepath.Join(base, "notes.txt"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != content {
+		t.Fatalf("unexpected content %q, want %q", got, content)
+	}
+}
+
+func TestAgentMoveFileFallsBackToCopyAcrossDevices(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("data"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	orig := renameFile
+	defer func() { renameFile = orig }()
+	renameFile = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+
+	if err := moveFile(src, dst); err != nil {
+		t.Fatalf("moveFile: %v", err)
+	}
+	if got, err := os.ReadFile(dst); err != nil || string(got) != "data" {
+		t.Fatalf("unexpected copied content %q err=%v", got, err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("expected source removed, got %v", err)
+	}
+}
+
+func TestAgentExecutorCatLineRange(t *testing.T) {
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "notes.txt"), []byte("one\ntwo\nthree\nfour"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"cat"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Args: []string{"--lines", "2-9", "notes.txt"}, ChatID: 1})
+	if !resp.Ok || resp.Stdout != "two\nthree\nfour" {
+		t.Fatalf("unexpected line range: %+v", resp)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Args: []string{"--lines", "3-2", "notes.txt"}, ChatID: 1})
+	if resp.Ok || !strings.Contains(resp.Error, "start is after end") {
+		t.Fatalf("expected reversed range to fail, got %+v", resp)
+	}
+}
+
+func TestAgentExecutorCatExpandsGlob(t *testing.T) {
+	base := t.TempDir()
+	for name, body := range map[string]string{"a.txt": "alpha\n", "b.txt": "beta\n"} {
+		if err := os.WriteFile(filepath.Join(base, name), []byte(body), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"cat"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Args: []string{"*.txt"}, ChatID: 1})
+	if !resp.Ok || resp.Stdout != "alpha\nbeta\n" {
+		t.Fatalf("unexpected cat response: %+v", resp)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Args: []string{"../*.txt"}, ChatID: 1})
+	if resp.Ok {
+		t.Fatalf("expected escaping pattern to be rejected")
+	}
+}
+
+func TestAgentExecutorDynamicBlocklist(t *testing.T) {
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           t.TempDir(),
+			DynamicAllowlist:  []string{"ls", "write"},
+			DynamicBlocklist:  []string{"write"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "write", Args: []string{"a.txt", "hi"}, ChatID: 1})
+	if resp.Ok || resp.Error != "command blocked" {
+		t.Fatalf("expected write to be blocked, got %+v", resp)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "ls", ChatID: 1})
+	if !resp.Ok {
+		t.Fatalf("expected ls to still work, got %+v", resp)
+	}
+}
+
+func TestAgentExecutorDynamicEnv(t *testing.T) {
+	t.Setenv("SHELLY_VISIBLE", "yes")
+	t.Setenv("SHELLY_SECRET", "hunter2")
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           t.TempDir(),
+			DynamicAllowlist:  []string{"env"},
+			EnvAllowlist:      []string{"SHELLY_VISIBLE"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "env", ChatID: 1})
+	if !resp.Ok || resp.Stdout != "SHELLY_VISIBLE=yes\n" {
+		t.Fatalf("unexpected env response: %+v", resp)
+	}
+}
+
+func TestAgentExecutorWc(t *testing.T) {
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "notes.txt"), []byte("one two\nthree  four five\n\nsix\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"wc"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "wc", Args: []string{"notes.txt"}, ChatID: 1})
+	if !resp.Ok {
+		t.Fatalf("wc failed: %+v", resp)
+	}
+	if want := "4 6 30 notes.txt\n"; resp.Stdout != want {
+		t.Fatalf("unexpected wc output %q, want %q", resp.Stdout, want)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "wc", Args: []string{"-x", "notes.txt"}, ChatID: 1})
+	if resp.Ok {
+		t.Fatalf("expected unknown flag to fail: %+v", resp)
+	}
+}
+
+func TestAgentExecutorJSONFmt(t *testing.T) {
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "config.json"), []byte(`{"a":[1,{"b":null}]}`), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"jsonfmt"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "jsonfmt", Args: []string{"config.json"}, ChatID: 1})
+	if !resp.Ok {
+		t.Fatalf("jsonfmt failed: %+v", resp)
+	}
+	if want := "{\n  \"a\": [\n    1,\n    {\n      \"b\": null\n    }\n  ]\n}\n"; resp.Stdout != want {
+		t.Fatalf("unexpected jsonfmt output %q, want %q", resp.Stdout, want)
+	}
+	if err := os.WriteFile(filepath.Join(base, "notes.txt"), []byte("plain text"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "jsonfmt", Args: []string{"notes.txt"}, ChatID: 1})
+	if resp.Ok || !strings.Contains(resp.Error, "not valid JSON") {
+		t.Fatalf("expected invalid JSON error, got %+v", resp)
+	}
+}
+
+func TestAgentExecutorGrepRecursive(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "a", "b"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for name, content := range map[string]string{
+		"a/one.txt":   "alpha\nneedle one\n",
+		"a/b/two.txt": "needle two\n",
+		"a/b/no.txt":  "haystack\n",
+		"a/b/bin.dat": "needle\x00",
+	} {
+		if err := os.WriteFile(filepath.Join(base, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"grep"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "grep", Args: []string{"-r", "needle"}, ChatID: 1})
+	if !resp.Ok {
+		t.Fatalf("grep failed: %+v", resp)
+	}
+	if want := "a/b/two.txt:1: needle two\na/one.txt:2: needle one\n"; resp.Stdout != want {
+		t.Fatalf("unexpected grep output %q, want %q", resp.Stdout, want)
+	}
+}
+
+func TestAgentExecutorTouchTimeAndParents(t *testing.T) {
+	base := t.TempDir()
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"touch"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "touch", Args: []string{"--parents", "--time", "2024-01-02T15:04:05Z", "sync/2024/stamp"}, ChatID: 1})
+	if !resp.Ok {
+		t.Fatalf("touch --parents --time failed: %+v", resp)
+	}
+	info, err := os.Stat(filepath.Join(base, "sync", "2024", "stamp"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if want := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC); !info.ModTime().Equal(want) {
+		t.Fatalf("expected mtime %s, got %s", want, info.ModTime())
+	}
+}
+
+func TestAgentExecutorMktemp(t *testing.T) {
+	base := t.TempDir()
+	if err := os.Mkdir(filepath.Join(base, "work"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"cd", "mktemp"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+	_ = exec.Execute(context.Background(), api.CommandRequest{Command: "cd", Args: []string{"work"}, ChatID: 1})
+
+	var paths []string
+	for i := 0; i < 2; i++ {
+		resp := exec.Execute(context.Background(), api.CommandRequest{Command: "mktemp", Args: []string{".txt"}, ChatID: 1})
+		if !resp.Ok {
+			t.Fatalf("mktemp failed: %+v", resp)
+		}
+		path := strings.TrimSpace(resp.Stdout)
+		if filepath.Dir(path) != filepath.Join(base, "work") || !strings.HasSuffix(path, ".txt") {
+			t.Fatalf("expected a .txt file in the working directory, got %q", path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s to exist: %v", path, err)
+		}
+		paths = append(paths, path)
+	}
+	if paths[0] == paths[1] {
+		t.Fatalf("expected distinct paths, got %q twice", paths[0])
+	}
+	for _, suffix := range []string{"/../x", "a b", strings.Repeat("x", mktempMaxSuffix+1)} {
+		if resp := exec.Execute(context.Background(), api.CommandRequest{Command: "mktemp", Args: []string{suffix}, ChatID: 1}); resp.Ok {
+			t.Fatalf("expected suffix %q to be refused, got %+v", suffix, resp)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+)
+
+var errQueueFull = errors.New("execution queue full")
+
+// execQueue bounds how many allowlisted commands run at once. When every slot
+// is busy, callers wait in a bounded queue and are admitted by priority, then
+// by arrival order.
+type execQueue struct {
+	mu        sync.Mutex
+	free      int
+	maxQueued int
+	seq       uint64
+	waiting   waiterHeap
+}
+
+type queueWaiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+	index    int
+}
+
+func newExecQueue(maxConcurrent, maxQueued int) *execQueue {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	return &execQueue{free: maxConcurrent, maxQueued: maxQueued}
+}
+
+// acquire blocks until a slot is available. A nil queue never blocks.
+func (q *execQueue) acquire(ctx context.Context, priority int) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	if q.free > 0 && len(q.waiting) == 0 {
+		q.free--
+		q.mu.Unlock()
+		return nil
+	}
+	if len(q.waiting) >= q.maxQueued {
+		q.mu.Unlock()
+		return errQueueFull
+	}
+	q.seq++
+	w := &queueWaiter{priority: priority, seq: q.seq, ready: make(chan struct{})}
+	heap.Push(&q.waiting, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		select {
+		case <-w.ready:
+			// The slot was handed over while we were giving up; pass it on.
+			q.releaseLocked()
+		default:
+			heap.Remove(&q.waiting, w.index)
+		}
+		return ctx.Err()
+	}
+}
+
+func (q *execQueue) release() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked()
+}
+
+func (q *execQueue) releaseLocked() {
+	if len(q.waiting) > 0 {
+		w := heap.Pop(&q.waiting).(*queueWaiter)
+		close(w.ready)
+		return
+	}
+	q.free++
+}
+
+func (q *execQueue) queued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+type waiterHeap []*queueWaiter
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x any) {
+	w := x.(*queueWaiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() any {
+	old := *h
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return w
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"log"
 	"strings"
 	"time"
 
@@ -15,32 +16,91 @@ type CommandExecutor interface {
 type agentExecutor struct {
 	cfg     *AgentConfig
 	chatCWD *chatCWDStore
+	queue   *execQueue
 }
 
 func newAgentExecutor(cfg *AgentConfig) *agentExecutor {
-	return &agentExecutor{cfg: cfg, chatCWD: newChatCWD()}
+	chatCWD := newChatCWD(cfg.Execution.ChatBaseDirs, cfg.Execution.SharedChatCWD)
+	if path := strings.TrimSpace(cfg.Execution.CWDStateFile); path != "" {
+		if err := chatCWD.load(path, cfg.Execution.BaseDir); err != nil {
+			log.Printf("load execution.cwd_state_file: %v", err)
+		}
+	}
+	return &agentExecutor{
+		cfg:     cfg,
+		chatCWD: chatCWD,
+		queue:   newExecQueue(cfg.Execution.MaxConcurrent, cfg.Execution.MaxQueued),
+	}
 }
 
 func (e *agentExecutor) Execute(ctx context.Context, req api.CommandRequest) api.CommandResponse {
 	cmdName := strings.TrimSpace(req.Command)
 	if cmdName == "" {
-		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "empty command"}
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "empty command", Reason: api.ReasonEmptyCommand}
+	}
+	if err := checkArgLimits(req.Args, e.cfg.Execution.MaxArgs, e.cfg.Execution.MaxArgBytes); err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error(), Reason: api.ReasonInvalidArgs}
 	}
 	if isBlocked(cmdName, e.cfg.Execution.CommandBlocklist) {
-		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "command blocked"}
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "command blocked", Reason: api.ReasonBlocked}
 	}
 
 	if isDynamicAllowed(cmdName, e.cfg.Execution.DynamicAllowlist) {
-		return handleDynamicCommand(e.cfg, e.chatCWD, req.ChatID, cmdName, req.Args)
+		if isBlocked(cmdName, e.cfg.Execution.DynamicBlocklist) {
+			return api.CommandResponse{Ok: false, ExitCode: 1, Error: "command blocked", Reason: api.ReasonBlocked}
+		}
+		if e.cfg.Execution.ReadOnly && isDynamicAllowed(cmdName, mutatingDynamicCommands) {
+			return readOnlyResponse(cmdName)
+		}
+		return handleDynamicCommand(ctx, e.cfg, e.chatCWD, req.ChatID, req.UserID, cmdName, req.Args)
 	}
 
-	allowed, ok := e.cfg.Execution.CommandAllowlist[cmdName]
+	allowed, pattern, ok, err := lookupAllowedCommand(e.cfg.Execution.CommandAllowlist, cmdName)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error(), Reason: api.ReasonNotAllowed}
+	}
+	if strings.EqualFold(cmdName, serviceCommand) && len(e.cfg.Execution.ManagedServices) > 0 {
+		svc, err := resolveManagedService(e.cfg.Execution.ManagedServices, req.Args)
+		if err != nil {
+			return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error(), Reason: api.ReasonInvalidArgs}
+		}
+		allowed, ok = svc, true
+	} else if ok {
+		args, err := expandArgTemplates(allowed.Args, req.Args)
+		if err != nil {
+			return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error(), Reason: api.ReasonInvalidArgs}
+		}
+		// A pattern entry learns which command it was run as.
+		if pattern != "" {
+			args = append([]string{cmdName}, args...)
+		}
+		allowed.Args = args
+	}
 	if !ok {
-		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "command not allowed"}
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "command not allowed", Reason: api.ReasonNotAllowed}
+	}
+	if e.cfg.Execution.ReadOnly && allowed.Mutating {
+		return readOnlyResponse(cmdName)
+	}
+	stdin := ""
+	if allowed.AllowStdin {
+		stdin = stdinFromRequest(req)
+		if len(stdin) > maxStdinBytes {
+			return api.CommandResponse{Ok: false, ExitCode: 1, Error: "stdin too large", Reason: api.ReasonInvalidArgs}
+		}
+	}
+
+	if err := e.queue.acquire(ctx, allowed.Priority); err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error(), Reason: api.ReasonBusy}
+	}
+	defer e.queue.release()
+
+	if allowed.RunAsUser == "" && allowed.RunAsGroup == "" {
+		allowed.RunAsUser, allowed.RunAsGroup = e.cfg.Execution.RunAsUser, e.cfg.Execution.RunAsGroup
 	}
 
 	execCtx, cancel := context.WithTimeout(ctx, time.Duration(e.cfg.Execution.DefaultTimeoutSec)*time.Second)
 	defer cancel()
 
-	return runAllowedCommand(execCtx, allowed, e.cfg.Execution.MaxOutputKB)
+	return runAllowedCommand(execCtx, allowed, stdin, e.cfg.Execution.ExecPath, e.cfg.Execution.EnvPassthrough, e.cfg.Execution.MaxOutputKB)
 }
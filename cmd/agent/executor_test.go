@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"personal_ai/internal/api"
 )
@@ -46,6 +50,29 @@ func TestAgentExecutorRunsAllowlistedCommand(t *testing.T) {
 	}
 }
 
+func TestAgentExecutorMatchesAllowlistPatterns(t *testing.T) {
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			CommandAllowlist: map[string]api.AllowedCommand{
+				"deploy-*": {Exec: "/bin/echo", Summarize: true},
+				"*-web":    {Exec: "/bin/echo"},
+			},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "deploy-api", Args: []string{"now"}})
+	if !resp.Ok || resp.Stdout != "deploy-api\n" || !resp.Summarize {
+		t.Fatalf("expected pattern entry to receive the command name and its summarize flag, got %+v", resp)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "deploy-web"})
+	if resp.Ok || resp.Reason != api.ReasonNotAllowed || !strings.Contains(resp.Error, "several allowlist patterns") {
+		t.Fatalf("expected ambiguous patterns to be refused, got %+v", resp)
+	}
+}
+
 func TestAgentExecutorDynamicPwd(t *testing.T) {
 	base := t.TempDir()
 	cfg := &AgentConfig{
@@ -66,3 +93,253 @@ func TestAgentExecutorDynamicPwd(t *testing.T) {
 		t.Fatalf("expected stdout %q, got %q", base, got)
 	}
 }
+
+func TestAgentExecutorChatBaseDirs(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "Projects"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"pwd"},
+			ChatBaseDirs:      map[int64]string{7: "Projects"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "pwd", ChatID: 7})
+	if got := strings.TrimSpace(resp.Stdout); got != filepath.Join(base, "Projects") {
+		t.Fatalf("expected configured chat to start in Projects, got %q", got)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "pwd", ChatID: 8})
+	if got := strings.TrimSpace(resp.Stdout); got != base {
+		t.Fatalf("expected other chat to start at base, got %q", got)
+	}
+}
+
+func TestAgentExecutorCWDIsolatedPerUser(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "sub"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"pwd", "cd"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	if resp := exec.Execute(context.Background(), api.CommandRequest{Command: "cd", Args: []string{"sub"}, ChatID: 5, UserID: 1}); !resp.Ok {
+		t.Fatalf("cd failed: %+v", resp)
+	}
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "pwd", ChatID: 5, UserID: 2})
+	if got := strings.TrimSpace(resp.Stdout); got != base {
+		t.Fatalf("expected second user to stay at base, got %q", got)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "pwd", ChatID: 5, UserID: 1})
+	if got := strings.TrimSpace(resp.Stdout); got != filepath.Join(base, "sub") {
+		t.Fatalf("expected first user in sub, got %q", got)
+	}
+}
+
+func TestAgentExecutorPassesStdinFromArgs(t *testing.T) {
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			CommandAllowlist: map[string]api.AllowedCommand{
+				"stdin": {Exec: "/bin/cat", AllowStdin: true},
+			},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "stdin", Args: []string{"hello", "world"}})
+	if !resp.Ok || resp.Stdout != "hello world" {
+		t.Fatalf("expected args echoed via stdin, got %+v", resp)
+	}
+
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "stdin", Text: "stdin line one\nline two", Args: []string{"line", "one", "line", "two"}})
+	if resp.Stdout != "line one\nline two" {
+		t.Fatalf("expected raw text after the command as stdin, got %q", resp.Stdout)
+	}
+
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "stdin", Text: "stdin " + strings.Repeat("x", maxStdinBytes+1)})
+	if resp.Ok || resp.Error != "stdin too large" || resp.Reason != api.ReasonInvalidArgs {
+		t.Fatalf("expected oversized stdin to be rejected, got %+v", resp)
+	}
+}
+
+func TestAgentExecutorRejectsSymlinkedParent(t *testing.T) {
+	base := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("s3cret"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(base, "link")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"cat"},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Args: []string{"link/secret"}, ChatID: 1})
+	if resp.Ok || resp.Reason != api.ReasonSymlinkEscape {
+		t.Fatalf("expected cat through symlinked parent to be rejected, got %+v", resp)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Args: []string{"../secret"}, ChatID: 1})
+	if resp.Ok || resp.Reason != api.ReasonPathOutsideBase {
+		t.Fatalf("expected cat outside base_dir to be rejected, got %+v", resp)
+	}
+	if _, err := sanitizePath(base, base, "link/secret"); !errors.Is(err, api.ErrSymlinkEscape) {
+		t.Fatalf("expected ErrSymlinkEscape, got %v", err)
+	}
+	if _, err := sanitizePath(base, base, "../secret"); !errors.Is(err, api.ErrPathOutsideBase) {
+		t.Fatalf("expected ErrPathOutsideBase, got %v", err)
+	}
+}
+
+func TestAgentExecutorRunsManagedService(t *testing.T) {
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			ManagedServices: map[string]api.AllowedCommand{
+				"web": {Exec: "/bin/echo", Args: []string{"{action}", "web"}},
+			},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "service", Args: []string{"web", "stop"}})
+	if !resp.Ok || resp.Stdout != "stop web\n" {
+		t.Fatalf("unexpected service response: %+v", resp)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "service", Args: []string{"web", "reload"}})
+	if resp.Ok {
+		t.Fatalf("expected unsupported action to be rejected")
+	}
+}
+
+func TestAgentRunAllowedCommandExitCodes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	resp := runAllowedCommand(ctx, api.AllowedCommand{Exec: "/bin/sh", Args: []string{"-c", "exec sleep 5"}}, "", "", nil, 8)
+	if resp.ExitCode != 124 {
+		t.Fatalf("expected timeout exit code 124, got %+v", resp)
+	}
+
+	resp = runAllowedCommand(context.Background(), api.AllowedCommand{Exec: "/bin/sh", Args: []string{"-c", "exit 2"}}, "", "", nil, 8)
+	if resp.Ok || resp.ExitCode != 2 {
+		t.Fatalf("expected exit code 2, got %+v", resp)
+	}
+}
+
+func TestAgentExecutorPersistsCWD(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "Movies"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"cd", "pwd"},
+			CWDStateFile:      filepath.Join(t.TempDir(), "cwd.json"),
+		},
+	}
+	resp := newAgentExecutor(cfg).Execute(context.Background(), api.CommandRequest{Command: "cd", Args: []string{"Movies"}, ChatID: 1, UserID: 7})
+	if !resp.Ok {
+		t.Fatalf("cd failed: %+v", resp)
+	}
+
+	resp = newAgentExecutor(cfg).Execute(context.Background(), api.CommandRequest{Command: "pwd", ChatID: 1, UserID: 7})
+	if want := filepath.Join(base, "Movies") + "\n"; resp.Stdout != want {
+		t.Fatalf("expected restored cwd %q, got %q", want, resp.Stdout)
+	}
+}
+
+func TestAgentExecutorRejectsOversizedArgs(t *testing.T) {
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           t.TempDir(),
+			DynamicAllowlist:  []string{"echo"},
+			MaxArgs:           2,
+			MaxArgBytes:       4,
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "echo", Args: []string{"a", "b", "c"}})
+	if resp.Ok || resp.Error != "too many arguments: 3 exceeds max_args 2" {
+		t.Fatalf("expected arg count limit, got %+v", resp)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "echo", Args: []string{"12345"}})
+	if resp.Ok || resp.Error != "argument 1 is 5 bytes, exceeds max_arg_bytes 4" {
+		t.Fatalf("expected arg size limit, got %+v", resp)
+	}
+}
+
+func TestAgentExecutorReadOnlyBlocksMutations(t *testing.T) {
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "notes.txt"), []byte("hello\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := &AgentConfig{
+		Execution: AgentExecConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			ReadOnly:          true,
+			DynamicAllowlist:  []string{"cat", "write"},
+			CommandAllowlist: map[string]api.AllowedCommand{
+				"deploy": {Exec: "/bin/echo", Args: []string{"deployed"}, Mutating: true},
+			},
+		},
+	}
+	exec := newAgentExecutor(cfg)
+
+	resp := exec.Execute(context.Background(), api.CommandRequest{Command: "write", Args: []string{"notes.txt", "changed"}, ChatID: 1})
+	if resp.Ok || resp.Reason != api.ReasonReadOnly {
+		t.Fatalf("expected write to be refused, got %+v", resp)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Args: []string{"notes.txt"}, ChatID: 1})
+	if !resp.Ok || resp.Stdout != "hello\n" {
+		t.Fatalf("expected cat to work and the file untouched, got %+v", resp)
+	}
+	resp = exec.Execute(context.Background(), api.CommandRequest{Command: "deploy", ChatID: 1})
+	if resp.Ok || resp.Reason != api.ReasonReadOnly {
+		t.Fatalf("expected mutating static command to be refused, got %+v", resp)
+	}
+}
+
+func TestAgentRunAllowedCommandRestrictsPath(t *testing.T) {
+	resp := runAllowedCommand(context.Background(), api.AllowedCommand{Exec: "echo", Args: []string{"hi"}}, "", "", nil, 8)
+	if resp.Ok || resp.Error != "exec path must be absolute: echo" {
+		t.Fatalf("expected relative exec to be rejected, got %+v", resp)
+	}
+	resp = runAllowedCommand(context.Background(), api.AllowedCommand{Exec: "/bin/sh", Args: []string{"-c", `printf %s "$PATH"`}}, "", "/opt/tools", nil, 8)
+	if !resp.Ok || resp.Stdout != "/opt/tools" {
+		t.Fatalf("expected PATH to be the configured exec_path, got %+v", resp)
+	}
+	t.Setenv("SHELLY_TEST_SECRET", "s3cret")
+	resp = runAllowedCommand(context.Background(), api.AllowedCommand{Exec: "/bin/sh", Args: []string{"-c", `printf %s "$SHELLY_TEST_SECRET"`}}, "", "", nil, 8)
+	if !resp.Ok || resp.Stdout != "" {
+		t.Fatalf("expected unlisted variables to stay out of the environment, got %+v", resp)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+// fetchMaxRedirects bounds how many redirects fetch follows, each of which
+// must pass the allowlist again.
+const fetchMaxRedirects = 3
+
+// hostAllowlist holds the hostnames and networks fetch and ping may reach.
+type hostAllowlist struct {
+	hosts map[string]bool
+	nets  []*net.IPNet
+}
+
+// parseHostAllowlist splits entries into hostnames and CIDRs. A bare IP is
+// treated as a single-address network.
+func parseHostAllowlist(entries []string) (hostAllowlist, error) {
+	list := hostAllowlist{hosts: map[string]bool{}}
+	for _, raw := range entries {
+		entry := strings.ToLower(strings.TrimSpace(raw))
+		if entry == "" {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			list.nets = append(list.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return hostAllowlist{}, fmt.Errorf("invalid CIDR %q", raw)
+			}
+			list.nets = append(list.nets, ipNet)
+			continue
+		}
+		if !isSafeHost(entry) {
+			return hostAllowlist{}, fmt.Errorf("invalid host %q", raw)
+		}
+		list.hosts[entry] = true
+	}
+	return list, nil
+}
+
+func (l hostAllowlist) containsIP(ip net.IP) bool {
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHost reports whether a URL host may be requested: hostnames must be
+// listed by name and IP literals must fall inside a listed network.
+func (l hostAllowlist) allowsHost(host string) bool {
+	host = strings.ToLower(host)
+	if ip := net.ParseIP(host); ip != nil {
+		return l.containsIP(ip)
+	}
+	return l.hosts[host]
+}
+
+// allowsAddr reports whether fetch may connect to ip. Loopback, private,
+// link-local and other internal addresses are refused unless a listed
+// network covers them, so an allowed name cannot resolve its way inside.
+func (l hostAllowlist) allowsAddr(ip net.IP) bool {
+	if l.containsIP(ip) {
+		return true
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// checkFetchURL validates the scheme and host of a URL fetch may request.
+func (l hostAllowlist) checkFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("fetch only supports http and https URLs")
+	}
+	if u.User != nil {
+		return fmt.Errorf("fetch URLs may not carry credentials")
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("fetch URL has no host")
+	}
+	if !l.allowsHost(host) {
+		return fmt.Errorf("fetch host not allowed: %s", host)
+	}
+	return nil
+}
+
+// newFetchClient returns a client that re-checks every redirect and every
+// dialed address against allowlist and ignores proxy settings.
+func newFetchClient(allowlist hostAllowlist, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !allowlist.allowsAddr(ip) {
+				return fmt.Errorf("fetch address not allowed: %s", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, ResponseHeaderTimeout: timeout},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > fetchMaxRedirects {
+				return fmt.Errorf("fetch stopped after %d redirects", fetchMaxRedirects)
+			}
+			return allowlist.checkFetchURL(req.URL)
+		},
+	}
+}
+
+// runSafeFetch performs a GET against an allowlisted host and returns the
+// status line and body, truncated at maxKB.
+func runSafeFetch(ctx context.Context, args []string, allowed []string, timeoutSec, maxKB int) api.CommandResponse {
+	if len(args) != 1 {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "fetch requires a single URL"}
+	}
+	allowlist, err := parseHostAllowlist(allowed)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "execution.fetch_allowed_hosts: " + err.Error()}
+	}
+	if len(allowlist.hosts) == 0 && len(allowlist.nets) == 0 {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "fetch has no allowed hosts configured"}
+	}
+	u, err := url.Parse(strings.TrimSpace(args[0]))
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "invalid fetch URL"}
+	}
+	if err := allowlist.checkFetchURL(u); err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	if timeoutSec <= 0 {
+		timeoutSec = 10
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "invalid fetch URL"}
+	}
+	resp, err := newFetchClient(allowlist, time.Duration(timeoutSec)*time.Second).Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "fetch failed: " + err.Error()}
+	}
+	defer resp.Body.Close()
+
+	out := newCappedWriter(maxKB, func() {})
+	fmt.Fprintf(out, "HTTP %s\n", resp.Status)
+	if _, err := io.Copy(out, io.LimitReader(resp.Body, int64(maxKB)*1024+1)); err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Stderr: out.String(), Error: "fetch failed: " + err.Error()}
+	}
+	if resp.StatusCode >= 400 {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Stderr: out.String(), Error: "fetch returned " + resp.Status}
+	}
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: out.String()}
+}
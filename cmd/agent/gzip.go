@@ -0,0 +1,49 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// requestBody returns r's body, decompressing it when the client sent
+// Content-Encoding: gzip.
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	if !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return r.Body, nil
+	}
+	return gzip.NewReader(r.Body)
+}
+
+// gzipResponseWriter compresses everything written through it.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	zw *gzip.Writer
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	return w.zw.Write(p)
+}
+
+// gzipResponse wraps w when the client accepts gzip. The returned close
+// function flushes the compressed stream and must run after the last write.
+func gzipResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		return w, func() {}
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	zw := gzip.NewWriter(w)
+	return &gzipResponseWriter{ResponseWriter: w, zw: zw}, func() { _ = zw.Close() }
+}
+
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") && strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
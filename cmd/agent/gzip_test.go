@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"personal_ai/internal/api"
+)
+
+type echoExec struct{}
+
+func (echoExec) Execute(ctx context.Context, req api.CommandRequest) api.CommandResponse {
+	return api.CommandResponse{Ok: true, Stdout: req.Text}
+}
+
+func TestCommandHandlerGzipRoundTrip(t *testing.T) {
+	h := newCommandHandler(&AgentConfig{}, echoExec{})
+	large := strings.Repeat("line of file content\n", 20000)
+
+	body, _ := json.Marshal(api.CommandRequest{Command: "cat", Text: large})
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, _ = zw.Write(body)
+	_ = zw.Close()
+	if compressed.Len() >= len(body)/10 {
+		t.Fatalf("expected the payload to compress well, got %d of %d bytes", compressed.Len(), len(body))
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/command", &compressed)
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzipped response")
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+	var resp api.CommandResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Stdout != large {
+		t.Fatalf("round-tripped output differs: got %d bytes, want %d", len(resp.Stdout), len(large))
+	}
+}
+
+func TestCommandHandlerUncompressedFallback(t *testing.T) {
+	h := newCommandHandler(&AgentConfig{}, echoExec{})
+	body, _ := json.Marshal(api.CommandRequest{Command: "cat", Text: "plain"})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "/command", bytes.NewReader(body)))
+
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("expected no compression without Accept-Encoding")
+	}
+	var resp api.CommandResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Stdout != "plain" {
+		t.Fatalf("unexpected response %+v err=%v", resp, err)
+	}
+}
@@ -3,44 +3,102 @@ package main
 import (
 	"encoding/json"
 	"io"
+	"log"
 	"net/http"
+	"strconv"
 
 	"personal_ai/internal/api"
 )
 
+// apiVersion is sent in X-API-Version and the api_version envelope field. It
+// changes only when the response format breaks compatibility.
+const apiVersion = 1
+
+// commandEnvelope is the /command response body: a CommandResponse with the
+// API version alongside, so existing decoders keep working.
+type commandEnvelope struct {
+	APIVersion int `json:"api_version"`
+	api.CommandResponse
+}
+
+// reasonStatus maps CommandResponse.Reason to an HTTP status. Responses
+// without a listed reason, including failed commands, use 200.
+var reasonStatus = map[string]int{
+	api.ReasonEmptyCommand:     http.StatusBadRequest,
+	api.ReasonInvalidArgs:      http.StatusBadRequest,
+	api.ReasonBadRequest:       http.StatusBadRequest,
+	api.ReasonUnauthorized:     http.StatusUnauthorized,
+	api.ReasonBlocked:          http.StatusForbidden,
+	api.ReasonNotAllowed:       http.StatusForbidden,
+	api.ReasonReadOnly:         http.StatusForbidden,
+	api.ReasonPathOutsideBase:  http.StatusForbidden,
+	api.ReasonSymlinkEscape:    http.StatusForbidden,
+	api.ReasonMethodNotAllowed: http.StatusMethodNotAllowed,
+	api.ReasonBusy:             http.StatusServiceUnavailable,
+}
+
 func newCommandHandler(cfg *AgentConfig, exec CommandExecutor) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		w, closeBody := gzipResponse(w, r)
+		defer closeBody()
 		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			writeCommandResponse(w, rejected(api.ReasonMethodNotAllowed, "method not allowed"))
 			return
 		}
 		if cfg.AuthToken != "" {
 			if r.Header.Get("X-Auth-Token") != cfg.AuthToken {
-				w.WriteHeader(http.StatusUnauthorized)
+				writeCommandResponse(w, rejected(api.ReasonUnauthorized, "unauthorized"))
 				return
 			}
 		}
-		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		reqBody, err := requestBody(r)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeCommandResponse(w, rejected(api.ReasonBadRequest, "read body: "+err.Error()))
+			return
+		}
+		defer reqBody.Close()
+		body, err := io.ReadAll(io.LimitReader(reqBody, 1<<20))
+		if err != nil {
+			writeCommandResponse(w, rejected(api.ReasonBadRequest, "read body: "+err.Error()))
 			return
 		}
 		var req api.CommandRequest
 		if err := json.Unmarshal(body, &req); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeCommandResponse(w, rejected(api.ReasonBadRequest, "invalid json: "+err.Error()))
 			return
 		}
+		if req.RequestID == "" {
+			req.RequestID = r.Header.Get("X-Request-ID")
+		}
 
 		resp := exec.Execute(r.Context(), req)
-		status := http.StatusOK
-		if !resp.Ok {
-			switch resp.Error {
-			case "empty command":
-				status = http.StatusBadRequest
-			case "command blocked", "command not allowed":
-				status = http.StatusForbidden
-			}
+		resp.RequestID = req.RequestID
+		if req.RequestID != "" {
+			w.Header().Set("X-Request-ID", req.RequestID)
 		}
-		writeJSON(w, status, resp)
+		log.Printf("command req=%s user=%d username=%s chat=%d cmd=%q ok=%t exit=%d reason=%s", orDash(req.RequestID), req.UserID, orDash(req.UserName), req.ChatID, req.Command, resp.Ok, resp.ExitCode, orDash(resp.Reason))
+		writeCommandResponse(w, resp)
+	}
+}
+
+func rejected(reason, msg string) api.CommandResponse {
+	return api.CommandResponse{Ok: false, ExitCode: 1, Error: msg, Reason: reason}
+}
+
+func writeCommandResponse(w http.ResponseWriter, resp api.CommandResponse) {
+	status := http.StatusOK
+	if !resp.Ok {
+		if s, ok := reasonStatus[resp.Reason]; ok {
+			status = s
+		}
+	}
+	w.Header().Set("X-API-Version", strconv.Itoa(apiVersion))
+	writeJSON(w, status, commandEnvelope{APIVersion: apiVersion, CommandResponse: resp})
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
 	}
+	return s
 }
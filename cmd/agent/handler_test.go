@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"personal_ai/internal/api"
@@ -46,3 +47,146 @@ func TestCommandHandlerReturnsExecutorResponse(t *testing.T) {
 		t.Fatalf("expected 200, got %d", w.Code)
 	}
 }
+
+func TestCommandHandlerEchoesRequestID(t *testing.T) {
+	cfg := &AgentConfig{}
+	h := newCommandHandler(cfg, execStub{resp: api.CommandResponse{Ok: true}})
+
+	body, _ := json.Marshal(api.CommandRequest{Command: "status"})
+	req := httptest.NewRequest(http.MethodPost, "/command", bytes.NewReader(body))
+	req.Header.Set("X-Request-ID", "abc123")
+	w := httptest.NewRecorder()
+	h(w, req)
+
+	if got := w.Header().Get("X-Request-ID"); got != "abc123" {
+		t.Fatalf("expected X-Request-ID header echoed, got %q", got)
+	}
+	var resp api.CommandResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.RequestID != "abc123" {
+		t.Fatalf("expected request id in body, got %q", resp.RequestID)
+	}
+}
+
+func TestCommandHandlerMapsReasonsToStatus(t *testing.T) {
+	cases := []struct {
+		reason string
+		want   int
+	}{
+		{reason: api.ReasonEmptyCommand, want: http.StatusBadRequest},
+		{reason: api.ReasonInvalidArgs, want: http.StatusBadRequest},
+		{reason: api.ReasonBlocked, want: http.StatusForbidden},
+		{reason: api.ReasonNotAllowed, want: http.StatusForbidden},
+		{reason: api.ReasonReadOnly, want: http.StatusForbidden},
+		{reason: api.ReasonPathOutsideBase, want: http.StatusForbidden},
+		{reason: api.ReasonBusy, want: http.StatusServiceUnavailable},
+		{reason: "", want: http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.reason, func(t *testing.T) {
+			stub := execStub{resp: api.CommandResponse{Ok: false, ExitCode: 1, Error: "rejected", Reason: tc.reason}}
+			h := newCommandHandler(&AgentConfig{}, stub)
+
+			body, _ := json.Marshal(api.CommandRequest{Command: "status"})
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodPost, "/command", bytes.NewReader(body)))
+
+			if w.Code != tc.want {
+				t.Fatalf("expected %d, got %d", tc.want, w.Code)
+			}
+			if got := w.Header().Get("X-API-Version"); got != "1" {
+				t.Fatalf("expected X-API-Version 1, got %q", got)
+			}
+			var env commandEnvelope
+			if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if env.APIVersion != apiVersion || env.Reason != tc.reason || env.Error != "rejected" {
+				t.Fatalf("unexpected envelope %+v", env)
+			}
+		})
+	}
+}
+
+func TestCommandHandlerRejectionsUseEnvelope(t *testing.T) {
+	h := newCommandHandler(&AgentConfig{AuthToken: "secret"}, execStub{resp: api.CommandResponse{Ok: true}})
+	cases := []struct {
+		name   string
+		req    *http.Request
+		want   int
+		reason string
+	}{
+		{name: "method", req: httptest.NewRequest(http.MethodGet, "/command", nil), want: http.StatusMethodNotAllowed, reason: api.ReasonMethodNotAllowed},
+		{name: "auth", req: httptest.NewRequest(http.MethodPost, "/command", bytes.NewBufferString("{}")), want: http.StatusUnauthorized, reason: api.ReasonUnauthorized},
+		{name: "json", req: func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/command", bytes.NewBufferString("{"))
+			r.Header.Set("X-Auth-Token", "secret")
+			return r
+		}(), want: http.StatusBadRequest, reason: api.ReasonBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h(w, tc.req)
+			if w.Code != tc.want {
+				t.Fatalf("expected %d, got %d", tc.want, w.Code)
+			}
+			var resp api.CommandResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if resp.Ok || resp.Reason != tc.reason {
+				t.Fatalf("unexpected response %+v", resp)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesHandlerListsCommandsAndLimits(t *testing.T) {
+	cfg := &AgentConfig{
+		AuthToken: "secret",
+		Execution: AgentExecConfig{
+			CommandAllowlist: map[string]api.AllowedCommand{
+				"status":   {Exec: "/bin/echo"},
+				"deploy-*": {Exec: "/bin/echo"},
+				"reboot":   {Exec: "/bin/echo"},
+			},
+			CommandBlocklist: []string{"reboot"},
+			DynamicAllowlist: []string{"pwd", "ls", "rm"},
+			DynamicBlocklist: []string{"rm"},
+			MaxOutputKB:      8,
+			MaxArgs:          16,
+			ReadOnly:         true,
+		},
+	}
+	h := newCapabilitiesHandler(cfg)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/capabilities", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/capabilities", nil)
+	req.Header.Set("X-Auth-Token", "secret")
+	w = httptest.NewRecorder()
+	h(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var caps capabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &caps); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got := strings.Join(caps.Commands, ","); got != "deploy-*,status" {
+		t.Fatalf("unexpected commands %q", got)
+	}
+	if got := strings.Join(caps.DynamicCommands, ","); got != "ls,pwd" {
+		t.Fatalf("unexpected dynamic commands %q", got)
+	}
+	if caps.APIVersion != apiVersion || caps.Limits.MaxOutputKB != 8 || caps.Limits.MaxArgs != 16 || !caps.Limits.ReadOnly {
+		t.Fatalf("unexpected capabilities %+v", caps)
+	}
+}
@@ -1,28 +1,44 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
 	"personal_ai/internal/api"
+	"personal_ai/internal/version"
 )
 
 type AgentConfig struct {
-	ListenAddr string          `json:"listen_addr"`
-	AuthToken  string          `json:"auth_token"`
-	Execution  AgentExecConfig `json:"execution"`
+	ListenAddr      string          `json:"listen_addr"`
+	AuthToken       string          `json:"auth_token"`
+	TLSCertFile     string          `json:"tls_cert_file"`
+	TLSKeyFile      string          `json:"tls_key_file"`
+	TLSClientCAFile string          `json:"tls_client_ca_file"`
+	Execution       AgentExecConfig `json:"execution"`
+	// StrictConfig turns startup warnings such as bad exec paths into errors.
+	StrictConfig bool `json:"strict_config"`
 }
 
 type AgentExecConfig struct {
@@ -31,10 +47,68 @@ type AgentExecConfig struct {
 	CommandAllowlist  map[string]api.AllowedCommand `json:"command_allowlist"`
 	CommandBlocklist  []string                      `json:"command_blocklist"`
 	DynamicAllowlist  []string                      `json:"dynamic_allowlist"`
+	DynamicBlocklist  []string                      `json:"dynamic_blocklist"`
 	BaseDir           string                        `json:"base_dir"`
+	ChatBaseDirs      map[int64]string              `json:"chat_base_dirs"`
+	SharedChatCWD     bool                          `json:"shared_chat_cwd"`
+	CWDStateFile      string                        `json:"cwd_state_file"`
+	MaxConcurrent     int                           `json:"max_concurrent"`
+	MaxQueued         int                           `json:"max_queued"`
+	MaxArgs           int                           `json:"max_args"`
+	MaxArgBytes       int                           `json:"max_arg_bytes"`
+	ReadOnly          bool                          `json:"read_only"`
+	ExecPath          string                        `json:"exec_path"`
+	EnvPassthrough    []string                      `json:"env_passthrough"`
+	AllowedLsFlags    []string                      `json:"allowed_ls_flags"`
+	DefaultLsFlags    []string                      `json:"default_ls_flags"`
+	DateFormat        string                        `json:"date_format"`
+	EnvAllowlist      []string                      `json:"env_allowlist"`
+	TreeMaxDepth      int                           `json:"tree_max_depth"`
+	TreeMaxEntries    int                           `json:"tree_max_entries"`
+	FindMaxDepth      int                           `json:"find_max_depth"`
+	FindMaxResults    int                           `json:"find_max_results"`
+	FetchAllowedHosts []string                      `json:"fetch_allowed_hosts"`
+	PingAllowedHosts  []string                      `json:"ping_allowed_hosts"`
+	PingPath          string                        `json:"ping_path"`
+	PingCount         int                           `json:"ping_count"`
+	PingMaxCount      int                           `json:"ping_max_count"`
+	ManagedServices   map[string]api.AllowedCommand `json:"managed_services"`
+	RunAsUser         string                        `json:"run_as_user"`
+	RunAsGroup        string                        `json:"run_as_group"`
 }
 
-func loadConfig(path string) (*AgentConfig, error) {
+// expandEnvRefs replaces each ${NAME} in value with the environment
+// variable NAME, failing when it is unset. Other text, including a lone $,
+// is kept as is.
+func expandEnvRefs(value string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			b.WriteString(value)
+			return b.String(), nil
+		}
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			b.WriteString(value)
+			return b.String(), nil
+		}
+		name := value[start+2 : start+end]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		b.WriteString(value[:start])
+		b.WriteString(env)
+		value = value[start+end+1:]
+	}
+}
+
+// loadConfig reads the config at path and merges each overlay over it in
+// order before applying defaults and validating. An overlay replaces the
+// fields it sets: nested objects and maps merge key by key, while arrays and
+// map values such as an allowlist entry are replaced whole.
+func loadConfig(path string, overlays ...string) (*AgentConfig, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -43,6 +117,20 @@ func loadConfig(path string) (*AgentConfig, error) {
 	if err := json.Unmarshal(b, &cfg); err != nil {
 		return nil, err
 	}
+	for _, overlay := range overlays {
+		b, err := os.ReadFile(overlay)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return nil, fmt.Errorf("overlay %s: %v", overlay, err)
+		}
+	}
+	authToken, err := expandEnvRefs(cfg.AuthToken)
+	if err != nil {
+		return nil, fmt.Errorf("auth_token: %v", err)
+	}
+	cfg.AuthToken = authToken
 	if cfg.ListenAddr == "" {
 		cfg.ListenAddr = "127.0.0.1:8080"
 	}
@@ -52,9 +140,187 @@ func loadConfig(path string) (*AgentConfig, error) {
 	if cfg.Execution.MaxOutputKB <= 0 {
 		cfg.Execution.MaxOutputKB = 8
 	}
+	if cfg.Execution.MaxConcurrent > 0 && cfg.Execution.MaxQueued <= 0 {
+		cfg.Execution.MaxQueued = 32
+	}
+	if cfg.Execution.MaxArgs <= 0 {
+		cfg.Execution.MaxArgs = defaultMaxArgs
+	}
+	if cfg.Execution.MaxArgBytes <= 0 {
+		cfg.Execution.MaxArgBytes = defaultMaxArgBytes
+	}
+	lsFlags, err := normalizeLsFlags(cfg.Execution.AllowedLsFlags)
+	if err != nil {
+		return nil, fmt.Errorf("execution.allowed_ls_flags: %v", err)
+	}
+	cfg.Execution.AllowedLsFlags = lsFlags
+	defaultFlags, err := normalizeLsFlags(cfg.Execution.DefaultLsFlags)
+	if err != nil {
+		return nil, fmt.Errorf("execution.default_ls_flags: %v", err)
+	}
+	for _, f := range defaultFlags {
+		if !isAllowedLsFlag(f, lsFlags) {
+			return nil, fmt.Errorf("execution.default_ls_flags: %s is not an allowed ls flag", f)
+		}
+	}
+	cfg.Execution.DefaultLsFlags = defaultFlags
+	if _, err := parseHostAllowlist(cfg.Execution.FetchAllowedHosts); err != nil {
+		return nil, fmt.Errorf("execution.fetch_allowed_hosts: %v", err)
+	}
+	if _, err := parseHostAllowlist(cfg.Execution.PingAllowedHosts); err != nil {
+		return nil, fmt.Errorf("execution.ping_allowed_hosts: %v", err)
+	}
+	if cfg.Execution.PingPath != "" && !filepath.IsAbs(cfg.Execution.PingPath) {
+		return nil, fmt.Errorf("execution.ping_path must be absolute: %s", cfg.Execution.PingPath)
+	}
+	if err := normalizeChatBaseDirs(cfg.Execution.BaseDir, cfg.Execution.ChatBaseDirs); err != nil {
+		return nil, fmt.Errorf("execution.%v", err)
+	}
+	if err := resolveRunAsConfig(&cfg.Execution); err != nil {
+		return nil, err
+	}
+	if err := checkWorkDirs("execution.command_allowlist", cfg.Execution.CommandAllowlist); err != nil {
+		return nil, err
+	}
+	problems := append(execPathProblems("execution.command_allowlist", cfg.Execution.CommandAllowlist),
+		execPathProblems("execution.managed_services", cfg.Execution.ManagedServices)...)
+	if err := reportExecPaths(cfg.StrictConfig, problems); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
+// execPathProblems lists allowlist entries whose exec is not an absolute path
+// to an existing executable file, sorted for stable messages.
+func execPathProblems(field string, cmds map[string]api.AllowedCommand) []string {
+	var problems []string
+	for name, c := range cmds {
+		if problem := checkExecPath(c.Exec); problem != "" {
+			problems = append(problems, fmt.Sprintf("%s.%s: %s %s", field, name, c.Exec, problem))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func checkExecPath(path string) string {
+	if !filepath.IsAbs(path) {
+		return "is not an absolute path"
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "does not exist"
+	}
+	if info.IsDir() || info.Mode().Perm()&0o111 == 0 {
+		return "is not executable"
+	}
+	return ""
+}
+
+// checkWorkDirs rejects allowlist entries whose work_dir is not an absolute
+// path to an existing directory.
+func checkWorkDirs(field string, cmds map[string]api.AllowedCommand) error {
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dir := cmds[name].WorkDir
+		if dir == "" {
+			continue
+		}
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("%s.%s.work_dir must be an absolute path", field, name)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("%s.%s.work_dir %s is not a directory", field, name, dir)
+		}
+	}
+	return nil
+}
+
+// reportExecPaths fails with every offending exec path under strict_config
+// and only logs them otherwise.
+func reportExecPaths(strict bool, problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	msg := "invalid exec paths: " + strings.Join(problems, "; ")
+	if strict {
+		return errors.New(msg)
+	}
+	log.Printf("warning: %s", msg)
+	return nil
+}
+
+// resolveRunAsConfig replaces user and group names with numeric IDs so
+// lookups happen once, at startup.
+func resolveRunAsConfig(cfg *AgentExecConfig) error {
+	groupSpec := cfg.RunAsGroup
+	uid, gid, err := resolveRunAs(cfg.RunAsUser, cfg.RunAsGroup)
+	if err != nil {
+		return fmt.Errorf("execution.%v", err)
+	}
+	cfg.RunAsUser, cfg.RunAsGroup = uid, gid
+	for _, cmds := range []struct {
+		field string
+		m     map[string]api.AllowedCommand
+	}{{"command_allowlist", cfg.CommandAllowlist}, {"managed_services", cfg.ManagedServices}} {
+		for name, c := range cmds.m {
+			if c.RunAsUser == "" && c.RunAsGroup == "" {
+				continue
+			}
+			// Fields the entry leaves unset fall back to the execution-level ones;
+			// the user's primary group applies only when neither sets a group.
+			group := c.RunAsGroup
+			if group == "" {
+				group = groupSpec
+			}
+			uid, gid, err := resolveRunAs(c.RunAsUser, group)
+			if err != nil {
+				return fmt.Errorf("execution.%s.%s.%v", cmds.field, name, err)
+			}
+			if c.RunAsUser == "" {
+				uid = cfg.RunAsUser
+			}
+			if gid == "" {
+				gid = cfg.RunAsGroup
+			}
+			c.RunAsUser, c.RunAsGroup = uid, gid
+			cmds.m[name] = c
+		}
+	}
+	return nil
+}
+
+// Defaults for max_args and max_arg_bytes. They leave room for write's
+// base64 payloads while stopping runaway LLM output.
+const (
+	defaultMaxArgs     = 256
+	defaultMaxArgBytes = 64 * 1024
+)
+
+// checkArgLimits rejects requests with more than maxArgs arguments or any
+// argument longer than maxArgBytes. Non-positive limits use the defaults.
+func checkArgLimits(args []string, maxArgs, maxArgBytes int) error {
+	if maxArgs <= 0 {
+		maxArgs = defaultMaxArgs
+	}
+	if maxArgBytes <= 0 {
+		maxArgBytes = defaultMaxArgBytes
+	}
+	if len(args) > maxArgs {
+		return fmt.Errorf("too many arguments: %d exceeds max_args %d", len(args), maxArgs)
+	}
+	for i, a := range args {
+		if len(a) > maxArgBytes {
+			return fmt.Errorf("argument %d is %d bytes, exceeds max_arg_bytes %d", i+1, len(a), maxArgBytes)
+		}
+	}
+	return nil
+}
+
 func isBlocked(cmd string, blocklist []string) bool {
 	for _, b := range blocklist {
 		if strings.EqualFold(cmd, b) {
@@ -66,29 +332,45 @@ func isBlocked(cmd string, blocklist []string) bool {
 
 func main() {
 	configPath := flag.String("config", "configs/agent.json", "path to agent config json")
+	overlayPath := flag.String("overlay", "", "optional config json merged over -config")
 	flag.Parse()
+	var overlays []string
+	if *overlayPath != "" {
+		overlays = append(overlays, *overlayPath)
+	}
 
-	cfg, err := loadConfig(*configPath)
+	cfg, err := loadConfig(*configPath, overlays...)
 	if err != nil {
 		log.Fatalf("load config: %v", err)
 	}
+	log.Printf("agent %s", version.Get())
 
-	mux := http.NewServeMux()
-	exec := newAgentExecutor(cfg)
-	mux.HandleFunc("/command", newCommandHandler(cfg, exec))
-
-	srv := &http.Server{
-		Addr:              cfg.ListenAddr,
-		Handler:           mux,
-		ReadHeaderTimeout: 5 * time.Second,
+	srv, err := newAgentServer(cfg, newAgentExecutor(cfg))
+	if err != nil {
+		log.Fatalf("server: %v", err)
 	}
 
-	log.Printf("agent listening on %s", cfg.ListenAddr)
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if srv.TLSConfig != nil {
+		log.Printf("agent listening on %s (tls)", cfg.ListenAddr)
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("agent listening on %s", cfg.ListenAddr)
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("server: %v", err)
 	}
 }
 
+// mutatingDynamicCommands are refused when read_only is set. rm and cp are
+// reserved names with no implementation yet, listed so read_only covers
+// them as soon as they land.
+var mutatingDynamicCommands = []string{"write", "append", "touch", "mkdir", "mktemp", "rm", "cp", "mv"}
+
+func readOnlyResponse(cmd string) api.CommandResponse {
+	return api.CommandResponse{Ok: false, ExitCode: 1, Error: "read-only mode: " + cmd + " is disabled", Reason: api.ReasonReadOnly}
+}
+
 func isDynamicAllowed(cmd string, allowed []string) bool {
 	for _, a := range allowed {
 		if strings.EqualFold(cmd, a) {
@@ -98,32 +380,134 @@ func isDynamicAllowed(cmd string, allowed []string) bool {
 	return false
 }
 
+// cwdKey identifies one working directory. UserID is zero when the store is
+// shared by everyone in a chat.
+type cwdKey struct {
+	chatID int64
+	userID int64
+}
+
 type chatCWDStore struct {
-	mu   sync.Mutex
-	byID map[int64]string
+	mu       sync.Mutex
+	byID     map[cwdKey]string
+	chatBase map[int64]string
+	shared   bool
+	// path and saved are set when directories persist across restarts.
+	path  string
+	saved map[cwdKey]string
 }
 
-func newChatCWD() *chatCWDStore {
-	return &chatCWDStore{byID: make(map[int64]string)}
+func newChatCWD(chatBase map[int64]string, shared bool) *chatCWDStore {
+	return &chatCWDStore{byID: make(map[cwdKey]string), chatBase: chatBase, shared: shared}
 }
 
-func (s *chatCWDStore) get(chatID int64, base string) string {
+func (s *chatCWDStore) key(chatID, userID int64) cwdKey {
+	if s.shared {
+		return cwdKey{chatID: chatID}
+	}
+	return cwdKey{chatID: chatID, userID: userID}
+}
+
+func (s *chatCWDStore) get(chatID, userID int64, base string) string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if v, ok := s.byID[chatID]; ok {
+	k := s.key(chatID, userID)
+	if v, ok := s.byID[k]; ok {
 		return v
 	}
-	s.byID[chatID] = base
-	return base
+	start := base
+	if rel, ok := s.chatBase[chatID]; ok {
+		dir := filepath.Join(base, rel)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			start = dir
+		}
+	}
+	s.byID[k] = start
+	return start
+}
+
+func (s *chatCWDStore) set(chatID, userID int64, dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.key(chatID, userID)
+	s.byID[k] = dir
+	if s.path == "" {
+		return
+	}
+	s.saved[k] = dir
+	if err := s.save(); err != nil {
+		log.Printf("save cwd state: %v", err)
+	}
 }
 
-func (s *chatCWDStore) set(chatID int64, dir string) {
+// load restores directories saved by a previous run from path, which later
+// set calls keep up to date. Saved directories that no longer exist or are
+// outside base are dropped so their users start over.
+func (s *chatCWDStore) load(path, base string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.byID[chatID] = dir
+	s.path = path
+	s.saved = make(map[cwdKey]string)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved map[string]string
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+	baseAbs, err := filepath.Abs(base)
+	if err != nil {
+		return err
+	}
+	for k, dir := range saved {
+		var key cwdKey
+		if _, err := fmt.Sscanf(k, "%d:%d", &key.chatID, &key.userID); err != nil || !filepath.IsAbs(dir) {
+			continue
+		}
+		clean, err := sanitizePath(baseAbs, baseAbs, dir)
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(clean); err != nil || !info.IsDir() {
+			continue
+		}
+		s.byID[key] = clean
+		s.saved[key] = clean
+	}
+	return nil
 }
 
-func handleDynamicCommand(cfg *AgentConfig, store *chatCWDStore, chatID int64, cmd string, args []string) api.CommandResponse {
+// save writes the directories chosen with cd to s.path. The caller holds s.mu.
+func (s *chatCWDStore) save() error {
+	out := make(map[string]string, len(s.saved))
+	for k, dir := range s.saved {
+		out[fmt.Sprintf("%d:%d", k.chatID, k.userID)] = dir
+	}
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".cwd-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func handleDynamicCommand(ctx context.Context, cfg *AgentConfig, store *chatCWDStore, chatID, userID int64, cmd string, args []string) api.CommandResponse {
 	base := strings.TrimSpace(cfg.Execution.BaseDir)
 	if base == "" {
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "base_dir not configured"}
@@ -134,63 +518,154 @@ func handleDynamicCommand(cfg *AgentConfig, store *chatCWDStore, chatID int64, c
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "invalid base_dir"}
 	}
 
+	// Filesystem walks share the command timeout so a huge tree cannot hang the request.
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Execution.DefaultTimeoutSec)*time.Second)
+	defer cancel()
+
 	switch strings.ToLower(cmd) {
 	case "pwd":
-		cwd := store.get(chatID, baseAbs)
+		cwd := store.get(chatID, userID, baseAbs)
 		return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: cwd + "\n"}
 	case "ls", "ll":
-		cwd := store.get(chatID, baseAbs)
-		return runSafeList(baseAbs, cwd, cmd, args, cfg.Execution.DefaultTimeoutSec, cfg.Execution.MaxOutputKB)
+		cwd := store.get(chatID, userID, baseAbs)
+		return runSafeList(baseAbs, cwd, cmd, args, cfg.Execution.AllowedLsFlags, cfg.Execution.DefaultLsFlags, cfg.Execution.DefaultTimeoutSec, cfg.Execution.MaxOutputKB, cfg.Execution.RunAsUser, cfg.Execution.RunAsGroup)
 	case "cat":
-		cwd := store.get(chatID, baseAbs)
-		return runSafeCat(baseAbs, cwd, args, cfg.Execution.DefaultTimeoutSec, cfg.Execution.MaxOutputKB)
+		cwd := store.get(chatID, userID, baseAbs)
+		return runSafeCat(baseAbs, cwd, args, cfg.Execution.DefaultTimeoutSec, cfg.Execution.MaxOutputKB, cfg.Execution.RunAsUser, cfg.Execution.RunAsGroup)
 	case "cd":
-		return runSafeCd(baseAbs, store, chatID, args)
+		return runSafeCd(baseAbs, store, chatID, userID, args)
 	case "touch":
-		cwd := store.get(chatID, baseAbs)
+		cwd := store.get(chatID, userID, baseAbs)
 		return runSafeTouch(baseAbs, cwd, args)
+	case "mktemp":
+		cwd := store.get(chatID, userID, baseAbs)
+		return runSafeMktemp(baseAbs, cwd, args)
 	case "mkdir":
-		cwd := store.get(chatID, baseAbs)
+		cwd := store.get(chatID, userID, baseAbs)
 		return runSafeMkdir(baseAbs, cwd, args)
 	case "write":
-		cwd := store.get(chatID, baseAbs)
+		cwd := store.get(chatID, userID, baseAbs)
 		return runSafeWrite(baseAbs, cwd, args, false)
 	case "append":
-		cwd := store.get(chatID, baseAbs)
+		cwd := store.get(chatID, userID, baseAbs)
 		return runSafeWrite(baseAbs, cwd, args, true)
+	case "mv":
+		cwd := store.get(chatID, userID, baseAbs)
+		return runSafeMove(baseAbs, cwd, args)
 	case "count":
-		cwd := store.get(chatID, baseAbs)
-		return runSafeCount(baseAbs, cwd, args)
+		cwd := store.get(chatID, userID, baseAbs)
+		return runSafeCount(ctx, baseAbs, cwd, args)
+	case "wc":
+		cwd := store.get(chatID, userID, baseAbs)
+		return runSafeWc(ctx, baseAbs, cwd, args)
+	case "jsonfmt":
+		cwd := store.get(chatID, userID, baseAbs)
+		return runSafeJSONFmt(baseAbs, cwd, args, cfg.Execution.MaxOutputKB)
 	case "find":
-		cwd := store.get(chatID, baseAbs)
-		return runSafeFind(baseAbs, cwd, args)
+		cwd := store.get(chatID, userID, baseAbs)
+		return runSafeFind(ctx, baseAbs, cwd, args, cfg.Execution.FindMaxDepth, cfg.Execution.FindMaxResults)
+	case "grep":
+		cwd := store.get(chatID, userID, baseAbs)
+		return runSafeGrep(ctx, baseAbs, cwd, args, cfg.Execution.MaxOutputKB)
+	case "du":
+		cwd := store.get(chatID, userID, baseAbs)
+		return runSafeDu(ctx, baseAbs, cwd, args, cfg.Execution.MaxOutputKB)
+	case "tree":
+		cwd := store.get(chatID, userID, baseAbs)
+		return runSafeTree(ctx, baseAbs, cwd, args, cfg.Execution.TreeMaxDepth, cfg.Execution.TreeMaxEntries, cfg.Execution.MaxOutputKB)
 	case "ping":
-		return runSafePing(args)
+		return runSafePing(args, cfg.Execution.PingAllowedHosts, cfg.Execution.PingPath, cfg.Execution.PingCount, cfg.Execution.PingMaxCount, cfg.Execution.RunAsUser, cfg.Execution.RunAsGroup)
+	case "fetch":
+		return runSafeFetch(ctx, args, cfg.Execution.FetchAllowedHosts, cfg.Execution.DefaultTimeoutSec, cfg.Execution.MaxOutputKB)
+	case "echo":
+		return runSafeEcho(args)
+	case "date":
+		return runSafeDate(cfg.Execution.DateFormat)
+	case "uptime":
+		return runSafeUptime()
+	case "env":
+		return runSafeEnv(cfg.Execution.EnvAllowlist)
+	case "whoami":
+		cwd := store.get(chatID, userID, baseAbs)
+		out := fmt.Sprintf("user: %d\nchat: %d\ncwd: %s\nbase_dir: %s\n", userID, chatID, cwd, baseAbs)
+		return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: out}
 	default:
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "unsupported dynamic command"}
 	}
 }
 
-func runSafeList(baseAbs, cwdAbs, cmd string, args []string, timeoutSec int, maxKB int) api.CommandResponse {
+// maxGlobMatches caps how many paths a single glob argument may expand to.
+const maxGlobMatches = 100
+
+// expandPathArg sanitizes a path argument, expanding glob patterns within
+// base_dir. Like the shell, a pattern without matches is passed on literally.
+func expandPathArg(baseAbs, cwdAbs, arg string) ([]string, error) {
+	pattern, err := sanitizePath(baseAbs, cwdAbs, arg)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.ContainsAny(arg, "*?[") {
+		return []string{pattern}, nil
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %s", arg)
+	}
+	if len(matches) == 0 {
+		return []string{pattern}, nil
+	}
+	if len(matches) > maxGlobMatches {
+		return nil, fmt.Errorf("pattern matches more than %d paths: %s", maxGlobMatches, arg)
+	}
+	paths := make([]string, 0, len(matches))
+	for _, m := range matches {
+		p, err := sanitizePath(baseAbs, cwdAbs, m)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+func runSafeList(baseAbs, cwdAbs, cmd string, args []string, allowedFlags, defaultFlags []string, timeoutSec int, maxKB int, runAsUser, runAsGroup string) api.CommandResponse {
 	flags := []string{}
 	paths := []string{}
+	page, perPage := 0, 0
 
 	if strings.ToLower(cmd) == "ll" {
 		flags = append(flags, "-la")
 	}
 
-	for _, a := range args {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--page" || a == "--per-page" {
+			if i+1 >= len(args) {
+				return api.CommandResponse{Ok: false, ExitCode: 1, Error: a + " requires a number"}
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return api.CommandResponse{Ok: false, ExitCode: 1, Error: a + " requires a positive number"}
+			}
+			if a == "--page" {
+				page = n
+			} else {
+				perPage = n
+			}
+			i++
+			continue
+		}
 		if strings.HasPrefix(a, "-") {
-			if !isAllowedLsFlag(a) {
+			if !isAllowedLsFlag(a, allowedFlags) {
 				return api.CommandResponse{Ok: false, ExitCode: 1, Error: "ls flag not allowed: " + a}
 			}
 			flags = append(flags, a)
 		} else {
-			p, err := sanitizePath(baseAbs, cwdAbs, a)
+			expanded, err := expandPathArg(baseAbs, cwdAbs, a)
 			if err != nil {
-				return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+				return pathErrorResponse(err)
 			}
-			paths = append(paths, p)
+			paths = append(paths, expanded...)
 		}
 	}
 
@@ -198,50 +673,286 @@ func runSafeList(baseAbs, cwdAbs, cmd string, args []string, timeoutSec int, max
 		paths = []string{cwdAbs}
 	}
 
-	return runCommand(cwdAbs, "/bin/ls", append(flags, paths...), timeoutSec, maxKB)
+	if page > 0 || perPage > 0 {
+		return runPagedList(paths, defaultFlags, flags, page, perPage, maxKB)
+	}
+	// Configured defaults go first so the user's own flags can refine them.
+	flags = append(append([]string{}, defaultFlags...), flags...)
+	return runCommand(cwdAbs, "/bin/ls", append(flags, paths...), timeoutSec, maxKB, runAsUser, runAsGroup)
+}
+
+// Defaults and cap for ls --per-page.
+const (
+	defaultLsPerPage = 50
+	maxLsPerPage     = 500
+)
+
+// runPagedList lists one directory a page at a time, sorted by name, in Go
+// rather than through /bin/ls. Only the -a, -l and -1 flags apply.
+func runPagedList(paths, defaultFlags, flags []string, page, perPage, maxKB int) api.CommandResponse {
+	if len(paths) != 1 {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "ls --page lists a single directory"}
+	}
+	showAll, long := false, false
+	// Default flags paging cannot honour, such as -h, are skipped; the
+	// user's own are refused.
+	for i, f := range append(append([]string{}, defaultFlags...), flags...) {
+		for _, c := range strings.TrimPrefix(f, "-") {
+			switch c {
+			case 'a':
+				showAll = true
+			case 'l':
+				long = true
+			case '1':
+			default:
+				if i >= len(defaultFlags) {
+					return api.CommandResponse{Ok: false, ExitCode: 1, Error: "ls flag not supported with --page: " + f}
+				}
+			}
+		}
+	}
+	if page == 0 {
+		page = 1
+	}
+	if perPage == 0 {
+		perPage = defaultLsPerPage
+	}
+	if perPage > maxLsPerPage {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: fmt.Sprintf("--per-page may not exceed %d", maxLsPerPage)}
+	}
+
+	entries, err := os.ReadDir(paths[0])
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	visible := entries[:0]
+	for _, e := range entries {
+		if showAll || !strings.HasPrefix(e.Name(), ".") {
+			visible = append(visible, e)
+		}
+	}
+	pages := (len(visible) + perPage - 1) / perPage
+	if pages == 0 {
+		pages = 1
+	}
+	if page > pages {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: fmt.Sprintf("page %d out of range (%d pages)", page, pages)}
+	}
+	start := (page - 1) * perPage
+	end := start + perPage
+	if end > len(visible) {
+		end = len(visible)
+	}
+
+	// The page line comes first so it survives truncation.
+	var b strings.Builder
+	fmt.Fprintf(&b, "page %d/%d (%d entries)\n", page, pages, len(visible))
+	for _, e := range visible[start:end] {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		if !long {
+			b.WriteString(name + "\n")
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// The entry vanished since it was read.
+			continue
+		}
+		fmt.Fprintf(&b, "%s %10d %s %s\n", info.Mode(), info.Size(), info.ModTime().Format("2006-01-02 15:04"), name)
+	}
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: limitOutput(b.String(), maxKB)}
 }
 
-func runSafeCat(baseAbs, cwdAbs string, args []string, timeoutSec int, maxKB int) api.CommandResponse {
+func runSafeCat(baseAbs, cwdAbs string, args []string, timeoutSec int, maxKB int, runAsUser, runAsGroup string) api.CommandResponse {
 	if len(args) == 0 {
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "cat requires a file path"}
 	}
+	for i, a := range args {
+		if a == "--lines" {
+			if i+1 >= len(args) {
+				return api.CommandResponse{Ok: false, ExitCode: 1, Error: "--lines requires a range like 50-80"}
+			}
+			rest := append(append([]string{}, args[:i]...), args[i+2:]...)
+			return runSafeCatLines(baseAbs, cwdAbs, rest, args[i+1], maxKB)
+		}
+	}
 	paths := []string{}
 	for _, a := range args {
 		if strings.HasPrefix(a, "-") {
 			return api.CommandResponse{Ok: false, ExitCode: 1, Error: "cat flags not allowed"}
 		}
-		p, err := sanitizePath(baseAbs, cwdAbs, a)
+		expanded, err := expandPathArg(baseAbs, cwdAbs, a)
+		if err != nil {
+			return pathErrorResponse(err)
+		}
+		paths = append(paths, expanded...)
+	}
+	return runCommand(baseAbs, "/bin/cat", paths, timeoutSec, maxKB, runAsUser, runAsGroup)
+}
+
+// parseLineRange parses an inclusive "start-end" range of 1-based lines.
+func parseLineRange(s string) (int, int, error) {
+	from, to, ok := strings.Cut(s, "-")
+	start, err1 := strconv.Atoi(from)
+	end, err2 := strconv.Atoi(to)
+	if !ok || err1 != nil || err2 != nil || start < 1 {
+		return 0, 0, fmt.Errorf("invalid line range %q (want start-end, e.g. 50-80)", s)
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("invalid line range %q: start is after end", s)
+	}
+	return start, end, nil
+}
+
+// runSafeCatLines returns lines start through end of a single file, reading
+// only as far as end. A range past the end of the file is clamped to it.
+func runSafeCatLines(baseAbs, cwdAbs string, args []string, lineRange string, maxKB int) api.CommandResponse {
+	start, end, err := parseLineRange(lineRange)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	if len(args) != 1 || strings.HasPrefix(args[0], "-") {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "cat --lines requires a single file path"}
+	}
+	target, err := sanitizePath(baseAbs, cwdAbs, args[0])
+	if err != nil {
+		return pathErrorResponse(err)
+	}
+	f, err := os.Open(target)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "cat --lines requires a regular file"}
+	}
+
+	out := newCappedWriter(maxKB, func() {})
+	r := bufio.NewReader(f)
+	line := 1
+	for line <= end {
+		// ReadSlice hands back long lines in pieces, so skipped lines are
+		// never held in memory whole.
+		chunk, err := r.ReadSlice('\n')
+		if line >= start {
+			out.Write(chunk)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if len(chunk) > 0 {
+			line++
+		}
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
 			return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
 		}
-		paths = append(paths, p)
 	}
-	return runCommand(baseAbs, "/bin/cat", paths, timeoutSec, maxKB)
+	if lines := line - 1; start > lines {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: fmt.Sprintf("line range starts past the end of %s (%d lines)", args[0], lines)}
+	}
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: out.String()}
 }
 
+// runSafeTouch creates a file if needed. --time <RFC3339> sets its access
+// and modification times, and --parents creates missing parent directories.
 func runSafeTouch(baseAbs, cwdAbs string, args []string) api.CommandResponse {
+	var mtime time.Time
+	parents := false
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		switch args[0] {
+		case "--parents":
+			parents = true
+			args = args[1:]
+		case "--time":
+			if len(args) < 2 {
+				return api.CommandResponse{Ok: false, ExitCode: 1, Error: "--time requires an RFC3339 timestamp"}
+			}
+			t, err := time.Parse(time.RFC3339, args[1])
+			if err != nil {
+				return api.CommandResponse{Ok: false, ExitCode: 1, Error: "invalid --time: use RFC3339, e.g. 2024-01-02T15:04:05Z"}
+			}
+			mtime = t
+			args = args[2:]
+		default:
+			return api.CommandResponse{Ok: false, ExitCode: 1, Error: "unsupported touch flag: " + args[0]}
+		}
+	}
 	if len(args) != 1 {
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "touch requires a single file path"}
 	}
 	target, err := sanitizePath(baseAbs, cwdAbs, args[0])
 	if err != nil {
-		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+		return pathErrorResponse(err)
+	}
+	if parents {
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+		}
 	}
 	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, 0o644)
 	if err != nil {
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
 	}
 	_ = f.Close()
+	if !mtime.IsZero() {
+		if err := os.Chtimes(target, mtime, mtime); err != nil {
+			return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+		}
+	}
 	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: target + "\n"}
 }
 
+// mktempMaxSuffix bounds the optional mktemp suffix.
+const mktempMaxSuffix = 32
+
+// runSafeMktemp creates an empty, uniquely named file in the working
+// directory and returns its path. An optional suffix such as ".txt" may only
+// use letters, digits, '.', '-', and '_'.
+func runSafeMktemp(baseAbs, cwdAbs string, args []string) api.CommandResponse {
+	if len(args) > 1 {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "mktemp takes at most one suffix"}
+	}
+	suffix := ""
+	if len(args) == 1 {
+		suffix = args[0]
+		if len(suffix) > mktempMaxSuffix || !isSafeMktempSuffix(suffix) {
+			return api.CommandResponse{Ok: false, ExitCode: 1, Error: "invalid mktemp suffix: use letters, digits, '.', '-', and '_'"}
+		}
+	}
+	dir, err := sanitizePath(baseAbs, cwdAbs, ".")
+	if err != nil {
+		return pathErrorResponse(err)
+	}
+	f, err := os.CreateTemp(dir, "tmp.*"+suffix)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	_ = f.Close()
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: f.Name() + "\n"}
+}
+
+func isSafeMktempSuffix(s string) bool {
+	for _, r := range s {
+		if !((r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
 func runSafeMkdir(baseAbs, cwdAbs string, args []string) api.CommandResponse {
 	if len(args) != 1 {
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "mkdir requires a single directory path"}
 	}
 	target, err := sanitizePath(baseAbs, cwdAbs, args[0])
 	if err != nil {
-		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+		return pathErrorResponse(err)
 	}
 	if err := os.MkdirAll(target, 0o755); err != nil {
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
@@ -250,14 +961,28 @@ func runSafeMkdir(baseAbs, cwdAbs string, args []string) api.CommandResponse {
 }
 
 func runSafeWrite(baseAbs, cwdAbs string, args []string, appendMode bool) api.CommandResponse {
+	useBase64 := len(args) > 0 && args[0] == "--base64"
+	if useBase64 {
+		args = args[1:]
+	}
 	if len(args) < 2 {
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "write requires a file path and content"}
 	}
 	target, err := sanitizePath(baseAbs, cwdAbs, args[0])
 	if err != nil {
-		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+		return pathErrorResponse(err)
 	}
 	content := strings.Join(args[1:], " ")
+	if useBase64 {
+		if len(args) != 2 {
+			return api.CommandResponse{Ok: false, ExitCode: 1, Error: "--base64 requires a single content argument"}
+		}
+		decoded, err := base64.StdEncoding.DecodeString(args[1])
+		if err != nil {
+			return api.CommandResponse{Ok: false, ExitCode: 1, Error: "invalid base64 content"}
+		}
+		content = string(decoded)
+	}
 	if len(content) > 32*1024 {
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "content too large"}
 	}
@@ -279,24 +1004,102 @@ func runSafeWrite(baseAbs, cwdAbs string, args []string, appendMode bool) api.Co
 	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: target + "\n"}
 }
 
-func runSafeCount(baseAbs, cwdAbs string, args []string) api.CommandResponse {
-	target := cwdAbs
-	if len(args) > 1 {
-		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "count accepts at most one path"}
+// renameFile is os.Rename, replaceable in tests to simulate cross-device moves.
+var renameFile = os.Rename
+
+// runSafeMove renames a file or directory within base_dir. Moving into an
+// existing directory keeps the source name; existing files are not replaced.
+func runSafeMove(baseAbs, cwdAbs string, args []string) api.CommandResponse {
+	if len(args) != 2 {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "mv requires a source and destination"}
 	}
-	if len(args) == 1 {
-		p, err := sanitizePath(baseAbs, cwdAbs, args[0])
-		if err != nil {
-			return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
-		}
-		target = p
+	src, err := sanitizePath(baseAbs, cwdAbs, args[0])
+	if err != nil {
+		return pathErrorResponse(err)
 	}
-	info, err := os.Stat(target)
+	dst, err := sanitizePath(baseAbs, cwdAbs, args[1])
 	if err != nil {
-		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+		return pathErrorResponse(err)
 	}
-	if !info.IsDir() {
-		return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: "1\n"}
+	if src == baseAbs {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "cannot move base_dir"}
+	}
+	if _, err := os.Lstat(src); err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		dst = filepath.Join(dst, filepath.Base(src))
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "destination exists"}
+	}
+	if err := moveFile(src, dst); err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: dst + "\n"}
+}
+
+// moveFile renames src to dst, falling back to copy-then-delete for regular
+// files when the rename crosses filesystems.
+func moveFile(src, dst string) error {
+	err := renameFile(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	info, statErr := os.Lstat(src)
+	if statErr != nil {
+		return statErr
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("cannot move %s across filesystems", info.Name())
+	}
+	if err := copyFile(src, dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	// OpenFile's mode is subject to the umask; set it explicitly.
+	return os.Chmod(dst, perm)
+}
+
+func runSafeCount(ctx context.Context, baseAbs, cwdAbs string, args []string) api.CommandResponse {
+	target := cwdAbs
+	if len(args) > 1 {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "count accepts at most one path"}
+	}
+	if len(args) == 1 {
+		p, err := sanitizePath(baseAbs, cwdAbs, args[0])
+		if err != nil {
+			return pathErrorResponse(err)
+		}
+		target = p
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	if !info.IsDir() {
+		return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: "1\n"}
 	}
 	entries, err := os.ReadDir(target)
 	if err != nil {
@@ -304,6 +1107,9 @@ func runSafeCount(baseAbs, cwdAbs string, args []string) api.CommandResponse {
 	}
 	count := 0
 	for _, e := range entries {
+		if ctx.Err() != nil {
+			return api.CommandResponse{Ok: false, ExitCode: 1, Error: errWalkTimeout.Error()}
+		}
 		if e.Type().IsRegular() {
 			count++
 		}
@@ -311,7 +1117,140 @@ func runSafeCount(baseAbs, cwdAbs string, args []string) api.CommandResponse {
 	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: fmt.Sprintf("%d\n", count)}
 }
 
-func runSafeFind(baseAbs, cwdAbs string, args []string) api.CommandResponse {
+// runSafeWc counts lines, words, and bytes of a single file in Go, reporting
+// all three unless -l, -w, or -c narrow the output.
+func runSafeWc(ctx context.Context, baseAbs, cwdAbs string, args []string) api.CommandResponse {
+	showLines, showWords, showBytes := false, false, false
+	paths := []string{}
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") || a == "-" {
+			paths = append(paths, a)
+			continue
+		}
+		for _, c := range a[1:] {
+			switch c {
+			case 'l':
+				showLines = true
+			case 'w':
+				showWords = true
+			case 'c':
+				showBytes = true
+			default:
+				return api.CommandResponse{Ok: false, ExitCode: 1, Error: "wc flag not allowed: " + a}
+			}
+		}
+	}
+	if len(paths) != 1 {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "wc requires a single file path"}
+	}
+	if !showLines && !showWords && !showBytes {
+		showLines, showWords, showBytes = true, true, true
+	}
+	target, err := sanitizePath(baseAbs, cwdAbs, paths[0])
+	if err != nil {
+		return pathErrorResponse(err)
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	if !info.Mode().IsRegular() {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "wc requires a regular file"}
+	}
+	f, err := os.Open(target)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	defer f.Close()
+
+	var lines, words, size int64
+	inWord := false
+	buf := make([]byte, 32*1024)
+	for {
+		if ctx.Err() != nil {
+			return api.CommandResponse{Ok: false, ExitCode: 1, Error: errWalkTimeout.Error()}
+		}
+		n, err := f.Read(buf)
+		for _, b := range buf[:n] {
+			if b == '\n' {
+				lines++
+			}
+			// Words are split on ASCII whitespace, which never occurs inside
+			// a multi-byte UTF-8 sequence.
+			if unicode.IsSpace(rune(b)) && b < 0x80 {
+				inWord = false
+			} else if !inWord {
+				inWord = true
+				words++
+			}
+		}
+		size += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+		}
+	}
+
+	fields := []string{}
+	if showLines {
+		fields = append(fields, fmt.Sprintf("%d", lines))
+	}
+	if showWords {
+		fields = append(fields, fmt.Sprintf("%d", words))
+	}
+	if showBytes {
+		fields = append(fields, fmt.Sprintf("%d", size))
+	}
+	fields = append(fields, paths[0])
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: strings.Join(fields, " ") + "\n"}
+}
+
+// jsonfmtMaxInputBytes caps the file size jsonfmt will parse.
+const jsonfmtMaxInputBytes = 1 << 20
+
+// runSafeJSONFmt validates a file as JSON and returns it indented, capped at
+// maxKB.
+func runSafeJSONFmt(baseAbs, cwdAbs string, args []string, maxKB int) api.CommandResponse {
+	if len(args) != 1 || strings.HasPrefix(args[0], "-") {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "jsonfmt requires a single file path"}
+	}
+	target, err := sanitizePath(baseAbs, cwdAbs, args[0])
+	if err != nil {
+		return pathErrorResponse(err)
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	if !info.Mode().IsRegular() {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "jsonfmt requires a regular file"}
+	}
+	if info.Size() > jsonfmtMaxInputBytes {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: fmt.Sprintf("jsonfmt: file larger than %dKB", jsonfmtMaxInputBytes/1024)}
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: fmt.Sprintf("%s is not valid JSON: %v", args[0], err)}
+	}
+	out.WriteByte('\n')
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: limitOutput(out.String(), maxKB)}
+}
+
+const (
+	defaultFindMaxDepth   = 7
+	defaultFindMaxResults = 200
+)
+
+// runSafeFind lists directories whose name contains the fragment, at most
+// maxDepth levels below base_dir and maxResults matches. Zero limits fall
+// back to defaults.
+func runSafeFind(ctx context.Context, baseAbs, cwdAbs string, args []string, maxDepth, maxResults int) api.CommandResponse {
 	if len(args) != 1 {
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "find requires a single name fragment"}
 	}
@@ -319,9 +1258,13 @@ func runSafeFind(baseAbs, cwdAbs string, args []string) api.CommandResponse {
 	if needle == "" {
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "find requires a non-empty name fragment"}
 	}
+	if maxDepth <= 0 {
+		maxDepth = defaultFindMaxDepth
+	}
+	if maxResults <= 0 {
+		maxResults = defaultFindMaxResults
+	}
 
-	const maxDepth = 7
-	const maxResults = 200
 	results := []string{}
 
 	baseAbsClean := baseAbs
@@ -329,6 +1272,9 @@ func runSafeFind(baseAbs, cwdAbs string, args []string) api.CommandResponse {
 		if err != nil {
 			return err
 		}
+		if ctx.Err() != nil {
+			return errWalkTimeout
+		}
 		rel, err := filepath.Rel(baseAbsClean, path)
 		if err != nil {
 			return err
@@ -348,7 +1294,7 @@ func runSafeFind(baseAbs, cwdAbs string, args []string) api.CommandResponse {
 			if strings.Contains(name, needle) {
 				results = append(results, path)
 				if len(results) >= maxResults {
-					return filepath.SkipDir
+					return filepath.SkipAll
 				}
 			}
 		}
@@ -363,32 +1309,533 @@ func runSafeFind(baseAbs, cwdAbs string, args []string) api.CommandResponse {
 	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: strings.Join(results, "\n") + "\n"}
 }
 
-func runSafePing(args []string) api.CommandResponse {
-	if len(args) != 1 {
-		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "ping requires a single host"}
+// runSafeGrep searches file contents for a literal pattern, printing
+// "path:line: text" for each matching line. -i ignores case; -r walks a
+// directory (default the working directory) like find, skipping binary files.
+func runSafeGrep(ctx context.Context, baseAbs, cwdAbs string, args []string, maxKB int) api.CommandResponse {
+	recursive, fold := false, false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		for _, c := range args[0][1:] {
+			switch c {
+			case 'r':
+				recursive = true
+			case 'i':
+				fold = true
+			default:
+				return api.CommandResponse{Ok: false, ExitCode: 1, Error: "grep flag not allowed: " + args[0]}
+			}
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 || len(args) > 2 || args[0] == "" {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "grep requires a pattern and a path"}
+	}
+	if len(args) == 1 && !recursive {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "grep requires a file path (use -r to search a directory)"}
+	}
+	needle := args[0]
+	if fold {
+		needle = strings.ToLower(needle)
+	}
+	target := cwdAbs
+	if len(args) == 2 {
+		p, err := sanitizePath(baseAbs, cwdAbs, args[1])
+		if err != nil {
+			return pathErrorResponse(err)
+		}
+		target = p
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	if info.IsDir() && !recursive {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "grep: is a directory (use -r)"}
+	}
+
+	const maxDepth = 7
+	const maxMatches = 200
+	maxBytes := maxKB * 1024
+	var b strings.Builder
+	matches := 0
+	emit := func(path string, line int, text string) error {
+		display, err := filepath.Rel(cwdAbs, path)
+		if err != nil {
+			display = path
+		}
+		fmt.Fprintf(&b, "%s:%d: %s\n", display, line, text)
+		matches++
+		if matches >= maxMatches || b.Len() > maxBytes {
+			return errWalkLimit
+		}
+		return nil
+	}
+
+	if !info.IsDir() {
+		err = grepFile(ctx, target, needle, fold, emit)
+	} else {
+		err = filepath.WalkDir(target, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return errWalkTimeout
+			}
+			if d.IsDir() {
+				rel, err := filepath.Rel(target, path)
+				if err != nil {
+					return err
+				}
+				if rel != "." && strings.Count(rel, string(os.PathSeparator)) >= maxDepth {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// Symlinks are skipped so the search cannot leave base_dir.
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			// Unreadable files are skipped rather than ending the search.
+			if err := grepFile(ctx, path, needle, fold, emit); errors.Is(err, errWalkLimit) || errors.Is(err, errWalkTimeout) {
+				return err
+			}
+			return nil
+		})
+	}
+	if err != nil && !errors.Is(err, errWalkLimit) {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	if matches == 0 {
+		return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: "(no matches)\n"}
+	}
+	out := limitOutput(b.String(), maxKB)
+	if errors.Is(err, errWalkLimit) && !strings.HasSuffix(out, "[truncated]\n") {
+		out += "[truncated]\n"
+	}
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: out}
+}
+
+// grepFile calls emit for each line of path containing needle. Files with a
+// NUL byte in their first block are treated as binary and skipped.
+func grepFile(ctx context.Context, path, needle string, fold bool, emit func(path string, line int, text string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if head, _ := r.Peek(8 * 1024); bytes.IndexByte(head, 0) >= 0 {
+		return nil
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if ctx.Err() != nil {
+			return errWalkTimeout
+		}
+		text := sc.Text()
+		hay := text
+		if fold {
+			hay = strings.ToLower(text)
+		}
+		if strings.Contains(hay, needle) {
+			if err := emit(path, line, text); err != nil {
+				return err
+			}
+		}
+	}
+	return sc.Err()
+}
+
+var (
+	errWalkLimit   = errors.New("walk limit reached")
+	errWalkTimeout = errors.New("walk timed out")
+)
+
+// runSafeDu sums regular file sizes under a directory, bounded by depth,
+// entry count, and ctx. Unreadable entries are skipped.
+func runSafeDu(ctx context.Context, baseAbs, cwdAbs string, args []string, maxKB int) api.CommandResponse {
+	if len(args) > 1 {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "du accepts at most one path"}
+	}
+	target := cwdAbs
+	if len(args) == 1 {
+		p, err := sanitizePath(baseAbs, cwdAbs, args[0])
+		if err != nil {
+			return pathErrorResponse(err)
+		}
+		target = p
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	if !info.IsDir() {
+		return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: fmt.Sprintf("total: %s\n", humanSize(info.Size()))}
+	}
+
+	const maxDepth = 7
+	const maxEntries = 100000
+	var total int64
+	perDir := map[string]int64{}
+	entries := 0
+
+	err = filepath.WalkDir(target, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() && path != target {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entries++
+		if entries > maxEntries || ctx.Err() != nil {
+			return errWalkLimit
+		}
+		rel, err := filepath.Rel(target, path)
+		if err != nil || rel == "." {
+			return nil
+		}
+		top, _, nested := strings.Cut(rel, string(os.PathSeparator))
+		if d.IsDir() {
+			if _, ok := perDir[top]; !ok {
+				perDir[top] = 0
+			}
+			if strings.Count(rel, string(os.PathSeparator)) >= maxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += fi.Size()
+		if nested {
+			perDir[top] += fi.Size()
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errWalkLimit) {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+
+	names := make([]string, 0, len(perDir))
+	for name := range perDir {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	fmt.Fprintf(&b, "total: %s\n", humanSize(total))
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %s: %s\n", name, humanSize(perDir[name]))
+	}
+	if errors.Is(err, errWalkLimit) {
+		b.WriteString("[partial: walk limit reached]\n")
+	}
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: limitOutput(b.String(), maxKB)}
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+const (
+	defaultTreeMaxDepth   = 3
+	defaultTreeMaxEntries = 200
+)
+
+// runSafeTree renders an indented directory tree, bounded by maxDepth levels
+// below the root and maxEntries lines. Zero limits fall back to defaults.
+func runSafeTree(ctx context.Context, baseAbs, cwdAbs string, args []string, maxDepth, maxEntries, maxKB int) api.CommandResponse {
+	if len(args) > 1 {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "tree accepts at most one path"}
 	}
-	host := strings.TrimSpace(args[0])
-	if host == "" {
-		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "ping requires a non-empty host"}
+	if maxDepth <= 0 {
+		maxDepth = defaultTreeMaxDepth
 	}
-	if !isSafeHost(host) {
-		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "ping host not allowed"}
+	if maxEntries <= 0 {
+		maxEntries = defaultTreeMaxEntries
+	}
+	target := cwdAbs
+	if len(args) == 1 {
+		p, err := sanitizePath(baseAbs, cwdAbs, args[0])
+		if err != nil {
+			return pathErrorResponse(err)
+		}
+		target = p
 	}
-	return runCommand(".", "/bin/ping", []string{"-c", "4", "-W", "2", host}, 10, 8)
+	info, err := os.Stat(target)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	if !info.IsDir() {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "tree requires a directory"}
+	}
+
+	var b strings.Builder
+	b.WriteString(filepath.Base(target) + "/\n")
+	entries := 0
+	err = filepath.WalkDir(target, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() && path != target {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return errWalkTimeout
+		}
+		rel, err := filepath.Rel(target, path)
+		if err != nil || rel == "." {
+			return nil
+		}
+		entries++
+		if entries > maxEntries {
+			return errWalkLimit
+		}
+		depth := strings.Count(rel, string(os.PathSeparator))
+		name := d.Name()
+		if d.IsDir() {
+			name += "/"
+		}
+		b.WriteString(strings.Repeat("  ", depth+1) + name + "\n")
+		if d.IsDir() && depth+1 >= maxDepth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errWalkLimit) {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	if errors.Is(err, errWalkLimit) {
+		b.WriteString("[partial: walk limit reached]\n")
+	}
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: limitOutput(b.String(), maxKB)}
+}
+
+const (
+	defaultPingPath     = "/bin/ping"
+	defaultPingCount    = 4
+	defaultPingMaxCount = 10
+)
+
+// pingRequest is a parsed `ping [-6] [-c <count>] <host>`.
+type pingRequest struct {
+	host  string
+	ipv6  bool
+	count int
 }
 
-func isAllowedLsFlag(flag string) bool {
-	allowed := map[string]bool{
-		"-a":  true,
-		"-l":  true,
-		"-h":  true,
-		"-t":  true,
-		"-r":  true,
-		"-1":  true,
-		"-la": true,
-		"-al": true,
+// parsePingArgs parses ping's flags. The count defaults to defaultCount and
+// may not exceed maxCount; zero values fall back to the package defaults.
+func parsePingArgs(args []string, defaultCount, maxCount int) (pingRequest, error) {
+	if defaultCount <= 0 {
+		defaultCount = defaultPingCount
+	}
+	if maxCount <= 0 {
+		maxCount = defaultPingMaxCount
+	}
+	req := pingRequest{count: defaultCount}
+	for i := 0; i < len(args); i++ {
+		switch arg := strings.TrimSpace(args[i]); {
+		case arg == "-6":
+			req.ipv6 = true
+		case arg == "-c":
+			if i+1 >= len(args) {
+				return pingRequest{}, errors.New("ping -c requires a count")
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n <= 0 {
+				return pingRequest{}, fmt.Errorf("invalid ping count: %s", args[i])
+			}
+			if n > maxCount {
+				return pingRequest{}, fmt.Errorf("ping count %d exceeds the maximum of %d", n, maxCount)
+			}
+			req.count = n
+		case strings.HasPrefix(arg, "-"):
+			return pingRequest{}, fmt.Errorf("ping flag not allowed: %s", arg)
+		case req.host != "":
+			return pingRequest{}, errors.New("ping requires a single host")
+		default:
+			req.host = arg
+		}
+	}
+	if req.host == "" {
+		return pingRequest{}, errors.New("ping requires a single host")
 	}
-	return allowed[flag]
+	return req, nil
+}
+
+func runSafePing(args []string, allowed []string, pingPath string, defaultCount, maxCount int, runAsUser, runAsGroup string) api.CommandResponse {
+	req, err := parsePingArgs(args, defaultCount, maxCount)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	ip, err := checkPingHost(req.host, req.ipv6, allowed)
+	if err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	if pingPath == "" {
+		pingPath = defaultPingPath
+	}
+	family := "-4"
+	if ip.To4() == nil {
+		family = "-6"
+	}
+	pingArgs := []string{family, "-c", strconv.Itoa(req.count), "-W", "2"}
+	// Each probe waits up to 2s for its reply, plus a second between probes.
+	return runCommand(".", pingPath, append(pingArgs, ip.String()), 3*req.count+2, 8, runAsUser, runAsGroup)
+}
+
+// pingLookupIP resolves ping hosts; tests replace it.
+var pingLookupIP = net.LookupIP
+
+// checkPingHost validates host's format and, when ping_allowed_hosts is set,
+// requires it to be listed by name or, for IPs and resolved names, to fall
+// inside a listed network. It returns the checked address to ping, IPv6 when
+// ipv6 is set and otherwise preferring IPv4, so a name cannot resolve
+// differently for ping than it did here.
+func checkPingHost(host string, ipv6 bool, allowed []string) (net.IP, error) {
+	if !isSafeHost(host) && net.ParseIP(host) == nil {
+		return nil, errors.New("ping host not allowed")
+	}
+	list, err := parseHostAllowlist(allowed)
+	if err != nil {
+		return nil, fmt.Errorf("execution.ping_allowed_hosts: %v", err)
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		resolved, err := pingLookupIP(host)
+		if err != nil || len(resolved) == 0 {
+			return nil, fmt.Errorf("ping host does not resolve: %s", host)
+		}
+		ips = resolved
+	}
+	if (len(list.hosts) > 0 || len(list.nets) > 0) && !list.allowsHost(host) {
+		inside := len(list.nets) > 0
+		for _, ip := range ips {
+			inside = inside && list.containsIP(ip)
+		}
+		if !inside {
+			return nil, fmt.Errorf("ping host not in ping_allowed_hosts: %s", host)
+		}
+	}
+	var fallback net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil && !ipv6 {
+			return ip, nil
+		}
+		if ip.To4() == nil && fallback == nil {
+			fallback = ip
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("ping host has no IPv6 address: %s", host)
+	}
+	return fallback, nil
+}
+
+// processStart is when this process started, reported by uptime.
+var processStart = time.Now()
+
+func runSafeDate(format string) api.CommandResponse {
+	now := time.Now()
+	out := now.Format(time.RFC3339) + "\n"
+	if strings.TrimSpace(format) != "" {
+		out += now.Format(format) + "\n"
+	}
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: out}
+}
+
+func runSafeUptime() api.CommandResponse {
+	up := time.Since(processStart).Truncate(time.Second)
+	out := fmt.Sprintf("up %s since %s\n", up, processStart.Format(time.RFC3339))
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: out}
+}
+
+// runSafeEnv reports only the allowlisted variables, never the full environment.
+func runSafeEnv(allowlist []string) api.CommandResponse {
+	if len(allowlist) == 0 {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "no environment variables are allowlisted"}
+	}
+	var b strings.Builder
+	for _, name := range allowlist {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			value = "(unset)"
+		}
+		fmt.Fprintf(&b, "%s=%s\n", name, value)
+	}
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: b.String()}
+}
+
+func runSafeEcho(args []string) api.CommandResponse {
+	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: strings.Join(args, " ") + "\n"}
+}
+
+var allowedLsFlagsDefault = []string{"-a", "-l", "-h", "-t", "-r", "-1", "-la", "-al"}
+
+// isAllowedLsFlag reports whether flag is in allowed, or in allowedLsFlagsDefault
+// when no flags are configured.
+func isAllowedLsFlag(flag string, allowed []string) bool {
+	if len(allowed) == 0 {
+		allowed = allowedLsFlagsDefault
+	}
+	for _, a := range allowed {
+		if a == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeLsFlags trims and de-duplicates configured ls flags, rejecting
+// anything that is not a short option such as "-S" or "-lh".
+func normalizeLsFlags(flags []string) ([]string, error) {
+	out := make([]string, 0, len(flags))
+	seen := make(map[string]bool)
+	for _, f := range flags {
+		f = strings.TrimSpace(f)
+		if len(f) < 2 || f[0] != '-' {
+			return nil, fmt.Errorf("invalid ls flag %q", f)
+		}
+		for _, r := range f[1:] {
+			if !((r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
+				return nil, fmt.Errorf("invalid ls flag %q", f)
+			}
+		}
+		if !seen[f] {
+			seen[f] = true
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+// pathErrorResponse reports a failed path check, tagging containment
+// violations with their Reason.
+func pathErrorResponse(err error) api.CommandResponse {
+	resp := api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	switch {
+	case errors.Is(err, api.ErrPathOutsideBase):
+		resp.Reason = api.ReasonPathOutsideBase
+	case errors.Is(err, api.ErrSymlinkEscape):
+		resp.Reason = api.ReasonSymlinkEscape
+	}
+	return resp
 }
 
 func sanitizePath(baseAbs string, cwdAbs string, p string) (string, error) {
@@ -407,22 +1854,82 @@ func sanitizePath(baseAbs string, cwdAbs string, p string) (string, error) {
 		return "", fmt.Errorf("invalid path")
 	}
 	if rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
-		return "", fmt.Errorf("path outside base_dir")
+		return "", api.ErrPathOutsideBase
 	}
 
-	if info, err := os.Lstat(abs); err == nil && info.Mode()&os.ModeSymlink != 0 {
-		if eval, err := filepath.EvalSymlinks(abs); err == nil {
-			if relEval, err := filepath.Rel(baseAbs, eval); err == nil {
-				if relEval == ".." || strings.HasPrefix(relEval, ".."+string(os.PathSeparator)) {
-					return "", fmt.Errorf("symlink points outside base_dir")
-				}
-			}
-		}
+	// Resolve symlinks along the whole path, not just the last component, so a
+	// symlinked parent directory cannot escape base_dir.
+	eval, err := resolveExisting(abs)
+	if err != nil {
+		return "", fmt.Errorf("invalid path")
+	}
+	baseEval, err := filepath.EvalSymlinks(baseAbs)
+	if err != nil {
+		baseEval = baseAbs
+	}
+	relEval, err := filepath.Rel(baseEval, eval)
+	if err != nil || relEval == ".." || strings.HasPrefix(relEval, ".."+string(os.PathSeparator)) {
+		return "", api.ErrSymlinkEscape
 	}
 
 	return abs, nil
 }
 
+// resolveExisting evaluates symlinks in the longest existing prefix of p and
+// appends the components that do not exist yet. Dangling symlinks are
+// rejected since writing through them could create files anywhere.
+func resolveExisting(p string) (string, error) {
+	rest := ""
+	for {
+		eval, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(eval, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, lerr := os.Lstat(p); lerr == nil {
+			return "", fmt.Errorf("dangling symlink")
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = parent
+	}
+}
+
+// normalizeChatBaseDirs cleans the configured per-chat start directories and
+// rejects any that are absolute, would leave base_dir, or do not exist.
+func normalizeChatBaseDirs(base string, dirs map[int64]string) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+	if strings.TrimSpace(base) == "" {
+		return fmt.Errorf("chat_base_dirs requires base_dir")
+	}
+	baseAbs, err := filepath.Abs(base)
+	if err != nil {
+		return fmt.Errorf("invalid base_dir")
+	}
+	for chatID, dir := range dirs {
+		if filepath.IsAbs(dir) {
+			return fmt.Errorf("chat_base_dirs[%d]: path must be relative to base_dir", chatID)
+		}
+		abs, err := sanitizePath(baseAbs, baseAbs, dir)
+		if err != nil {
+			return fmt.Errorf("chat_base_dirs[%d]: %v", chatID, err)
+		}
+		if info, err := os.Stat(abs); err != nil || !info.IsDir() {
+			return fmt.Errorf("chat_base_dirs[%d]: %s is not a directory", chatID, dir)
+		}
+		rel, _ := filepath.Rel(baseAbs, abs)
+		dirs[chatID] = rel
+	}
+	return nil
+}
+
 func isSafeHost(host string) bool {
 	if len(host) > 253 {
 		return false
@@ -439,56 +1946,226 @@ func isSafeHost(host string) bool {
 	return true
 }
 
-func runSafeCd(baseAbs string, store *chatCWDStore, chatID int64, args []string) api.CommandResponse {
+func runSafeCd(baseAbs string, store *chatCWDStore, chatID, userID int64, args []string) api.CommandResponse {
 	if len(args) == 0 {
-		store.set(chatID, baseAbs)
+		store.set(chatID, userID, baseAbs)
 		return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: baseAbs + "\n"}
 	}
 	if len(args) > 1 {
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "cd accepts a single path"}
 	}
-	target, err := sanitizePath(baseAbs, store.get(chatID, baseAbs), args[0])
+	target, err := sanitizePath(baseAbs, store.get(chatID, userID, baseAbs), args[0])
 	if err != nil {
-		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+		return pathErrorResponse(err)
 	}
 	info, err := os.Stat(target)
 	if err != nil || !info.IsDir() {
 		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "not a directory"}
 	}
-	store.set(chatID, target)
+	store.set(chatID, userID, target)
 	return api.CommandResponse{Ok: true, ExitCode: 0, Stdout: target + "\n"}
 }
 
-func runCommand(baseAbs, execPath string, args []string, timeoutSec int, maxKB int) api.CommandResponse {
+func runCommand(baseAbs, execPath string, args []string, timeoutSec int, maxKB int, runAsUser, runAsGroup string) api.CommandResponse {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSec)*time.Second)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, execPath, args...)
 	cmd.Dir = baseAbs
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	cmd.Env = commandEnv("", nil)
+	if err := applyRunAs(cmd, runAsUser, runAsGroup); err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	return runCapped(ctx, cancel, cmd, false, maxKB)
+}
 
-	err := cmd.Run()
-	resp := api.CommandResponse{}
-	if err == nil {
-		resp.Ok = true
-		resp.ExitCode = 0
-	} else {
-		resp.Ok = false
-		resp.ExitCode = exitCode(err)
-		resp.Error = err.Error()
+// maxStdinBytes caps the input passed to commands with AllowStdin.
+const maxStdinBytes = 64 * 1024
+
+// stdinFromRequest returns the text following the command word, preserving
+// newlines, or the args joined by spaces when the text does not start with the
+// command (as with LLM-routed requests).
+func stdinFromRequest(req api.CommandRequest) string {
+	text := strings.TrimLeft(req.Text, " \t")
+	first := strings.FieldsFunc(text, unicode.IsSpace)
+	if len(first) > 0 && strings.EqualFold(strings.TrimPrefix(first[0], "/"), req.Command) {
+		rest := strings.TrimPrefix(text, first[0])
+		return strings.TrimLeft(rest, " \t\r\n")
+	}
+	return strings.Join(req.Args, " ")
+}
+
+// lookupAllowedCommand finds the allowlist entry for name. An exact key wins;
+// otherwise keys that are glob patterns, e.g. "deploy-*", are tried and the
+// matching pattern is returned. A name matching several patterns is refused
+// as ambiguous, as is a pattern-matched name with characters outside
+// letters, digits, '-', '_' and '.', since it is passed to the command.
+func lookupAllowedCommand(cmds map[string]api.AllowedCommand, name string) (api.AllowedCommand, string, bool, error) {
+	if c, ok := cmds[name]; ok {
+		return c, "", true, nil
+	}
+	var matches []string
+	for key := range cmds {
+		if !strings.ContainsAny(key, "*?[") {
+			continue
+		}
+		if ok, _ := path.Match(key, name); ok {
+			matches = append(matches, key)
+		}
 	}
-	resp.Stdout = limitOutput(stdout.String(), maxKB)
-	resp.Stderr = limitOutput(stderr.String(), maxKB)
-	return resp
+	if len(matches) == 0 {
+		return api.AllowedCommand{}, "", false, nil
+	}
+	if len(matches) > 1 {
+		sort.Strings(matches)
+		return api.AllowedCommand{}, "", false, fmt.Errorf("command %s matches several allowlist patterns: %s", name, strings.Join(matches, ", "))
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return api.AllowedCommand{}, "", false, fmt.Errorf("command not allowed")
+		}
+	}
+	return cmds[matches[0]], matches[0], true, nil
 }
 
-func runAllowedCommand(ctx context.Context, allowed api.AllowedCommand, maxKB int) api.CommandResponse {
+// argPlaceholder matches a {N} positional placeholder in an allowlist arg.
+var argPlaceholder = regexp.MustCompile(`\{(\d+)\}`)
+
+// expandArgTemplates substitutes each {N} in templates with args[N], so an
+// allowlist entry like {"exec": "/usr/bin/du", "args": ["-sh", "{0}"]} takes
+// its path from the request. Entries without placeholders keep their fixed
+// args and ignore the request's. Every request arg must be used.
+func expandArgTemplates(templates, args []string) ([]string, error) {
+	templated := false
+	used := 0
+	var expandErr error
+	out := make([]string, len(templates))
+	for i, tmpl := range templates {
+		out[i] = argPlaceholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+			templated = true
+			n, err := strconv.Atoi(m[1 : len(m)-1])
+			if err != nil || n >= len(args) {
+				if expandErr == nil {
+					expandErr = fmt.Errorf("missing argument %s", m)
+				}
+				return ""
+			}
+			if n+1 > used {
+				used = n + 1
+			}
+			v, err := templateArgValue(args[n])
+			if err != nil && expandErr == nil {
+				expandErr = err
+			}
+			return v
+		})
+	}
+	if !templated {
+		return templates, nil
+	}
+	if expandErr != nil {
+		return nil, expandErr
+	}
+	if len(args) > used {
+		return nil, fmt.Errorf("too many arguments (expected %d)", used)
+	}
+	return out, nil
+}
+
+// templateArgValue validates a substituted argument: it may not be empty,
+// look like a flag, or hold control characters, and paths are cleaned and
+// may not step up with "..".
+func templateArgValue(v string) (string, error) {
+	if v == "" {
+		return "", fmt.Errorf("empty argument")
+	}
+	if strings.HasPrefix(v, "-") {
+		return "", fmt.Errorf("argument may not start with '-': %s", v)
+	}
+	for _, r := range v {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("argument contains control characters")
+		}
+	}
+	if strings.ContainsAny(v, `/\`) {
+		v = filepath.Clean(v)
+		for _, part := range strings.FieldsFunc(v, func(r rune) bool { return r == '/' || r == '\\' }) {
+			if part == ".." {
+				return "", fmt.Errorf("argument may not contain '..': %s", v)
+			}
+		}
+	}
+	return v, nil
+}
+
+// runAllowedCommand runs an allowlisted command, capping output at the
+// command's own max_output_kb when set and maxKB otherwise.
+func runAllowedCommand(ctx context.Context, allowed api.AllowedCommand, stdin, execPath string, envPassthrough []string, maxKB int) api.CommandResponse {
+	if !filepath.IsAbs(allowed.Exec) {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: "exec path must be absolute: " + allowed.Exec}
+	}
+	if allowed.MaxOutputKB > 0 {
+		maxKB = allowed.MaxOutputKB
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	cmd := exec.CommandContext(ctx, allowed.Exec, allowed.Args...)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	cmd.Dir = allowed.WorkDir
+	cmd.Env = commandEnv(execPath, envPassthrough)
+	if err := applyRunAs(cmd, allowed.RunAsUser, allowed.RunAsGroup); err != nil {
+		return api.CommandResponse{Ok: false, ExitCode: 1, Error: err.Error()}
+	}
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	resp := runCapped(ctx, cancel, cmd, allowed.CombineOutput, maxKB)
+	resp.Summarize = allowed.Summarize
+	return resp
+}
+
+// defaultExecPath is the PATH allowlisted commands run with unless
+// exec_path is set.
+const defaultExecPath = "/usr/local/bin:/usr/bin:/bin"
+
+// defaultEnvPassthrough lists the variables commands inherit unless
+// env_passthrough is set.
+var defaultEnvPassthrough = []string{"HOME", "LANG", "LC_ALL", "TZ"}
+
+// commandEnv returns PATH set to execPath plus the passthrough variables that
+// are set in the process environment. Everything else, such as the bot token
+// or API keys, stays out of the command's environment.
+func commandEnv(execPath string, passthrough []string) []string {
+	if execPath == "" {
+		execPath = defaultExecPath
+	}
+	if passthrough == nil {
+		passthrough = defaultEnvPassthrough
+	}
+	env := []string{"PATH=" + execPath}
+	for _, name := range passthrough {
+		if name == "PATH" {
+			continue
+		}
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env
+}
+
+// runCapped runs cmd with stdout and stderr capped at maxKB each, cancelling
+// the command's context as soon as either overflows. combine sends stderr to
+// the stdout buffer.
+func runCapped(ctx context.Context, cancel context.CancelFunc, cmd *exec.Cmd, combine bool, maxKB int) api.CommandResponse {
+	stdout := newCappedWriter(maxKB, cancel)
+	stderr := newCappedWriter(maxKB, cancel)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if combine {
+		cmd.Stderr = stdout
+	}
+	cmd.WaitDelay = outputKillWait
 
 	err := cmd.Run()
 	resp := api.CommandResponse{}
@@ -497,31 +2174,90 @@ func runAllowedCommand(ctx context.Context, allowed api.AllowedCommand, maxKB in
 		resp.ExitCode = 0
 	} else {
 		resp.Ok = false
-		resp.ExitCode = exitCode(err)
+		resp.ExitCode = exitCode(ctx, err)
 		resp.Error = err.Error()
 	}
-	resp.Stdout = limitOutput(stdout.String(), maxKB)
-	resp.Stderr = limitOutput(stderr.String(), maxKB)
+	if err != nil && (stdout.truncated || stderr.truncated) && errors.Is(ctx.Err(), context.Canceled) {
+		resp.Error = errOutputLimit.Error()
+	}
+	resp.Stdout = stdout.String()
+	resp.Stderr = stderr.String()
 	return resp
 }
 
-func exitCode(err error) int {
-	var exitErr *exec.ExitError
-	if err == context.DeadlineExceeded {
+// signalStatus is implemented by syscall.WaitStatus on platforms that report
+// the signal that terminated a process.
+type signalStatus interface {
+	Signaled() bool
+	Signal() syscall.Signal
+}
+
+// exitCode maps a command error to a shell-style exit status: 124 when the
+// process was killed because ctx's deadline passed, 128+n when it died from
+// signal n, and its own exit status otherwise.
+func exitCode(ctx context.Context, err error) int {
+	if err == nil {
+		return 0
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
 		return 124
 	}
-	if ok := strings.Contains(err.Error(), "signal: killed"); ok {
-		return 137
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return 1
 	}
-	if err == nil {
-		return 0
+	if ws, ok := exitErr.Sys().(signalStatus); ok && ws.Signaled() {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return 124
+		}
+		return 128 + int(ws.Signal())
 	}
-	if errors.As(err, &exitErr) {
-		return exitErr.ExitCode()
+	return exitErr.ExitCode()
+}
+
+// errOutputLimit is reported when a command is killed for exceeding
+// max_output_kb.
+var errOutputLimit = errors.New("output exceeded max_output_kb; process killed")
+
+// cappedWriter keeps at most max bytes and calls onFull once when more
+// arrive, so a flooding process is stopped instead of buffered in memory.
+// Extra bytes are discarded without error so the copy goroutine drains the
+// pipe until the process exits.
+type cappedWriter struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+	onFull    func()
+}
+
+func newCappedWriter(maxKB int, onFull func()) *cappedWriter {
+	return &cappedWriter{max: maxKB * 1024, onFull: onFull}
+}
+
+func (w *cappedWriter) Write(p []byte) (int, error) {
+	if w.truncated {
+		return len(p), nil
+	}
+	if room := w.max - w.buf.Len(); len(p) > room {
+		w.buf.Write(p[:room])
+		w.truncated = true
+		w.onFull()
+		return len(p), nil
+	}
+	return w.buf.Write(p)
+}
+
+func (w *cappedWriter) String() string {
+	if w.truncated {
+		return w.buf.String() + "\n[truncated]\n"
 	}
-	return 1
+	return w.buf.String()
 }
 
+// outputKillWait bounds how long Wait blocks on pipes held open by children
+// after the command has been killed.
+const outputKillWait = time.Second
+
 func limitOutput(s string, maxKB int) string {
 	maxBytes := maxKB * 1024
 	if len(s) <= maxBytes {
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"personal_ai/internal/version"
+)
+
+// newAgentServer builds the command server. TLS is enabled when both
+// tls_cert_file and tls_key_file are set; plain HTTP otherwise.
+func newAgentServer(cfg *AgentConfig, exec CommandExecutor) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/command", newCommandHandler(cfg, exec))
+	mux.HandleFunc("/version", version.Handler)
+	mux.HandleFunc("/capabilities", newCapabilitiesHandler(cfg))
+
+	tlsCfg, err := serverTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           mux,
+		TLSConfig:         tlsCfg,
+		ReadHeaderTimeout: 5 * time.Second,
+	}, nil
+}
+
+// serverTLSConfig returns nil when TLS is not configured. With
+// tls_client_ca_file set, clients must present a certificate signed by it.
+func serverTLSConfig(cfg *AgentConfig) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		if cfg.TLSClientCAFile != "" {
+			return nil, errors.New("tls_client_ca_file requires tls_cert_file and tls_key_file")
+		}
+		return nil, nil
+	}
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		return nil, errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls key pair: %v", err)
+	}
+	tlsCfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if cfg.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read tls_client_ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("tls_client_ca_file contains no certificates")
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+// writeTestCert creates a certificate for 127.0.0.1 signed by parent (or
+// self-signed when parent is nil) and writes PEM cert and key files.
+func writeTestCert(t *testing.T, dir, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent, parentKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse cert: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return cert, key, certPath, keyPath
+}
+
+// startTLSAgent serves cfg over TLS on a loopback port and returns its URL.
+func startTLSAgent(t *testing.T, cfg *AgentConfig) string {
+	t.Helper()
+	srv, err := newAgentServer(cfg, execStub{resp: api.CommandResponse{Ok: true, Stdout: "ok"}})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	if srv.TLSConfig == nil {
+		t.Fatalf("expected TLS to be enabled")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + ln.Addr().String() + "/command"
+}
+
+func postCommand(client *http.Client, url string) (*api.CommandResponse, error) {
+	body, _ := json.Marshal(api.CommandRequest{Command: "status"})
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out api.CommandResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func TestAgentServerServesCommandsOverTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, _, certPath, keyPath := writeTestCert(t, dir, "agent", 1, nil, nil)
+	url := startTLSAgent(t, &AgentConfig{TLSCertFile: certPath, TLSKeyFile: keyPath})
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := postCommand(client, url)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	if !resp.Ok || resp.Stdout != "ok" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
+
+func TestAgentServerRequiresClientCertWhenConfigured(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caPath, _ := writeTestCert(t, dir, "ca", 1, nil, nil)
+	_, _, certPath, keyPath := writeTestCert(t, dir, "agent", 2, ca, caKey)
+	_, _, clientCertPath, clientKeyPath := writeTestCert(t, dir, "broker", 3, ca, caKey)
+	url := startTLSAgent(t, &AgentConfig{TLSCertFile: certPath, TLSKeyFile: keyPath, TLSClientCAFile: caPath})
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if _, err := postCommand(anonymous, url); err == nil {
+		t.Fatalf("expected request without client cert to fail")
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+	if err != nil {
+		t.Fatalf("load client cert: %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}}}
+	resp, err := postCommand(client, url)
+	if err != nil {
+		t.Fatalf("post with client cert: %v", err)
+	}
+	if !resp.Ok {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
+
+func TestServerTLSConfigRequiresCertAndKeyTogether(t *testing.T) {
+	if _, err := serverTLSConfig(&AgentConfig{TLSCertFile: "agent.crt"}); err == nil {
+		t.Fatalf("expected error for cert without key")
+	}
+	if _, err := serverTLSConfig(&AgentConfig{TLSClientCAFile: "ca.crt"}); err == nil {
+		t.Fatalf("expected error for client CA without server cert")
+	}
+	if tlsCfg, err := serverTLSConfig(&AgentConfig{}); err != nil || tlsCfg != nil {
+		t.Fatalf("expected plain HTTP by default, got %v, %v", tlsCfg, err)
+	}
+}
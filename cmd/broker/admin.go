@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+// configCommand is the admin-only builtin that prints the effective config.
+const configCommand = "config"
+
+const redacted = "[redacted]"
+
+func isAdmin(userID int64, cfg *BrokerConfig) bool {
+	return isAllowed(userID, cfg.Telegram.AdminUserIDs)
+}
+
+// defaultAdminNotifyPerMinute caps failure notices when
+// telegram.admin_notify_per_minute is unset.
+const defaultAdminNotifyPerMinute = 10
+
+// adminNoticeMaxError bounds the error text quoted in a failure notice.
+const adminNoticeMaxError = 500
+
+func (t TelegramConfig) adminNotifyPerMinute() int {
+	if t.AdminNotifyPerMinute > 0 {
+		return t.AdminNotifyPerMinute
+	}
+	return defaultAdminNotifyPerMinute
+}
+
+// notifyAdmin tells telegram.admin_chat_id that a command failed. Failures in
+// the admin chat itself are not echoed back, and notices past the per-minute
+// cap are dropped.
+func notifyAdmin(ctx *pipelineContext, errText string) {
+	adminChat := ctx.cfg.Telegram.AdminChatID
+	if adminChat == 0 || adminChat == ctx.chatID {
+		return
+	}
+	if ctx.adminRL != nil && !ctx.adminRL.allow(adminChat) {
+		log.Printf("admin notice dropped: more than %d a minute", ctx.cfg.Telegram.adminNotifyPerMinute())
+		return
+	}
+	if len(errText) > adminNoticeMaxError {
+		// Cut on a rune boundary so the notice stays valid UTF-8.
+		cut := adminNoticeMaxError
+		for cut > 0 && !utf8.RuneStart(errText[cut]) {
+			cut--
+		}
+		errText = errText[:cut] + "..."
+	}
+	name := ctx.userName
+	if name == "" {
+		name = "-"
+	}
+	line := strings.TrimSpace(ctx.cmd + " " + strings.Join(ctx.args, " "))
+	text := fmt.Sprintf("Command failed in chat %d\nuser: %d (%s)\ncommand: %s\nerror: %s", ctx.chatID, ctx.userID, name, ctx.redactor.apply(line), errText)
+	if err := ctx.sender.Send(adminChat, text); err != nil {
+		log.Printf("send admin notice: %v", err)
+		logAudit(ctx, "send_failed", err.Error(), "error")
+	}
+}
+
+// redactedConfig returns cfg as indented JSON with tokens and keys replaced.
+func redactedConfig(cfg *BrokerConfig) (string, error) {
+	c := *cfg
+	c.Telegram.BotToken = redact(c.Telegram.BotToken)
+	c.Telegram.Bots = append([]BotConfig(nil), cfg.Telegram.Bots...)
+	for i := range c.Telegram.Bots {
+		c.Telegram.Bots[i].BotToken = redact(c.Telegram.Bots[i].BotToken)
+	}
+	c.LLM.APIKey = redact(c.LLM.APIKey)
+	c.Execution.ForwardAuthToken = redact(c.Execution.ForwardAuthToken)
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// redact hides a secret while still showing whether it was set.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// replyConfig sends the redacted config to admins and refuses everyone else.
+func replyConfig(ctx *pipelineContext) bool {
+	if !isAdmin(ctx.userID, ctx.cfg) {
+		logAudit(ctx, "config_denied", "not an admin", "denied")
+		return sendReply(ctx, "The config command is limited to admins.")
+	}
+	out, err := redactedConfig(ctx.cfg)
+	if err != nil {
+		logAudit(ctx, "config_error", err.Error(), "error")
+		return sendReply(ctx, "Could not render config: "+err.Error())
+	}
+	logAudit(ctx, "config", "shown", "ok")
+	return sendReply(ctx, out)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"personal_ai/internal/api"
+)
+
+func TestConfigCommandRedactsSecretsForAdmins(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			BotToken:       "123:secret-bot-token",
+			AllowedUserIDs: []int64{1, 2},
+			AdminUserIDs:   []int64{1},
+			Bots:           []BotConfig{{Name: "work", BotToken: "456:other-token"}},
+		},
+		Execution: ExecutionConfig{Mode: "forward", ForwardURL: "http://agent", ForwardAuthToken: "shared-secret"},
+		LLM:       LLMConfig{APIKey: "sk-secret"},
+	}
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, sender, nil, nil)
+
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: "/config",
+	}})
+	if len(sender.calls) != 1 {
+		t.Fatalf("expected one reply, got %v", sender.calls)
+	}
+	out := sender.calls[0]
+	for _, secret := range []string{"secret-bot-token", "other-token", "shared-secret", "sk-secret"} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("config output leaks %q: %s", secret, out)
+		}
+	}
+	if !strings.Contains(out, `"forward_url": "http://agent"`) || !strings.Contains(out, `"forward_auth_token": "[redacted]"`) {
+		t.Fatalf("expected effective config with redacted secrets, got %s", out)
+	}
+
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 2},
+		Chat: TelegramChat{ID: 99},
+		Text: "config",
+	}})
+	if len(sender.calls) != 2 || !strings.Contains(sender.calls[1], "limited to admins") {
+		t.Fatalf("expected non-admin to be refused, got %v", sender.calls)
+	}
+}
+
+func TestFailedCommandNotifiesAdminChat(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}, AdminChatID: 500, AdminNotifyPerMinute: 2},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"status", "broken"}},
+	}
+	resp := &api.CommandResponse{Ok: false, ExitCode: 3, Error: "disk on fire"}
+	exec := executorStub(func(api.CommandRequest) (*api.CommandResponse, error) {
+		out := *resp
+		return &out, nil
+	})
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, nil)
+	send := func(text string) {
+		broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+			From: TelegramUser{ID: 1, UserName: "wir"},
+			Chat: TelegramChat{ID: 99},
+			Text: text,
+		}})
+	}
+
+	send("broken now")
+	if len(sender.calls) != 2 {
+		t.Fatalf("expected a user reply and an admin notice, got %v", sender.calls)
+	}
+	if sender.chats[0] != 99 || !strings.Contains(sender.calls[0], "disk on fire") {
+		t.Fatalf("expected the user to see the failure, got %v %v", sender.chats, sender.calls)
+	}
+	notice := sender.calls[1]
+	if sender.chats[1] != 500 || !strings.Contains(notice, "user: 1 (wir)") || !strings.Contains(notice, "command: broken now") || !strings.Contains(notice, "exit 3: disk on fire") {
+		t.Fatalf("unexpected admin notice to chat %d: %q", sender.chats[1], notice)
+	}
+
+	resp = &api.CommandResponse{Ok: true, Stdout: "fine"}
+	send("status")
+	if len(sender.calls) != 3 {
+		t.Fatalf("expected no admin notice for a successful command, got %v", sender.calls)
+	}
+
+	resp = &api.CommandResponse{Ok: false, ExitCode: 1, Error: "again"}
+	send("broken")
+	send("broken")
+	admin := 0
+	for _, chat := range sender.chats {
+		if chat == 500 {
+			admin++
+		}
+	}
+	if admin != 2 {
+		t.Fatalf("expected notices capped at admin_notify_per_minute, got %d", admin)
+	}
+}
+
+func TestAdminNoticeTruncatesOnRuneBoundary(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}, AdminChatID: 500},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"broken"}},
+	}
+	// "é" is two bytes, so a byte cut at an odd length would split it.
+	exec := executorStub(func(api.CommandRequest) (*api.CommandResponse, error) {
+		return &api.CommandResponse{Ok: false, ExitCode: 1, Error: "x" + strings.Repeat("é", adminNoticeMaxError)}, nil
+	})
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, nil)
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: "broken",
+	}})
+	if len(sender.calls) != 2 || sender.chats[1] != 500 {
+		t.Fatalf("expected an admin notice, got %v", sender.calls)
+	}
+	if notice := sender.calls[1]; !utf8.ValidString(notice) || !strings.HasSuffix(notice, "é...") {
+		t.Fatalf("expected a valid truncated notice, got %q", notice)
+	}
+}
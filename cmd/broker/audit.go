@@ -3,35 +3,87 @@ package main
 import (
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
+// AuditSink receives formatted audit lines. Sinks are selected with
+// audit.sink.
+type AuditSink interface {
+	WriteLine(line string) error
+}
+
+// writerSink appends each line to a file or stream.
+type writerSink struct {
+	w io.Writer
+}
+
+func (s writerSink) WriteLine(line string) error {
+	_, err := io.WriteString(s.w, line+"\n")
+	return err
+}
+
+// auditStdout is where the stdout sink writes; tests replace it.
+var auditStdout io.Writer = os.Stdout
+
 type auditLogger struct {
-	mu     sync.Mutex
-	writer io.Writer
+	mu   sync.Mutex
+	sink AuditSink
+}
+
+// normalizeAuditSink lowercases audit.sink, defaulting to "file".
+func normalizeAuditSink(sink string) (string, error) {
+	sink = strings.ToLower(strings.TrimSpace(sink))
+	switch sink {
+	case "":
+		return "file", nil
+	case "file", "syslog", "stdout":
+		return sink, nil
+	}
+	return "", fmt.Errorf("audit.sink must be file, syslog, or stdout")
 }
 
+// newAuditLogger returns nil, disabling auditing, when the file sink has no
+// path or the sink cannot be opened.
 func newAuditLogger(cfg AuditConfig) AuditLogger {
-	if cfg.FilePath == "" {
+	sink, err := newAuditSink(cfg)
+	if err != nil {
+		log.Printf("audit sink: %v", err)
 		return nil
 	}
+	if sink == nil {
+		return nil
+	}
+	return &auditLogger{sink: sink}
+}
+
+func newAuditSink(cfg AuditConfig) (AuditSink, error) {
+	switch cfg.Sink {
+	case "stdout":
+		return writerSink{w: auditStdout}, nil
+	case "syslog":
+		return newSyslogSink()
+	}
+	if cfg.FilePath == "" {
+		return nil, nil
+	}
 	f, err := os.OpenFile(cfg.FilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	return &auditLogger{writer: f}
+	return writerSink{w: f}, nil
 }
 
 func (l *auditLogger) Log(event AuditEvent) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	if l.writer == nil {
+	if l.sink == nil {
 		return
 	}
-	line := formatAuditLine(event)
-	_, _ = io.WriteString(l.writer, line+"\n")
+	_ = l.sink.WriteLine(formatAuditLine(event))
 }
 
 func formatAuditLine(e AuditEvent) string {
@@ -47,6 +99,27 @@ func formatAuditLine(e AuditEvent) string {
 	if cmd == "" {
 		cmd = "-"
 	}
-	return fmt.Sprintf("%s %s user=%d chat=%d cmd=\"%s\" outcome=\"%s\" msg=\"%s\"",
-		t.Format(time.RFC3339), e.Type, e.UserID, e.ChatID, cmd, e.Outcome, msg)
+	reqID := e.RequestID
+	if reqID == "" {
+		reqID = "-"
+	}
+	ip := e.ClientIP
+	if ip == "" {
+		ip = "-"
+	}
+	name := e.UserName
+	if name == "" {
+		name = "-"
+	}
+	line := fmt.Sprintf("%s %s req=%s ip=%s user=%d username=%s chat=%d cmd=\"%s\" outcome=\"%s\" msg=\"%s\"",
+		t.Format(time.RFC3339), e.Type, reqID, ip, e.UserID, name, e.ChatID, cmd, e.Outcome, msg)
+	// Only execution events ran a command, so only they carry args and an
+	// exit code.
+	if e.Type == "execution" {
+		line += fmt.Sprintf(" args=%q exit=%d", e.Args, e.ExitCode)
+		if e.Reason != "" {
+			line += " reason=" + e.Reason
+		}
+	}
+	return line
 }
@@ -33,3 +33,38 @@ func TestAuditLoggerWritesFile(t *testing.T) {
 		t.Fatalf("expected log line, got: %s", string(b))
 	}
 }
+
+func TestAuditLoggerStdoutSink(t *testing.T) {
+	var buf strings.Builder
+	prev := auditStdout
+	auditStdout = &buf
+	defer func() { auditStdout = prev }()
+
+	logger := newAuditLogger(AuditConfig{Sink: "stdout"})
+	if logger == nil {
+		t.Fatalf("expected logger")
+	}
+	logger.Log(AuditEvent{
+		Timestamp: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		Type:      "execution",
+		RequestID: "abc",
+		UserID:    1,
+		ChatID:    2,
+		Command:   "status",
+		Outcome:   "ok",
+		Message:   "done",
+	})
+	want := `2025-01-02T03:04:05Z execution req=abc ip=- user=1 username=- chat=2 cmd="status" outcome="ok" msg="done" args=[] exit=0` + "\n"
+	if buf.String() != want {
+		t.Fatalf("unexpected line %q, want %q", buf.String(), want)
+	}
+}
+
+func TestNormalizeAuditSink(t *testing.T) {
+	if sink, err := normalizeAuditSink(""); err != nil || sink != "file" {
+		t.Fatalf("expected file by default, got %q err=%v", sink, err)
+	}
+	if _, err := normalizeAuditSink("kafka"); err == nil {
+		t.Fatalf("expected unknown sink to be rejected")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// newSyslogSink fails where log/syslog is unavailable.
+func newSyslogSink() (AuditSink, error) {
+	return nil, errors.New("audit.sink syslog is not supported on this platform")
+}
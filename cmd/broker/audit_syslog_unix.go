@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import "log/syslog"
+
+// syslogTag identifies broker audit lines in the system log.
+const syslogTag = "shelly-broker"
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink() (AuditSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, syslogTag)
+	if err != nil {
+		return nil, err
+	}
+	return syslogSink{w: w}, nil
+}
+
+func (s syslogSink) WriteLine(line string) error {
+	return s.w.Info(line)
+}
@@ -9,8 +9,10 @@ import (
 func TestFormatAuditLine(t *testing.T) {
 	e := AuditEvent{
 		Timestamp: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		RequestID: "abc123",
 		Type:      "execution",
 		UserID:    1,
+		UserName:  "wir",
 		ChatID:    2,
 		Command:   "status",
 		Outcome:   "ok",
@@ -24,9 +26,15 @@ func TestFormatAuditLine(t *testing.T) {
 	if !strings.Contains(line, "execution") {
 		t.Fatalf("missing type: %s", line)
 	}
+	if !strings.Contains(line, "req=abc123") {
+		t.Fatalf("missing request id: %s", line)
+	}
 	if !strings.Contains(line, "user=1") || !strings.Contains(line, "chat=2") {
 		t.Fatalf("missing ids: %s", line)
 	}
+	if !strings.Contains(line, "username=wir") {
+		t.Fatalf("missing username: %s", line)
+	}
 	if !strings.Contains(line, "cmd=\"status\"") {
 		t.Fatalf("missing cmd: %s", line)
 	}
@@ -37,3 +45,22 @@ func TestFormatAuditLine(t *testing.T) {
 		t.Fatalf("missing msg: %s", line)
 	}
 }
+
+func TestFormatAuditLineIncludesArgsAndExitCode(t *testing.T) {
+	line := formatAuditLine(AuditEvent{
+		Type:     "execution",
+		Command:  "cat",
+		Outcome:  "error",
+		Args:     []string{"secrets.txt", "my notes"},
+		ExitCode: 1,
+	})
+	if !strings.HasSuffix(line, ` args=["secrets.txt" "my notes"] exit=1`) {
+		t.Fatalf("missing args or exit code: %s", line)
+	}
+	if line := formatAuditLine(AuditEvent{Type: "execution", ExitCode: 1, Reason: "path_outside_base"}); !strings.HasSuffix(line, ` exit=1 reason=path_outside_base`) {
+		t.Fatalf("missing reason: %s", line)
+	}
+	if line := formatAuditLine(AuditEvent{Type: "auth_denied"}); strings.Contains(line, "exit=") {
+		t.Fatalf("non-execution event should not carry an exit code: %s", line)
+	}
+}
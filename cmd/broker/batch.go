@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultMaxBatchCommands caps the sub-commands in one message when
+// policy.max_batch_commands is unset.
+const defaultMaxBatchCommands = 5
+
+// batchStep is one sub-command of a batch message. afterSuccess marks a step
+// joined with && that only runs when the previous step succeeded.
+type batchStep struct {
+	text         string
+	afterSuccess bool
+}
+
+// splitBatch splits text at && and ; outside quotes, following the quoting
+// rules of splitArgs. A message without separators yields one step.
+func splitBatch(text string) ([]batchStep, error) {
+	var steps []batchStep
+	var cur strings.Builder
+	afterSuccess := false
+	var quote rune
+	escaped := false
+	runes := []rune(text)
+	cut := func(nextAfterSuccess bool) error {
+		step := strings.TrimSpace(cur.String())
+		if step == "" {
+			return fmt.Errorf("empty command in batch")
+		}
+		steps = append(steps, batchStep{text: step, afterSuccess: afterSuccess})
+		cur.Reset()
+		afterSuccess = nextAfterSuccess
+		return nil
+	}
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '\\':
+			escaped = true
+		case r == ';':
+			if err := cut(false); err != nil {
+				return nil, err
+			}
+			continue
+		case r == '&' && i+1 < len(runes) && runes[i+1] == '&':
+			if err := cut(true); err != nil {
+				return nil, err
+			}
+			i++
+			continue
+		}
+		cur.WriteRune(r)
+	}
+	if len(steps) == 0 {
+		return []batchStep{{text: strings.TrimSpace(text)}}, nil
+	}
+	// A trailing ; is allowed, as in a shell; a trailing && is not.
+	if strings.TrimSpace(cur.String()) == "" && !afterSuccess {
+		return steps, nil
+	}
+	if err := cut(false); err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+func (p PolicyConfig) maxBatchCommands() int {
+	if p.MaxBatchCommands > 0 {
+		return p.MaxBatchCommands
+	}
+	return defaultMaxBatchCommands
+}
+
+// stageBatch runs a message holding several commands joined by && or ;.
+// Each sub-command is parsed directly, bypassing builtins and the LLM, and
+// still passes the allowlist, blocklist, and intent checks. Their replies
+// are sent as one message. With the LLM enabled, text whose sub-commands are
+// not all allowlisted is left for the LLM so chat may contain semicolons.
+func stageBatch(ctx *pipelineContext) bool {
+	steps, err := splitBatch(ctx.msg.Text)
+	if err != nil || len(steps) < 2 {
+		if err != nil && !ctx.cfg.LLM.Enabled {
+			logAudit(ctx, "command_error", err.Error(), "error")
+			return sendReply(ctx, "Could not parse command: "+err.Error())
+		}
+		return false
+	}
+	if ctx.cfg.LLM.Enabled {
+		for _, step := range steps {
+			cmd, _, err := normalizeCommand(step.text)
+			if err != nil || !isCommandAllowlisted(cmd, ctx.cfg.Policy.CommandAllowlist) {
+				return false
+			}
+		}
+	}
+	if max := ctx.cfg.Policy.maxBatchCommands(); len(steps) > max {
+		logAudit(ctx, "batch_rejected", fmt.Sprintf("%d commands", len(steps)), "denied")
+		return sendReply(ctx, fmt.Sprintf("Too many commands in one message (max %d).", max))
+	}
+	logAudit(ctx, "batch", fmt.Sprintf("%d commands", len(steps)), "ok")
+
+	var replies []string
+	ok := true
+	for _, step := range steps {
+		if step.afterSuccess && !ok {
+			continue
+		}
+		msg := *ctx.msg
+		msg.Text = step.text
+		sub := *ctx
+		sub.msg = &msg
+		sub.replies = &replies
+		sub.outcome = ""
+		runBatchStep(&sub)
+		ok = sub.outcome == "ok"
+		if sub.outcome == "cancelled" {
+			break
+		}
+	}
+	return sendReply(ctx, strings.Join(replies, "\n\n"))
+}
+
+// runBatchStep routes and runs one sub-command, leaving its result in
+// ctx.outcome and its reply in ctx.replies.
+func runBatchStep(ctx *pipelineContext) {
+	cmd, args, err := normalizeCommand(ctx.msg.Text)
+	if err != nil {
+		logAudit(ctx, "command_error", err.Error(), "error")
+		sendReply(ctx, ctx.msg.Text+": could not parse command: "+err.Error())
+		return
+	}
+	ctx.cmd = cmd
+	ctx.args = args
+	logAudit(ctx, "command", "batch", "ok")
+	if isCommandAllowed(cmd, ctx.cfg.Policy.ConfirmCommands) {
+		logAudit(ctx, "batch_confirm_refused", "needs confirmation", "denied")
+		sendReply(ctx, cmd+" needs confirmation; send it on its own.")
+		return
+	}
+	n := len(*ctx.replies)
+	for _, stage := range []pipelineStage{stagePolicy, stageIntentPolicy, stageExecute} {
+		if stage(ctx) {
+			break
+		}
+	}
+	// Executed commands name themselves in the reply; policy refusals do not.
+	if ctx.outcome == "" && len(*ctx.replies) > n {
+		(*ctx.replies)[n] = cmd + ": " + (*ctx.replies)[n]
+	}
+}
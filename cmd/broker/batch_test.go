@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+func newBatchBroker(t *testing.T) (*Broker, *senderStub, *[]string) {
+	t.Helper()
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}},
+		Policy: PolicyConfig{
+			CommandAllowlist: []string{"cd", "ls", "count", "fail"},
+			CommandBlocklist: []string{"rm"},
+			MaxBatchCommands: 3,
+		},
+	}
+	var ran []string
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		ran = append(ran, strings.TrimSpace(req.Command+" "+strings.Join(req.Args, " ")))
+		if req.Command == "fail" {
+			return &api.CommandResponse{Ok: false, ExitCode: 1, Error: "boom"}, nil
+		}
+		return &api.CommandResponse{Ok: true, Stdout: req.Command + " done"}, nil
+	})
+	sender := &senderStub{}
+	return newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, nil), sender, &ran
+}
+
+func sendBatch(b *Broker, text string) {
+	b.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: text,
+	}})
+}
+
+func TestBatchAndStopsOnFirstFailure(t *testing.T) {
+	broker, sender, ran := newBatchBroker(t)
+
+	sendBatch(broker, `cd "My Movies" && ls && count`)
+	if strings.Join(*ran, ",") != "cd My Movies,ls,count" {
+		t.Fatalf("expected all three to run in order, got %v", *ran)
+	}
+	if len(sender.calls) != 1 || sender.calls[0] != "cd:\ncd done\n\nls:\nls done\n\ncount:\ncount done" {
+		t.Fatalf("expected one combined reply, got %q", sender.calls)
+	}
+
+	*ran = nil
+	sendBatch(broker, "ls && fail && count")
+	if strings.Join(*ran, ",") != "ls,fail" {
+		t.Fatalf("expected count to be skipped after the failure, got %v", *ran)
+	}
+
+	*ran = nil
+	sendBatch(broker, "rm x && ls")
+	if len(*ran) != 0 || !strings.Contains(sender.calls[len(sender.calls)-1], "rm: Command blocked.") {
+		t.Fatalf("expected blocked sub-command to stop the chain, got %v %q", *ran, sender.calls)
+	}
+}
+
+func TestBatchSemicolonContinuesAfterFailure(t *testing.T) {
+	broker, sender, ran := newBatchBroker(t)
+
+	sendBatch(broker, "fail; nope; ls")
+	if strings.Join(*ran, ",") != "fail,ls" {
+		t.Fatalf("expected ls to run after failures, got %v", *ran)
+	}
+	reply := sender.calls[0]
+	if !strings.Contains(reply, "nope: Command not allowed.") || !strings.HasSuffix(reply, "ls:\nls done") {
+		t.Fatalf("unexpected combined reply %q", reply)
+	}
+
+	*ran = nil
+	sendBatch(broker, "ls; ls; ls; ls")
+	if len(*ran) != 0 || sender.calls[1] != "Too many commands in one message (max 3)." {
+		t.Fatalf("expected batch over the cap to be refused, got %v %q", *ran, sender.calls)
+	}
+}
+
+func TestSplitBatchRespectsQuotes(t *testing.T) {
+	steps, err := splitBatch(`write a.txt "x && y; z" ; ls`)
+	if err != nil || len(steps) != 2 || steps[0].text != `write a.txt "x && y; z"` || steps[1].afterSuccess {
+		t.Fatalf("unexpected steps %+v err=%v", steps, err)
+	}
+	if _, err := splitBatch("ls && && count"); err == nil {
+		t.Fatalf("expected empty sub-command to be rejected")
+	}
+	if steps, _ := splitBatch("ls"); len(steps) != 1 {
+		t.Fatalf("expected a plain command to be a single step, got %+v", steps)
+	}
+}
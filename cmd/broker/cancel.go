@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cancelCommand is the builtin that aborts the chat's running command.
+const cancelCommand = "cancel"
+
+// psCommand is the admin builtin that lists running commands.
+const psCommand = "ps"
+
+// runningCommands tracks the commands executing in each chat with their
+// cancel functions. The chat queue runs one command per chat at a time, but a
+// watch runs beside it in the background, so a chat may hold several entries.
+type runningCommands struct {
+	mu     sync.Mutex
+	nextID uint64
+	byChat map[int64][]runningCommand
+}
+
+type runningCommand struct {
+	id      uint64
+	chatID  int64
+	userID  int64
+	command string
+	args    []string
+	started time.Time
+	cancel  context.CancelFunc
+}
+
+func newRunningCommands() *runningCommands {
+	return &runningCommands{byChat: map[int64][]runningCommand{}}
+}
+
+// track records cmd as running in its chat. The returned release function
+// removes it again.
+func (r *runningCommands) track(cmd runningCommand) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	id := r.nextID
+	chatID := cmd.chatID
+	cmd.id = id
+	r.byChat[chatID] = append(r.byChat[chatID], cmd)
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.remove(chatID, id)
+	}
+}
+
+// remove drops the entry with id from chatID. The caller holds r.mu.
+func (r *runningCommands) remove(chatID int64, id uint64) {
+	cmds := r.byChat[chatID]
+	for i, cmd := range cmds {
+		if cmd.id == id {
+			cmds = append(cmds[:i:i], cmds[i+1:]...)
+			break
+		}
+	}
+	if len(cmds) == 0 {
+		delete(r.byChat, chatID)
+	} else {
+		r.byChat[chatID] = cmds
+	}
+}
+
+// cancel aborts the most recently started command for chatID and reports
+// whether there was one.
+func (r *runningCommands) cancel(chatID int64) bool {
+	r.mu.Lock()
+	cmds := r.byChat[chatID]
+	var cur runningCommand
+	ok := len(cmds) > 0
+	if ok {
+		cur = cmds[len(cmds)-1]
+		r.remove(chatID, cur.id)
+	}
+	r.mu.Unlock()
+	if ok {
+		cur.cancel()
+	}
+	return ok
+}
+
+// list returns the running commands, longest-running first.
+func (r *runningCommands) list() []runningCommand {
+	r.mu.Lock()
+	var out []runningCommand
+	for _, cmds := range r.byChat {
+		out = append(out, cmds...)
+	}
+	r.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].started.Before(out[j].started) })
+	return out
+}
+
+// skipsChatQueue reports whether update is a plain `cancel` or `ps` message.
+// These skip the chat queue, which would otherwise hold them behind the very
+// command they are meant to stop or inspect.
+func skipsChatQueue(update TelegramUpdate) bool {
+	if update.Message == nil {
+		return false
+	}
+	cmd, args, err := normalizeCommand(update.Message.Text)
+	return err == nil && (cmd == cancelCommand || cmd == psCommand) && len(args) == 0
+}
+
+// replyCancel cancels the chat's running command, if any.
+func replyCancel(ctx *pipelineContext) bool {
+	if ctx.running != nil && ctx.running.cancel(ctx.chatID) {
+		logAudit(ctx, "cancel", "running command cancelled", "ok")
+		return sendReply(ctx, "Cancelled the running command.")
+	}
+	logAudit(ctx, "cancel", "nothing running", "ok")
+	return sendReply(ctx, "Nothing is running.")
+}
+
+// replyPS lists running commands for admins.
+func replyPS(ctx *pipelineContext) bool {
+	if !isAdmin(ctx.userID, ctx.cfg) {
+		logAudit(ctx, "ps_denied", "not an admin", "denied")
+		return sendReply(ctx, "The ps command is limited to admins.")
+	}
+	var running []runningCommand
+	if ctx.running != nil {
+		running = ctx.running.list()
+	}
+	logAudit(ctx, "ps", fmt.Sprintf("%d running", len(running)), "ok")
+	if len(running) == 0 {
+		return sendReply(ctx, "No commands running.")
+	}
+	var b strings.Builder
+	now := time.Now()
+	for i, cmd := range running {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		line := strings.TrimSpace(strings.Join(append([]string{cmd.command}, cmd.args...), " "))
+		fmt.Fprintf(&b, "chat %d user %d, %s: %s", cmd.chatID, cmd.userID, now.Sub(cmd.started).Round(time.Second), line)
+	}
+	return sendReply(ctx, b.String())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+func TestCancelStopsRunningSleep(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"nap"}},
+		Execution: ExecutionConfig{Local: LocalExecutionConfig{
+			DefaultTimeoutSec: 30,
+			MaxOutputKB:       8,
+			BaseDir:           t.TempDir(),
+			CommandAllowlist: map[string]api.AllowedCommand{
+				"nap": {Exec: "/bin/sh", Args: []string{"-c", "exec sleep 30"}},
+			},
+		}},
+	}
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), newLocalExecutor(cfg), sender, nil, nil)
+	update := func(id int64, text string) TelegramUpdate {
+		return TelegramUpdate{UpdateID: id, Message: &TelegramMessage{
+			MessageID: id,
+			From:      TelegramUser{ID: 1},
+			Chat:      TelegramChat{ID: 99},
+			Text:      text,
+		}}
+	}
+
+	start := time.Now()
+	napDone := broker.enqueueUpdate(update(1, "nap"), "")
+	// Wait for the command to register before cancelling it.
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		broker.running.mu.Lock()
+		_, ok := broker.running.byChat[99]
+		broker.running.mu.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("command never started")
+		}
+	}
+	<-broker.enqueueUpdate(update(2, "cancel"), "")
+	select {
+	case <-napDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("cancelled command did not return")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected prompt cancellation, took %s", elapsed)
+	}
+
+	replies := strings.Join(sender.calls, "\n")
+	if !strings.Contains(replies, "Cancelled the running command.") || !strings.Contains(replies, "Command cancelled.") {
+		t.Fatalf("unexpected replies %v", sender.calls)
+	}
+
+	<-broker.enqueueUpdate(update(3, "cancel"), "")
+	if last := sender.calls[len(sender.calls)-1]; last != "Nothing is running." {
+		t.Fatalf("expected nothing to cancel, got %q", last)
+	}
+}
+
+func TestPSListsRunningCommandsForAdmins(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1, 2}, AdminUserIDs: []int64{1}},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"backup"}},
+	}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		close(started)
+		<-release
+		return &api.CommandResponse{Ok: true}, nil
+	})
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, nil)
+	message := func(userID, chatID int64, text string) TelegramUpdate {
+		return TelegramUpdate{Message: &TelegramMessage{
+			From: TelegramUser{ID: userID},
+			Chat: TelegramChat{ID: chatID},
+			Text: text,
+		}}
+	}
+	ps := func() string {
+		<-broker.enqueueUpdate(message(1, 7, "ps"), "")
+		sender.mu.Lock()
+		defer sender.mu.Unlock()
+		return sender.calls[len(sender.calls)-1]
+	}
+
+	done := broker.enqueueUpdate(message(2, 99, "backup --full"), "")
+	<-started
+	if out := ps(); !strings.Contains(out, "chat 99 user 2") || !strings.HasSuffix(out, ": backup --full") {
+		t.Fatalf("expected running backup in listing, got %q", out)
+	}
+	<-broker.enqueueUpdate(message(2, 99, "ps"), "")
+	if last := sender.calls[len(sender.calls)-1]; last != "The ps command is limited to admins." {
+		t.Fatalf("expected non-admin to be refused, got %q", last)
+	}
+
+	close(release)
+	<-done
+	if out := ps(); out != "No commands running." {
+		t.Fatalf("expected empty listing after completion, got %q", out)
+	}
+}
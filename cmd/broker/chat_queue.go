@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// chatQueue runs submitted work strictly in order per chat while different
+// chats proceed concurrently. Each chat holds at most depth pending items.
+type chatQueue struct {
+	mu    sync.Mutex
+	depth int
+	lanes map[int64]*chatLane
+}
+
+type chatLane struct {
+	pending []func()
+}
+
+// defaultChatQueueDepth applies when telegram.chat_queue_depth is unset.
+const defaultChatQueueDepth = 10
+
+func newChatQueue(depth int) *chatQueue {
+	if depth <= 0 {
+		depth = defaultChatQueueDepth
+	}
+	return &chatQueue{depth: depth, lanes: map[int64]*chatLane{}}
+}
+
+// submit queues fn behind earlier work for chatID. It reports false without
+// queueing when the chat already has depth items waiting.
+func (q *chatQueue) submit(chatID int64, fn func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	lane, running := q.lanes[chatID]
+	if !running {
+		lane = &chatLane{}
+		q.lanes[chatID] = lane
+	}
+	if len(lane.pending) >= q.depth {
+		return false
+	}
+	lane.pending = append(lane.pending, fn)
+	if !running {
+		go q.drain(chatID, lane)
+	}
+	return true
+}
+
+// drain runs a chat's work until its lane is empty, then retires the lane so
+// idle chats hold no goroutine.
+func (q *chatQueue) drain(chatID int64, lane *chatLane) {
+	for {
+		q.mu.Lock()
+		if len(lane.pending) == 0 {
+			delete(q.lanes, chatID)
+			q.mu.Unlock()
+			return
+		}
+		fn := lane.pending[0]
+		lane.pending = lane.pending[1:]
+		q.mu.Unlock()
+		fn()
+	}
+}
+
+// defaultMaxQueuedChats applies when telegram.max_concurrent_chats is set but
+// telegram.max_queued_chats is not.
+const defaultMaxQueuedChats = 100
+
+// updateLimiter is a global ceiling on updates processed at once, across all
+// chats. Updates wait for a slot up to maxWaiting at a time; later ones are
+// refused. A nil limiter admits everything.
+type updateLimiter struct {
+	slots      chan struct{}
+	waiting    atomic.Int64
+	maxWaiting int64
+}
+
+func newUpdateLimiter(maxConcurrent, maxWaiting int) *updateLimiter {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	if maxWaiting <= 0 {
+		maxWaiting = defaultMaxQueuedChats
+	}
+	return &updateLimiter{slots: make(chan struct{}, maxConcurrent), maxWaiting: int64(maxWaiting)}
+}
+
+// acquire blocks until a slot is free. It reports false without waiting when
+// maxWaiting updates are already queued.
+func (l *updateLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.waiting.Add(1) > l.maxWaiting {
+		l.waiting.Add(-1)
+		return false
+	}
+	l.slots <- struct{}{}
+	l.waiting.Add(-1)
+	return true
+}
+
+func (l *updateLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
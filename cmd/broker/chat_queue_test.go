@@ -0,0 +1,234 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+func TestEnqueueUpdateRunsChatCommandsInOrder(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"first", "second"}},
+	}
+	var mu sync.Mutex
+	order := []string{}
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		if req.Command == "first" {
+			// Give the second command every chance to overtake.
+			time.Sleep(50 * time.Millisecond)
+		}
+		mu.Lock()
+		order = append(order, req.Command)
+		mu.Unlock()
+		return &api.CommandResponse{Ok: true}, nil
+	})
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, &senderStub{}, nil, nil)
+
+	update := func(id int64, text string) TelegramUpdate {
+		return TelegramUpdate{UpdateID: id, Message: &TelegramMessage{
+			From: TelegramUser{ID: 1},
+			Chat: TelegramChat{ID: 99},
+			Text: text,
+		}}
+	}
+	first := broker.enqueueUpdate(update(1, "first"), "")
+	second := broker.enqueueUpdate(update(2, "second"), "")
+	<-first
+	<-second
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Fatalf("expected commands in submission order, got %v", order)
+	}
+}
+
+func TestChatQueueRejectsWhenFull(t *testing.T) {
+	q := newChatQueue(1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	if !q.submit(7, func() { close(started); <-release }) {
+		t.Fatalf("expected first submit to be accepted")
+	}
+	<-started
+	if !q.submit(7, func() {}) {
+		t.Fatalf("expected one pending item to fit")
+	}
+	if q.submit(7, func() {}) {
+		t.Fatalf("expected submit beyond depth to be rejected")
+	}
+	done := make(chan struct{})
+	if !q.submit(8, func() { close(done) }) {
+		t.Fatalf("expected other chats to be unaffected")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("other chat blocked behind a busy chat")
+	}
+	close(release)
+}
+
+func TestMaxConcurrentChatsBoundsInFlightUpdates(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}, MaxConcurrentChats: 2},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"work"}},
+	}
+	var mu sync.Mutex
+	running, peak, ran := 0, 0, 0
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		ran++
+		mu.Unlock()
+		return &api.CommandResponse{Ok: true}, nil
+	})
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, &senderStub{}, nil, nil)
+
+	var done []<-chan struct{}
+	for chat := int64(1); chat <= 8; chat++ {
+		done = append(done, broker.enqueueUpdate(TelegramUpdate{UpdateID: chat, Message: &TelegramMessage{
+			From: TelegramUser{ID: 1},
+			Chat: TelegramChat{ID: chat},
+			Text: "work",
+		}}, ""))
+	}
+	for _, d := range done {
+		<-d
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if ran != 8 {
+		t.Fatalf("expected every update to run, got %d", ran)
+	}
+	if peak > 2 {
+		t.Fatalf("expected at most 2 updates in flight, saw %d", peak)
+	}
+}
+
+func TestUpdateLimiterDropsPastQueueBound(t *testing.T) {
+	l := newUpdateLimiter(1, 1)
+	if !l.acquire() {
+		t.Fatalf("expected a free slot")
+	}
+	admitted := make(chan bool)
+	go func() { admitted <- l.acquire() }()
+	for deadline := time.Now().Add(2 * time.Second); l.waiting.Load() != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("second update never queued")
+		}
+	}
+	if l.acquire() {
+		t.Fatalf("expected an update past the queue bound to be dropped")
+	}
+	l.release()
+	if !<-admitted {
+		t.Fatalf("expected the queued update to get the freed slot")
+	}
+	l.release()
+	if newUpdateLimiter(0, 0) != nil {
+		t.Fatalf("expected no limiter without max_concurrent_chats")
+	}
+}
+
+func TestFullChatQueueOnlyNotifiesAllowedUsers(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}, ChatQueueDepth: 1},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"hold"}},
+	}
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		started <- struct{}{}
+		<-release
+		return &api.CommandResponse{Ok: true}, nil
+	})
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, nil)
+
+	update := func(id, userID int64) TelegramUpdate {
+		return TelegramUpdate{UpdateID: id, Message: &TelegramMessage{
+			From: TelegramUser{ID: userID},
+			Chat: TelegramChat{ID: 99},
+			Text: "hold",
+		}}
+	}
+	running := broker.enqueueUpdate(update(1, 1), "")
+	<-started
+	pending := broker.enqueueUpdate(update(2, 1), "")
+
+	<-broker.enqueueUpdate(update(3, 2), "")
+	sender.mu.Lock()
+	if len(sender.calls) != 0 {
+		sender.mu.Unlock()
+		t.Fatalf("expected no reply to a stranger, got %v", sender.calls)
+	}
+	sender.mu.Unlock()
+
+	<-broker.enqueueUpdate(update(4, 1), "")
+	sender.mu.Lock()
+	if len(sender.calls) != 1 || sender.calls[0] != "Too many pending commands; please wait and try again." {
+		sender.mu.Unlock()
+		t.Fatalf("expected the allowed user to be told, got %v", sender.calls)
+	}
+	sender.mu.Unlock()
+
+	close(release)
+	<-running
+	<-pending
+}
+
+func TestBusyReplyOnlyGoesToAllowedUsers(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}, MaxConcurrentChats: 1, MaxQueuedChats: 1},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"hold"}},
+	}
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		started <- struct{}{}
+		<-release
+		return &api.CommandResponse{Ok: true}, nil
+	})
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, nil)
+
+	update := func(chatID, userID int64) TelegramUpdate {
+		return TelegramUpdate{UpdateID: chatID, Message: &TelegramMessage{
+			From: TelegramUser{ID: userID},
+			Chat: TelegramChat{ID: chatID},
+			Text: "hold",
+		}}
+	}
+	running := broker.enqueueUpdate(update(1, 1), "")
+	<-started
+	waiting := broker.enqueueUpdate(update(2, 1), "")
+	for deadline := time.Now().Add(2 * time.Second); broker.inflight.waiting.Load() != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("second update never queued")
+		}
+	}
+
+	<-broker.enqueueUpdate(update(3, 2), "")
+	<-broker.enqueueUpdate(update(4, 1), "")
+	sender.mu.Lock()
+	if len(sender.calls) != 1 || sender.chats[0] != 4 || sender.calls[0] != "The bot is busy; please try again shortly." {
+		sender.mu.Unlock()
+		t.Fatalf("expected only the allowed user to be told, got %v in chats %v", sender.calls, sender.chats)
+	}
+	sender.mu.Unlock()
+
+	close(release)
+	<-running
+	<-waiting
+}
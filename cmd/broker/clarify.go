@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// clarifyTTL bounds how long a clarifying question waits for its answer.
+const clarifyTTL = 5 * time.Minute
+
+// pendingClarify is the partial intent the LLM stashed while asking a
+// clarifying question.
+type pendingClarify struct {
+	userID   int64
+	text     string
+	question string
+	intent   string
+	args     []string
+	expires  time.Time
+}
+
+// clarifyStore holds at most one open question per chat.
+type clarifyStore struct {
+	mu     sync.Mutex
+	byChat map[int64]pendingClarify
+}
+
+func newClarifyStore() *clarifyStore {
+	return &clarifyStore{byChat: make(map[int64]pendingClarify)}
+}
+
+func (s *clarifyStore) put(chatID int64, p pendingClarify) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byChat[chatID] = p
+}
+
+// take removes and returns the open question for chatID when it was asked of
+// userID and has not expired. Another user's message leaves it in place.
+func (s *clarifyStore) take(chatID, userID int64) (pendingClarify, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.byChat[chatID]
+	if !ok || p.userID != userID {
+		return pendingClarify{}, false
+	}
+	delete(s.byChat, chatID)
+	if time.Now().After(p.expires) {
+		return pendingClarify{}, false
+	}
+	return p, true
+}
+
+// mergeClarification folds the original request, the question, and its
+// partial intent into the follow-up so the LLM sees the whole exchange.
+func mergeClarification(p pendingClarify, reply string) string {
+	var b strings.Builder
+	b.WriteString("Original request: " + p.text + "\n")
+	if p.intent != "" {
+		b.WriteString("Partial intent: " + strings.TrimSpace(p.intent+" "+strings.Join(p.args, " ")) + "\n")
+	}
+	b.WriteString("You asked: " + p.question + "\n")
+	b.WriteString("User answered: " + reply)
+	return b.String()
+}
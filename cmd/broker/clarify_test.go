@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+func TestClarifyThenExecute(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1, 2}},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"ls"}},
+		LLM:      LLMConfig{Enabled: true},
+	}
+	var executed []api.CommandRequest
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		executed = append(executed, req)
+		return &api.CommandResponse{Ok: true, Stdout: "film.mkv"}, nil
+	})
+	llm := &llmStub{decisions: []*api.LLMDecision{
+		{Type: "clarify", Intent: "ls", Response: "Which folder, Movies or Music?", Confidence: 0.5},
+		{Type: "command", Intent: "ls", Args: []string{"Movies"}, Confidence: 1},
+	}}
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, llm, nil)
+	send := func(userID int64, text string) {
+		broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+			From: TelegramUser{ID: userID},
+			Chat: TelegramChat{ID: 99},
+			Text: text,
+		}})
+	}
+
+	send(1, "show me my videos")
+	if len(executed) != 0 || len(sender.calls) != 1 || sender.calls[0] != "Which folder, Movies or Music?" {
+		t.Fatalf("expected the clarifying question, got %v executed=%v", sender.calls, executed)
+	}
+
+	send(1, "yes, the Movies folder")
+	if len(executed) != 1 || executed[0].Command != "ls" || len(executed[0].Args) != 1 || executed[0].Args[0] != "Movies" {
+		t.Fatalf("expected ls Movies to run, got %v", executed)
+	}
+	merged := llm.inputs[1]
+	for _, want := range []string{"show me my videos", "Partial intent: ls", "Which folder", "yes, the Movies folder"} {
+		if !strings.Contains(merged, want) {
+			t.Fatalf("follow-up missing %q: %q", want, merged)
+		}
+	}
+
+	// The question was answered, so the next message goes to the LLM alone.
+	llm.decision = &api.LLMDecision{Type: "chat", Response: "hi", Confidence: 1}
+	send(1, "hello")
+	if llm.inputs[2] != "hello" {
+		t.Fatalf("expected pending clarification to be cleared, got %q", llm.inputs[2])
+	}
+}
+
+func TestClarifyStoreExpiresAndIsPerUser(t *testing.T) {
+	store := newClarifyStore()
+	store.put(99, pendingClarify{userID: 1, question: "which?", expires: time.Now().Add(time.Minute)})
+	if _, ok := store.take(99, 2); ok {
+		t.Fatalf("expected another user's message not to answer the question")
+	}
+	if _, ok := store.take(99, 1); !ok {
+		t.Fatalf("expected the asking user to get the pending question")
+	}
+	store.put(99, pendingClarify{userID: 1, question: "which?", expires: time.Now().Add(-time.Second)})
+	if _, ok := store.take(99, 1); ok {
+		t.Fatalf("expected expired question to be dropped")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"personal_ai/internal/api"
@@ -56,4 +57,158 @@ func TestLoadConfigDefaultsAndAllowlistDerivation(t *testing.T) {
 	if len(cfg.Policy.CommandAllowlist) == 0 {
 		t.Fatalf("expected derived command_allowlist")
 	}
+	if len(cfg.Telegram.PolledUpdateTypes) != 1 || cfg.Telegram.PolledUpdateTypes[0] != "message" {
+		t.Fatalf("expected default polled_update_types [message], got %v", cfg.Telegram.PolledUpdateTypes)
+	}
+}
+
+func TestLoadConfigRejectsChatBaseDirOutsideBase(t *testing.T) {
+	cfgIn := BrokerConfig{
+		Execution: ExecutionConfig{
+			Local: LocalExecutionConfig{
+				BaseDir:          t.TempDir(),
+				DynamicAllowlist: []string{"pwd"},
+				ChatBaseDirs:     map[int64]string{1: "../elsewhere"},
+			},
+		},
+	}
+	b, err := json.Marshal(cfgIn)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "broker.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if _, err := loadConfig(path); err == nil {
+		t.Fatalf("expected chat_base_dirs outside base_dir to be rejected")
+	}
+
+	if err := normalizeChatBaseDirs(t.TempDir(), map[int64]string{1: "Missing"}); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Fatalf("expected a missing chat_base_dirs entry to be rejected, got %v", err)
+	}
+}
+
+func TestValidateExecutionConfigChecksExecPaths(t *testing.T) {
+	cfg := &BrokerConfig{
+		StrictConfig: true,
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				CommandAllowlist: map[string]api.AllowedCommand{"typo": {Exec: "/bin/ehco-missing"}},
+				ManagedServices:  map[string]api.AllowedCommand{"web": {Exec: "/bin/sh"}},
+			},
+		},
+	}
+	err := validateExecutionConfig(cfg)
+	if err == nil || !strings.Contains(err.Error(), "execution.local.command_allowlist.typo: /bin/ehco-missing does not exist") {
+		t.Fatalf("expected missing exec path to be rejected, got %v", err)
+	}
+	cfg.StrictConfig = false
+	if err := validateExecutionConfig(cfg); err != nil {
+		t.Fatalf("expected only a warning without strict_config, got %v", err)
+	}
+	// Forward mode never runs the local allowlist, so it is not checked.
+	cfg.StrictConfig = true
+	cfg.Execution.Mode = "forward"
+	cfg.Execution.ForwardURL = "http://agent"
+	if err := validateExecutionConfig(cfg); err != nil {
+		t.Fatalf("expected forward mode to skip exec checks, got %v", err)
+	}
+}
+
+func TestValidateExecutionConfigChecksWorkDirs(t *testing.T) {
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				CommandAllowlist: map[string]api.AllowedCommand{"build": {Exec: "/bin/sh", WorkDir: "scripts"}},
+			},
+		},
+	}
+	if err := validateExecutionConfig(cfg); err == nil || !strings.Contains(err.Error(), "build.work_dir must be an absolute path") {
+		t.Fatalf("expected relative work_dir to be rejected, got %v", err)
+	}
+	cfg.Execution.Local.CommandAllowlist["build"] = api.AllowedCommand{Exec: "/bin/sh", WorkDir: filepath.Join(t.TempDir(), "missing")}
+	if err := validateExecutionConfig(cfg); err == nil || !strings.Contains(err.Error(), "is not a directory") {
+		t.Fatalf("expected missing work_dir to be rejected, got %v", err)
+	}
+	cfg.Execution.Local.CommandAllowlist["build"] = api.AllowedCommand{Exec: "/bin/sh", WorkDir: t.TempDir()}
+	if err := validateExecutionConfig(cfg); err != nil {
+		t.Fatalf("expected existing work_dir to pass, got %v", err)
+	}
+}
+
+func TestLoadConfigExpandsEnvReferences(t *testing.T) {
+	t.Setenv("TEST_TOKEN", "123:from-env")
+	t.Setenv("TEST_KEY", "sk-env")
+	path := filepath.Join(t.TempDir(), "broker.json")
+	write := func(body string) {
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	write(`{"telegram":{"bot_token":"${TEST_TOKEN}"},"llm":{"api_key":"prefix-${TEST_KEY}"},"execution":{"forward_auth_token":"literal$value"}}`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Telegram.BotToken != "123:from-env" || cfg.LLM.APIKey != "prefix-sk-env" {
+		t.Fatalf("expected env references expanded, got %q %q", cfg.Telegram.BotToken, cfg.LLM.APIKey)
+	}
+	if cfg.Execution.ForwardAuthToken != "literal$value" {
+		t.Fatalf("expected literal value kept, got %q", cfg.Execution.ForwardAuthToken)
+	}
+
+	write(`{"telegram":{"bot_token":"${TEST_UNSET_TOKEN}"}}`)
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "TEST_UNSET_TOKEN") {
+		t.Fatalf("expected unset variable to be rejected, got %v", err)
+	}
+}
+
+func TestLoadConfigAppliesOverlay(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "broker.json")
+	overlay := filepath.Join(dir, "host.json")
+	if err := os.WriteFile(base, []byte(`{
+		"listen_addr": "127.0.0.1:8081",
+		"telegram": {"bot_token": "t", "allowed_user_ids": [1, 2]},
+		"policy": {"command_allowlist": ["status", "disk"], "rate_limit_per_minute": 7},
+		"execution": {"local": {"base_dir": "/srv", "command_allowlist": {"status": {"exec": "/bin/echo", "args": ["ok"]}}}}
+	}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(overlay, []byte(`{
+		"listen_addr": "0.0.0.0:9000",
+		"telegram": {"allowed_user_ids": [3]},
+		"execution": {"local": {"command_allowlist": {"uptime": {"exec": "/usr/bin/uptime"}}}}
+	}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	cfg, err := loadConfig(base, overlay)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.ListenAddr != "0.0.0.0:9000" {
+		t.Fatalf("expected overlay listen address, got %q", cfg.ListenAddr)
+	}
+	if cfg.Telegram.BotToken != "t" || cfg.Policy.RateLimitPerMinute != 7 || cfg.Execution.Local.BaseDir != "/srv" {
+		t.Fatalf("expected fields the overlay leaves out to be kept, got %+v", cfg)
+	}
+	if got := cfg.Telegram.AllowedUserIDs; len(got) != 1 || got[0] != 3 {
+		t.Fatalf("expected overlay arrays to replace the base, got %v", got)
+	}
+	if got := cfg.Execution.Local.CommandAllowlist; len(got) != 2 || got["status"].Exec != "/bin/echo" || got["uptime"].Exec != "/usr/bin/uptime" {
+		t.Fatalf("expected overlay maps to merge by key, got %+v", got)
+	}
+
+	if err := os.WriteFile(overlay, []byte(`{"policy": {"redact_patterns": ["("]}}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := loadConfig(base, overlay); err == nil {
+		t.Fatalf("expected the merged config to be validated")
+	}
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// confirmTTL bounds how long a confirmation prompt stays answerable.
+const confirmTTL = 5 * time.Minute
+
+type pendingConfirm struct {
+	token   string
+	userID  int64
+	cmd     string
+	args    []string
+	text    string
+	expires time.Time
+}
+
+// confirmStore holds at most one command awaiting Yes/No per chat.
+type confirmStore struct {
+	mu     sync.Mutex
+	byChat map[int64]pendingConfirm
+}
+
+func newConfirmStore() *confirmStore {
+	return &confirmStore{byChat: make(map[int64]pendingConfirm)}
+}
+
+func (s *confirmStore) put(chatID int64, p pendingConfirm) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byChat[chatID] = p
+}
+
+// take removes and returns the pending command for chatID when token matches
+// and it has not expired.
+func (s *confirmStore) take(chatID int64, token string) (pendingConfirm, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.byChat[chatID]
+	if !ok || p.token != token {
+		return pendingConfirm{}, false
+	}
+	delete(s.byChat, chatID)
+	if time.Now().After(p.expires) {
+		return pendingConfirm{}, false
+	}
+	return p, true
+}
+
+func stageConfirm(ctx *pipelineContext) bool {
+	if ctx.confirmed || !isCommandAllowed(ctx.cmd, ctx.cfg.Policy.ConfirmCommands) {
+		return false
+	}
+	token := randomHex(8)
+	ctx.confirm.put(ctx.chatID, pendingConfirm{
+		token:   token,
+		userID:  ctx.userID,
+		cmd:     ctx.cmd,
+		args:    ctx.args,
+		text:    ctx.msg.Text,
+		expires: time.Now().Add(confirmTTL),
+	})
+	logAudit(ctx, "confirm_requested", "awaiting confirmation", "ok")
+	keyboard := [][]TelegramInlineButton{{
+		{Text: "Yes", CallbackData: "confirm:" + token},
+		{Text: "No", CallbackData: "deny:" + token},
+	}}
+	prompt := "Run " + strings.TrimSpace(ctx.cmd+" "+strings.Join(ctx.args, " ")) + "?"
+	if err := ctx.sender.SendKeyboard(ctx.chatID, prompt, keyboard); err != nil {
+		log.Printf("send telegram: %v", err)
+		logAudit(ctx, "send_failed", err.Error(), "error")
+	}
+	return true
+}
+
+// processCallback handles a press on a confirmation button.
+func (b *Broker) processCallback(cq *TelegramCallbackQuery, clientIP string) {
+	if cq.Message == nil {
+		return
+	}
+	ctx, done := b.newPipelineContext(clientIP)
+	defer done()
+	ctx.userID = cq.From.ID
+	ctx.userName = cq.From.UserName
+	ctx.chatID = cq.Message.Chat.ID
+	answer := func(text string) {
+		if err := b.sender.AnswerCallback(cq.ID, text); err != nil {
+			log.Printf("answer callback: %v", err)
+		}
+	}
+	if !isAllowed(ctx.userID, ctx.cfg.Telegram.AllowedUserIDs) {
+		logAudit(ctx, "auth_denied", "unauthorized callback", "denied")
+		if !repliesToUnauthorized(ctx) {
+			// Still clear the button's spinner, just without saying why.
+			answer("")
+			return
+		}
+		answer("Unauthorized user.")
+		return
+	}
+
+	action, token, _ := strings.Cut(cq.Data, ":")
+	if action != "confirm" && action != "deny" {
+		answer("")
+		return
+	}
+	pending, ok := b.confirm.take(ctx.chatID, token)
+	if !ok {
+		logAudit(ctx, "confirm_expired", "unknown or expired confirmation", "denied")
+		answer("This confirmation has expired.")
+		return
+	}
+	if pending.userID != ctx.userID {
+		// Only the requester may answer; put the prompt back for them.
+		b.confirm.put(ctx.chatID, pending)
+		answer("Only the requesting user can confirm this command.")
+		return
+	}
+
+	ctx.cmd = pending.cmd
+	ctx.args = pending.args
+	ctx.msg = &TelegramMessage{From: cq.From, Chat: cq.Message.Chat, Text: pending.text}
+	if action == "deny" {
+		logAudit(ctx, "confirm_denied", "cancelled by user", "ok")
+		answer("Cancelled.")
+		sendReply(ctx, "Cancelled.")
+		return
+	}
+
+	logAudit(ctx, "confirm_accepted", "confirmed by user", "ok")
+	answer("")
+	ctx.confirmed = true
+	for _, stage := range []pipelineStage{stagePolicy, stageExecute} {
+		if stop := stage(ctx); stop {
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+func newConfirmTestBroker(onExec func(api.CommandRequest)) (*Broker, *senderStub) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			BotToken:       "token",
+			AllowedUserIDs: []int64{1, 2},
+		},
+		Policy: PolicyConfig{
+			CommandAllowlist: []string{"deploy"},
+			ConfirmCommands:  []string{"deploy"},
+		},
+	}
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		onExec(req)
+		return &api.CommandResponse{Ok: true, ExitCode: 0, Stdout: "deployed"}, nil
+	})
+	sender := &senderStub{}
+	return newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, nil), sender
+}
+
+func confirmCallbackData(t *testing.T, sender *senderStub, action string) string {
+	t.Helper()
+	if len(sender.keyboards) != 1 {
+		t.Fatalf("expected a confirmation keyboard, got %d", len(sender.keyboards))
+	}
+	for _, row := range sender.keyboards[0] {
+		for _, btn := range row {
+			if strings.HasPrefix(btn.CallbackData, action+":") {
+				return btn.CallbackData
+			}
+		}
+	}
+	t.Fatalf("no %s button in keyboard", action)
+	return ""
+}
+
+func callbackUpdate(userID int64, data string) TelegramUpdate {
+	return TelegramUpdate{CallbackQuery: &TelegramCallbackQuery{
+		ID:      "cb",
+		From:    TelegramUser{ID: userID},
+		Message: &TelegramMessage{Chat: TelegramChat{ID: 99}},
+		Data:    data,
+	}}
+}
+
+func TestConfirmCallbackRunsPendingCommand(t *testing.T) {
+	var ran []api.CommandRequest
+	broker, sender := newConfirmTestBroker(func(req api.CommandRequest) { ran = append(ran, req) })
+
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: "deploy web",
+	}})
+	if len(ran) != 0 {
+		t.Fatalf("expected command to wait for confirmation")
+	}
+
+	broker.processUpdate(callbackUpdate(1, confirmCallbackData(t, sender, "confirm")))
+
+	if len(ran) != 1 || ran[0].Command != "deploy" || len(ran[0].Args) != 1 || ran[0].Args[0] != "web" {
+		t.Fatalf("expected confirmed deploy to run, got %+v", ran)
+	}
+	if last := sender.calls[len(sender.calls)-1]; !strings.Contains(last, "deployed") {
+		t.Fatalf("expected command output reply, got %q", last)
+	}
+
+	// The confirmation is single use.
+	broker.processUpdate(callbackUpdate(1, confirmCallbackData(t, sender, "confirm")))
+	if len(ran) != 1 {
+		t.Fatalf("expected replayed callback to be ignored")
+	}
+}
+
+func TestConfirmCallbackDenyAndWrongUser(t *testing.T) {
+	ran := 0
+	broker, sender := newConfirmTestBroker(func(api.CommandRequest) { ran++ })
+
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: "deploy",
+	}})
+
+	broker.processUpdate(callbackUpdate(2, confirmCallbackData(t, sender, "confirm")))
+	if ran != 0 {
+		t.Fatalf("expected other user's confirmation to be rejected")
+	}
+
+	broker.processUpdate(callbackUpdate(1, confirmCallbackData(t, sender, "deny")))
+	if ran != 0 {
+		t.Fatalf("expected denied command not to run")
+	}
+	if last := sender.calls[len(sender.calls)-1]; last != "Cancelled." {
+		t.Fatalf("expected cancel reply, got %q", last)
+	}
+}
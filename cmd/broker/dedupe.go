@@ -0,0 +1,100 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// recentUpdatesSize bounds how many update and message IDs are remembered.
+const recentUpdatesSize = 1024
+
+// recentIDs is a bounded LRU set used to drop updates Telegram redelivers.
+type recentIDs struct {
+	mu    sync.Mutex
+	max   int
+	order *list.List
+	set   map[string]*list.Element
+}
+
+func newRecentIDs(max int) *recentIDs {
+	return &recentIDs{max: max, order: list.New(), set: make(map[string]*list.Element)}
+}
+
+// seen records key and reports whether it was already present.
+func (r *recentIDs) seen(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if el, ok := r.set[key]; ok {
+		r.order.MoveToFront(el)
+		return true
+	}
+	r.set[key] = r.order.PushFront(key)
+	if r.order.Len() > r.max {
+		oldest := r.order.Back()
+		r.order.Remove(oldest)
+		delete(r.set, oldest.Value.(string))
+	}
+	return false
+}
+
+// isDuplicateUpdate reports whether update, or the message it carries, has
+// already been processed. Zero IDs are never treated as duplicates.
+func (b *Broker) isDuplicateUpdate(update TelegramUpdate) bool {
+	dup := false
+	if update.UpdateID != 0 && b.recent.seen(fmt.Sprintf("u:%d", update.UpdateID)) {
+		dup = true
+	}
+	if msg := update.Message; msg != nil && msg.MessageID != 0 {
+		key := fmt.Sprintf("m:%d:%d", msg.Chat.ID, msg.MessageID)
+		if msg.EditDate != 0 {
+			key += fmt.Sprintf(":e%d", msg.EditDate)
+		}
+		if b.recent.seen(key) {
+			dup = true
+		}
+	}
+	return dup
+}
+
+// loadPollOffset reads a persisted getUpdates offset, returning 0 when the
+// file is unset, missing, or unreadable.
+func loadPollOffset(path string) int64 {
+	if path == "" {
+		return 0
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return offset
+}
+
+// savePollOffset atomically replaces the offset file.
+func savePollOffset(path string, offset int64) error {
+	if path == "" {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".offset-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(strconv.FormatInt(offset, 10) + "\n"); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
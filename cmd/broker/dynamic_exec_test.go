@@ -2,9 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"personal_ai/internal/api"
 )
@@ -63,6 +71,40 @@ func TestLocalExecutorTouchMkdirCountFind(t *testing.T) {
 	}
 }
 
+func TestLocalExecutorFindHonorsConfiguredLimits(t *testing.T) {
+	base := t.TempDir()
+	for _, dir := range []string{"a/match", "a/b/c/match"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	find := func(maxDepth, maxResults int) []string {
+		cfg := &BrokerConfig{Execution: ExecutionConfig{Mode: "local", Local: LocalExecutionConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"find"},
+			FindMaxDepth:      maxDepth,
+			FindMaxResults:    maxResults,
+		}}}
+		resp, err := newLocalExecutor(cfg).Execute(context.Background(), api.CommandRequest{Command: "find", Args: []string{"match"}, ChatID: 1})
+		if err != nil || !resp.Ok {
+			t.Fatalf("find failed: %+v err=%v", resp, err)
+		}
+		return strings.Fields(resp.Stdout)
+	}
+
+	if got := find(0, 0); len(got) != 2 {
+		t.Fatalf("expected both matches with default limits, got %v", got)
+	}
+	if got := find(1, 0); len(got) != 1 || got[0] != filepath.Join(base, "a", "match") {
+		t.Fatalf("expected depth 1 to stop before a/b/c, got %v", got)
+	}
+	if got := find(0, 1); len(got) != 1 {
+		t.Fatalf("expected a single result, got %v", got)
+	}
+}
+
 func TestPingValidationRejectsBadHost(t *testing.T) {
 	base := t.TempDir()
 	cfg := &BrokerConfig{
@@ -86,3 +128,874 @@ func TestPingValidationRejectsBadHost(t *testing.T) {
 		t.Fatalf("expected ping to fail for invalid host")
 	}
 }
+
+func TestParsePingArgs(t *testing.T) {
+	req, err := parsePingArgs([]string{"example.com"}, 0, 0)
+	if err != nil || req.host != "example.com" || req.count != defaultPingCount || req.ipv6 {
+		t.Fatalf("unexpected defaults %+v err=%v", req, err)
+	}
+	req, err = parsePingArgs([]string{"-6", "-c", "2", "::1"}, 3, 5)
+	if err != nil || req.host != "::1" || req.count != 2 || !req.ipv6 {
+		t.Fatalf("unexpected flags %+v err=%v", req, err)
+	}
+	if ip, err := checkPingHost(req.host, req.ipv6, nil); err != nil || ip.String() != "::1" {
+		t.Fatalf("expected IPv6 literal to be accepted, got %v err=%v", ip, err)
+	}
+	if req, _ := parsePingArgs([]string{"example.com"}, 3, 5); req.count != 3 {
+		t.Fatalf("expected configured default count, got %d", req.count)
+	}
+	for _, args := range [][]string{
+		{"-c", "6", "example.com"},
+		{"-c", "0", "example.com"},
+		{"-c"},
+		{"-f", "example.com"},
+		{"a.com", "b.com"},
+		{"-6"},
+	} {
+		if _, err := parsePingArgs(args, 3, 5); err == nil {
+			t.Fatalf("expected %q to be rejected", args)
+		}
+	}
+}
+
+func TestCheckPingHostHonorsAllowlist(t *testing.T) {
+	saved := pingLookupIP
+	pingLookupIP = func(host string) ([]net.IP, error) {
+		switch strings.ToLower(host) {
+		case "router.lan":
+			return []net.IP{net.ParseIP("fd00::1"), net.ParseIP("10.0.0.1")}, nil
+		case "printer.lan":
+			return []net.IP{net.ParseIP("192.168.1.30")}, nil
+		case "split.lan":
+			return []net.IP{net.ParseIP("192.168.1.31"), net.ParseIP("8.8.4.4")}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+	t.Cleanup(func() { pingLookupIP = saved })
+
+	allowed := []string{"router.lan", "192.168.1.0/24"}
+	for host, want := range map[string]string{
+		"router.lan":   "10.0.0.1",
+		"ROUTER.lan":   "10.0.0.1",
+		"192.168.1.20": "192.168.1.20",
+		"printer.lan":  "192.168.1.30",
+	} {
+		if ip, err := checkPingHost(host, false, allowed); err != nil || ip.String() != want {
+			t.Fatalf("expected %s to pass as %s, got %v err=%v", host, want, ip, err)
+		}
+	}
+	if ip, err := checkPingHost("router.lan", true, allowed); err != nil || ip.String() != "fd00::1" {
+		t.Fatalf("expected -6 to pick the IPv6 address, got %v err=%v", ip, err)
+	}
+	for _, host := range []string{"8.8.8.8", "192.168.2.1", "bad host", "split.lan", "unknown.lan"} {
+		if _, err := checkPingHost(host, false, allowed); err == nil {
+			t.Fatalf("expected %s to be rejected", host)
+		}
+	}
+	if _, err := checkPingHost("printer.lan", true, allowed); err == nil {
+		t.Fatalf("expected -6 to be refused for a name without an IPv6 address")
+	}
+	if _, err := checkPingHost("8.8.8.8", false, nil); err != nil {
+		t.Fatalf("expected any valid host without an allowlist, got %v", err)
+	}
+}
+
+func TestLocalExecutorDu(t *testing.T) {
+	base := t.TempDir()
+	files := map[string]int{
+		"top.txt":      10,
+		"a/x.bin":      100,
+		"a/nested/y":   200,
+		"c/z.log":      1500,
+		"empty/.keep/": 0,
+	}
+	for name, size := range files {
+		p := filepath.Join(base, name)
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(p, 0o755); err != nil {
+				t.Fatalf("mkdir: %v", err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(p, make([]byte, size), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"du"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "du", ChatID: 1})
+	if err != nil || !resp.Ok {
+		t.Fatalf("du failed: %+v err=%v", resp, err)
+	}
+	want := "total: 1.8K\n  a: 300B\n  c: 1.5K\n  empty: 0B\n"
+	if resp.Stdout != want {
+		t.Fatalf("unexpected du output:\n%s\nwant:\n%s", resp.Stdout, want)
+	}
+
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "du", Args: []string{"../"}, ChatID: 1})
+	if resp.Ok {
+		t.Fatalf("expected du outside base_dir to fail")
+	}
+
+	// A directory with many entries is cut at max_output_kb.
+	for i := 0; i < 500; i++ {
+		if err := os.Mkdir(filepath.Join(base, fmt.Sprintf("dir-%03d-padding-padding", i)), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "du", ChatID: 1})
+	if !resp.Ok || len(resp.Stdout) > 8*1024+len("\n[truncated]\n") || !strings.HasSuffix(resp.Stdout, "[truncated]\n") {
+		t.Fatalf("expected du output truncated to 8KB, got %d bytes", len(resp.Stdout))
+	}
+}
+
+func TestLocalExecutorConfiguredLsFlags(t *testing.T) {
+	base := t.TempDir()
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"ls"},
+				AllowedLsFlags:    []string{"-S", "-l"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "ls", Args: []string{"-S"}, ChatID: 1})
+	if err != nil || !resp.Ok {
+		t.Fatalf("expected configured flag to be accepted: %+v err=%v", resp, err)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "ls", Args: []string{"-R"}, ChatID: 1})
+	if resp.Ok || resp.Error != "ls flag not allowed: -R" {
+		t.Fatalf("expected unconfigured flag to be rejected, got %+v", resp)
+	}
+}
+
+func TestLocalExecutorDefaultLsFlags(t *testing.T) {
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, ".hidden"), []byte("12345"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"ls"},
+				DefaultLsFlags:    []string{"-a"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "ls", ChatID: 1})
+	if err != nil || !resp.Ok || !strings.Contains(resp.Stdout, ".hidden") {
+		t.Fatalf("expected default -a to list hidden files: %+v err=%v", resp, err)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "ls", Args: []string{"-l"}, ChatID: 1})
+	if !resp.Ok || !strings.Contains(resp.Stdout, ".hidden") || !strings.Contains(resp.Stdout, " 5 ") {
+		t.Fatalf("expected user -l to apply on top of the defaults, got %+v", resp)
+	}
+
+	cfg.Execution.Local.DefaultLsFlags = []string{"-a", "-h"}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "ls", Args: []string{"--page", "1"}, ChatID: 1})
+	if !resp.Ok || !strings.Contains(resp.Stdout, ".hidden") {
+		t.Fatalf("expected paged ls to apply default -a and skip -h, got %+v", resp)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "ls", Args: []string{"-h", "--page", "1"}, ChatID: 1})
+	if resp.Ok || resp.Error != "ls flag not supported with --page: -h" {
+		t.Fatalf("expected a user -h to be refused with --page, got %+v", resp)
+	}
+}
+
+func TestLocalExecutorPagedLs(t *testing.T) {
+	base := t.TempDir()
+	for i := 0; i < 25; i++ {
+		if err := os.WriteFile(filepath.Join(base, fmt.Sprintf("file%02d.txt", i)), nil, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(base, ".hidden"), nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"ls"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	var seen []string
+	for page := 1; page <= 3; page++ {
+		resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "ls", Args: []string{"--page", strconv.Itoa(page), "--per-page", "10"}, ChatID: 1})
+		if err != nil || !resp.Ok {
+			t.Fatalf("page %d failed: %+v err=%v", page, resp, err)
+		}
+		lines := strings.Split(strings.TrimSuffix(resp.Stdout, "\n"), "\n")
+		if want := fmt.Sprintf("page %d/3 (25 entries)", page); lines[0] != want {
+			t.Fatalf("unexpected page header %q, want %q", lines[0], want)
+		}
+		seen = append(seen, lines[1:]...)
+	}
+	if len(seen) != 25 || seen[0] != "file00.txt" || seen[24] != "file24.txt" {
+		t.Fatalf("expected all files once in order, got %v", seen)
+	}
+	resp, _ := exec.Execute(context.Background(), api.CommandRequest{Command: "ls", Args: []string{"--page", "4", "--per-page", "10"}, ChatID: 1})
+	if resp.Ok || !strings.Contains(resp.Error, "out of range") {
+		t.Fatalf("expected out-of-range page to fail, got %+v", resp)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "ls", Args: []string{"-a", "--per-page", "100"}, ChatID: 1})
+	if !resp.Ok || !strings.HasPrefix(resp.Stdout, "page 1/1 (26 entries)\n.hidden\n") {
+		t.Fatalf("expected -a to include hidden files, got %+v", resp)
+	}
+}
+
+func TestLocalExecutorTree(t *testing.T) {
+	base := t.TempDir()
+	for _, dir := range []string{"proj/src/pkg/deep", "proj/docs"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	for _, name := range []string{"proj/README", "proj/src/main.go", "proj/src/pkg/deep/hidden.go"} {
+		if err := os.WriteFile(filepath.Join(base, name), nil, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"tree"},
+				TreeMaxDepth:      3,
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "tree", Args: []string{"proj"}, ChatID: 1})
+	if err != nil || !resp.Ok {
+		t.Fatalf("tree failed: %+v err=%v", resp, err)
+	}
+	want := "proj/\n  README\n  docs/\n  src/\n    main.go\n    pkg/\n      deep/\n"
+	if resp.Stdout != want {
+		t.Fatalf("unexpected tree output:\n%s\nwant:\n%s", resp.Stdout, want)
+	}
+
+	cfg.Execution.Local.TreeMaxEntries = 2
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "tree", Args: []string{"proj"}, ChatID: 1})
+	if !strings.HasSuffix(resp.Stdout, "[partial: walk limit reached]\n") {
+		t.Fatalf("expected partial tree output, got %q", resp.Stdout)
+	}
+
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "tree", Args: []string{"../"}, ChatID: 1})
+	if resp.Ok {
+		t.Fatalf("expected tree outside base_dir to fail")
+	}
+}
+
+func TestWalksAbortOnTimeout(t *testing.T) {
+	base := t.TempDir()
+	for i := 0; i < 50; i++ {
+		if err := os.MkdirAll(filepath.Join(base, "d", strings.Repeat("x", i+1), "sub"), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	if resp := runSafeFind(ctx, base, base, []string{"sub"}, 0, 0); resp.Ok || resp.Error != errWalkTimeout.Error() {
+		t.Fatalf("expected find timeout, got %+v", resp)
+	}
+	if resp := runSafeTree(ctx, base, base, nil, 10, 10000, 64); resp.Ok || resp.Error != errWalkTimeout.Error() {
+		t.Fatalf("expected tree timeout, got %+v", resp)
+	}
+	if resp := runSafeCount(ctx, base, filepath.Join(base, "d"), nil); resp.Ok || resp.Error != errWalkTimeout.Error() {
+		t.Fatalf("expected count timeout, got %+v", resp)
+	}
+}
+
+func TestLocalExecutorRejectsSymlinkedParent(t *testing.T) {
+	base := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("s3cret"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(base, "link")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"cat", "write"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, _ := exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Args: []string{"link/secret"}, ChatID: 1})
+	if resp.Ok || strings.Contains(resp.Stdout, "s3cret") {
+		t.Fatalf("expected cat through symlinked parent to be rejected, got %+v", resp)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "write", Args: []string{"link/new.txt", "x"}, ChatID: 1})
+	if resp.Ok {
+		t.Fatalf("expected write through symlinked parent to be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); err == nil {
+		t.Fatalf("expected no file created outside base_dir")
+	}
+}
+
+func TestSanitizePathReportsContainmentErrors(t *testing.T) {
+	base := t.TempDir()
+	if err := os.Symlink(t.TempDir(), filepath.Join(base, "link")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if _, err := sanitizePath(base, base, "../etc/passwd"); !errors.Is(err, api.ErrPathOutsideBase) {
+		t.Fatalf("expected ErrPathOutsideBase, got %v", err)
+	}
+	if _, err := sanitizePath(base, base, "link/secret"); !errors.Is(err, api.ErrSymlinkEscape) {
+		t.Fatalf("expected ErrSymlinkEscape, got %v", err)
+	}
+	if _, err := sanitizePath(base, base, " "); err == nil || errors.Is(err, api.ErrPathOutsideBase) || errors.Is(err, api.ErrSymlinkEscape) {
+		t.Fatalf("expected an empty path to fail without a containment error, got %v", err)
+	}
+
+	cfg := &BrokerConfig{Execution: ExecutionConfig{Mode: "local", Local: LocalExecutionConfig{
+		DefaultTimeoutSec: 2,
+		MaxOutputKB:       8,
+		BaseDir:           base,
+		DynamicAllowlist:  []string{"cat", "ls"},
+	}}}
+	exec := newLocalExecutor(cfg)
+	for _, tc := range []struct {
+		cmd, arg, reason string
+	}{
+		{"cat", "../etc/passwd", api.ReasonPathOutsideBase},
+		{"cat", "link/secret", api.ReasonSymlinkEscape},
+		{"ls", "link/", api.ReasonSymlinkEscape},
+		{"cat", "missing.txt", ""},
+	} {
+		resp, _ := exec.Execute(context.Background(), api.CommandRequest{Command: tc.cmd, Args: []string{tc.arg}, ChatID: 1})
+		if resp.Ok || resp.Reason != tc.reason {
+			t.Fatalf("%s %s: expected reason %q, got %+v", tc.cmd, tc.arg, tc.reason, resp)
+		}
+	}
+}
+
+func TestLocalExecutorWriteBase64(t *testing.T) {
+	base := t.TempDir()
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"write", "append"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	content := "[server]\n\tport = 8080\nname = \"shelly\"\n"
+	encoded := base64.StdEncoding.EncodeToString([]byte(content))
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "write", Args: []string{"--base64", "app.conf", encoded}, ChatID: 1})
+	if err != nil || !resp.Ok {
+		t.Fatalf("write failed: %+v err=%v", resp, err)
+	}
+	got, err := os.ReadFile(filepath.Join(base, "app.conf"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != content {
+		t.Fatalf("unexpected content %q, want %q", got, content)
+	}
+
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "append", Args: []string{"--base64", "app.conf", "not base64!"}, ChatID: 1})
+	if resp.Ok {
+		t.Fatalf("expected invalid base64 to be rejected")
+	}
+	big := base64.StdEncoding.EncodeToString(make([]byte, 32*1024+1))
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "write", Args: []string{"--base64", "big.bin", big}, ChatID: 1})
+	if resp.Ok || resp.Error != "content too large" {
+		t.Fatalf("expected oversized content to be rejected, got %+v", resp)
+	}
+}
+
+func TestLocalExecutorMove(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "dir"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"mv"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "mv", Args: []string{"a.txt", "dir"}, ChatID: 1})
+	if err != nil || !resp.Ok {
+		t.Fatalf("mv failed: %+v err=%v", resp, err)
+	}
+	if _, err := os.Stat(filepath.Join(base, "dir", "a.txt")); err != nil {
+		t.Fatalf("expected file moved into dir: %v", err)
+	}
+
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "mv", Args: []string{"dir/a.txt", "../a.txt"}, ChatID: 1})
+	if resp.Ok {
+		t.Fatalf("expected mv outside base_dir to fail")
+	}
+}
+
+func TestMoveFileFallsBackToCopyAcrossDevices(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.sh")
+	dst := filepath.Join(dir, "dst.sh")
+	if err := os.WriteFile(src, []byte("#!/bin/sh\necho hi\n"), 0o640); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Chmod(src, 0o750); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	orig := renameFile
+	defer func() { renameFile = orig }()
+	renamed := false
+	renameFile = func(oldpath, newpath string) error {
+		renamed = true
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+
+	if err := moveFile(src, dst); err != nil {
+		t.Fatalf("moveFile: %v", err)
+	}
+	if !renamed {
+		t.Fatalf("expected rename to be attempted first")
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil || string(got) != "#!/bin/sh\necho hi\n" {
+		t.Fatalf("unexpected copied content %q err=%v", got, err)
+	}
+	info, err := os.Stat(dst)
+	if err != nil || info.Mode().Perm() != 0o750 {
+		t.Fatalf("expected mode 0750 preserved, got %v err=%v", info.Mode(), err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("expected source removed, got %v", err)
+	}
+}
+
+func TestLocalExecutorCatLineRange(t *testing.T) {
+	base := t.TempDir()
+	var b strings.Builder
+	for i := 1; i <= 100; i++ {
+		fmt.Fprintf(&b, "line %d\n", i)
+	}
+	if err := os.WriteFile(filepath.Join(base, "app.log"), []byte(b.String()), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"cat"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--lines", "50-52", "app.log"}, "line 50\nline 51\nline 52\n"},
+		{[]string{"app.log", "--lines", "7-7"}, "line 7\n"},
+		{[]string{"--lines", "99-150", "app.log"}, "line 99\nline 100\n"},
+	}
+	for _, tc := range cases {
+		resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Args: tc.args, ChatID: 1})
+		if err != nil || !resp.Ok || resp.Stdout != tc.want {
+			t.Fatalf("cat %v: got %+v err=%v, want %q", tc.args, resp, err, tc.want)
+		}
+	}
+	for _, args := range [][]string{{"--lines", "80-50", "app.log"}, {"--lines", "0-5", "app.log"}, {"--lines", "101-110", "app.log"}, {"--lines", "1-2"}} {
+		if resp, _ := exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Args: args, ChatID: 1}); resp.Ok {
+			t.Fatalf("expected cat %v to fail, got %+v", args, resp)
+		}
+	}
+}
+
+func TestLocalExecutorCatExpandsGlob(t *testing.T) {
+	base := t.TempDir()
+	for name, body := range map[string]string{"a.txt": "alpha\n", "b.txt": "beta\n", "c.log": "gamma\n"} {
+		if err := os.WriteFile(filepath.Join(base, name), []byte(body), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"cat", "ls"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Args: []string{"*.txt"}, ChatID: 1})
+	if err != nil || !resp.Ok {
+		t.Fatalf("cat failed: %+v err=%v", resp, err)
+	}
+	if resp.Stdout != "alpha\nbeta\n" {
+		t.Fatalf("unexpected cat output %q", resp.Stdout)
+	}
+
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "ls", Args: []string{"*.log"}, ChatID: 1})
+	if !resp.Ok || !strings.Contains(resp.Stdout, "c.log") || strings.Contains(resp.Stdout, "a.txt") {
+		t.Fatalf("unexpected ls output: %+v", resp)
+	}
+
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Args: []string{"../*"}, ChatID: 1})
+	if resp.Ok || resp.Error != "path outside base_dir" {
+		t.Fatalf("expected escaping pattern to be rejected, got %+v", resp)
+	}
+}
+
+func TestLocalExecutorDynamicBlocklist(t *testing.T) {
+	base := t.TempDir()
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"ls", "write"},
+				DynamicBlocklist:  []string{"WRITE"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, _ := exec.Execute(context.Background(), api.CommandRequest{Command: "write", Args: []string{"a.txt", "hi"}, ChatID: 1})
+	if resp.Ok || resp.Error != "command blocked" {
+		t.Fatalf("expected write to be blocked, got %+v", resp)
+	}
+	if _, err := os.Stat(filepath.Join(base, "a.txt")); err == nil {
+		t.Fatalf("expected blocked write not to create a file")
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "ls", ChatID: 1})
+	if !resp.Ok {
+		t.Fatalf("expected ls to still work, got %+v", resp)
+	}
+}
+
+func TestLocalExecutorWc(t *testing.T) {
+	base := t.TempDir()
+	content := "one two\nthree  four five\n\nsix\n"
+	if err := os.WriteFile(filepath.Join(base, "notes.txt"), []byte(content), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"wc"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"notes.txt"}, "4 6 30 notes.txt\n"},
+		{[]string{"-l", "notes.txt"}, "4 notes.txt\n"},
+		{[]string{"-wc", "notes.txt"}, "6 30 notes.txt\n"},
+	}
+	for _, tc := range cases {
+		resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "wc", Args: tc.args, ChatID: 1})
+		if err != nil || !resp.Ok {
+			t.Fatalf("wc %v failed: %+v err=%v", tc.args, resp, err)
+		}
+		if resp.Stdout != tc.want {
+			t.Fatalf("wc %v: got %q, want %q", tc.args, resp.Stdout, tc.want)
+		}
+	}
+
+	resp, _ := exec.Execute(context.Background(), api.CommandRequest{Command: "wc", Args: []string{"../outside"}, ChatID: 1})
+	if resp.Ok {
+		t.Fatalf("expected wc outside base_dir to fail: %+v", resp)
+	}
+}
+
+func TestLocalExecutorJSONFmt(t *testing.T) {
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "config.json"), []byte(`{"name":"shelly","ports":[80,443]}`), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "broken.json"), []byte(`{"name":`), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"jsonfmt"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "jsonfmt", Args: []string{"config.json"}, ChatID: 1})
+	if err != nil || !resp.Ok {
+		t.Fatalf("jsonfmt failed: %+v err=%v", resp, err)
+	}
+	if want := "{\n  \"name\": \"shelly\",\n  \"ports\": [\n    80,\n    443\n  ]\n}\n"; resp.Stdout != want {
+		t.Fatalf("unexpected jsonfmt output %q, want %q", resp.Stdout, want)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "jsonfmt", Args: []string{"broken.json"}, ChatID: 1})
+	if resp.Ok || !strings.Contains(resp.Error, "not valid JSON") {
+		t.Fatalf("expected invalid JSON error, got %+v", resp)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "jsonfmt", Args: []string{"../config.json"}, ChatID: 1})
+	if resp.Ok {
+		t.Fatalf("expected jsonfmt outside base_dir to fail: %+v", resp)
+	}
+}
+
+func TestLocalExecutorGrepRecursive(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "proj", "src", "pkg"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	files := map[string]string{
+		"proj/README":           "nothing here\n",
+		"proj/src/main.go":      "package main\n// TODO: wire config\nfunc main() {}\n",
+		"proj/src/pkg/util.go":  "package pkg\n\n// todo later\n",
+		"proj/src/pkg/blob.bin": "TODO\x00binary",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(base, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"grep"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "grep", Args: []string{"-ri", "todo", "proj"}, ChatID: 1})
+	if err != nil || !resp.Ok {
+		t.Fatalf("grep failed: %+v err=%v", resp, err)
+	}
+	want := "proj/src/main.go:2: // TODO: wire config\nproj/src/pkg/util.go:3: // todo later\n"
+	if resp.Stdout != want {
+		t.Fatalf("unexpected grep output %q, want %q", resp.Stdout, want)
+	}
+
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "grep", Args: []string{"TODO", "proj/src/main.go"}, ChatID: 1})
+	if !resp.Ok || resp.Stdout != "proj/src/main.go:2: // TODO: wire config\n" {
+		t.Fatalf("unexpected single-file grep: %+v", resp)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "grep", Args: []string{"TODO", "proj"}, ChatID: 1})
+	if resp.Ok {
+		t.Fatalf("expected directory without -r to fail: %+v", resp)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "grep", Args: []string{"-r", "TODO", "../"}, ChatID: 1})
+	if resp.Ok {
+		t.Fatalf("expected grep outside base_dir to fail: %+v", resp)
+	}
+}
+
+func TestLocalExecutorReadOnlyBlocksMutations(t *testing.T) {
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "notes.txt"), []byte("hello\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				ReadOnly:          true,
+				DynamicAllowlist:  []string{"cat", "write"},
+				CommandAllowlist: map[string]api.AllowedCommand{
+					"deploy": {Exec: "/bin/echo", Args: []string{"deployed"}, Mutating: true},
+					"uptime": {Exec: "/bin/echo", Args: []string{"up"}},
+				},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, _ := exec.Execute(context.Background(), api.CommandRequest{Command: "write", Args: []string{"notes.txt", "changed"}, ChatID: 1})
+	if resp.Ok || resp.Reason != api.ReasonReadOnly || resp.Error != "read-only mode: write is disabled" {
+		t.Fatalf("expected write to be refused, got %+v", resp)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Args: []string{"notes.txt"}, ChatID: 1})
+	if !resp.Ok || resp.Stdout != "hello\n" {
+		t.Fatalf("expected cat to work and the file untouched, got %+v", resp)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "deploy", ChatID: 1})
+	if resp.Ok || resp.Reason != api.ReasonReadOnly {
+		t.Fatalf("expected mutating static command to be refused, got %+v", resp)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "uptime", ChatID: 1})
+	if !resp.Ok {
+		t.Fatalf("expected non-mutating static command to run, got %+v", resp)
+	}
+	if _, err := exec.SaveUpload(1, 1, "new.txt", []byte("x")); err == nil {
+		t.Fatalf("expected uploads to be refused in read-only mode")
+	}
+}
+
+func TestLocalExecutorTouchTimeAndParents(t *testing.T) {
+	base := t.TempDir()
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"touch"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+	touch := func(args ...string) *api.CommandResponse {
+		resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "touch", Args: args, ChatID: 1})
+		if err != nil {
+			t.Fatalf("touch: %v", err)
+		}
+		return resp
+	}
+
+	if resp := touch("sync/2024/stamp"); resp.Ok {
+		t.Fatalf("expected missing parents to fail without --parents, got %+v", resp)
+	}
+	if resp := touch("--parents", "--time", "2024-01-02T15:04:05Z", "sync/2024/stamp"); !resp.Ok {
+		t.Fatalf("touch --parents --time failed: %+v", resp)
+	}
+	info, err := os.Stat(filepath.Join(base, "sync", "2024", "stamp"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if want := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC); !info.ModTime().Equal(want) {
+		t.Fatalf("expected mtime %s, got %s", want, info.ModTime())
+	}
+	if resp := touch("--time", "yesterday", "stamp"); resp.Ok || !strings.Contains(resp.Error, "RFC3339") {
+		t.Fatalf("expected invalid timestamp to be rejected, got %+v", resp)
+	}
+	if resp := touch("--parents", "../outside/stamp"); resp.Ok {
+		t.Fatalf("expected path outside base to be rejected, got %+v", resp)
+	}
+}
+
+func TestLocalExecutorMktemp(t *testing.T) {
+	base := t.TempDir()
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"mktemp"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	first, err := exec.Execute(context.Background(), api.CommandRequest{Command: "mktemp", ChatID: 1})
+	if err != nil || !first.Ok {
+		t.Fatalf("mktemp failed: %+v err=%v", first, err)
+	}
+	second, _ := exec.Execute(context.Background(), api.CommandRequest{Command: "mktemp", Args: []string{".log"}, ChatID: 1})
+	if !second.Ok || !strings.HasSuffix(strings.TrimSpace(second.Stdout), ".log") {
+		t.Fatalf("expected a .log scratch file, got %+v", second)
+	}
+	a, b := strings.TrimSpace(first.Stdout), strings.TrimSpace(second.Stdout)
+	if a == b {
+		t.Fatalf("expected distinct paths, got %q twice", a)
+	}
+	for _, path := range []string{a, b} {
+		if filepath.Dir(path) != base {
+			t.Fatalf("expected %s inside base_dir", path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s to exist: %v", path, err)
+		}
+	}
+	if resp, _ := exec.Execute(context.Background(), api.CommandRequest{Command: "mktemp", Args: []string{"../x"}, ChatID: 1}); resp.Ok {
+		t.Fatalf("expected a suffix with a separator to be refused, got %+v", resp)
+	}
+}
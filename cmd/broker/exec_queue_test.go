@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExecQueueServesHigherPriorityFirst(t *testing.T) {
+	q := newExecQueue(1, 4)
+	if err := q.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	order := make(chan string, 2)
+	enqueue := func(name string, priority int) {
+		go func() {
+			if err := q.acquire(context.Background(), priority); err != nil {
+				order <- "error: " + err.Error()
+				return
+			}
+			order <- name
+			q.release()
+		}()
+	}
+	waitQueued := func(n int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for q.queued() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d queued", n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	enqueue("backup", 0)
+	waitQueued(1)
+	enqueue("status", 10)
+	waitQueued(2)
+
+	q.release()
+
+	if got := <-order; got != "status" {
+		t.Fatalf("expected status to run first, got %q", got)
+	}
+	if got := <-order; got != "backup" {
+		t.Fatalf("expected backup to run second, got %q", got)
+	}
+}
+
+func TestExecQueueRejectsWhenFull(t *testing.T) {
+	q := newExecQueue(1, 0)
+	if err := q.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if err := q.acquire(context.Background(), 0); err != errQueueFull {
+		t.Fatalf("expected queue full, got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"personal_ai/internal/api"
+)
+
+// routingExecutor sends each command to the executor named for it in
+// execution.command_routing, and everything else to the default executor.
+type routingExecutor struct {
+	fallback Executor
+	routes   map[string]Executor
+}
+
+func (e *routingExecutor) Execute(ctx context.Context, req api.CommandRequest) (*api.CommandResponse, error) {
+	if exec, ok := e.routes[strings.ToLower(req.Command)]; ok {
+		return exec.Execute(ctx, req)
+	}
+	return e.fallback.Execute(ctx, req)
+}
+
+// normalizeCommandRouting lowercases command names and modes, rejecting
+// modes other than local and forward.
+func normalizeCommandRouting(routing map[string]string) (map[string]string, error) {
+	if len(routing) == 0 {
+		return routing, nil
+	}
+	out := make(map[string]string, len(routing))
+	for cmd, mode := range routing {
+		mode = strings.ToLower(strings.TrimSpace(mode))
+		if mode != "local" && mode != "forward" {
+			return nil, fmt.Errorf("execution.command_routing.%s: mode must be local or forward", cmd)
+		}
+		out[strings.ToLower(strings.TrimSpace(cmd))] = mode
+	}
+	return out, nil
+}
+
+// routesTo reports whether any command is routed to mode.
+func routesTo(routing map[string]string, mode string) bool {
+	for _, m := range routing {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"personal_ai/internal/api"
+)
+
+func TestBuildExecutorRoutesCommandsPerConfig(t *testing.T) {
+	forwarded := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req api.CommandRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		forwarded = append(forwarded, req.Command)
+		_ = json.NewEncoder(w).Encode(api.CommandResponse{Ok: true, Stdout: "agent\n"})
+	}))
+	defer server.Close()
+
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode:           "local",
+			ForwardURL:     server.URL,
+			CommandRouting: map[string]string{"status": "forward"},
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           t.TempDir(),
+				DynamicAllowlist:  []string{"echo"},
+			},
+		},
+	}
+	if err := validateExecutionConfig(cfg); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	exec := buildExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "status", ChatID: 1})
+	if err != nil || resp.Stdout != "agent\n" {
+		t.Fatalf("expected status to be forwarded, got %+v err=%v", resp, err)
+	}
+	resp, err = exec.Execute(context.Background(), api.CommandRequest{Command: "echo", Args: []string{"local"}, ChatID: 1})
+	if err != nil || resp.Stdout != "local\n" {
+		t.Fatalf("expected echo to run locally, got %+v err=%v", resp, err)
+	}
+	if len(forwarded) != 1 || forwarded[0] != "status" {
+		t.Fatalf("expected only status to reach the agent, got %v", forwarded)
+	}
+}
+
+func TestNormalizeCommandRoutingRejectsUnknownMode(t *testing.T) {
+	if _, err := normalizeCommandRouting(map[string]string{"status": "remote"}); err == nil {
+		t.Fatalf("expected unknown routing mode to be rejected")
+	}
+	routing, err := normalizeCommandRouting(map[string]string{"Status": " Forward "})
+	if err != nil || routing["status"] != "forward" {
+		t.Fatalf("expected normalized routing, got %v err=%v", routing, err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchAllowlistsHosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://example.invalid/", http.StatusFound)
+			return
+		}
+		w.Write([]byte("healthy"))
+	}))
+	defer server.Close()
+	localhostURL := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	if resp := runSafeFetch(context.Background(), []string{server.URL}, []string{"example.com"}, 2, 8); resp.Ok || !strings.Contains(resp.Error, "not allowed") {
+		t.Fatalf("expected unlisted IP to be refused, got %+v", resp)
+	}
+	// An allowed name that resolves to loopback is still blocked unless a
+	// listed network covers the address.
+	if resp := runSafeFetch(context.Background(), []string{localhostURL}, []string{"localhost"}, 2, 8); resp.Ok || !strings.Contains(resp.Error, "address not allowed") {
+		t.Fatalf("expected loopback address to be refused, got %+v", resp)
+	}
+	if resp := runSafeFetch(context.Background(), []string{"file:///etc/passwd"}, []string{"127.0.0.1/32"}, 2, 8); resp.Ok {
+		t.Fatalf("expected non-http scheme to be refused, got %+v", resp)
+	}
+
+	resp := runSafeFetch(context.Background(), []string{server.URL + "/health"}, []string{"127.0.0.0/8"}, 2, 8)
+	if !resp.Ok || resp.Stdout != "HTTP 200 OK\nhealthy" {
+		t.Fatalf("expected allowed fetch to succeed, got %+v", resp)
+	}
+	resp = runSafeFetch(context.Background(), []string{server.URL + "/redirect"}, []string{"127.0.0.1"}, 2, 8)
+	if resp.Ok || !strings.Contains(resp.Error, "fetch host not allowed: example.invalid") {
+		t.Fatalf("expected redirect to unlisted host to be refused, got %+v", resp)
+	}
+}
+
+func TestFetchCapsResponseSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 64*1024)))
+	}))
+	defer server.Close()
+
+	resp := runSafeFetch(context.Background(), []string{server.URL}, []string{"127.0.0.1/32"}, 2, 1)
+	if !resp.Ok {
+		t.Fatalf("expected fetch to succeed, got %+v", resp)
+	}
+	if len(resp.Stdout) > 1024+len("\n[truncated]\n") || !strings.HasSuffix(resp.Stdout, "[truncated]\n") {
+		t.Fatalf("expected body capped at 1KB, got %d bytes", len(resp.Stdout))
+	}
+}
+
+func TestParseHostAllowlistRejectsBadEntries(t *testing.T) {
+	for _, entry := range []string{"10.0.0.0/33", "bad host", "-example.com"} {
+		if _, err := parseHostAllowlist([]string{entry}); err == nil {
+			t.Fatalf("expected %q to be rejected", entry)
+		}
+	}
+}
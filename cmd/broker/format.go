@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Values for policy.output_formats. plain is the default reply layout.
+const (
+	outputPlain = "plain"
+	outputCode  = "code"
+	outputTable = "table"
+)
+
+// normalizeOutputFormats lowercases command names and formats, rejecting
+// unknown formats.
+func normalizeOutputFormats(formats map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(formats))
+	for cmd, format := range formats {
+		format = strings.ToLower(strings.TrimSpace(format))
+		switch format {
+		case outputPlain, outputCode, outputTable:
+		default:
+			return nil, fmt.Errorf("policy.output_formats.%s: unknown format %q (want plain, code, or table)", cmd, format)
+		}
+		out[strings.ToLower(strings.TrimSpace(cmd))] = format
+	}
+	return out, nil
+}
+
+// outputFormat returns the configured format for cmd, plain by default.
+func (p PolicyConfig) outputFormat(cmd string) string {
+	if format, ok := p.OutputFormats[strings.ToLower(cmd)]; ok {
+		return format
+	}
+	return outputPlain
+}
+
+// formatOutput lays out command output in format and reports whether the
+// result is a monospace block: code keeps it as is and table also aligns its
+// whitespace-separated columns.
+func formatOutput(out, format string) (string, bool) {
+	switch format {
+	case outputCode:
+		return out, true
+	case outputTable:
+		return alignColumns(out), true
+	}
+	return out, false
+}
+
+// alignColumns pads each whitespace-separated field to its column's widest
+// value. The last field of each line is left unpadded.
+func alignColumns(out string) string {
+	lines := strings.Split(out, "\n")
+	rows := make([][]string, len(lines))
+	var widths []int
+	for i, line := range lines {
+		rows[i] = strings.Fields(line)
+		for j, field := range rows[i] {
+			if j == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[j] = max(widths[j], utf8.RuneCountInString(field))
+		}
+	}
+	var b strings.Builder
+	for i, row := range rows {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		for j, field := range row {
+			if j == len(row)-1 {
+				b.WriteString(field)
+				break
+			}
+			b.WriteString(field)
+			b.WriteString(strings.Repeat(" ", widths[j]-utf8.RuneCountInString(field)+2))
+		}
+	}
+	return b.String()
+}
+
+// messageEntity is a Bot API MessageEntity; offsets count UTF-16 code units.
+// Replies carry them explicitly, so text is never parsed for markup.
+type messageEntity struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// preEntity marks block, which follows prefix in a reply, as monospace.
+func preEntity(prefix, block string) messageEntity {
+	return messageEntity{Type: "pre", Offset: utf16Len(prefix), Length: utf16Len(block)}
+}
+
+// shiftEntities moves entities past prefix, for replies wrapped in a header.
+func shiftEntities(prefix string, entities []messageEntity) []messageEntity {
+	if len(entities) == 0 {
+		return nil
+	}
+	n := utf16Len(prefix)
+	out := make([]messageEntity, len(entities))
+	for i, e := range entities {
+		e.Offset += n
+		out[i] = e
+	}
+	return out
+}
+
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
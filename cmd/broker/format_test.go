@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"personal_ai/internal/api"
+)
+
+func TestRenderResponseOutputFormats(t *testing.T) {
+	resp := &api.CommandResponse{Ok: true, Stdout: "Filesystem Size Use%\n/dev/sda1 20G 45%\ntmpfs 512M 1%\n"}
+
+	got, entities := renderResponse("df", resp, outputPlain, true)
+	if want := "df:\nFilesystem Size Use%\n/dev/sda1 20G 45%\ntmpfs 512M 1%"; got != want || entities != nil {
+		t.Fatalf("plain: got %q %+v, want %q", got, entities, want)
+	}
+	got, entities = renderResponse("df", resp, outputCode, true)
+	if want := "df:\nFilesystem Size Use%\n/dev/sda1 20G 45%\ntmpfs 512M 1%"; got != want {
+		t.Fatalf("code: got %q, want %q", got, want)
+	}
+	if want := []messageEntity{{Type: "pre", Offset: 4, Length: 52}}; !reflect.DeepEqual(entities, want) {
+		t.Fatalf("code: unexpected entities %+v, want %+v", entities, want)
+	}
+	want := "df:\n" +
+		"Filesystem  Size  Use%\n" +
+		"/dev/sda1   20G   45%\n" +
+		"tmpfs       512M  1%"
+	got, entities = renderResponse("df", resp, outputTable, true)
+	if got != want || len(entities) != 1 || entities[0].Offset != 4 || entities[0].Length != len(want)-4 {
+		t.Fatalf("table: got %q %+v, want %q", got, entities, want)
+	}
+	if got, entities := renderResponse("df", &api.CommandResponse{Ok: true}, outputTable, true); got != "df:\n(no output)" || entities != nil {
+		t.Fatalf("expected empty output to stay plain, got %q %+v", got, entities)
+	}
+
+	// Plain output is sent as is, even when it contains fence lines.
+	fenced := &api.CommandResponse{Ok: true, Stdout: "```\nx\n```"}
+	if got, entities := renderResponse("cat", fenced, outputPlain, true); got != "cat:\n```\nx\n```" || entities != nil {
+		t.Fatalf("expected fences to pass through, got %q %+v", got, entities)
+	}
+	if payload := messagePayload(1, "```\nx\n```", nil); payload["text"] != "```\nx\n```" || payload["entities"] != nil {
+		t.Fatalf("expected payload text unchanged, got %v", payload)
+	}
+}
+
+func TestNormalizeOutputFormats(t *testing.T) {
+	got, err := normalizeOutputFormats(map[string]string{"DF": " Table ", "status": "plain"})
+	if err != nil || !reflect.DeepEqual(got, map[string]string{"df": "table", "status": "plain"}) {
+		t.Fatalf("unexpected formats %v err=%v", got, err)
+	}
+	if _, err := normalizeOutputFormats(map[string]string{"df": "html"}); err == nil {
+		t.Fatalf("expected unknown format to be rejected")
+	}
+	if got := (PolicyConfig{OutputFormats: got}).outputFormat("uptime"); got != outputPlain {
+		t.Fatalf("expected plain by default, got %q", got)
+	}
+}
+
+func TestPreEntityCountsUTF16(t *testing.T) {
+	// Offsets count UTF-16 units, so an emoji before the block counts twice.
+	if got, want := preEntity("🙂\n", "é"), (messageEntity{Type: "pre", Offset: 3, Length: 1}); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got := shiftEntities("ab", []messageEntity{{Type: "pre", Offset: 1, Length: 2}}); len(got) != 1 || got[0].Offset != 3 || got[0].Length != 2 {
+		t.Fatalf("unexpected shifted entities %+v", got)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyCommand is the builtin that lists the user's recent commands.
+const historyCommand = "history"
+
+// historySize is how many commands are kept per chat and user.
+const historySize = 20
+
+type historyEntry struct {
+	at      time.Time
+	command string
+	outcome string
+}
+
+type historyKey struct {
+	chatID int64
+	userID int64
+}
+
+// commandHistory keeps each user's last historySize executed commands in
+// memory. It is lost on restart; the audit log is the durable record.
+type commandHistory struct {
+	mu      sync.Mutex
+	max     int
+	entries map[historyKey][]historyEntry
+}
+
+func newCommandHistory(max int) *commandHistory {
+	return &commandHistory{max: max, entries: map[historyKey][]historyEntry{}}
+}
+
+func (h *commandHistory) record(chatID, userID int64, entry historyEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := historyKey{chatID: chatID, userID: userID}
+	list := append(h.entries[k], entry)
+	if len(list) > h.max {
+		list = append([]historyEntry(nil), list[len(list)-h.max:]...)
+	}
+	h.entries[k] = list
+}
+
+// last returns up to n of the user's most recent commands, oldest first.
+func (h *commandHistory) last(chatID, userID int64, n int) []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := h.entries[historyKey{chatID: chatID, userID: userID}]
+	if n > 0 && n < len(list) {
+		list = list[len(list)-n:]
+	}
+	return append([]historyEntry(nil), list...)
+}
+
+// recordHistory adds the command ctx just ran to the user's history.
+func recordHistory(ctx *pipelineContext, outcome string) {
+	ctx.outcome = outcome
+	if ctx.history == nil {
+		return
+	}
+	command := strings.TrimSpace(strings.Join(append([]string{ctx.cmd}, ctx.args...), " "))
+	ctx.history.record(ctx.chatID, ctx.userID, historyEntry{at: time.Now().UTC(), command: command, outcome: outcome})
+}
+
+// replyHistory lists the user's recent commands; an optional argument limits
+// how many are shown.
+func replyHistory(ctx *pipelineContext, args []string) bool {
+	n := 0
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil || v <= 0 || len(args) > 1 {
+			return sendReply(ctx, "Usage: history [count]")
+		}
+		n = v
+	}
+	var entries []historyEntry
+	if ctx.history != nil {
+		entries = ctx.history.last(ctx.chatID, ctx.userID, n)
+	}
+	logAudit(ctx, "history", fmt.Sprintf("%d entries", len(entries)), "ok")
+	if len(entries) == 0 {
+		return sendReply(ctx, "No commands yet.")
+	}
+	var b strings.Builder
+	for i, e := range entries {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%s %s (%s)", e.at.Format(time.RFC3339), e.command, e.outcome)
+	}
+	return sendReply(ctx, b.String())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+func TestHistoryListsRecentCommandsInOrder(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1, 2}},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"status", "ls", "fail"}},
+	}
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		if req.Command == "fail" {
+			return &api.CommandResponse{Ok: false, ExitCode: 2, Error: "boom"}, nil
+		}
+		return &api.CommandResponse{Ok: true}, nil
+	})
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, nil)
+	send := func(userID int64, text string) string {
+		broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+			From: TelegramUser{ID: userID},
+			Chat: TelegramChat{ID: 99},
+			Text: text,
+		}})
+		return sender.calls[len(sender.calls)-1]
+	}
+
+	if reply := send(1, "history"); reply != "No commands yet." {
+		t.Fatalf("expected empty history, got %q", reply)
+	}
+	send(1, "status")
+	send(1, "ls -l docs")
+	send(1, "fail")
+	send(2, "status")
+
+	lines := strings.Split(send(1, "history"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected three entries, got %q", lines)
+	}
+	for i, want := range []string{"status (ok)", "ls -l docs (ok)", "fail (exit 2)"} {
+		if !strings.HasSuffix(lines[i], " "+want) {
+			t.Fatalf("entry %d: expected %q, got %q", i, want, lines[i])
+		}
+	}
+	if reply := send(1, "history 1"); !strings.HasSuffix(reply, " fail (exit 2)") || strings.Contains(reply, "\n") {
+		t.Fatalf("expected only the last entry, got %q", reply)
+	}
+}
+
+func TestCommandHistoryIsBounded(t *testing.T) {
+	h := newCommandHistory(2)
+	for _, cmd := range []string{"a", "b", "c"} {
+		h.record(1, 1, historyEntry{command: cmd})
+	}
+	got := h.last(1, 1, 0)
+	if len(got) != 2 || got[0].command != "b" || got[1].command != "c" {
+		t.Fatalf("expected the two newest entries, got %+v", got)
+	}
+}
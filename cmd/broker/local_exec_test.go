@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"personal_ai/internal/api"
 )
@@ -35,6 +38,42 @@ func TestLocalExecutorRunsAllowlistedCommand(t *testing.T) {
 	}
 }
 
+func TestLocalExecutorSubstitutesArgTemplates(t *testing.T) {
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				CommandAllowlist: map[string]api.AllowedCommand{
+					"usage": {Exec: "/bin/echo", Args: []string{"-n", "size of {0}"}},
+					"fixed": {Exec: "/bin/echo", Args: []string{"-n", "hello"}},
+				},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+	run := func(cmd string, args ...string) *api.CommandResponse {
+		resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: cmd, Args: args})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	if resp := run("usage", "/var//log/"); !resp.Ok || resp.Stdout != "size of /var/log" {
+		t.Fatalf("expected cleaned path substituted, got %+v", resp)
+	}
+	if resp := run("fixed", "ignored", "--extra"); !resp.Ok || resp.Stdout != "hello" {
+		t.Fatalf("expected fixed args to ignore request args, got %+v", resp)
+	}
+	for _, args := range [][]string{nil, {"--help"}, {"../etc"}, {"/var", "extra"}} {
+		if resp := run("usage", args...); resp.Ok || resp.Reason != api.ReasonInvalidArgs {
+			t.Fatalf("expected %q to be rejected, got %+v", args, resp)
+		}
+	}
+}
+
 func TestLocalExecutorDynamicPwd(t *testing.T) {
 	base := t.TempDir()
 	cfg := &BrokerConfig{
@@ -61,3 +100,521 @@ func TestLocalExecutorDynamicPwd(t *testing.T) {
 		t.Fatalf("expected stdout %q, got %q", base, got)
 	}
 }
+
+func TestLocalExecutorChatBaseDirs(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "Projects"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"pwd"},
+				ChatBaseDirs:      map[int64]string{42: "Projects"},
+			},
+		},
+	}
+
+	exec := newLocalExecutor(cfg)
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "pwd", ChatID: 42})
+	if err != nil || !resp.Ok {
+		t.Fatalf("pwd failed: %+v err=%v", resp, err)
+	}
+	if got := strings.TrimSpace(resp.Stdout); got != filepath.Join(base, "Projects") {
+		t.Fatalf("expected configured chat to start in Projects, got %q", got)
+	}
+
+	resp, err = exec.Execute(context.Background(), api.CommandRequest{Command: "pwd", ChatID: 7})
+	if err != nil || !resp.Ok {
+		t.Fatalf("pwd failed: %+v err=%v", resp, err)
+	}
+	if got := strings.TrimSpace(resp.Stdout); got != base {
+		t.Fatalf("expected other chat to start at base, got %q", got)
+	}
+}
+
+func TestLocalExecutorCWDIsolatedPerUser(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "sub"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	newCfg := func(shared bool) *BrokerConfig {
+		return &BrokerConfig{
+			Execution: ExecutionConfig{
+				Mode: "local",
+				Local: LocalExecutionConfig{
+					DefaultTimeoutSec: 2,
+					MaxOutputKB:       8,
+					BaseDir:           base,
+					DynamicAllowlist:  []string{"pwd", "cd"},
+					SharedChatCWD:     shared,
+				},
+			},
+		}
+	}
+
+	exec := newLocalExecutor(newCfg(false))
+	if resp, _ := exec.Execute(context.Background(), api.CommandRequest{Command: "cd", Args: []string{"sub"}, ChatID: 5, UserID: 1}); !resp.Ok {
+		t.Fatalf("cd failed: %+v", resp)
+	}
+	resp, _ := exec.Execute(context.Background(), api.CommandRequest{Command: "pwd", ChatID: 5, UserID: 2})
+	if got := strings.TrimSpace(resp.Stdout); got != base {
+		t.Fatalf("expected second user to stay at base, got %q", got)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "pwd", ChatID: 5, UserID: 1})
+	if got := strings.TrimSpace(resp.Stdout); got != filepath.Join(base, "sub") {
+		t.Fatalf("expected first user in sub, got %q", got)
+	}
+
+	exec = newLocalExecutor(newCfg(true))
+	_, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "cd", Args: []string{"sub"}, ChatID: 5, UserID: 1})
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "pwd", ChatID: 5, UserID: 2})
+	if got := strings.TrimSpace(resp.Stdout); got != filepath.Join(base, "sub") {
+		t.Fatalf("expected shared cwd in sub, got %q", got)
+	}
+}
+
+func TestLocalExecutorDynamicEcho(t *testing.T) {
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           t.TempDir(),
+				DynamicAllowlist:  []string{"echo"},
+			},
+		},
+	}
+
+	exec := newLocalExecutor(cfg)
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "echo", Args: []string{"hello", "big", "world"}})
+	if err != nil || !resp.Ok {
+		t.Fatalf("echo failed: %+v err=%v", resp, err)
+	}
+	if got := strings.TrimSpace(resp.Stdout); got != "hello big world" {
+		t.Fatalf("expected joined args, got %q", got)
+	}
+}
+
+func TestLocalExecutorDynamicWhoami(t *testing.T) {
+	base := t.TempDir()
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           base,
+				DynamicAllowlist:  []string{"whoami"},
+			},
+		},
+	}
+
+	exec := newLocalExecutor(cfg)
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "whoami", UserID: 11, ChatID: 22})
+	if err != nil || !resp.Ok {
+		t.Fatalf("whoami failed: %+v err=%v", resp, err)
+	}
+	for _, want := range []string{"user: 11", "chat: 22", "cwd: " + base, "base_dir: " + base} {
+		if !strings.Contains(resp.Stdout, want) {
+			t.Fatalf("expected %q in output, got %q", want, resp.Stdout)
+		}
+	}
+}
+
+func TestLocalExecutorCombineOutputInterleaves(t *testing.T) {
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				CommandAllowlist: map[string]api.AllowedCommand{
+					"build": {
+						Exec:          "/bin/sh",
+						Args:          []string{"-c", "echo out1; echo err1 >&2; echo out2; echo err2 >&2"},
+						CombineOutput: true,
+					},
+				},
+			},
+		},
+	}
+
+	exec := newLocalExecutor(cfg)
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "build"})
+	if err != nil || !resp.Ok {
+		t.Fatalf("build failed: %+v err=%v", resp, err)
+	}
+	if resp.Stdout != "out1\nerr1\nout2\nerr2\n" {
+		t.Fatalf("expected interleaved output, got %q", resp.Stdout)
+	}
+	if resp.Stderr != "" {
+		t.Fatalf("expected empty stderr, got %q", resp.Stderr)
+	}
+}
+
+func TestLocalExecutorDateAndUptime(t *testing.T) {
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           t.TempDir(),
+				DynamicAllowlist:  []string{"date", "uptime"},
+				DateFormat:        "2006-01-02",
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "date"})
+	if err != nil || !resp.Ok {
+		t.Fatalf("date failed: %+v err=%v", resp, err)
+	}
+	lines := strings.Split(strings.TrimSpace(resp.Stdout), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected RFC3339 and custom format lines, got %q", resp.Stdout)
+	}
+	if _, err := time.Parse(time.RFC3339, lines[0]); err != nil {
+		t.Fatalf("date output not RFC3339: %v", err)
+	}
+	if _, err := time.Parse("2006-01-02", lines[1]); err != nil {
+		t.Fatalf("date output not in configured format: %v", err)
+	}
+
+	resp, err = exec.Execute(context.Background(), api.CommandRequest{Command: "uptime"})
+	if err != nil || !resp.Ok {
+		t.Fatalf("uptime failed: %+v err=%v", resp, err)
+	}
+	fields := strings.Fields(resp.Stdout)
+	since, err := time.Parse(time.RFC3339, fields[len(fields)-1])
+	if err != nil {
+		t.Fatalf("uptime start not RFC3339: %v", err)
+	}
+	if since.After(time.Now()) {
+		t.Fatalf("uptime start in the future: %s", since)
+	}
+}
+
+func TestLocalExecutorMatchesAllowlistPatterns(t *testing.T) {
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				CommandAllowlist: map[string]api.AllowedCommand{
+					"deploy-*":   {Exec: "/bin/echo", Args: []string{"deploying"}},
+					"deploy-api": {Exec: "/bin/echo", Args: []string{"exact"}, Summarize: true},
+					"backup-*":   {Exec: "/bin/echo"},
+					"backup-d?":  {Exec: "/bin/echo"},
+				},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "deploy-web"})
+	if err != nil || !resp.Ok || resp.Stdout != "deploy-web deploying\n" {
+		t.Fatalf("expected pattern entry to receive the command name, got %+v err=%v", resp, err)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "deploy-api"})
+	if !resp.Ok || resp.Stdout != "exact\n" || !resp.Summarize {
+		t.Fatalf("expected exact entry to win over the pattern with its summarize flag, got %+v", resp)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "backup-db"})
+	if resp.Ok || resp.Reason != api.ReasonNotAllowed || !strings.Contains(resp.Error, "backup-*, backup-d?") {
+		t.Fatalf("expected ambiguous patterns to be refused, got %+v", resp)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "deploy-$x"})
+	if resp.Ok {
+		t.Fatalf("expected unsafe pattern-matched name to be refused, got %+v", resp)
+	}
+	if !isCommandAllowlisted("deploy-web", []string{"status", "deploy-*"}) || isCommandAllowlisted("undeploy", []string{"deploy-*"}) {
+		t.Fatalf("expected policy allowlist to match patterns")
+	}
+	if isCommandAllowed("-x", []string{"-[a-z]"}) || isCommandAllowed("deploy-web", []string{"deploy-*"}) {
+		t.Fatalf("expected other command lists to match names exactly")
+	}
+}
+
+func TestLocalExecutorPassesStdinFromArgs(t *testing.T) {
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				CommandAllowlist: map[string]api.AllowedCommand{
+					"stdin": {Exec: "/bin/cat", AllowStdin: true},
+					"plain": {Exec: "/bin/cat"},
+				},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "stdin", Args: []string{"hello", "world"}})
+	if err != nil || !resp.Ok || resp.Stdout != "hello world" {
+		t.Fatalf("expected args echoed via stdin, got %+v err=%v", resp, err)
+	}
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "plain", Args: []string{"hello"}})
+	if resp.Stdout != "" {
+		t.Fatalf("expected no stdin without allow_stdin, got %q", resp.Stdout)
+	}
+}
+
+func TestRunAllowedCommandExitCodes(t *testing.T) {
+	cases := []struct {
+		name    string
+		args    []string
+		timeout time.Duration
+		want    int
+	}{
+		{name: "non-zero exit", args: []string{"-c", "exit 3"}, timeout: 2 * time.Second, want: 3},
+		{name: "timeout", args: []string{"-c", "exec sleep 5"}, timeout: 50 * time.Millisecond, want: 124},
+		{name: "killed", args: []string{"-c", "kill -9 $$"}, timeout: 2 * time.Second, want: 137},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+			resp := runAllowedCommand(ctx, api.AllowedCommand{Exec: "/bin/sh", Args: tc.args}, "", "", nil, 8)
+			if resp.Ok || resp.ExitCode != tc.want {
+				t.Fatalf("expected exit code %d, got %+v", tc.want, resp)
+			}
+		})
+	}
+}
+
+func TestRunAllowedCommandKillsOutputFlood(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	// The shell's child keeps writing after the shell is killed; the pipe is
+	// closed once the wait delay passes.
+	resp := runAllowedCommand(ctx, api.AllowedCommand{Exec: "/bin/sh", Args: []string{"-c", "yes flood"}}, "", "", nil, 1)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected flooding command to be killed promptly, took %s", elapsed)
+	}
+	if resp.Ok || resp.Error != errOutputLimit.Error() {
+		t.Fatalf("expected output limit error, got %+v", resp)
+	}
+	if max := 1024 + len("\n[truncated]\n"); len(resp.Stdout) > max || !strings.HasSuffix(resp.Stdout, "[truncated]\n") {
+		t.Fatalf("expected stdout capped at 1KB, got %d bytes", len(resp.Stdout))
+	}
+}
+
+func TestChatCWDPersistsAcrossStores(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "Projects"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(base, "Gone"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	state := filepath.Join(t.TempDir(), "cwd.json")
+
+	first := newChatCWD(nil, false)
+	if err := first.load(state, base); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	first.set(1, 7, filepath.Join(base, "Projects"))
+	first.set(2, 7, filepath.Join(base, "Gone"))
+	if err := os.Remove(filepath.Join(base, "Gone")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	second := newChatCWD(nil, false)
+	if err := second.load(state, base); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := second.get(1, 7, base); got != filepath.Join(base, "Projects") {
+		t.Fatalf("expected restored cwd, got %q", got)
+	}
+	if got := second.get(2, 7, base); got != base {
+		t.Fatalf("expected missing dir to fall back to base, got %q", got)
+	}
+	if got := second.get(1, 8, base); got != base {
+		t.Fatalf("expected other user to start at base, got %q", got)
+	}
+}
+
+func TestChatCWDLoadRejectsDirsOutsideBase(t *testing.T) {
+	base := t.TempDir()
+	outside := t.TempDir()
+	state := filepath.Join(t.TempDir(), "cwd.json")
+	if err := os.WriteFile(state, []byte(`{"1:7": "`+outside+`"}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	store := newChatCWD(nil, false)
+	if err := store.load(state, base); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := store.get(1, 7, base); got != base {
+		t.Fatalf("expected outside dir to be ignored, got %q", got)
+	}
+}
+
+func TestLocalExecutorDynamicEnv(t *testing.T) {
+	t.Setenv("SHELLY_VISIBLE", "yes")
+	t.Setenv("SHELLY_SECRET", "hunter2")
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           t.TempDir(),
+				DynamicAllowlist:  []string{"env"},
+				EnvAllowlist:      []string{"SHELLY_VISIBLE", "SHELLY_MISSING"},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "env", ChatID: 1})
+	if err != nil || !resp.Ok {
+		t.Fatalf("env failed: %+v err=%v", resp, err)
+	}
+	if want := "SHELLY_VISIBLE=yes\nSHELLY_MISSING=(unset)\n"; resp.Stdout != want {
+		t.Fatalf("unexpected env output %q, want %q", resp.Stdout, want)
+	}
+	if strings.Contains(resp.Stdout, "hunter2") {
+		t.Fatalf("env leaked a variable that is not allowlisted")
+	}
+}
+
+func TestLocalExecutorRejectsOversizedArgs(t *testing.T) {
+	called := filepath.Join(t.TempDir(), "called")
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				BaseDir:           t.TempDir(),
+				DynamicAllowlist:  []string{"echo"},
+				CommandAllowlist: map[string]api.AllowedCommand{
+					"mark": {Exec: "/usr/bin/touch", Args: []string{called}},
+				},
+				MaxArgs:     3,
+				MaxArgBytes: 8,
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	cases := []struct {
+		cmd  string
+		args []string
+		want string
+	}{
+		{cmd: "echo", args: []string{"a", "b", "c", "d"}, want: "too many arguments: 4 exceeds max_args 3"},
+		{cmd: "echo", args: []string{"ok", "123456789"}, want: "argument 2 is 9 bytes, exceeds max_arg_bytes 8"},
+		{cmd: "mark", args: []string{"a", "b", "c", "d"}, want: "too many arguments: 4 exceeds max_args 3"},
+		{cmd: "mark", args: []string{"123456789"}, want: "argument 1 is 9 bytes, exceeds max_arg_bytes 8"},
+	}
+	for _, tc := range cases {
+		resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: tc.cmd, Args: tc.args, ChatID: 1})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp.Ok || resp.Error != tc.want {
+			t.Fatalf("%s %v: expected %q, got %+v", tc.cmd, tc.args, tc.want, resp)
+		}
+	}
+	if _, err := os.Stat(called); !os.IsNotExist(err) {
+		t.Fatalf("expected static command not to run, stat err=%v", err)
+	}
+
+	resp, _ := exec.Execute(context.Background(), api.CommandRequest{Command: "echo", Args: []string{"a", "b", "c"}, ChatID: 1})
+	if !resp.Ok || resp.Stdout != "a b c\n" {
+		t.Fatalf("expected args within limits to run, got %+v", resp)
+	}
+}
+
+func TestLocalExecutorPerCommandOutputLimit(t *testing.T) {
+	print3KB := []string{"-c", "printf '%03000d' 0"}
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       1,
+				CommandAllowlist: map[string]api.AllowedCommand{
+					"logs":   {Exec: "/bin/sh", Args: print3KB, MaxOutputKB: 4},
+					"status": {Exec: "/bin/sh", Args: print3KB},
+				},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "logs"})
+	if err != nil || !resp.Ok || len(resp.Stdout) != 3000 {
+		t.Fatalf("expected full 3000 bytes under the per-command limit, got %d bytes: %+v err=%v", len(resp.Stdout), resp.Error, err)
+	}
+	resp, err = exec.Execute(context.Background(), api.CommandRequest{Command: "status"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasSuffix(resp.Stdout, "[truncated]\n") || len(resp.Stdout) > 1024+len("\n[truncated]\n") {
+		t.Fatalf("expected global 1KB limit without an override, got %d bytes", len(resp.Stdout))
+	}
+}
+
+func TestRunAllowedCommandUsesWorkDir(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("eval symlinks: %v", err)
+	}
+	resp := runAllowedCommand(context.Background(), api.AllowedCommand{Exec: "/bin/pwd", WorkDir: dir}, "", "", nil, 8)
+	if !resp.Ok || strings.TrimSpace(resp.Stdout) != dir {
+		t.Fatalf("expected command to run in %s, got %+v", dir, resp)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	resp = runAllowedCommand(context.Background(), api.AllowedCommand{Exec: "/bin/pwd"}, "", "", nil, 8)
+	if got := strings.TrimSpace(resp.Stdout); got != cwd {
+		t.Fatalf("expected default working directory %s, got %q", cwd, got)
+	}
+}
+
+func TestRunAllowedCommandRestrictsPath(t *testing.T) {
+	resp := runAllowedCommand(context.Background(), api.AllowedCommand{Exec: "echo", Args: []string{"hi"}}, "", "", nil, 8)
+	if resp.Ok || resp.Error != "exec path must be absolute: echo" {
+		t.Fatalf("expected relative exec to be rejected, got %+v", resp)
+	}
+	resp = runAllowedCommand(context.Background(), api.AllowedCommand{Exec: "/bin/sh", Args: []string{"-c", `printf %s "$PATH"`}}, "", "/opt/tools", nil, 8)
+	if !resp.Ok || resp.Stdout != "/opt/tools" {
+		t.Fatalf("expected PATH to be the configured exec_path, got %+v", resp)
+	}
+	resp = runAllowedCommand(context.Background(), api.AllowedCommand{Exec: "/bin/sh", Args: []string{"-c", `printf %s "$PATH"`}}, "", "", nil, 8)
+	if resp.Stdout != defaultExecPath {
+		t.Fatalf("expected default PATH, got %q", resp.Stdout)
+	}
+}
+
+func TestRunAllowedCommandPassesOnlyListedEnv(t *testing.T) {
+	t.Setenv("SHELLY_TEST_SECRET", "s3cret")
+	t.Setenv("TZ", "UTC")
+	show := api.AllowedCommand{Exec: "/bin/sh", Args: []string{"-c", `printf '%s|%s' "$SHELLY_TEST_SECRET" "$TZ"`}}
+	resp := runAllowedCommand(context.Background(), show, "", "", nil, 8)
+	if !resp.Ok || resp.Stdout != "|UTC" {
+		t.Fatalf("expected only the default passthrough variables, got %+v", resp)
+	}
+	resp = runAllowedCommand(context.Background(), show, "", "", []string{"SHELLY_TEST_SECRET"}, 8)
+	if !resp.Ok || resp.Stdout != "s3cret|" {
+		t.Fatalf("expected env_passthrough to replace the defaults, got %+v", resp)
+	}
+}
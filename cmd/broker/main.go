@@ -3,19 +3,26 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"personal_ai/internal/api"
+	"personal_ai/internal/version"
 )
 
 type BrokerConfig struct {
@@ -25,6 +32,8 @@ type BrokerConfig struct {
 	LLM        LLMConfig       `json:"llm"`
 	Policy     PolicyConfig    `json:"policy"`
 	Audit      AuditConfig     `json:"audit"`
+	// StrictConfig turns startup warnings such as bad exec paths into errors.
+	StrictConfig bool `json:"strict_config"`
 }
 
 type TelegramConfig struct {
@@ -32,45 +41,188 @@ type TelegramConfig struct {
 	Mode            string  `json:"mode"`
 	WebhookPath     string  `json:"webhook_path"`
 	AllowedUserIDs  []int64 `json:"allowed_user_ids"`
+	AdminUserIDs    []int64 `json:"admin_user_ids"`
 	PollIntervalSec int     `json:"poll_interval_sec"`
+	OnPollConflict  string  `json:"on_poll_conflict"`
+	// UnauthorizedBehavior is "reply", "silent", or "log_only".
+	UnauthorizedBehavior string `json:"unauthorized_behavior"`
+	// WebhookPathPrefix is an external prefix a reverse proxy leaves on the
+	// path, e.g. "/bots/shelly".
+	WebhookPathPrefix string `json:"webhook_path_prefix"`
+	TrustProxyHeaders bool   `json:"trust_proxy_headers"`
+	OffsetFile        string `json:"offset_file"`
+	TypingIndicator   bool   `json:"typing_indicator"`
+	APIBaseURL        string `json:"api_base_url"`
+	// PolledUpdateTypes is sent as allowed_updates to getUpdates.
+	PolledUpdateTypes []string `json:"polled_update_types"`
+	ChatQueueDepth    int      `json:"chat_queue_depth"`
+	// HandleEdits runs edited messages as new commands.
+	HandleEdits     bool `json:"handle_edits"`
+	SendMaxAttempts int  `json:"send_max_attempts"`
+	// WelcomeMessage answers /start; empty uses defaultWelcomeMessage.
+	WelcomeMessage string `json:"welcome_message"`
+	// MaxWebhookBodyBytes rejects larger webhook requests with 413.
+	MaxWebhookBodyBytes int64 `json:"max_webhook_body_bytes"`
+	// AdminChatID, when set, receives a notice about every failed command,
+	// at most AdminNotifyPerMinute (default 10) a minute.
+	AdminChatID          int64 `json:"admin_chat_id"`
+	AdminNotifyPerMinute int   `json:"admin_notify_per_minute"`
+	// MaxConcurrentChats caps updates processed at once across all chats;
+	// up to MaxQueuedChats more wait and the rest are dropped.
+	MaxConcurrentChats int `json:"max_concurrent_chats"`
+	MaxQueuedChats     int `json:"max_queued_chats"`
+	// RequestTimeoutSec bounds handling one update, LLM and command
+	// included; zero means no deadline.
+	RequestTimeoutSec int `json:"request_timeout_sec"`
+	// Bots, when set, replaces the top-level bot token with several bots
+	// routed by webhook path.
+	Bots []BotConfig `json:"bots"`
 }
 
 type ExecutionConfig struct {
-	Mode             string               `json:"mode"`
-	ForwardURL       string               `json:"forward_url"`
-	ForwardAuthToken string               `json:"forward_auth_token"`
-	Local            LocalExecutionConfig `json:"local"`
+	Mode             string `json:"mode"`
+	ForwardURL       string `json:"forward_url"`
+	ForwardAuthToken string `json:"forward_auth_token"`
+	// ForwardGzip compresses request bodies sent to the agent; responses are
+	// always accepted gzipped.
+	ForwardGzip bool                 `json:"forward_gzip"`
+	Local       LocalExecutionConfig `json:"local"`
+	// CommandRouting maps a command to "local" or "forward", overriding Mode
+	// for that command.
+	CommandRouting map[string]string `json:"command_routing"`
 }
 
 type LocalExecutionConfig struct {
-	DefaultTimeoutSec int                           `json:"default_timeout_sec"`
-	MaxOutputKB       int                           `json:"max_output_kb"`
-	BaseDir           string                        `json:"base_dir"`
-	DynamicAllowlist  []string                      `json:"dynamic_allowlist"`
-	CommandAllowlist  map[string]api.AllowedCommand `json:"command_allowlist"`
+	DefaultTimeoutSec   int                           `json:"default_timeout_sec"`
+	MaxOutputKB         int                           `json:"max_output_kb"`
+	BaseDir             string                        `json:"base_dir"`
+	DynamicAllowlist    []string                      `json:"dynamic_allowlist"`
+	DynamicBlocklist    []string                      `json:"dynamic_blocklist"`
+	CommandAllowlist    map[string]api.AllowedCommand `json:"command_allowlist"`
+	DynamicDescriptions map[string]string             `json:"dynamic_descriptions"`
+	ChatBaseDirs        map[int64]string              `json:"chat_base_dirs"`
+	SharedChatCWD       bool                          `json:"shared_chat_cwd"`
+	CWDStateFile        string                        `json:"cwd_state_file"`
+	MaxConcurrent       int                           `json:"max_concurrent"`
+	MaxQueued           int                           `json:"max_queued"`
+	MaxArgs             int                           `json:"max_args"`
+	MaxArgBytes         int                           `json:"max_arg_bytes"`
+	MaxUploadKB         int                           `json:"max_upload_kb"`
+	ReadOnly            bool                          `json:"read_only"`
+	ExecPath            string                        `json:"exec_path"`
+	EnvPassthrough      []string                      `json:"env_passthrough"`
+	AllowedLsFlags      []string                      `json:"allowed_ls_flags"`
+	DefaultLsFlags      []string                      `json:"default_ls_flags"`
+	DateFormat          string                        `json:"date_format"`
+	EnvAllowlist        []string                      `json:"env_allowlist"`
+	TreeMaxDepth        int                           `json:"tree_max_depth"`
+	TreeMaxEntries      int                           `json:"tree_max_entries"`
+	FindMaxDepth        int                           `json:"find_max_depth"`
+	FindMaxResults      int                           `json:"find_max_results"`
+	FetchAllowedHosts   []string                      `json:"fetch_allowed_hosts"`
+	PingAllowedHosts    []string                      `json:"ping_allowed_hosts"`
+	PingPath            string                        `json:"ping_path"`
+	PingCount           int                           `json:"ping_count"`
+	PingMaxCount        int                           `json:"ping_max_count"`
+	ManagedServices     map[string]api.AllowedCommand `json:"managed_services"`
 }
 
 type LLMConfig struct {
-	Enabled             bool    `json:"enabled"`
-	APIKey              string  `json:"api_key"`
-	Model               string  `json:"model"`
-	TimeoutSec          int     `json:"timeout_sec"`
-	ConfidenceThreshold float64 `json:"confidence_threshold"`
+	Enabled              bool               `json:"enabled"`
+	APIKey               string             `json:"api_key"`
+	Model                string             `json:"model"`
+	TimeoutSec           int                `json:"timeout_sec"`
+	ConfidenceThreshold  float64            `json:"confidence_threshold"`
+	Retries              int                `json:"retries"`
+	SummaryMaxInputKB    int                `json:"summary_max_input_kb"`
+	IntentConfidence     map[string]float64 `json:"intent_confidence"`
+	RateLimitPerMinute   int                `json:"rate_limit_per_minute"`
+	SystemPromptTemplate string             `json:"system_prompt_template"`
+	// UserModels and ChatModels override Model for a Telegram user or chat;
+	// a user override wins over a chat one.
+	UserModels map[int64]string `json:"user_models"`
+	ChatModels map[int64]string `json:"chat_models"`
 }
 
 type PolicyConfig struct {
-	RateLimitPerMinute int      `json:"rate_limit_per_minute"`
-	CommandAllowlist   []string `json:"command_allowlist"`
-	CommandBlocklist   []string `json:"command_blocklist"`
+	// RateLimitPerMinute is the number of commands allowed per
+	// RateLimitWindowSec, which defaults to a minute.
+	RateLimitPerMinute int                     `json:"rate_limit_per_minute"`
+	RateLimitWindowSec int                     `json:"rate_limit_window_sec"`
+	CommandAllowlist   []string                `json:"command_allowlist"`
+	CommandBlocklist   []string                `json:"command_blocklist"`
+	SanitizeUTF8       *bool                   `json:"sanitize_utf8"`
+	ConfirmCommands    []string                `json:"confirm_commands"`
+	IntentPolicy       map[string]IntentPolicy `json:"intent_policy"`
+	// RedactPatterns are regexes masked in output and audit messages.
+	RedactPatterns []string `json:"redact_patterns"`
+	// MaxBatchCommands caps the commands joined by && or ; in one message.
+	MaxBatchCommands int `json:"max_batch_commands"`
+	// WatchMinIntervalSec and WatchMaxDurationSec bound the watch builtin.
+	WatchMinIntervalSec int `json:"watch_min_interval_sec"`
+	WatchMaxDurationSec int `json:"watch_max_duration_sec"`
+	// ReactInsteadOfReply lists commands acknowledged with a reaction on the
+	// user's message, rather than a reply, when they print nothing.
+	ReactInsteadOfReply []string `json:"react_instead_of_reply"`
+	// OutputFormats maps a command to plain, code, or table output.
+	OutputFormats map[string]string `json:"output_formats"`
+}
+
+type IntentPolicy struct {
+	MaxArgs      *int     `json:"max_args"`
+	AllowedFlags []string `json:"allowed_flags"`
+	AllowPaths   bool     `json:"allow_paths"`
+}
+
+// confidenceThreshold returns the minimum confidence for routing to intent,
+// preferring a per-intent override over the global threshold.
+func (l LLMConfig) confidenceThreshold(intent string) float64 {
+	if t, ok := l.IntentConfidence[intent]; ok {
+		return t
+	}
+	return l.ConfidenceThreshold
+}
+
+// sanitizeUTF8 reports whether replies should have invalid UTF-8 replaced.
+// It defaults to true when unset.
+func (p PolicyConfig) sanitizeUTF8() bool {
+	return p.SanitizeUTF8 == nil || *p.SanitizeUTF8
+}
+
+// sanitizeReply replaces invalid UTF-8 in text unless sanitize_utf8 is off.
+func (p PolicyConfig) sanitizeReply(text string) string {
+	if !p.sanitizeUTF8() {
+		return text
+	}
+	return strings.ToValidUTF8(text, "\uFFFD")
+}
+
+// rateLimitWindow is the window rate_limit_per_minute counts over.
+func (p PolicyConfig) rateLimitWindow() time.Duration {
+	if p.RateLimitWindowSec <= 0 {
+		return time.Minute
+	}
+	return time.Duration(p.RateLimitWindowSec) * time.Second
 }
 
 type AuditConfig struct {
 	FilePath string `json:"file_path"`
+	// Sink is "file" (default, writes FilePath), "syslog", or "stdout".
+	Sink string `json:"sink"`
 }
 
 type TelegramUpdate struct {
-	UpdateID int64            `json:"update_id"`
-	Message  *TelegramMessage `json:"message"`
+	UpdateID      int64                  `json:"update_id"`
+	Message       *TelegramMessage       `json:"message"`
+	EditedMessage *TelegramMessage       `json:"edited_message"`
+	CallbackQuery *TelegramCallbackQuery `json:"callback_query"`
+}
+
+type TelegramCallbackQuery struct {
+	ID      string           `json:"id"`
+	From    TelegramUser     `json:"from"`
+	Message *TelegramMessage `json:"message"`
+	Data    string           `json:"data"`
 }
 
 type TelegramUpdatesResponse struct {
@@ -83,7 +235,17 @@ type TelegramMessage struct {
 	From      TelegramUser `json:"from"`
 	Chat      TelegramChat `json:"chat"`
 	Date      int64        `json:"date"`
+	EditDate  int64        `json:"edit_date"`
 	Text      string       `json:"text"`
+	// Document is set when the user sends a file instead of text.
+	Document *TelegramDocument `json:"document"`
+}
+
+type TelegramDocument struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	FileSize int64  `json:"file_size"`
 }
 
 type TelegramUser struct {
@@ -109,14 +271,14 @@ func newRateLimiter(window time.Duration, max int) *rateLimiter {
 }
 
 func (r *rateLimiter) allow(userID int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if r.max <= 0 {
 		return true
 	}
 	now := time.Now()
 	cut := now.Add(-r.window)
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
 	list := r.stamp[userID]
 	out := list[:0]
 	for _, t := range list {
@@ -133,7 +295,81 @@ func (r *rateLimiter) allow(userID int64) bool {
 	return true
 }
 
-func loadConfig(path string) (*BrokerConfig, error) {
+// setLimit changes the window and maximum while keeping each user's recent
+// requests, so a config reload does not reset anyone's budget.
+func (r *rateLimiter) setLimit(window time.Duration, max int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.window = window
+	r.max = max
+}
+
+// limit returns the current window and maximum; config reloads change them
+// under mu.
+func (r *rateLimiter) limit() (time.Duration, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.window, r.max
+}
+
+// expandConfigSecrets resolves ${NAME} references in the secret-bearing
+// fields so tokens can live in the environment instead of the JSON file.
+func expandConfigSecrets(cfg *BrokerConfig) error {
+	type field struct {
+		name  string
+		value *string
+	}
+	fields := []field{
+		{"telegram.bot_token", &cfg.Telegram.BotToken},
+		{"llm.api_key", &cfg.LLM.APIKey},
+		{"execution.forward_url", &cfg.Execution.ForwardURL},
+		{"execution.forward_auth_token", &cfg.Execution.ForwardAuthToken},
+	}
+	for i := range cfg.Telegram.Bots {
+		fields = append(fields, field{fmt.Sprintf("telegram.bots[%d].bot_token", i), &cfg.Telegram.Bots[i].BotToken})
+	}
+	for _, f := range fields {
+		v, err := expandEnvRefs(*f.value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.name, err)
+		}
+		*f.value = v
+	}
+	return nil
+}
+
+// expandEnvRefs replaces each ${NAME} in value with the environment
+// variable NAME, failing when it is unset. Other text, including a lone $,
+// is kept as is.
+func expandEnvRefs(value string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			b.WriteString(value)
+			return b.String(), nil
+		}
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			b.WriteString(value)
+			return b.String(), nil
+		}
+		name := value[start+2 : start+end]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		b.WriteString(value[:start])
+		b.WriteString(env)
+		value = value[start+end+1:]
+	}
+}
+
+// loadConfig reads the config at path and merges each overlay over it in
+// order before applying defaults and validating. An overlay replaces the
+// fields it sets: nested objects and maps merge key by key, while arrays and
+// map values such as an allowlist entry are replaced whole.
+func loadConfig(path string, overlays ...string) (*BrokerConfig, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -142,6 +378,18 @@ func loadConfig(path string) (*BrokerConfig, error) {
 	if err := json.Unmarshal(b, &cfg); err != nil {
 		return nil, err
 	}
+	for _, overlay := range overlays {
+		b, err := os.ReadFile(overlay)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return nil, fmt.Errorf("overlay %s: %v", overlay, err)
+		}
+	}
+	if err := expandConfigSecrets(&cfg); err != nil {
+		return nil, err
+	}
 	if cfg.ListenAddr == "" {
 		cfg.ListenAddr = "127.0.0.1:8081"
 	}
@@ -151,6 +399,34 @@ func loadConfig(path string) (*BrokerConfig, error) {
 	if cfg.Telegram.WebhookPath == "" {
 		cfg.Telegram.WebhookPath = "/telegram/webhook"
 	}
+	cfg.Telegram.APIBaseURL = strings.TrimRight(strings.TrimSpace(cfg.Telegram.APIBaseURL), "/")
+	if cfg.Telegram.APIBaseURL == "" {
+		cfg.Telegram.APIBaseURL = defaultTelegramAPIBaseURL
+	}
+	cfg.Telegram.PolledUpdateTypes = normalizeUpdateTypes(cfg.Telegram.PolledUpdateTypes)
+	if len(cfg.Telegram.PolledUpdateTypes) == 0 {
+		cfg.Telegram.PolledUpdateTypes = []string{"message"}
+	}
+	// Confirmation buttons arrive as callback queries.
+	if len(cfg.Policy.ConfirmCommands) > 0 && !isCommandAllowed("callback_query", cfg.Telegram.PolledUpdateTypes) {
+		cfg.Telegram.PolledUpdateTypes = append(cfg.Telegram.PolledUpdateTypes, "callback_query")
+	}
+	if cfg.Telegram.HandleEdits && !isCommandAllowed("edited_message", cfg.Telegram.PolledUpdateTypes) {
+		cfg.Telegram.PolledUpdateTypes = append(cfg.Telegram.PolledUpdateTypes, "edited_message")
+	}
+	if _, err := compileRedactPatterns(cfg.Policy.RedactPatterns); err != nil {
+		return nil, err
+	}
+	formats, err := normalizeOutputFormats(cfg.Policy.OutputFormats)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Policy.OutputFormats = formats
+	sink, err := normalizeAuditSink(cfg.Audit.Sink)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Audit.Sink = sink
 	if cfg.Execution.Mode == "" {
 		if strings.TrimSpace(cfg.Execution.ForwardURL) == "" {
 			cfg.Execution.Mode = "local"
@@ -161,23 +437,115 @@ func loadConfig(path string) (*BrokerConfig, error) {
 	if cfg.Policy.RateLimitPerMinute <= 0 {
 		cfg.Policy.RateLimitPerMinute = 20
 	}
+	if cfg.Policy.RateLimitWindowSec <= 0 {
+		cfg.Policy.RateLimitWindowSec = 60
+	}
 	if cfg.Telegram.PollIntervalSec <= 0 {
 		cfg.Telegram.PollIntervalSec = 3
 	}
+	onConflict, err := normalizeOnPollConflict(cfg.Telegram.OnPollConflict)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Telegram.OnPollConflict = onConflict
+	if cfg.Telegram.SendMaxAttempts <= 0 {
+		cfg.Telegram.SendMaxAttempts = 3
+	}
+	behavior, err := normalizeUnauthorizedBehavior(cfg.Telegram.UnauthorizedBehavior)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Telegram.UnauthorizedBehavior = behavior
+	if err := normalizeBots(cfg.Telegram.Bots); err != nil {
+		return nil, err
+	}
 	if cfg.LLM.TimeoutSec <= 0 {
 		cfg.LLM.TimeoutSec = 15
 	}
 	if cfg.LLM.ConfidenceThreshold <= 0 {
 		cfg.LLM.ConfidenceThreshold = 0.7
 	}
+	if len(cfg.LLM.IntentConfidence) > 0 {
+		thresholds := make(map[string]float64, len(cfg.LLM.IntentConfidence))
+		for intent, t := range cfg.LLM.IntentConfidence {
+			if t < 0 || t > 1 {
+				return nil, fmt.Errorf("llm.intent_confidence.%s: must be between 0 and 1", intent)
+			}
+			thresholds[strings.ToLower(strings.TrimSpace(intent))] = t
+		}
+		cfg.LLM.IntentConfidence = thresholds
+	}
+	if cfg.LLM.Retries == 0 {
+		cfg.LLM.Retries = 2
+	}
+	if _, err := parseSystemPrompt(cfg.LLM.SystemPromptTemplate); err != nil {
+		return nil, fmt.Errorf("llm.system_prompt_template: %v", err)
+	}
+	if cfg.LLM.SummaryMaxInputKB <= 0 {
+		cfg.LLM.SummaryMaxInputKB = 4
+	}
 	if cfg.Execution.Local.DefaultTimeoutSec <= 0 {
 		cfg.Execution.Local.DefaultTimeoutSec = 10
 	}
 	if cfg.Execution.Local.MaxOutputKB <= 0 {
 		cfg.Execution.Local.MaxOutputKB = 8
 	}
-	if len(cfg.Policy.CommandAllowlist) == 0 && (len(cfg.Execution.Local.CommandAllowlist) > 0 || len(cfg.Execution.Local.DynamicAllowlist) > 0) {
-		cfg.Policy.CommandAllowlist = buildAllowlistFromLocal(cfg.Execution.Local.CommandAllowlist, cfg.Execution.Local.DynamicAllowlist)
+	if cfg.Execution.Local.MaxConcurrent > 0 && cfg.Execution.Local.MaxQueued <= 0 {
+		cfg.Execution.Local.MaxQueued = 32
+	}
+	if cfg.Execution.Local.MaxArgs <= 0 {
+		cfg.Execution.Local.MaxArgs = defaultMaxArgs
+	}
+	if cfg.Execution.Local.MaxArgBytes <= 0 {
+		cfg.Execution.Local.MaxArgBytes = defaultMaxArgBytes
+	}
+	if cfg.Execution.Local.MaxUploadKB <= 0 {
+		cfg.Execution.Local.MaxUploadKB = defaultMaxUploadKB
+	}
+	routing, err := normalizeCommandRouting(cfg.Execution.CommandRouting)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Execution.CommandRouting = routing
+	lsFlags, err := normalizeLsFlags(cfg.Execution.Local.AllowedLsFlags)
+	if err != nil {
+		return nil, fmt.Errorf("execution.local.allowed_ls_flags: %v", err)
+	}
+	cfg.Execution.Local.AllowedLsFlags = lsFlags
+	defaultFlags, err := normalizeLsFlags(cfg.Execution.Local.DefaultLsFlags)
+	if err != nil {
+		return nil, fmt.Errorf("execution.local.default_ls_flags: %v", err)
+	}
+	for _, f := range defaultFlags {
+		if !isAllowedLsFlag(f, lsFlags) {
+			return nil, fmt.Errorf("execution.local.default_ls_flags: %s is not an allowed ls flag", f)
+		}
+	}
+	cfg.Execution.Local.DefaultLsFlags = defaultFlags
+	if _, err := parseHostAllowlist(cfg.Execution.Local.FetchAllowedHosts); err != nil {
+		return nil, fmt.Errorf("execution.local.fetch_allowed_hosts: %v", err)
+	}
+	if _, err := parseHostAllowlist(cfg.Execution.Local.PingAllowedHosts); err != nil {
+		return nil, fmt.Errorf("execution.local.ping_allowed_hosts: %v", err)
+	}
+	if cfg.Execution.Local.PingPath != "" && !filepath.IsAbs(cfg.Execution.Local.PingPath) {
+		return nil, fmt.Errorf("execution.local.ping_path must be absolute: %s", cfg.Execution.Local.PingPath)
+	}
+	if err := normalizeChatBaseDirs(cfg.Execution.Local.BaseDir, cfg.Execution.Local.ChatBaseDirs); err != nil {
+		return nil, fmt.Errorf("execution.local.%v", err)
+	}
+	if len(cfg.Policy.CommandAllowlist) == 0 && (len(cfg.Execution.Local.CommandAllowlist) > 0 || len(cfg.Execution.Local.DynamicAllowlist) > 0 || len(cfg.Execution.Local.ManagedServices) > 0) {
+		dynamic := append([]string{}, cfg.Execution.Local.DynamicAllowlist...)
+		if len(cfg.Execution.Local.ManagedServices) > 0 {
+			dynamic = append(dynamic, serviceCommand)
+		}
+		// Commands routed to the agent are not in the local allowlists.
+		for cmd, mode := range cfg.Execution.CommandRouting {
+			if mode == "forward" {
+				dynamic = append(dynamic, cmd)
+			}
+		}
+		cfg.Policy.CommandAllowlist = buildAllowlistFromLocal(cfg.Execution.Local.CommandAllowlist, dynamic)
 	}
 	return &cfg, nil
 }
@@ -216,6 +584,23 @@ func isCommandAllowed(cmd string, allow []string) bool {
 	return false
 }
 
+// isCommandAllowlisted reports whether cmd is in policy.command_allowlist,
+// either by name or by a glob pattern such as "deploy-*". Other command
+// lists match names exactly with isCommandAllowed.
+func isCommandAllowlisted(cmd string, allow []string) bool {
+	for _, c := range allow {
+		if strings.EqualFold(cmd, c) {
+			return true
+		}
+		if strings.ContainsAny(c, "*?[") {
+			if ok, _ := path.Match(strings.ToLower(c), strings.ToLower(cmd)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func isCommandBlocked(cmd string, block []string) bool {
 	for _, c := range block {
 		if strings.EqualFold(cmd, c) {
@@ -231,10 +616,19 @@ type Executor interface {
 
 type TelegramSender interface {
 	Send(chatID int64, text string) error
+	SendEntities(chatID int64, text string, entities []messageEntity) error
+	SendForEdit(chatID int64, text string, entities []messageEntity) (int64, error)
+	EditMessage(chatID, messageID int64, text string, entities []messageEntity) error
+	SendKeyboard(chatID int64, text string, keyboard [][]TelegramInlineButton) error
+	AnswerCallback(callbackID string, text string) error
+	SendChatAction(chatID int64, action string) error
+	SetMessageReaction(chatID, messageID int64, emoji string) error
+	DownloadFile(fileID string, maxBytes int64) ([]byte, error)
 }
 
 type LLMClient interface {
-	Map(ctx context.Context, userText string, allowlist []string) (*api.LLMDecision, error)
+	Map(ctx context.Context, chatID, userID int64, userText string, allowlist []string) (*api.LLMDecision, error)
+	Summarize(ctx context.Context, cmd string, output string) (string, error)
 }
 
 type AuditLogger interface {
@@ -243,50 +637,111 @@ type AuditLogger interface {
 
 type AuditEvent struct {
 	Timestamp time.Time
+	RequestID string
+	ClientIP  string
 	Type      string
 	UserID    int64
+	UserName  string
 	ChatID    int64
 	Command   string
 	Outcome   string
 	Message   string
+	// Args and ExitCode are set on execution events; Args are redacted.
+	Args     []string
+	ExitCode int
+	// Reason is the executor's rejection code, such as path_outside_base.
+	Reason string
 }
 
 type pipelineContext struct {
-	cfg    *BrokerConfig
-	rl     *rateLimiter
-	exec   Executor
-	update TelegramUpdate
-	msg    *TelegramMessage
-	userID int64
-	chatID int64
-	cmd    string
-	args   []string
-	sender TelegramSender
-	llm    LLMClient
-	audit  AuditLogger
+	cfg       *BrokerConfig
+	rl        *rateLimiter
+	llmRL     *rateLimiter
+	adminRL   *rateLimiter
+	exec      Executor
+	update    TelegramUpdate
+	msg       *TelegramMessage
+	userID    int64
+	userName  string
+	chatID    int64
+	cmd       string
+	args      []string
+	sender    TelegramSender
+	llm       LLMClient
+	audit     AuditLogger
+	confirm   *confirmStore
+	clarify   *clarifyStore
+	running   *runningCommands
+	history   *commandHistory
+	redactor  outputRedactor
+	confirmed bool
+	requestID string
+	fromLLM   bool
+	clientIP  string
+	// reqCtx carries the telegram.request_timeout_sec deadline.
+	reqCtx context.Context
+	// replies, when set, collects replies instead of sending them, and
+	// outcome holds the last executed command's history outcome; both
+	// serve batch messages.
+	replies *[]string
+	outcome string
 }
 
 type pipelineStage func(*pipelineContext) bool
 
 type Broker struct {
-	cfg    *BrokerConfig
-	rl     *rateLimiter
-	exec   Executor
-	sender TelegramSender
-	llm    LLMClient
-	audit  AuditLogger
+	// mu guards cfg, exec, llm, and redactor, which a config reload swaps.
+	mu       sync.RWMutex
+	cfg      *BrokerConfig
+	rl       *rateLimiter
+	llmRL    *rateLimiter
+	adminRL  *rateLimiter
+	exec     Executor
+	sender   TelegramSender
+	llm      LLMClient
+	audit    AuditLogger
+	confirm  *confirmStore
+	clarify  *clarifyStore
+	recent   *recentIDs
+	chats    *chatQueue
+	inflight *updateLimiter
+	running  *runningCommands
+	history  *commandHistory
+	redactor outputRedactor
 }
 
 func newBroker(cfg *BrokerConfig, rl *rateLimiter, exec Executor, sender TelegramSender, llm LLMClient, audit AuditLogger) *Broker {
-	return &Broker{cfg: cfg, rl: rl, exec: exec, sender: sender, llm: llm, audit: audit}
+	// loadConfig has already rejected invalid patterns.
+	redactor, err := compileRedactPatterns(cfg.Policy.RedactPatterns)
+	if err != nil {
+		log.Printf("redact patterns: %v", err)
+	}
+	return &Broker{
+		cfg:      cfg,
+		rl:       rl,
+		llmRL:    newRateLimiter(time.Minute, cfg.LLM.RateLimitPerMinute),
+		adminRL:  newRateLimiter(time.Minute, cfg.Telegram.adminNotifyPerMinute()),
+		exec:     exec,
+		sender:   sender,
+		llm:      llm,
+		audit:    audit,
+		confirm:  newConfirmStore(),
+		clarify:  newClarifyStore(),
+		recent:   newRecentIDs(recentUpdatesSize),
+		chats:    newChatQueue(cfg.Telegram.ChatQueueDepth),
+		inflight: newUpdateLimiter(cfg.Telegram.MaxConcurrentChats, cfg.Telegram.MaxQueuedChats),
+		running:  newRunningCommands(),
+		history:  newCommandHistory(historySize),
+		redactor: redactor,
+	}
 }
 
 func validateExecutionConfig(cfg *BrokerConfig) error {
 	mode := strings.ToLower(strings.TrimSpace(cfg.Execution.Mode))
 	switch mode {
 	case "local":
-		if len(cfg.Execution.Local.CommandAllowlist) == 0 && len(cfg.Execution.Local.DynamicAllowlist) == 0 {
-			return fmt.Errorf("local mode requires execution.local.command_allowlist or execution.local.dynamic_allowlist")
+		if len(cfg.Execution.Local.CommandAllowlist) == 0 && len(cfg.Execution.Local.DynamicAllowlist) == 0 && len(cfg.Execution.Local.ManagedServices) == 0 {
+			return fmt.Errorf("local mode requires execution.local.command_allowlist, execution.local.dynamic_allowlist, or execution.local.managed_services")
 		}
 	case "forward":
 		if strings.TrimSpace(cfg.Execution.ForwardURL) == "" {
@@ -295,22 +750,143 @@ func validateExecutionConfig(cfg *BrokerConfig) error {
 	default:
 		return fmt.Errorf("unsupported execution.mode: %s", cfg.Execution.Mode)
 	}
+	if mode != "forward" && routesTo(cfg.Execution.CommandRouting, "forward") && strings.TrimSpace(cfg.Execution.ForwardURL) == "" {
+		return fmt.Errorf("execution.forward_url required when execution.command_routing forwards commands")
+	}
+	if !cfg.LLM.Enabled {
+		for name, c := range cfg.Execution.Local.CommandAllowlist {
+			if c.Summarize {
+				return fmt.Errorf("execution.local.command_allowlist.%s: summarize requires llm.enabled", name)
+			}
+		}
+	}
+	if mode == "local" || routesTo(cfg.Execution.CommandRouting, "local") {
+		if err := checkWorkDirs("execution.local.command_allowlist", cfg.Execution.Local.CommandAllowlist); err != nil {
+			return err
+		}
+		problems := append(execPathProblems("execution.local.command_allowlist", cfg.Execution.Local.CommandAllowlist),
+			execPathProblems("execution.local.managed_services", cfg.Execution.Local.ManagedServices)...)
+		if err := reportExecPaths(cfg.StrictConfig, problems); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execPathProblems lists allowlist entries whose exec is not an absolute path
+// to an existing executable file, sorted for stable messages.
+func execPathProblems(field string, cmds map[string]api.AllowedCommand) []string {
+	var problems []string
+	for name, c := range cmds {
+		if problem := checkExecPath(c.Exec); problem != "" {
+			problems = append(problems, fmt.Sprintf("%s.%s: %s %s", field, name, c.Exec, problem))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func checkExecPath(path string) string {
+	if !filepath.IsAbs(path) {
+		return "is not an absolute path"
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "does not exist"
+	}
+	if info.IsDir() || info.Mode().Perm()&0o111 == 0 {
+		return "is not executable"
+	}
+	return ""
+}
+
+// checkWorkDirs rejects allowlist entries whose work_dir is not an absolute
+// path to an existing directory.
+func checkWorkDirs(field string, cmds map[string]api.AllowedCommand) error {
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dir := cmds[name].WorkDir
+		if dir == "" {
+			continue
+		}
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("%s.%s.work_dir must be an absolute path", field, name)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("%s.%s.work_dir %s is not a directory", field, name, dir)
+		}
+	}
+	return nil
+}
+
+// reportExecPaths fails with every offending exec path under strict_config
+// and only logs them otherwise.
+func reportExecPaths(strict bool, problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	msg := "invalid exec paths: " + strings.Join(problems, "; ")
+	if strict {
+		return errors.New(msg)
+	}
+	log.Printf("warning: %s", msg)
 	return nil
 }
 
 func buildExecutor(cfg *BrokerConfig) Executor {
+	return buildExecutorFrom(cfg, nil)
+}
+
+// buildExecutorFrom builds the executor for cfg. A non-nil prev hands its
+// working directories and exec queue to the new local executor, so a reload
+// neither re-reads cwd_state_file nor forgets commands still running.
+func buildExecutorFrom(cfg *BrokerConfig, prev *localExecutor) Executor {
 	mode := strings.ToLower(strings.TrimSpace(cfg.Execution.Mode))
+	if !routesTo(cfg.Execution.CommandRouting, otherMode(mode)) {
+		return buildModeExecutor(cfg, mode, prev)
+	}
+	executors := map[string]Executor{
+		"local":   buildModeExecutor(cfg, "local", prev),
+		"forward": buildModeExecutor(cfg, "forward", prev),
+	}
+	routes := make(map[string]Executor, len(cfg.Execution.CommandRouting))
+	for cmd, m := range cfg.Execution.CommandRouting {
+		routes[cmd] = executors[m]
+	}
+	return &routingExecutor{fallback: executors[mode], routes: routes}
+}
+
+func buildModeExecutor(cfg *BrokerConfig, mode string, prev *localExecutor) Executor {
 	if mode == "local" {
+		if prev != nil {
+			return &localExecutor{cfg: cfg, chatCWD: prev.chatCWD, queue: prev.queue}
+		}
 		return newLocalExecutor(cfg)
 	}
 	return newRemoteExecutor(cfg)
 }
 
+func otherMode(mode string) string {
+	if mode == "local" {
+		return "forward"
+	}
+	return "local"
+}
+
 func main() {
 	configPath := flag.String("config", "configs/broker.json", "path to broker config json")
+	overlayPath := flag.String("overlay", "", "optional config json merged over -config")
 	flag.Parse()
+	var overlays []string
+	if *overlayPath != "" {
+		overlays = append(overlays, *overlayPath)
+	}
 
-	cfg, err := loadConfig(*configPath)
+	cfg, err := loadConfig(*configPath, overlays...)
 	if err != nil {
 		log.Fatalf("load config: %v", err)
 	}
@@ -318,40 +894,40 @@ func main() {
 		log.Fatalf("config validation: %v", err)
 	}
 
-	rl := newRateLimiter(time.Minute, cfg.Policy.RateLimitPerMinute)
 	exec := buildExecutor(cfg)
-	sender := newTelegramSender(cfg.Telegram.BotToken)
 	llm := newOpenAIClient(cfg.LLM)
 	audit := newAuditLogger(cfg.Audit)
-	broker := newBroker(cfg, rl, exec, sender, llm, audit)
+	brokers := []*Broker{}
+	for _, tenant := range tenantConfigs(cfg) {
+		rl := newRateLimiter(tenant.Policy.rateLimitWindow(), tenant.Policy.RateLimitPerMinute)
+		sender := newTelegramSender(tenant.Telegram.APIBaseURL, tenant.Telegram.BotToken, tenant.Telegram.SendMaxAttempts)
+		brokers = append(brokers, newBroker(tenant, rl, exec, sender, llm, audit))
+	}
+	// The in-flight ceiling spans every bot, not each one separately.
+	inflight := newUpdateLimiter(cfg.Telegram.MaxConcurrentChats, cfg.Telegram.MaxQueuedChats)
+	for _, b := range brokers {
+		b.inflight = inflight
+	}
 
+	reloadOnSIGHUP(*configPath, overlays, brokers)
+
+	log.Printf("broker %s", version.Get())
 	mode := strings.ToLower(strings.TrimSpace(cfg.Telegram.Mode))
 	if mode == "polling" {
-		log.Printf("broker starting in polling mode")
-		broker.pollLoop()
-		return
-	}
-
-	mux := http.NewServeMux()
-	mux.HandleFunc(cfg.Telegram.WebhookPath, func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+		log.Printf("broker starting in polling mode (%d bot(s))", len(brokers))
+		errs := make(chan error, len(brokers))
+		for _, broker := range brokers {
+			go func(b *Broker) { errs <- b.pollLoop(context.Background()) }(broker)
 		}
-		var update TelegramUpdate
-		if err := json.Unmarshal(body, &update); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+		for range brokers {
+			if err := <-errs; err != nil {
+				log.Fatalf("polling: %v", err)
+			}
 		}
+		return
+	}
 
-		broker.processUpdate(update)
-		w.WriteHeader(http.StatusOK)
-	})
+	mux := newWebhookMux(brokers...)
 
 	srv := &http.Server{
 		Addr:              cfg.ListenAddr,
@@ -365,23 +941,109 @@ func main() {
 	}
 }
 
+// enqueueUpdate processes update behind earlier updates from the same chat so
+// commands like `cd` and `ls` cannot overtake each other, and within the
+// global telegram.max_concurrent_chats ceiling. The returned channel is closed
+// once the update has been handled or rejected.
+func (b *Broker) enqueueUpdate(update TelegramUpdate, clientIP string) <-chan struct{} {
+	done := make(chan struct{})
+	chatID, ok := updateChatID(update)
+	if !ok || skipsChatQueue(update) {
+		b.processUpdateFrom(update, clientIP)
+		close(done)
+		return done
+	}
+	queued := b.chats.submit(chatID, func() {
+		defer close(done)
+		if !b.inflight.acquire() {
+			log.Printf("too many updates in flight; dropping update %d from chat %d", update.UpdateID, chatID)
+			b.notifyDropped(update, chatID, "The bot is busy; please try again shortly.")
+			return
+		}
+		defer b.inflight.release()
+		b.processUpdateFrom(update, clientIP)
+	})
+	if !queued {
+		log.Printf("chat %d queue full; dropping update %d", chatID, update.UpdateID)
+		b.notifyDropped(update, chatID, "Too many pending commands; please wait and try again.")
+		close(done)
+	}
+	return done
+}
+
+func updateChatID(update TelegramUpdate) (int64, bool) {
+	if update.Message != nil {
+		return update.Message.Chat.ID, true
+	}
+	if update.EditedMessage != nil {
+		return update.EditedMessage.Chat.ID, true
+	}
+	if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+		return update.CallbackQuery.Message.Chat.ID, true
+	}
+	return 0, false
+}
+
+// updateUserID returns the ID of the user who sent update.
+func updateUserID(update TelegramUpdate) int64 {
+	switch {
+	case update.Message != nil:
+		return update.Message.From.ID
+	case update.EditedMessage != nil:
+		return update.EditedMessage.From.ID
+	case update.CallbackQuery != nil:
+		return update.CallbackQuery.From.ID
+	}
+	return 0
+}
+
+// notifyDropped tells the sender of an update dropped before auth why. Users
+// outside telegram.allowed_user_ids get nothing, so the bot stays silent to
+// strangers.
+func (b *Broker) notifyDropped(update TelegramUpdate, chatID int64, text string) {
+	if !isAllowed(updateUserID(update), b.config().Telegram.AllowedUserIDs) {
+		return
+	}
+	_ = b.sender.Send(chatID, text)
+}
+
 func (b *Broker) processUpdate(update TelegramUpdate) {
-	ctx := &pipelineContext{
-		cfg:    b.cfg,
-		rl:     b.rl,
-		exec:   b.exec,
-		update: update,
-		sender: b.sender,
-		llm:    b.llm,
-		audit:  b.audit,
+	b.processUpdateFrom(update, "")
+}
+
+// processUpdateFrom handles an update received from clientIP, which is empty
+// for polled updates.
+func (b *Broker) processUpdateFrom(update TelegramUpdate, clientIP string) {
+	if update.Message == nil && update.EditedMessage != nil {
+		if !b.config().Telegram.HandleEdits {
+			return
+		}
+		// An edit is handled like the message it replaces; dedupe keys on the
+		// edit date so each edit runs once.
+		update.Message = update.EditedMessage
 	}
+	if b.isDuplicateUpdate(update) {
+		log.Printf("skipping duplicate update %d", update.UpdateID)
+		return
+	}
+	if update.CallbackQuery != nil {
+		b.processCallback(update.CallbackQuery, clientIP)
+		return
+	}
+	ctx, done := b.newPipelineContext(clientIP)
+	defer done()
+	ctx.update = update
 
 	stages := []pipelineStage{
 		stageExtractMessage,
 		stageAuth,
 		stageRateLimit,
+		stageUpload,
+		stageBatch,
 		stageRoute,
 		stagePolicy,
+		stageIntentPolicy,
+		stageConfirm,
 		stageExecute,
 	}
 
@@ -398,6 +1060,7 @@ func stageExtractMessage(ctx *pipelineContext) bool {
 	}
 	ctx.msg = ctx.update.Message
 	ctx.userID = ctx.msg.From.ID
+	ctx.userName = ctx.msg.From.UserName
 	ctx.chatID = ctx.msg.Chat.ID
 	return false
 }
@@ -405,34 +1068,153 @@ func stageExtractMessage(ctx *pipelineContext) bool {
 func stageAuth(ctx *pipelineContext) bool {
 	if !isAllowed(ctx.userID, ctx.cfg.Telegram.AllowedUserIDs) {
 		logAudit(ctx, "auth_denied", "unauthorized user", "denied")
+		if !repliesToUnauthorized(ctx) {
+			return true
+		}
 		return sendReply(ctx, "Unauthorized user.")
 	}
 	return false
 }
 
+// normalizeUnauthorizedBehavior lowercases telegram.unauthorized_behavior,
+// defaulting to "reply".
+func normalizeUnauthorizedBehavior(behavior string) (string, error) {
+	behavior = strings.ToLower(strings.TrimSpace(behavior))
+	switch behavior {
+	case "":
+		return "reply", nil
+	case "reply", "silent", "log_only":
+		return behavior, nil
+	}
+	return "", fmt.Errorf("telegram.unauthorized_behavior must be reply, silent, or log_only")
+}
+
+// repliesToUnauthorized reports whether strangers get a reply. The audit
+// event is logged either way; log_only also writes to the process log.
+func repliesToUnauthorized(ctx *pipelineContext) bool {
+	switch ctx.cfg.Telegram.UnauthorizedBehavior {
+	case "silent":
+		return false
+	case "log_only":
+		log.Printf("unauthorized user %d (%s) in chat %d", ctx.userID, ctx.userName, ctx.chatID)
+		return false
+	}
+	return true
+}
+
 func stageRateLimit(ctx *pipelineContext) bool {
 	if !ctx.rl.allow(ctx.userID) {
 		logAudit(ctx, "rate_limited", "rate limit exceeded", "denied")
-		return sendReply(ctx, "Rate limit exceeded. Try again soon.")
+		window, max := ctx.rl.limit()
+		return sendReply(ctx, fmt.Sprintf("Rate limit exceeded (%d per %s). Try again soon.", max, window))
 	}
 	return false
 }
 
+func capabilitiesMessage(cfg *BrokerConfig) string {
+	var b strings.Builder
+	b.WriteString("Capabilities: run allowlisted commands (including safe file ops like ls/cd/cat/touch/mkdir/write/append/count/find and ping) and answer chat when LLM is enabled.\nAllowed commands:")
+	for _, name := range cfg.Policy.CommandAllowlist {
+		b.WriteString("\n- " + name)
+		if desc := commandDescription(cfg, name); desc != "" {
+			b.WriteString(" — " + desc)
+		}
+	}
+	return b.String()
+}
+
+// defaultWelcomeMessage answers /start when telegram.welcome_message is unset.
+const defaultWelcomeMessage = "Welcome! Send a command such as `status`, or `help` to see what you can run here."
+
+func welcomeMessage(cfg *BrokerConfig) string {
+	if msg := strings.TrimSpace(cfg.Telegram.WelcomeMessage); msg != "" {
+		return msg
+	}
+	return defaultWelcomeMessage
+}
+
+func commandDescription(cfg *BrokerConfig, name string) string {
+	if c, _, ok, _ := lookupAllowedCommand(cfg.Execution.Local.CommandAllowlist, name); ok && c.Description != "" {
+		return strings.TrimSpace(c.Description)
+	}
+	return strings.TrimSpace(cfg.Execution.Local.DynamicDescriptions[name])
+}
+
 func stageRoute(ctx *pipelineContext) bool {
 	if isCapabilityQuestion(ctx.msg.Text) {
 		logAudit(ctx, "help", "capabilities question", "ok")
-		return sendReply(ctx, "Capabilities: run allowlisted commands (including safe file ops like ls/cd/cat/touch/mkdir/write/append/count/find and ping) and answer chat when LLM is enabled.\nAllowed commands: "+strings.Join(ctx.cfg.Policy.CommandAllowlist, ", "))
+		return sendReply(ctx, capabilitiesMessage(ctx.cfg))
+	}
+	// Builtins bypass the LLM so they are never paraphrased.
+	if cmd, args, err := normalizeCommand(ctx.msg.Text); err == nil {
+		switch {
+		case cmd == "start":
+			ctx.cmd = cmd
+			logAudit(ctx, "start", "welcome", "ok")
+			return sendReply(ctx, welcomeMessage(ctx.cfg))
+		case cmd == configCommand:
+			ctx.cmd = cmd
+			return replyConfig(ctx)
+		case cmd == selftestCommand && len(args) == 0:
+			ctx.cmd = cmd
+			return replySelftest(ctx)
+		case cmd == cancelCommand && len(args) == 0:
+			ctx.cmd = cmd
+			return replyCancel(ctx)
+		case cmd == psCommand && len(args) == 0:
+			ctx.cmd = cmd
+			return replyPS(ctx)
+		case cmd == historyCommand:
+			ctx.cmd = cmd
+			return replyHistory(ctx, args)
+		case cmd == watchCommand:
+			ctx.cmd = cmd
+			return replyWatch(ctx, args)
+		case cmd == versionCommand && len(args) == 0:
+			ctx.cmd = cmd
+			return replyVersion(ctx)
+		}
 	}
 	if ctx.cfg.LLM.Enabled {
 		if ctx.llm == nil {
 			logAudit(ctx, "llm_error", "llm client not configured", "error")
 			return sendReply(ctx, "LLM error: client not configured")
 		}
-		decision, err := ctx.llm.Map(context.Background(), ctx.msg.Text, ctx.cfg.Policy.CommandAllowlist)
+		if !ctx.llmRL.allow(ctx.userID) {
+			logAudit(ctx, "llm_rate_limited", "llm rate limit exceeded", "denied")
+			return sendReply(ctx, "You're sending messages faster than I can think. Please slow down and try again in a minute.")
+		}
+		text := ctx.msg.Text
+		if ctx.clarify != nil {
+			if pending, ok := ctx.clarify.take(ctx.chatID, ctx.userID); ok {
+				text = mergeClarification(pending, text)
+				logAudit(ctx, "llm_clarify_answer", "merged follow-up", "ok")
+			}
+		}
+		decision, err := ctx.llm.Map(ctx.reqCtx, ctx.chatID, ctx.userID, text, ctx.cfg.Policy.CommandAllowlist)
 		if err != nil {
 			logAudit(ctx, "llm_error", err.Error(), "error")
 			return sendReply(ctx, "LLM error: "+err.Error())
 		}
+		logAudit(ctx, "llm_decision", fmt.Sprintf("type=%s intent=%s confidence=%.2f", decision.Type, decision.Intent, decision.Confidence), "ok")
+
+		if strings.EqualFold(decision.Type, "clarify") {
+			question := strings.TrimSpace(decision.Response)
+			if question == "" || ctx.clarify == nil {
+				logAudit(ctx, "llm_clarify", "empty question", "ok")
+				return sendReply(ctx, "I didn't understand that. Try a command or ask again.")
+			}
+			ctx.clarify.put(ctx.chatID, pendingClarify{
+				userID:   ctx.userID,
+				text:     text,
+				question: question,
+				intent:   strings.ToLower(strings.TrimSpace(decision.Intent)),
+				args:     decision.Args,
+				expires:  time.Now().Add(clarifyTTL),
+			})
+			logAudit(ctx, "llm_clarify", "awaiting answer", "ok")
+			return sendReply(ctx, question)
+		}
 
 		if strings.EqualFold(decision.Type, "chat") {
 			resp := strings.TrimSpace(decision.Response)
@@ -449,28 +1231,33 @@ func stageRoute(ctx *pipelineContext) bool {
 			logAudit(ctx, "llm_command_error", "missing intent", "error")
 			return sendReply(ctx, "I couldn't determine a command. Try again.")
 		}
-		if decision.Confidence < ctx.cfg.LLM.ConfidenceThreshold {
-			logAudit(ctx, "llm_command_low_confidence", "low confidence", "denied")
+		if threshold := ctx.cfg.LLM.confidenceThreshold(cmd); decision.Confidence < threshold {
+			logAudit(ctx, "llm_rejected_low_confidence", fmt.Sprintf("intent=%s confidence=%.2f threshold=%.2f", cmd, decision.Confidence, threshold), "denied")
 			return sendReply(ctx, "I am not confident this is a command. Please rephrase or use a direct command.")
 		}
 		if cmd == "help" {
 			logAudit(ctx, "help", "llm requested help", "ok")
-			return sendReply(ctx, "Capabilities: run allowlisted commands (including safe file ops like ls/cd/cat/touch/mkdir/count/find and ping) and answer chat when LLM is enabled.\nAllowed commands: "+strings.Join(ctx.cfg.Policy.CommandAllowlist, ", "))
+			return sendReply(ctx, capabilitiesMessage(ctx.cfg))
 		}
 		ctx.cmd = cmd
 		ctx.args = decision.Args
+		ctx.fromLLM = true
 		logAudit(ctx, "llm_command", "routed", "ok")
 		return false
 	}
 
-	cmd, args := normalizeCommand(ctx.msg.Text)
+	cmd, args, err := normalizeCommand(ctx.msg.Text)
+	if err != nil {
+		logAudit(ctx, "command_error", err.Error(), "error")
+		return sendReply(ctx, "Could not parse command: "+err.Error())
+	}
 	if cmd == "" {
 		logAudit(ctx, "command_error", "empty command", "error")
 		return sendReply(ctx, "Empty command.")
 	}
 	if cmd == "help" {
 		logAudit(ctx, "help", "direct help", "ok")
-		return sendReply(ctx, "Capabilities: run allowlisted commands (including safe file ops like ls/cd/cat/touch/mkdir/write/append/count/find and ping) and answer chat when LLM is enabled.\nAllowed commands: "+strings.Join(ctx.cfg.Policy.CommandAllowlist, ", "))
+		return sendReply(ctx, capabilitiesMessage(ctx.cfg))
 	}
 	ctx.cmd = cmd
 	ctx.args = args
@@ -483,38 +1270,229 @@ func stagePolicy(ctx *pipelineContext) bool {
 		logAudit(ctx, "command_blocked", "blocked", "denied")
 		return sendReply(ctx, "Command blocked.")
 	}
-	if !isCommandAllowed(ctx.cmd, ctx.cfg.Policy.CommandAllowlist) {
+	if !isCommandAllowlisted(ctx.cmd, ctx.cfg.Policy.CommandAllowlist) {
 		logAudit(ctx, "command_not_allowed", "not allowed", "denied")
+		if suggestion := suggestCommand(ctx.cmd, ctx.cfg.Policy.CommandAllowlist); suggestion != "" && !ctx.fromLLM {
+			return sendReply(ctx, fmt.Sprintf("Command not allowed. Did you mean '%s'?", suggestion))
+		}
 		return sendReply(ctx, "Command not allowed.")
 	}
 	return false
 }
 
+func stageIntentPolicy(ctx *pipelineContext) bool {
+	if !ctx.fromLLM {
+		return false
+	}
+	policy, ok := ctx.cfg.Policy.IntentPolicy[ctx.cmd]
+	if !ok {
+		return false
+	}
+	if err := checkIntentArgs(policy, ctx.args); err != nil {
+		logAudit(ctx, "llm_args_rejected", err.Error(), "denied")
+		return sendReply(ctx, "Rejected LLM arguments: "+err.Error())
+	}
+	return false
+}
+
+func checkIntentArgs(policy IntentPolicy, args []string) error {
+	if policy.MaxArgs != nil && len(args) > *policy.MaxArgs {
+		return fmt.Errorf("too many args (%d > %d)", len(args), *policy.MaxArgs)
+	}
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") {
+			if !isCommandAllowed(a, policy.AllowedFlags) {
+				return fmt.Errorf("flag not allowed: %s", a)
+			}
+			continue
+		}
+		if !policy.AllowPaths && looksLikePath(a) {
+			return fmt.Errorf("paths not allowed: %s", a)
+		}
+	}
+	return nil
+}
+
+func looksLikePath(arg string) bool {
+	return strings.ContainsAny(arg, `/\`) || arg == "." || arg == ".." || strings.HasPrefix(arg, "~")
+}
+
+// typingRefresh is how often the typing indicator is resent; Telegram clears
+// it after about five seconds.
+const typingRefresh = 4 * time.Second
+
+// startTyping shows the typing indicator until the returned stop function is
+// called. It does nothing unless telegram.typing_indicator is enabled.
+func startTyping(ctx *pipelineContext) func() {
+	if !ctx.cfg.Telegram.TypingIndicator {
+		return func() {}
+	}
+	send := func() {
+		if err := ctx.sender.SendChatAction(ctx.chatID, "typing"); err != nil {
+			log.Printf("send chat action: %v", err)
+		}
+	}
+	send()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(typingRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				send()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
 func stageExecute(ctx *pipelineContext) bool {
-	resp, err := ctx.exec.Execute(context.Background(), api.CommandRequest{
-		Command: ctx.cmd,
-		UserID:  ctx.userID,
-		ChatID:  ctx.chatID,
-		Text:    ctx.msg.Text,
-		Args:    ctx.args,
+	execCtx, cancel := context.WithCancel(ctx.reqCtx)
+	defer cancel()
+	if ctx.running != nil {
+		defer ctx.running.track(runningCommand{
+			chatID:  ctx.chatID,
+			userID:  ctx.userID,
+			command: ctx.cmd,
+			args:    ctx.args,
+			started: time.Now(),
+			cancel:  cancel,
+		})()
+	}
+	stopTyping := startTyping(ctx)
+	resp, err := ctx.exec.Execute(execCtx, api.CommandRequest{
+		Command:   ctx.cmd,
+		UserID:    ctx.userID,
+		UserName:  ctx.msg.From.UserName,
+		ChatID:    ctx.chatID,
+		Text:      ctx.msg.Text,
+		Args:      ctx.args,
+		RequestID: ctx.requestID,
 	})
+	stopTyping()
+	if errors.Is(execCtx.Err(), context.Canceled) {
+		logAudit(ctx, "execution_cancelled", "cancelled by user", "ok")
+		recordHistory(ctx, "cancelled")
+		return sendReply(ctx, "Command cancelled.")
+	}
+	if errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+		limit := time.Duration(ctx.cfg.Telegram.RequestTimeoutSec) * time.Second
+		logAudit(ctx, "execution_timeout", "request deadline "+limit.String()+" exceeded", "error")
+		recordHistory(ctx, "timeout")
+		sendReply(ctx, fmt.Sprintf("Command timed out after %s.", limit))
+		notifyAdmin(ctx, "request deadline exceeded")
+		return true
+	}
 	if err != nil {
 		logAudit(ctx, "execution_error", err.Error(), "error")
-		return sendReply(ctx, "Agent error: "+err.Error())
+		recordHistory(ctx, "error")
+		sendReply(ctx, ctx.cfg.Policy.sanitizeReply("Agent error: "+ctx.redactor.apply(err.Error())))
+		notifyAdmin(ctx, ctx.redactor.apply(err.Error()))
+		return true
 	}
+	resp.Stdout = ctx.redactor.apply(resp.Stdout)
+	resp.Stderr = ctx.redactor.apply(resp.Stderr)
+	resp.Error = ctx.redactor.apply(resp.Error)
 
-	reply := renderResponse(ctx.cmd, resp)
+	reply, entities := renderResponse(ctx.cmd, resp, ctx.cfg.Policy.outputFormat(ctx.cmd), ctx.cfg.Policy.sanitizeUTF8())
+	if summary, ok := summarizeOutput(ctx, resp); ok {
+		reply, entities = ctx.cfg.Policy.sanitizeReply(fmt.Sprintf("%s (summary):\n%s", ctx.cmd, summary)), nil
+	}
 	if resp.Ok {
-		logAudit(ctx, "execution", "ok", "ok")
+		logExecutionAudit(ctx, resp, "ok", "ok")
+		recordHistory(ctx, "ok")
 	} else {
-		logAudit(ctx, "execution", resp.Error, "error")
+		logExecutionAudit(ctx, resp, resp.Error, "error")
+		recordHistory(ctx, fmt.Sprintf("exit %d", resp.ExitCode))
 	}
-	return sendReply(ctx, reply)
+	if !reactToCommand(ctx, resp) {
+		sendFormattedReply(ctx, reply, entities)
+	}
+	if !resp.Ok {
+		notifyAdmin(ctx, fmt.Sprintf("exit %d: %s", resp.ExitCode, resp.Error))
+	}
+	return true
+}
+
+// summarizeOutput replaces a successful command's output with an LLM summary
+// when the executor flagged the response for it. The output sent to the model
+// is capped at llm.summary_max_input_kb.
+func summarizeOutput(ctx *pipelineContext, resp *api.CommandResponse) (string, bool) {
+	if !resp.Summarize || !ctx.cfg.LLM.Enabled || ctx.llm == nil || !resp.Ok {
+		return "", false
+	}
+	out := strings.TrimSpace(resp.Stdout)
+	if out == "" {
+		return "", false
+	}
+	summary, err := ctx.llm.Summarize(ctx.reqCtx, ctx.cmd, limitOutput(out, ctx.cfg.LLM.SummaryMaxInputKB))
+	if err != nil {
+		logAudit(ctx, "llm_error", "summarize: "+err.Error(), "error")
+		return "", false
+	}
+	summary = strings.TrimSpace(summary)
+	return summary, summary != ""
+}
+
+// Reactions for policy.react_instead_of_reply. Telegram only accepts emoji
+// from its fixed reaction set, which has no check or cross mark.
+const (
+	reactionOK     = "👍"
+	reactionFailed = "👎"
+)
+
+// reactToCommand reacts to the user's message instead of replying when the
+// command is listed in policy.react_instead_of_reply and printed nothing. It
+// reports false when a text reply is still needed, including when the
+// reaction cannot be set.
+func reactToCommand(ctx *pipelineContext, resp *api.CommandResponse) bool {
+	if ctx.replies != nil || ctx.msg == nil || ctx.msg.MessageID == 0 || !isCommandAllowed(ctx.cmd, ctx.cfg.Policy.ReactInsteadOfReply) {
+		return false
+	}
+	if strings.TrimSpace(resp.Stdout) != "" || strings.TrimSpace(resp.Stderr) != "" {
+		return false
+	}
+	emoji := reactionOK
+	if !resp.Ok {
+		emoji = reactionFailed
+	}
+	if err := ctx.sender.SetMessageReaction(ctx.chatID, ctx.msg.MessageID, emoji); err != nil {
+		log.Printf("set telegram reaction: %v", err)
+		logAudit(ctx, "send_failed", err.Error(), "error")
+		return false
+	}
+	return true
 }
 
 func sendReply(ctx *pipelineContext, text string) bool {
+	if ctx.replies != nil {
+		*ctx.replies = append(*ctx.replies, text)
+		return true
+	}
 	if err := ctx.sender.Send(ctx.chatID, text); err != nil {
 		log.Printf("send telegram: %v", err)
+		logAudit(ctx, "send_failed", err.Error(), "error")
+	}
+	return true
+}
+
+// sendFormattedReply sends text with entities marking its monospace blocks.
+// Batch replies are joined as plain text, so they drop the entities.
+func sendFormattedReply(ctx *pipelineContext, text string, entities []messageEntity) bool {
+	if ctx.replies != nil || len(entities) == 0 {
+		return sendReply(ctx, text)
+	}
+	if err := ctx.sender.SendEntities(ctx.chatID, text, entities); err != nil {
+		log.Printf("send telegram: %v", err)
+		logAudit(ctx, "send_failed", err.Error(), "error")
 	}
 	return true
 }
@@ -523,23 +1501,54 @@ func logAudit(ctx *pipelineContext, eventType, message, outcome string) {
 	if ctx.audit == nil {
 		return
 	}
-	ctx.audit.Log(AuditEvent{
+	ctx.audit.Log(newAuditEvent(ctx, eventType, message, outcome))
+}
+
+// logExecutionAudit records a finished command with its redacted args and
+// exit code.
+func logExecutionAudit(ctx *pipelineContext, resp *api.CommandResponse, message, outcome string) {
+	if ctx.audit == nil {
+		return
+	}
+	e := newAuditEvent(ctx, "execution", message, outcome)
+	e.Args = make([]string, len(ctx.args))
+	for i, arg := range ctx.args {
+		e.Args[i] = ctx.redactor.apply(arg)
+	}
+	e.ExitCode = resp.ExitCode
+	e.Reason = resp.Reason
+	ctx.audit.Log(e)
+}
+
+func newAuditEvent(ctx *pipelineContext, eventType, message, outcome string) AuditEvent {
+	return AuditEvent{
 		Timestamp: time.Now().UTC(),
+		RequestID: ctx.requestID,
+		ClientIP:  ctx.clientIP,
 		Type:      eventType,
 		UserID:    ctx.userID,
+		UserName:  ctx.userName,
 		ChatID:    ctx.chatID,
 		Command:   ctx.cmd,
 		Outcome:   outcome,
-		Message:   message,
-	})
+		Message:   ctx.redactor.apply(message),
+	}
+}
+
+// randomHex returns n random bytes hex-encoded, used for request IDs and
+// callback tokens.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
 func parseDirectCommand(text string, allowlist []string) (string, []string, bool) {
-	cmd, args := normalizeCommand(text)
-	if cmd == "" {
+	cmd, args, err := normalizeCommand(text)
+	if err != nil || cmd == "" {
 		return "", nil, false
 	}
-	if !isCommandAllowed(cmd, allowlist) {
+	if !isCommandAllowlisted(cmd, allowlist) {
 		return "", nil, false
 	}
 	return cmd, args, true
@@ -567,34 +1576,118 @@ func isCapabilityQuestion(text string) bool {
 	return false
 }
 
-func (b *Broker) pollLoop() {
+// errPollConflict is returned by getUpdates when Telegram reports that another
+// getUpdates request (usually a second broker with the same token) is active.
+var errPollConflict = errors.New("telegram polling conflict: another instance is using this bot token")
+
+// normalizeUpdateTypes trims and lowercases update types, dropping blanks and
+// duplicates.
+func normalizeUpdateTypes(types []string) []string {
+	out := []string{}
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || isCommandAllowed(t, out) {
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// pollConflictBackoff is how long polling pauses after a 409 conflict.
+const pollConflictBackoff = 30 * time.Second
+
+// pollErrorBackoffMax caps the delay after consecutive getUpdates errors.
+const pollErrorBackoffMax = 5 * time.Minute
+
+// pollErrorBackoff doubles base for each consecutive failure, up to
+// pollErrorBackoffMax.
+func pollErrorBackoff(base time.Duration, failures int) time.Duration {
+	d := base
+	for i := 1; i < failures && d < pollErrorBackoffMax; i++ {
+		d *= 2
+	}
+	if d > pollErrorBackoffMax {
+		d = pollErrorBackoffMax
+	}
+	return d
+}
+
+type updateFetcher func(offset int64) ([]TelegramUpdate, error)
+
+func (b *Broker) pollLoop(ctx context.Context) error {
 	client := &http.Client{Timeout: 35 * time.Second}
-	var offset int64
-	for {
-		updates, err := getUpdates(client, b.cfg.Telegram.BotToken, offset)
+	fetch := func(offset int64) ([]TelegramUpdate, error) {
+		cfg := b.config()
+		return getUpdates(client, cfg.Telegram.APIBaseURL, cfg.Telegram.BotToken, offset, cfg.Telegram.PolledUpdateTypes)
+	}
+	return b.runPoll(ctx, fetch, time.Sleep)
+}
+
+// normalizeOnPollConflict lowercases telegram.on_poll_conflict, defaulting to
+// "backoff".
+func normalizeOnPollConflict(action string) (string, error) {
+	action = strings.ToLower(strings.TrimSpace(action))
+	switch action {
+	case "":
+		return "backoff", nil
+	case "backoff", "exit":
+		return action, nil
+	}
+	return "", fmt.Errorf("telegram.on_poll_conflict must be backoff or exit")
+}
+
+// runPoll fetches and processes updates until ctx is done. It only returns an
+// error when a polling conflict is configured to be fatal.
+func (b *Broker) runPoll(ctx context.Context, fetch updateFetcher, sleep func(time.Duration)) error {
+	offset := loadPollOffset(b.config().Telegram.OffsetFile)
+	interval := time.Duration(b.config().Telegram.PollIntervalSec) * time.Second
+	failures := 0
+	for ctx.Err() == nil {
+		updates, err := fetch(offset)
+		if errors.Is(err, errPollConflict) {
+			if strings.EqualFold(b.config().Telegram.OnPollConflict, "exit") {
+				return err
+			}
+			log.Printf("getUpdates conflict: %v; is another broker running? retrying in %s", err, pollConflictBackoff)
+			sleep(pollConflictBackoff)
+			continue
+		}
 		if err != nil {
-			log.Printf("getUpdates error: %v", err)
-			time.Sleep(time.Duration(b.cfg.Telegram.PollIntervalSec) * time.Second)
+			failures++
+			wait := pollErrorBackoff(interval, failures)
+			log.Printf("getUpdates error: %v; retrying in %s", err, wait)
+			sleep(wait)
 			continue
 		}
+		failures = 0
 		for _, upd := range updates {
-			b.processUpdate(upd)
+			// Persist the offset before processing so a crash mid-command
+			// does not run it again after a restart.
 			if upd.UpdateID >= offset {
 				offset = upd.UpdateID + 1
+				if err := savePollOffset(b.config().Telegram.OffsetFile, offset); err != nil {
+					log.Printf("save poll offset: %v", err)
+				}
 			}
+			b.enqueueUpdate(upd, "")
 		}
 		if len(updates) == 0 {
-			time.Sleep(time.Duration(b.cfg.Telegram.PollIntervalSec) * time.Second)
+			sleep(interval)
 		}
 	}
+	return nil
 }
 
-func getUpdates(client *http.Client, token string, offset int64) ([]TelegramUpdate, error) {
-	url := fmt.Sprintf("https://api.telegram.org/bot%s/getUpdates", token)
+func getUpdates(client *http.Client, baseURL, token string, offset int64, updateTypes []string) ([]TelegramUpdate, error) {
+	if baseURL == "" {
+		baseURL = defaultTelegramAPIBaseURL
+	}
+	url := fmt.Sprintf("%s/bot%s/getUpdates", baseURL, token)
 	payload := map[string]any{
 		"offset":          offset,
 		"timeout":         30,
-		"allowed_updates": []string{"message"},
+		"allowed_updates": updateTypes,
 	}
 	body, _ := json.Marshal(payload)
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
@@ -608,6 +1701,10 @@ func getUpdates(client *http.Client, token string, offset int64) ([]TelegramUpda
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return nil, fmt.Errorf("%w: %s", errPollConflict, strings.TrimSpace(string(b)))
+	}
 	if resp.StatusCode != http.StatusOK {
 		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
 		return nil, fmt.Errorf("telegram status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
@@ -626,27 +1723,110 @@ func getUpdates(client *http.Client, token string, offset int64) ([]TelegramUpda
 	return tr.Result, nil
 }
 
-func normalizeCommand(text string) (string, []string) {
-	parts := strings.Fields(strings.TrimSpace(text))
+func normalizeCommand(text string) (string, []string, error) {
+	parts, err := splitArgs(strings.TrimSpace(text))
+	if err != nil {
+		return "", nil, err
+	}
 	if len(parts) == 0 {
-		return "", nil
+		return "", nil, nil
 	}
 	cmd := parts[0]
 	cmd = strings.TrimPrefix(cmd, "/")
 	cmd = strings.ToLower(cmd)
 	if len(parts) == 1 {
-		return cmd, nil
+		return cmd, nil, nil
 	}
-	return cmd, parts[1:]
+	return cmd, parts[1:], nil
 }
 
-func renderResponse(cmd string, resp *api.CommandResponse) string {
+// splitArgs tokenizes text like a POSIX shell without expansion: whitespace
+// separates words, single quotes are literal, double quotes only treat \" and
+// \\ as escapes, and a backslash outside quotes escapes the next character.
+func splitArgs(text string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range text {
+		switch {
+		case escaped:
+			if quote == '"' && r != '"' && r != '\\' {
+				cur.WriteRune('\\')
+			}
+			cur.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case unicode.IsSpace(r):
+			if inWord {
+				args = append(args, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unbalanced %c quote", quote)
+	}
+	if inWord {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+func renderResponse(cmd string, resp *api.CommandResponse, format string, sanitizeUTF8 bool) (string, []messageEntity) {
+	if sanitizeUTF8 {
+		// Sanitize before formatting so entity offsets match the sent text.
+		clean := *resp
+		clean.Stdout = strings.ToValidUTF8(resp.Stdout, "\uFFFD")
+		clean.Stderr = strings.ToValidUTF8(resp.Stderr, "\uFFFD")
+		clean.Error = strings.ToValidUTF8(resp.Error, "\uFFFD")
+		return formatResponse(strings.ToValidUTF8(cmd, "\uFFFD"), &clean, format)
+	}
+	return formatResponse(cmd, resp, format)
+}
+
+// formatResponse renders resp as reply text, with a pre entity over the
+// output when format is code or table.
+func formatResponse(cmd string, resp *api.CommandResponse, format string) (string, []messageEntity) {
 	if resp.Ok {
 		out := strings.TrimSpace(resp.Stdout)
 		if out == "" {
-			out = "(no output)"
+			return cmd + ":\n(no output)", nil
+		}
+		prefix := cmd + ":\n"
+		block, mono := formatOutput(out, format)
+		if !mono {
+			return prefix + block, nil
 		}
-		return fmt.Sprintf("%s:\n%s", cmd, out)
+		return prefix + block, []messageEntity{preEntity(prefix, block)}
 	}
 
 	errMsg := resp.Error
@@ -658,7 +1838,7 @@ func renderResponse(cmd string, resp *api.CommandResponse) string {
 		out = strings.TrimSpace(resp.Stdout)
 	}
 	if out != "" {
-		return fmt.Sprintf("%s failed (exit %d): %s\n%s", cmd, resp.ExitCode, errMsg, out)
+		return fmt.Sprintf("%s failed (exit %d): %s\n%s", cmd, resp.ExitCode, errMsg, out), nil
 	}
-	return fmt.Sprintf("%s failed (exit %d): %s", cmd, resp.ExitCode, errMsg)
+	return fmt.Sprintf("%s failed (exit %d): %s", cmd, resp.ExitCode, errMsg), nil
 }
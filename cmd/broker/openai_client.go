@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"personal_ai/internal/api"
@@ -20,26 +23,114 @@ type openAIClient struct {
 	baseURL   string
 	client    *http.Client
 	maxBodyKB int64
+	retries   int
+	backoff   time.Duration
+	prompt    *template.Template
+	// userModels and chatModels override model per user or chat.
+	userModels map[int64]string
+	chatModels map[int64]string
 }
 
+// retryableError marks a failed attempt that may succeed if repeated, such as
+// a 429, a 5xx, or a network error. retryAfter carries the server's hint.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+
+func (e *retryableError) Unwrap() error { return e.err }
+
 func newOpenAIClient(cfg LLMConfig) *openAIClient {
 	model := strings.TrimSpace(cfg.Model)
 	if model == "" {
 		model = "gpt-5.2"
 	}
+	retries := cfg.Retries
+	if retries < 0 {
+		retries = 0
+	}
+	// The template was validated by loadConfig; a parse error here leaves the
+	// default prompt in place.
+	prompt, _ := parseSystemPrompt(cfg.SystemPromptTemplate)
 	return &openAIClient{
-		apiKey:    cfg.APIKey,
-		model:     model,
-		timeout:   time.Duration(cfg.TimeoutSec) * time.Second,
-		baseURL:   "https://api.openai.com/v1/responses",
-		client:    &http.Client{Timeout: time.Duration(cfg.TimeoutSec) * time.Second},
-		maxBodyKB: 1024,
+		apiKey:     cfg.APIKey,
+		model:      model,
+		timeout:    time.Duration(cfg.TimeoutSec) * time.Second,
+		baseURL:    "https://api.openai.com/v1/responses",
+		client:     &http.Client{Timeout: time.Duration(cfg.TimeoutSec) * time.Second},
+		maxBodyKB:  1024,
+		retries:    retries,
+		backoff:    500 * time.Millisecond,
+		prompt:     prompt,
+		userModels: cfg.UserModels,
+		chatModels: cfg.ChatModels,
+	}
+}
+
+// modelFor returns the model for a request from userID in chatID: the user's
+// override, then the chat's, then the global model.
+func (c *openAIClient) modelFor(chatID, userID int64) string {
+	if model := strings.TrimSpace(c.userModels[userID]); model != "" {
+		return model
+	}
+	if model := strings.TrimSpace(c.chatModels[chatID]); model != "" {
+		return model
+	}
+	return c.model
+}
+
+// systemPromptData is passed to llm.system_prompt_template.
+type systemPromptData struct {
+	Allowlist string
+}
+
+// parseSystemPrompt parses a custom router prompt, returning nil for an empty
+// template. The template must reference {{.Allowlist}}.
+func parseSystemPrompt(text string) (*template.Template, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("system_prompt").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	const sentinel = "\x00allowlist\x00"
+	var b strings.Builder
+	if err := tmpl.Execute(&b, systemPromptData{Allowlist: sentinel}); err != nil {
+		return nil, err
 	}
+	if !strings.Contains(b.String(), sentinel) {
+		return nil, fmt.Errorf("template must include {{.Allowlist}}")
+	}
+	return tmpl, nil
+}
+
+func (c *openAIClient) systemPrompt(allowlist []string) (string, error) {
+	joined := strings.Join(allowlist, ", ")
+	if c.prompt == nil {
+		return "You are a command router. Decide whether the user wants to run an allowed command or just chat. " +
+			"If the user asks to perform an action that matches an allowed command, you MUST return type=command. " +
+			"If it is a command, map it to one of these intents: " + joined + ". " +
+			"Commands may include dynamic filesystem actions (pwd, ls/ll, cd, cat, jsonfmt, touch, mkdir, write, append, count, find) and ping, " +
+			"but always stay within the configured base directory when using paths. " +
+			"Examples: 'ping google.com' => command intent=ping args=[google.com]. " +
+			"Examples: 'write X with hello' => command intent=write args=[X, hello]. " +
+			"If a command is intended but a detail such as which file or folder is ambiguous, return type=clarify with a short question in 'response' " +
+			"and your best partial intent and args; the user's answer will be sent back to you with that context. " +
+			"Return JSON only that matches the provided schema. If it is chat, respond in the 'response' field.", nil
+	}
+	var b strings.Builder
+	if err := c.prompt.Execute(&b, systemPromptData{Allowlist: joined}); err != nil {
+		return "", fmt.Errorf("render system prompt: %v", err)
+	}
+	return b.String(), nil
 }
 
-func (c *openAIClient) Map(ctx context.Context, userText string, allowlist []string) (*api.LLMDecision, error) {
+func (c *openAIClient) ensureDefaults() error {
 	if strings.TrimSpace(c.apiKey) == "" {
-		return nil, fmt.Errorf("llm.api_key is not set")
+		return fmt.Errorf("llm.api_key is not set")
 	}
 	if c.timeout == 0 {
 		c.timeout = 15 * time.Second
@@ -53,18 +144,21 @@ func (c *openAIClient) Map(ctx context.Context, userText string, allowlist []str
 	if c.maxBodyKB == 0 {
 		c.maxBodyKB = 1024
 	}
+	return nil
+}
 
-	systemPrompt := "You are a command router. Decide whether the user wants to run an allowed command or just chat. " +
-		"If the user asks to perform an action that matches an allowed command, you MUST return type=command. " +
-		"If it is a command, map it to one of these intents: " + strings.Join(allowlist, ", ") + ". " +
-		"Commands may include dynamic filesystem actions (pwd, ls/ll, cd, cat, touch, mkdir, write, append, count, find) and ping, " +
-		"but always stay within the configured base directory when using paths. " +
-		"Examples: 'ping google.com' => command intent=ping args=[google.com]. " +
-		"Examples: 'write X with hello' => command intent=write args=[X, hello]. " +
-		"Return JSON only that matches the provided schema. If it is chat, respond in the 'response' field."
+func (c *openAIClient) Map(ctx context.Context, chatID, userID int64, userText string, allowlist []string) (*api.LLMDecision, error) {
+	if err := c.ensureDefaults(); err != nil {
+		return nil, err
+	}
+
+	systemPrompt, err := c.systemPrompt(allowlist)
+	if err != nil {
+		return nil, err
+	}
 
 	reqBody := map[string]any{
-		"model": c.model,
+		"model": c.modelFor(chatID, userID),
 		"input": []any{
 			map[string]any{
 				"role": "system",
@@ -88,7 +182,7 @@ func (c *openAIClient) Map(ctx context.Context, userText string, allowlist []str
 					"properties": map[string]any{
 						"type": map[string]any{
 							"type": "string",
-							"enum": []string{"command", "chat"},
+							"enum": []string{"command", "chat", "clarify"},
 						},
 						"intent": map[string]any{"type": "string"},
 						"args": map[string]any{
@@ -110,21 +204,97 @@ func (c *openAIClient) Map(ctx context.Context, userText string, allowlist []str
 	}
 
 	payload, _ := json.Marshal(reqBody)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL, bytes.NewReader(payload))
+	text, err := c.complete(ctx, payload)
 	if err != nil {
 		return nil, err
 	}
+	var decision api.LLMDecision
+	if err := json.Unmarshal([]byte(text), &decision); err != nil {
+		return nil, fmt.Errorf("llm json parse error: %v", err)
+	}
+	return &decision, nil
+}
+
+// Summarize asks the model for a one-line summary of a command's output.
+func (c *openAIClient) Summarize(ctx context.Context, cmd string, output string) (string, error) {
+	if err := c.ensureDefaults(); err != nil {
+		return "", err
+	}
+	systemPrompt := "You summarize command output for a chat user. " +
+		"Reply with a single concise line of plain text describing the important result. " +
+		"Do not invent details that are not in the output."
+	reqBody := map[string]any{
+		"model": c.model,
+		"input": []any{
+			map[string]any{
+				"role": "system",
+				"content": []any{
+					map[string]any{"type": "input_text", "text": systemPrompt},
+				},
+			},
+			map[string]any{
+				"role": "user",
+				"content": []any{
+					map[string]any{"type": "input_text", "text": "Output of `" + cmd + "`:\n" + output},
+				},
+			},
+		},
+	}
+	payload, _ := json.Marshal(reqBody)
+	text, err := c.complete(ctx, payload)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(text), nil
+}
+
+// complete posts payload, retrying transient failures, and returns the first
+// output text of the response.
+func (c *openAIClient) complete(ctx context.Context, payload []byte) (string, error) {
+	for attempt := 0; ; attempt++ {
+		text, err := c.send(ctx, payload)
+		var retryErr *retryableError
+		if err == nil || !errors.As(err, &retryErr) || attempt >= c.retries {
+			return text, err
+		}
+		wait := c.backoff << attempt
+		if retryErr.retryAfter > 0 {
+			wait = retryErr.retryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return "", err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return "", err
+		}
+	}
+}
+
+func (c *openAIClient) send(ctx context.Context, payload []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
 	req.Header.Set("Authorization", "Bearer "+c.apiKey)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, err
+		if ctx.Err() != nil {
+			return "", err
+		}
+		return "", &retryableError{err: err}
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<12))
-		return nil, fmt.Errorf("llm status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+		err := fmt.Errorf("llm status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return "", &retryableError{err: err, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+		}
+		return "", err
 	}
 
 	var parsed struct {
@@ -141,10 +311,10 @@ func (c *openAIClient) Map(ctx context.Context, userText string, allowlist []str
 	}
 	raw, err := io.ReadAll(io.LimitReader(resp.Body, c.maxBodyKB*1024))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	if err := json.Unmarshal(raw, &parsed); err != nil {
-		return nil, err
+		return "", err
 	}
 
 	for _, out := range parsed.Output {
@@ -153,17 +323,22 @@ func (c *openAIClient) Map(ctx context.Context, userText string, allowlist []str
 		}
 		for _, c := range out.Content {
 			if c.Type == "output_text" && strings.TrimSpace(c.Text) != "" {
-				var decision api.LLMDecision
-				if err := json.Unmarshal([]byte(c.Text), &decision); err != nil {
-					return nil, fmt.Errorf("llm json parse error: %v", err)
-				}
-				return &decision, nil
+				return c.Text, nil
 			}
 			if c.Type == "refusal" && strings.TrimSpace(c.Refusal) != "" {
-				return nil, fmt.Errorf("llm refused: %s", c.Refusal)
+				return "", fmt.Errorf("llm refused: %s", c.Refusal)
 			}
 		}
 	}
 
-	return nil, fmt.Errorf("llm returned no usable output")
+	return "", fmt.Errorf("llm returned no usable output")
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds.
+func parseRetryAfter(v string) time.Duration {
+	secs, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || secs <= 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
 }
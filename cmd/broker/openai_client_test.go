@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+func writeLLMDecision(t *testing.T, w http.ResponseWriter, decision api.LLMDecision) {
+	t.Helper()
+	text, err := json.Marshal(decision)
+	if err != nil {
+		t.Fatalf("marshal decision: %v", err)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"output": []any{
+			map[string]any{
+				"type": "message",
+				"content": []any{
+					map[string]any{"type": "output_text", "text": string(text)},
+				},
+			},
+		},
+	})
+}
+
+func TestOpenAIClientRetriesAfterRateLimit(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		writeLLMDecision(t, w, api.LLMDecision{Type: "command", Intent: "status", Confidence: 0.9})
+	}))
+	defer server.Close()
+
+	client := newOpenAIClient(LLMConfig{APIKey: "key", TimeoutSec: 2, Retries: 2})
+	client.baseURL = server.URL
+	client.backoff = time.Millisecond
+
+	decision, err := client.Map(context.Background(), 1, 1, "how is the server", []string{"status"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decision.Intent != "status" {
+		t.Fatalf("unexpected decision: %+v", decision)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls)
+	}
+}
+
+func TestOpenAIClientDoesNotRetryBadRequest(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	client := newOpenAIClient(LLMConfig{APIKey: "key", TimeoutSec: 2, Retries: 2})
+	client.baseURL = server.URL
+	client.backoff = time.Millisecond
+
+	if _, err := client.Map(context.Background(), 1, 1, "hi", []string{"status"}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single call, got %d", calls)
+	}
+}
+
+func TestOpenAIClientRendersCustomSystemPrompt(t *testing.T) {
+	var prompt string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input []struct {
+				Role    string `json:"role"`
+				Content []struct {
+					Text string `json:"text"`
+				} `json:"content"`
+			} `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(body.Input) > 0 && len(body.Input[0].Content) > 0 {
+			prompt = body.Input[0].Content[0].Text
+		}
+		writeLLMDecision(t, w, api.LLMDecision{Type: "command", Intent: "status", Confidence: 0.9})
+	}))
+	defer server.Close()
+
+	client := newOpenAIClient(LLMConfig{
+		APIKey:               "key",
+		TimeoutSec:           2,
+		SystemPromptTemplate: "Route to one of: {{.Allowlist}}. Prefer status for health questions.",
+	})
+	client.baseURL = server.URL
+
+	if _, err := client.Map(context.Background(), 1, 1, "is the box ok?", []string{"status", "disk"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "Route to one of: status, disk. Prefer status for health questions."; prompt != want {
+		t.Fatalf("unexpected system prompt %q, want %q", prompt, want)
+	}
+}
+
+func TestOpenAIClientUsesPerUserModel(t *testing.T) {
+	var models []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		models = append(models, body.Model)
+		writeLLMDecision(t, w, api.LLMDecision{Type: "chat", Response: "hi", Confidence: 0.9})
+	}))
+	defer server.Close()
+
+	client := newOpenAIClient(LLMConfig{
+		APIKey:     "key",
+		Model:      "global-model",
+		TimeoutSec: 2,
+		UserModels: map[int64]string{7: "user-model"},
+		ChatModels: map[int64]string{100: "chat-model"},
+	})
+	client.baseURL = server.URL
+
+	for _, ids := range [][2]int64{{100, 7}, {100, 8}, {200, 8}} {
+		if _, err := client.Map(context.Background(), ids[0], ids[1], "hi", []string{"status"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if want := []string{"user-model", "chat-model", "global-model"}; strings.Join(models, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected models %v, want %v", models, want)
+	}
+}
+
+func TestParseSystemPromptValidates(t *testing.T) {
+	for _, text := range []string{"no placeholder here", "{{.Allowlist", "{{.Missing}} {{.Allowlist}}"} {
+		if _, err := parseSystemPrompt(text); err == nil {
+			t.Fatalf("expected %q to be rejected", text)
+		}
+	}
+	if tmpl, err := parseSystemPrompt(""); err != nil || tmpl != nil {
+		t.Fatalf("expected empty template to fall back to default, got %v %v", tmpl, err)
+	}
+}
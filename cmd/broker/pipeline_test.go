@@ -2,22 +2,106 @@ package main
 
 import (
 	"context"
+	"errors"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"personal_ai/internal/api"
 )
 
 type senderStub struct {
-	calls []string
+	// mu guards calls for tests where replies come from concurrent goroutines.
+	mu        sync.Mutex
+	calls     []string
+	keyboards [][][]TelegramInlineButton
+	answers   []string
+	actions   []string
+	sendErr   error
+	files     map[string][]byte
+	downloads []string
+	// edits records EditMessage texts; SendForEdit also appends to calls.
+	edits []string
+	// chats records the chat ID of each Send, parallel to its calls entry.
+	chats []int64
+	// entities records the entities of each SendEntities call.
+	entities [][]messageEntity
+	// reactions records SetMessageReaction emoji; reactErr fails them.
+	reactions []string
+	reactErr  error
 }
 
-func (s *senderStub) Send(_ int64, text string) error {
+func (s *senderStub) Send(chatID int64, text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.calls = append(s.calls, text)
+	s.chats = append(s.chats, chatID)
+	return s.sendErr
+}
+
+func (s *senderStub) SendEntities(chatID int64, text string, entities []messageEntity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, text)
+	s.chats = append(s.chats, chatID)
+	s.entities = append(s.entities, entities)
+	return s.sendErr
+}
+
+func (s *senderStub) SendForEdit(_ int64, text string, _ []messageEntity) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, text)
+	return int64(len(s.calls)), s.sendErr
+}
+
+func (s *senderStub) EditMessage(_, _ int64, text string, _ []messageEntity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.edits = append(s.edits, text)
+	return nil
+}
+
+func (s *senderStub) SendKeyboard(_ int64, text string, keyboard [][]TelegramInlineButton) error {
+	s.calls = append(s.calls, text)
+	s.keyboards = append(s.keyboards, keyboard)
+	return nil
+}
+
+func (s *senderStub) AnswerCallback(_ string, text string) error {
+	s.answers = append(s.answers, text)
+	return nil
+}
+
+func (s *senderStub) SendChatAction(_ int64, action string) error {
+	s.actions = append(s.actions, action)
+	return nil
+}
+
+func (s *senderStub) SetMessageReaction(_, _ int64, emoji string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reactErr != nil {
+		return s.reactErr
+	}
+	s.reactions = append(s.reactions, emoji)
 	return nil
 }
 
+func (s *senderStub) DownloadFile(fileID string, maxBytes int64) ([]byte, error) {
+	s.downloads = append(s.downloads, fileID)
+	data, ok := s.files[fileID]
+	if !ok {
+		return nil, errors.New("file not found")
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, errFileTooLarge
+	}
+	return data, nil
+}
+
 type executorStub func(req api.CommandRequest) (*api.CommandResponse, error)
 
 func (e executorStub) Execute(ctx context.Context, req api.CommandRequest) (*api.CommandResponse, error) {
@@ -25,16 +109,32 @@ func (e executorStub) Execute(ctx context.Context, req api.CommandRequest) (*api
 }
 
 type llmStub struct {
-	decision *api.LLMDecision
-	err      error
-	calls    int
+	decision     *api.LLMDecision
+	err          error
+	calls        int
+	summary      string
+	summaryInput string
+	// decisions, when set, are returned in order ahead of decision.
+	decisions []*api.LLMDecision
+	inputs    []string
 }
 
-func (l *llmStub) Map(ctx context.Context, userText string, allowlist []string) (*api.LLMDecision, error) {
+func (l *llmStub) Map(ctx context.Context, chatID, userID int64, userText string, allowlist []string) (*api.LLMDecision, error) {
 	l.calls++
+	l.inputs = append(l.inputs, userText)
+	if len(l.decisions) > 0 {
+		d := l.decisions[0]
+		l.decisions = l.decisions[1:]
+		return d, l.err
+	}
 	return l.decision, l.err
 }
 
+func (l *llmStub) Summarize(ctx context.Context, cmd string, output string) (string, error) {
+	l.summaryInput = output
+	return l.summary, l.err
+}
+
 type auditStub struct {
 	events []AuditEvent
 }
@@ -82,14 +182,68 @@ func TestPipelineUnauthorizedStopsBeforeExecute(t *testing.T) {
 	}
 }
 
+func TestPipelineUnauthorizedBehavior(t *testing.T) {
+	cases := []struct {
+		behavior string
+		replies  int
+	}{
+		{behavior: "reply", replies: 1},
+		{behavior: "silent", replies: 0},
+		{behavior: "log_only", replies: 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.behavior, func(t *testing.T) {
+			cfg := &BrokerConfig{
+				Telegram: TelegramConfig{AllowedUserIDs: []int64{1}, UnauthorizedBehavior: tc.behavior},
+				Policy:   PolicyConfig{CommandAllowlist: []string{"status"}},
+			}
+			sender := &senderStub{}
+			audit := &auditStub{}
+			broker := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, sender, nil, audit)
+
+			broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+				From: TelegramUser{ID: 2},
+				Chat: TelegramChat{ID: 99},
+				Text: "status",
+			}})
+			if len(sender.calls) != tc.replies {
+				t.Fatalf("expected %d replies, got %v", tc.replies, sender.calls)
+			}
+			if len(audit.events) != 1 || audit.events[0].Type != "auth_denied" {
+				t.Fatalf("expected a single auth_denied event, got %+v", audit.events)
+			}
+		})
+	}
+}
+
+func TestNormalizeUnauthorizedBehavior(t *testing.T) {
+	if got, err := normalizeUnauthorizedBehavior(""); err != nil || got != "reply" {
+		t.Fatalf("expected reply by default, got %q err=%v", got, err)
+	}
+	if got, err := normalizeUnauthorizedBehavior(" Silent "); err != nil || got != "silent" {
+		t.Fatalf("expected silent, got %q err=%v", got, err)
+	}
+	if _, err := normalizeUnauthorizedBehavior("ignore"); err == nil {
+		t.Fatalf("expected unknown behavior to be rejected")
+	}
+}
+
 func TestPipelineHelpSendsAllowlist(t *testing.T) {
 	cfg := &BrokerConfig{
 		Telegram: TelegramConfig{
 			BotToken:       "token",
 			AllowedUserIDs: []int64{1},
 		},
+		Execution: ExecutionConfig{
+			Local: LocalExecutionConfig{
+				CommandAllowlist: map[string]api.AllowedCommand{
+					"status": {Exec: "uptime", Description: "show system uptime"},
+				},
+				DynamicDescriptions: map[string]string{"ls": "list files"},
+			},
+		},
 		Policy: PolicyConfig{
-			CommandAllowlist: []string{"status", "disk"},
+			CommandAllowlist: []string{"status", "ls", "disk"},
 		},
 	}
 	rl := newRateLimiter(time.Minute, 0)
@@ -115,12 +269,40 @@ func TestPipelineHelpSendsAllowlist(t *testing.T) {
 	if len(sender.calls) != 1 {
 		t.Fatalf("expected 1 send call, got %d", len(sender.calls))
 	}
-	expected := "Capabilities: run allowlisted commands (including safe file ops like ls/cd/cat/touch/mkdir/write/append/count/find and ping) and answer chat when LLM is enabled.\nAllowed commands: " + strings.Join(cfg.Policy.CommandAllowlist, ", ")
+	expected := "Capabilities: run allowlisted commands (including safe file ops like ls/cd/cat/touch/mkdir/write/append/count/find and ping) and answer chat when LLM is enabled.\nAllowed commands:\n- status — show system uptime\n- ls — list files\n- disk"
 	if sender.calls[0] != expected {
 		t.Fatalf("unexpected response: %q", sender.calls[0])
 	}
 }
 
+func TestPipelineStartSendsWelcome(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			AllowedUserIDs: []int64{1},
+			WelcomeMessage: "Hi! Try `status`.",
+		},
+		Policy: PolicyConfig{CommandAllowlist: []string{"status"}},
+	}
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, sender, nil, nil)
+	send := func(userID int64) {
+		broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+			From: TelegramUser{ID: userID},
+			Chat: TelegramChat{ID: 99},
+			Text: "/start",
+		}})
+	}
+
+	send(1)
+	if len(sender.calls) != 1 || sender.calls[0] != "Hi! Try `status`." {
+		t.Fatalf("expected welcome message, got %v", sender.calls)
+	}
+	send(2)
+	if len(sender.calls) != 2 || sender.calls[1] != "Unauthorized user." {
+		t.Fatalf("expected unauthorized reply, got %v", sender.calls)
+	}
+}
+
 func TestPipelineLLMChatSkipsExecution(t *testing.T) {
 	cfg := &BrokerConfig{
 		Telegram: TelegramConfig{
@@ -195,3 +377,609 @@ func TestPipelineCapabilitiesQuestionReturnsHelp(t *testing.T) {
 		t.Fatalf("expected capabilities response, got %q", sender.calls[0])
 	}
 }
+
+func TestPipelineSanitizesInvalidUTF8Output(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			BotToken:       "token",
+			AllowedUserIDs: []int64{1},
+		},
+		Policy: PolicyConfig{
+			CommandAllowlist: []string{"ls"},
+		},
+	}
+	rl := newRateLimiter(time.Minute, 0)
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		return &api.CommandResponse{Ok: true, ExitCode: 0, Stdout: "caf\xe9.txt\n"}, nil
+	})
+	sender := &senderStub{}
+	broker := newBroker(cfg, rl, exec, sender, nil, nil)
+
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: "ls",
+	}})
+
+	if len(sender.calls) != 1 {
+		t.Fatalf("expected 1 send call, got %d", len(sender.calls))
+	}
+	if !utf8.ValidString(sender.calls[0]) {
+		t.Fatalf("expected valid UTF-8 reply, got %q", sender.calls[0])
+	}
+	if !strings.Contains(sender.calls[0], "caf�.txt") {
+		t.Fatalf("expected replacement character in reply, got %q", sender.calls[0])
+	}
+
+	// Agent errors are sanitized too.
+	failing := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		return nil, errors.New("open caf\xe9.txt")
+	})
+	sender = &senderStub{}
+	newBroker(cfg, rl, failing, sender, nil, nil).processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: "ls",
+	}})
+	if len(sender.calls) != 1 || !utf8.ValidString(sender.calls[0]) {
+		t.Fatalf("expected a valid UTF-8 agent error, got %q", sender.calls)
+	}
+
+	disabled := false
+	cfg.Policy.SanitizeUTF8 = &disabled
+	if got, _ := renderResponse("ls", &api.CommandResponse{Ok: true, Stdout: "caf\xe9"}, outputPlain, cfg.Policy.sanitizeUTF8()); utf8.ValidString(got) {
+		t.Fatalf("expected raw output when sanitization is disabled, got %q", got)
+	}
+}
+
+func TestPipelineSummarizesFlaggedCommandOutput(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			BotToken:       "token",
+			AllowedUserIDs: []int64{1},
+		},
+		LLM: LLMConfig{
+			Enabled:           true,
+			SummaryMaxInputKB: 1,
+		},
+		Policy: PolicyConfig{
+			CommandAllowlist: []string{"logs"},
+		},
+	}
+	rl := newRateLimiter(time.Minute, 0)
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		// The executor, local or forwarded, flags the response for summary.
+		return &api.CommandResponse{Ok: true, ExitCode: 0, Stdout: strings.Repeat("line of log output\n", 500), Summarize: true}, nil
+	})
+	sender := &senderStub{}
+	llm := &llmStub{
+		decision: &api.LLMDecision{Type: "command", Intent: "logs", Confidence: 1},
+		summary:  "all services healthy",
+	}
+	broker := newBroker(cfg, rl, exec, sender, llm, nil)
+
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: "show logs",
+	}})
+
+	if len(sender.calls) != 1 {
+		t.Fatalf("expected 1 send call, got %d", len(sender.calls))
+	}
+	if sender.calls[0] != "logs (summary):\nall services healthy" {
+		t.Fatalf("unexpected reply: %q", sender.calls[0])
+	}
+	if max := 1024 + len("\n[truncated]\n"); len(llm.summaryInput) > max {
+		t.Fatalf("expected summary input capped at %d bytes, got %d", max, len(llm.summaryInput))
+	}
+
+	// Summaries pass through sanitize_utf8 like any other reply.
+	llm.summary = "caf\xe9 healthy"
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: "show logs again",
+	}})
+	if len(sender.calls) != 2 || sender.calls[1] != "logs (summary):\ncaf\uFFFD healthy" {
+		t.Fatalf("expected a sanitized summary, got %q", sender.calls)
+	}
+}
+
+func TestPipelineIntentPolicyRejectsLLMArgs(t *testing.T) {
+	maxArgs := 1
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			BotToken:       "token",
+			AllowedUserIDs: []int64{1},
+		},
+		LLM: LLMConfig{Enabled: true},
+		Policy: PolicyConfig{
+			CommandAllowlist: []string{"ls"},
+			IntentPolicy: map[string]IntentPolicy{
+				"ls": {MaxArgs: &maxArgs, AllowedFlags: []string{"-l"}},
+			},
+		},
+	}
+	cases := []struct {
+		name    string
+		args    []string
+		wantRun bool
+		reply   string
+	}{
+		{name: "allowed", args: []string{"-l"}, wantRun: true},
+		{name: "too many args", args: []string{"-l", "Movies"}, reply: "Rejected LLM arguments: too many args (2 > 1)"},
+		{name: "flag not allowed", args: []string{"-R"}, reply: "Rejected LLM arguments: flag not allowed: -R"},
+		{name: "path not allowed", args: []string{"../etc"}, reply: "Rejected LLM arguments: paths not allowed: ../etc"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			called := false
+			exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+				called = true
+				return &api.CommandResponse{Ok: true}, nil
+			})
+			sender := &senderStub{}
+			llm := &llmStub{decision: &api.LLMDecision{Type: "command", Intent: "ls", Args: tc.args, Confidence: 1}}
+			broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, llm, nil)
+
+			broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+				From: TelegramUser{ID: 1},
+				Chat: TelegramChat{ID: 99},
+				Text: "list my files",
+			}})
+
+			if called != tc.wantRun {
+				t.Fatalf("expected executor called=%t, got %t", tc.wantRun, called)
+			}
+			if tc.reply != "" && (len(sender.calls) != 1 || sender.calls[0] != tc.reply) {
+				t.Fatalf("unexpected reply: %v", sender.calls)
+			}
+		})
+	}
+}
+
+func TestPipelineSkipsDuplicateUpdate(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			BotToken:       "token",
+			AllowedUserIDs: []int64{1},
+		},
+		Policy: PolicyConfig{
+			CommandAllowlist: []string{"status"},
+		},
+	}
+	rl := newRateLimiter(time.Minute, 0)
+	calls := 0
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		calls++
+		return &api.CommandResponse{Ok: true, ExitCode: 0, Stdout: "ok"}, nil
+	})
+	broker := newBroker(cfg, rl, exec, &senderStub{}, nil, nil)
+
+	update := TelegramUpdate{UpdateID: 42, Message: &TelegramMessage{
+		MessageID: 7,
+		From:      TelegramUser{ID: 1},
+		Chat:      TelegramChat{ID: 99},
+		Text:      "/status",
+	}}
+
+	broker.processUpdate(update)
+	broker.processUpdate(update)
+
+	if calls != 1 {
+		t.Fatalf("expected 1 execution, got %d", calls)
+	}
+}
+
+func TestPipelineHandlesEditedMessages(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		cfg := &BrokerConfig{
+			Telegram: TelegramConfig{AllowedUserIDs: []int64{1}, HandleEdits: enabled},
+			Policy:   PolicyConfig{CommandAllowlist: []string{"ls", "status"}},
+		}
+		ran := []string{}
+		exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+			ran = append(ran, req.Command)
+			return &api.CommandResponse{Ok: true}, nil
+		})
+		broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, &senderStub{}, nil, nil)
+		message := func(text string, editDate int64) *TelegramMessage {
+			return &TelegramMessage{MessageID: 7, From: TelegramUser{ID: 1}, Chat: TelegramChat{ID: 99}, Text: text, EditDate: editDate}
+		}
+
+		broker.processUpdate(TelegramUpdate{UpdateID: 1, Message: message("stauts", 0)})
+		edit := TelegramUpdate{UpdateID: 2, EditedMessage: message("status", 100)}
+		broker.processUpdate(edit)
+		// A redelivered edit runs once; a later edit of the same message runs again.
+		broker.processUpdate(edit)
+		broker.processUpdate(TelegramUpdate{UpdateID: 3, EditedMessage: message("ls", 200)})
+
+		want := []string{}
+		if enabled {
+			want = []string{"status", "ls"}
+		}
+		if strings.Join(ran, ",") != strings.Join(want, ",") {
+			t.Fatalf("handle_edits=%v: expected %v to run, got %v", enabled, want, ran)
+		}
+	}
+}
+
+func TestPipelineIntentConfidenceThreshold(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			BotToken:       "token",
+			AllowedUserIDs: []int64{1},
+		},
+		LLM: LLMConfig{
+			Enabled:             true,
+			ConfidenceThreshold: 0.7,
+			IntentConfidence:    map[string]float64{"rm": 0.95},
+		},
+		Policy: PolicyConfig{
+			CommandAllowlist: []string{"ls", "rm"},
+		},
+	}
+	cases := []struct {
+		intent  string
+		wantRun bool
+	}{
+		{intent: "ls", wantRun: true},
+		{intent: "rm", wantRun: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.intent, func(t *testing.T) {
+			called := false
+			exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+				called = true
+				return &api.CommandResponse{Ok: true}, nil
+			})
+			sender := &senderStub{}
+			llm := &llmStub{decision: &api.LLMDecision{Type: "command", Intent: tc.intent, Confidence: 0.8}}
+			broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, llm, nil)
+
+			broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+				From: TelegramUser{ID: 1},
+				Chat: TelegramChat{ID: 99},
+				Text: "please " + tc.intent,
+			}})
+
+			if called != tc.wantRun {
+				t.Fatalf("expected executor called=%t, got %t", tc.wantRun, called)
+			}
+			if !tc.wantRun && (len(sender.calls) != 1 || !strings.Contains(sender.calls[0], "not confident")) {
+				t.Fatalf("expected low-confidence reply, got %v", sender.calls)
+			}
+		})
+	}
+}
+
+func TestPipelineAuditsLLMDecision(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			BotToken:       "token",
+			AllowedUserIDs: []int64{1},
+		},
+		LLM: LLMConfig{
+			Enabled:             true,
+			ConfidenceThreshold: 0.9,
+		},
+		Policy: PolicyConfig{
+			CommandAllowlist: []string{"ls"},
+		},
+	}
+	audit := &auditStub{}
+	llm := &llmStub{decision: &api.LLMDecision{Type: "command", Intent: "ls", Confidence: 0.42}}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, &senderStub{}, llm, audit)
+
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: "show files",
+	}})
+
+	var decision, rejected *AuditEvent
+	for i := range audit.events {
+		switch audit.events[i].Type {
+		case "llm_decision":
+			decision = &audit.events[i]
+		case "llm_rejected_low_confidence":
+			rejected = &audit.events[i]
+		}
+	}
+	if decision == nil || !strings.Contains(decision.Message, "intent=ls") || !strings.Contains(decision.Message, "confidence=0.42") {
+		t.Fatalf("expected llm_decision event with confidence, got %+v", audit.events)
+	}
+	if rejected == nil || rejected.Outcome != "denied" || !strings.Contains(rejected.Message, "threshold=0.90") {
+		t.Fatalf("expected llm_rejected_low_confidence event, got %+v", audit.events)
+	}
+}
+
+func TestPipelineLLMRateLimitSkipsLLM(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			BotToken:       "token",
+			AllowedUserIDs: []int64{1},
+		},
+		LLM: LLMConfig{
+			Enabled:            true,
+			RateLimitPerMinute: 2,
+		},
+		Policy: PolicyConfig{
+			CommandAllowlist: []string{"status"},
+		},
+	}
+	sender := &senderStub{}
+	llm := &llmStub{decision: &api.LLMDecision{Type: "chat", Response: "hi", Confidence: 1}}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, sender, llm, nil)
+
+	for i := 0; i < 3; i++ {
+		broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+			From: TelegramUser{ID: 1},
+			Chat: TelegramChat{ID: 99},
+			Text: "hello there",
+		}})
+	}
+
+	if llm.calls != 2 {
+		t.Fatalf("expected 2 LLM calls, got %d", llm.calls)
+	}
+	if len(sender.calls) != 3 || !strings.Contains(sender.calls[2], "slow down") {
+		t.Fatalf("expected slow down reply, got %v", sender.calls)
+	}
+}
+
+func TestPipelineSendsTypingIndicatorWhenEnabled(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		cfg := &BrokerConfig{
+			Telegram: TelegramConfig{
+				BotToken:        "token",
+				AllowedUserIDs:  []int64{1},
+				TypingIndicator: enabled,
+			},
+			Policy: PolicyConfig{
+				CommandAllowlist: []string{"status"},
+			},
+		}
+		sender := &senderStub{}
+		exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+			return &api.CommandResponse{Ok: true, Stdout: "ok"}, nil
+		})
+		broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, nil)
+
+		broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+			From: TelegramUser{ID: 1},
+			Chat: TelegramChat{ID: 99},
+			Text: "/status",
+		}})
+
+		if enabled && (len(sender.actions) != 1 || sender.actions[0] != "typing") {
+			t.Fatalf("expected one typing action, got %v", sender.actions)
+		}
+		if !enabled && len(sender.actions) != 0 {
+			t.Fatalf("expected no chat actions when disabled, got %v", sender.actions)
+		}
+	}
+}
+
+func TestNormalizeCommandTokenizesQuotes(t *testing.T) {
+	cases := []struct {
+		text string
+		cmd  string
+		args []string
+	}{
+		{text: `/Write notes.txt "hello world"`, cmd: "write", args: []string{"notes.txt", "hello world"}},
+		{text: `cat my\ file.txt`, cmd: "cat", args: []string{"my file.txt"}},
+		{text: `echo 'it''s' "say \"hi\"" "a\b" ""`, cmd: "echo", args: []string{"its", `say "hi"`, `a\b`, ""}},
+		{text: "  ls   -la  ", cmd: "ls", args: []string{"-la"}},
+	}
+	for _, tc := range cases {
+		cmd, args, err := normalizeCommand(tc.text)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tc.text, err)
+		}
+		if cmd != tc.cmd || strings.Join(args, "|") != strings.Join(tc.args, "|") || len(args) != len(tc.args) {
+			t.Fatalf("%q: got cmd=%q args=%q, want cmd=%q args=%q", tc.text, cmd, args, tc.cmd, tc.args)
+		}
+	}
+
+	for _, text := range []string{`write notes.txt "hello`, `echo 'oops`, `echo trailing\`} {
+		if _, _, err := normalizeCommand(text); err == nil {
+			t.Fatalf("%q: expected error", text)
+		}
+	}
+}
+
+func TestPipelineRejectsUnbalancedQuotes(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			BotToken:       "token",
+			AllowedUserIDs: []int64{1},
+		},
+		Policy: PolicyConfig{
+			CommandAllowlist: []string{"write"},
+		},
+	}
+	called := false
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		called = true
+		return &api.CommandResponse{Ok: true}, nil
+	})
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, nil)
+
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: `write notes.txt "hello`,
+	}})
+
+	if called {
+		t.Fatalf("expected executor not to be called")
+	}
+	if len(sender.calls) != 1 || sender.calls[0] != `Could not parse command: unbalanced " quote` {
+		t.Fatalf("unexpected reply: %v", sender.calls)
+	}
+}
+
+func TestPipelineAuditsFailedSend(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"status"}},
+	}
+	audit := &auditStub{}
+	sender := &senderStub{sendErr: errors.New("telegram status 429: too many requests")}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, sender, nil, audit)
+
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 2},
+		Chat: TelegramChat{ID: 99},
+		Text: "status",
+	}})
+
+	last := audit.events[len(audit.events)-1]
+	if last.Type != "send_failed" || !strings.Contains(last.Message, "429") {
+		t.Fatalf("expected send_failed audit event, got %+v", audit.events)
+	}
+}
+
+func TestPipelineRateLimitShortWindow(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"status"}, RateLimitPerMinute: 1, RateLimitWindowSec: 1},
+	}
+	if got := cfg.Policy.rateLimitWindow(); got != time.Second {
+		t.Fatalf("expected a 1s window, got %s", got)
+	}
+	calls := 0
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		calls++
+		return &api.CommandResponse{Ok: true}, nil
+	})
+	sender := &senderStub{}
+	// A shorter window than the config's keeps the test fast.
+	broker := newBroker(cfg, newRateLimiter(50*time.Millisecond, 1), exec, sender, nil, nil)
+	send := func() {
+		broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+			From: TelegramUser{ID: 1},
+			Chat: TelegramChat{ID: 99},
+			Text: "status",
+		}})
+	}
+
+	send()
+	send()
+	if calls != 1 {
+		t.Fatalf("expected the second command to be limited, got %d runs", calls)
+	}
+	if last := sender.calls[len(sender.calls)-1]; last != "Rate limit exceeded (1 per 50ms). Try again soon." {
+		t.Fatalf("unexpected rate limit reply %q", last)
+	}
+	time.Sleep(60 * time.Millisecond)
+	send()
+	if calls != 2 {
+		t.Fatalf("expected the window to have passed, got %d runs", calls)
+	}
+}
+
+func TestReactInsteadOfReplyForSilentCommands(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}},
+		Policy: PolicyConfig{
+			CommandAllowlist:    []string{"touch", "status"},
+			ReactInsteadOfReply: []string{"touch"},
+		},
+	}
+	outputs := map[string]*api.CommandResponse{
+		"touch":  {Ok: true},
+		"status": {Ok: true},
+	}
+	sender := &senderStub{}
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		if len(req.Args) > 0 {
+			switch req.Args[0] {
+			case "fail":
+				return &api.CommandResponse{Ok: false, ExitCode: 1, Error: "exit status 1"}, nil
+			case "loud":
+				return &api.CommandResponse{Ok: true, Stdout: "created"}, nil
+			}
+		}
+		return outputs[req.Command], nil
+	})
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, nil)
+	messageID := int64(0)
+	send := func(text string) {
+		sender.calls, sender.reactions = nil, nil
+		messageID++
+		broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+			MessageID: messageID,
+			From:      TelegramUser{ID: 1},
+			Chat:      TelegramChat{ID: 99},
+			Text:      text,
+		}})
+	}
+
+	send("touch a")
+	if len(sender.calls) != 0 || len(sender.reactions) != 1 || sender.reactions[0] != reactionOK {
+		t.Fatalf("expected a success reaction only, got calls=%v reactions=%v", sender.calls, sender.reactions)
+	}
+	send("touch fail")
+	if len(sender.calls) != 0 || len(sender.reactions) != 1 || sender.reactions[0] != reactionFailed {
+		t.Fatalf("expected a failure reaction only, got calls=%v reactions=%v", sender.calls, sender.reactions)
+	}
+	send("touch loud")
+	if len(sender.reactions) != 0 || len(sender.calls) != 1 || sender.calls[0] != "touch:\ncreated" {
+		t.Fatalf("expected output to be replied as text, got calls=%v reactions=%v", sender.calls, sender.reactions)
+	}
+	send("status")
+	if len(sender.reactions) != 0 || len(sender.calls) != 1 || sender.calls[0] != "status:\n(no output)" {
+		t.Fatalf("expected unlisted command to reply, got calls=%v reactions=%v", sender.calls, sender.reactions)
+	}
+
+	sender.reactErr = errors.New("REACTION_INVALID")
+	send("touch a")
+	if len(sender.calls) != 1 || sender.calls[0] != "touch:\n(no output)" {
+		t.Fatalf("expected a text reply when the reaction fails, got %v", sender.calls)
+	}
+}
+
+type ctxExecutorStub func(ctx context.Context, req api.CommandRequest) (*api.CommandResponse, error)
+
+func (e ctxExecutorStub) Execute(ctx context.Context, req api.CommandRequest) (*api.CommandResponse, error) {
+	return e(ctx, req)
+}
+
+func TestRequestTimeoutCancelsSlowExecutor(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}, RequestTimeoutSec: 1},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"status"}},
+	}
+	var execErr error
+	exec := ctxExecutorStub(func(ctx context.Context, req api.CommandRequest) (*api.CommandResponse, error) {
+		select {
+		case <-ctx.Done():
+			execErr = ctx.Err()
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Second):
+			return &api.CommandResponse{Ok: true, Stdout: "too late"}, nil
+		}
+	})
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, nil)
+
+	start := time.Now()
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: "status",
+	}})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the request deadline to stop the executor, took %s", elapsed)
+	}
+	if !errors.Is(execErr, context.DeadlineExceeded) {
+		t.Fatalf("expected executor context to hit the deadline, got %v", execErr)
+	}
+	if len(sender.calls) != 1 || sender.calls[0] != "Command timed out after 1s." {
+		t.Fatalf("expected a timeout reply, got %v", sender.calls)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunPollExitsOnConflictWhenConfigured(t *testing.T) {
+	cfg := &BrokerConfig{Telegram: TelegramConfig{PollIntervalSec: 1, OnPollConflict: "exit"}}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, &senderStub{}, nil, nil)
+
+	fetch := func(offset int64) ([]TelegramUpdate, error) {
+		return nil, errPollConflict
+	}
+	err := broker.runPoll(context.Background(), fetch, func(time.Duration) {
+		t.Fatalf("expected no sleep before exiting")
+	})
+	if !errors.Is(err, errPollConflict) {
+		t.Fatalf("expected conflict error, got %v", err)
+	}
+}
+
+func TestNormalizeOnPollConflict(t *testing.T) {
+	if got, err := normalizeOnPollConflict(""); err != nil || got != "backoff" {
+		t.Fatalf("expected backoff by default, got %q err=%v", got, err)
+	}
+	if got, err := normalizeOnPollConflict(" Exit "); err != nil || got != "exit" {
+		t.Fatalf("expected exit, got %q err=%v", got, err)
+	}
+	if _, err := normalizeOnPollConflict("exti"); err == nil {
+		t.Fatalf("expected unknown action to be rejected")
+	}
+}
+
+func TestRunPollBacksOffOnConflict(t *testing.T) {
+	cfg := &BrokerConfig{Telegram: TelegramConfig{PollIntervalSec: 1, OnPollConflict: "backoff"}}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, &senderStub{}, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fetches := 0
+	fetch := func(offset int64) ([]TelegramUpdate, error) {
+		fetches++
+		return nil, errPollConflict
+	}
+	var slept []time.Duration
+	sleep := func(d time.Duration) {
+		slept = append(slept, d)
+		if len(slept) == 2 {
+			cancel()
+		}
+	}
+
+	if err := broker.runPoll(ctx, fetch, sleep); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fetches != 2 {
+		t.Fatalf("expected polling to retry after conflict, got %d fetches", fetches)
+	}
+	for _, d := range slept {
+		if d != pollConflictBackoff {
+			t.Fatalf("expected conflict backoff %s, got %s", pollConflictBackoff, d)
+		}
+	}
+}
+
+func TestRunPollBacksOffExponentiallyOnErrors(t *testing.T) {
+	cfg := &BrokerConfig{Telegram: TelegramConfig{PollIntervalSec: 2}}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, &senderStub{}, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Four failures, one empty success, then another failure.
+	results := []error{errors.New("down"), errors.New("down"), errors.New("down"), errors.New("down"), nil, errors.New("down")}
+	fetch := func(offset int64) ([]TelegramUpdate, error) {
+		err := results[0]
+		results = results[1:]
+		if len(results) == 0 {
+			cancel()
+		}
+		return nil, err
+	}
+	var slept []time.Duration
+	if err := broker.runPoll(ctx, fetch, func(d time.Duration) { slept = append(slept, d) }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 2 * time.Second, 2 * time.Second}
+	if len(slept) != len(want) {
+		t.Fatalf("expected sleeps %v, got %v", want, slept)
+	}
+	for i := range want {
+		if slept[i] != want[i] {
+			t.Fatalf("expected sleeps %v, got %v", want, slept)
+		}
+	}
+	if got := pollErrorBackoff(2*time.Second, 50); got != pollErrorBackoffMax {
+		t.Fatalf("expected backoff capped at %s, got %s", pollErrorBackoffMax, got)
+	}
+}
+
+func TestRunPollPersistsOffset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offset")
+	cfg := &BrokerConfig{Telegram: TelegramConfig{PollIntervalSec: 1, OffsetFile: path}}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, &senderStub{}, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fetch := func(offset int64) ([]TelegramUpdate, error) {
+		cancel()
+		return []TelegramUpdate{{UpdateID: 10}}, nil
+	}
+	if err := broker.runPoll(ctx, fetch, func(time.Duration) {}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := loadPollOffset(path); got != 11 {
+		t.Fatalf("expected persisted offset 11, got %d", got)
+	}
+
+	restarted := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, &senderStub{}, nil, nil)
+	ctx, cancel = context.WithCancel(context.Background())
+	var first int64 = -1
+	fetch = func(offset int64) ([]TelegramUpdate, error) {
+		first = offset
+		cancel()
+		return nil, nil
+	}
+	if err := restarted.runPoll(ctx, fetch, func(time.Duration) {}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first != 11 {
+		t.Fatalf("expected restart to resume at offset 11, got %d", first)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// redactionMask replaces text matched by policy.redact_patterns.
+const redactionMask = "***"
+
+// outputRedactor masks secrets in command output and audit messages.
+type outputRedactor []*regexp.Regexp
+
+func compileRedactPatterns(patterns []string) (outputRedactor, error) {
+	out := make(outputRedactor, 0, len(patterns))
+	for i, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("policy.redact_patterns[%d]: %v", i, err)
+		}
+		out = append(out, re)
+	}
+	return out, nil
+}
+
+func (r outputRedactor) apply(s string) string {
+	for _, re := range r {
+		s = re.ReplaceAllString(s, redactionMask)
+	}
+	return s
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+func TestRedactPatternsMaskReplyAndAudit(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}},
+		Policy: PolicyConfig{
+			CommandAllowlist: []string{"env", "login"},
+			RedactPatterns:   []string{`(?i)token=\S+`, `hunter2`},
+		},
+	}
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		if req.Command == "login" {
+			return &api.CommandResponse{Ok: false, ExitCode: 1, Stderr: "login with hunter2 failed", Error: "exit status 1 (token=abc123)"}, nil
+		}
+		return &api.CommandResponse{Ok: true, Stdout: "HOME=/root\nAPI_TOKEN=abc123\n"}, nil
+	})
+	sender := &senderStub{}
+	audit := &auditStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, audit)
+	for _, text := range []string{"env", "login"} {
+		broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+			From: TelegramUser{ID: 1},
+			Chat: TelegramChat{ID: 99},
+			Text: text,
+		}})
+	}
+
+	if len(sender.calls) != 2 {
+		t.Fatalf("expected two replies, got %v", sender.calls)
+	}
+	for _, reply := range sender.calls {
+		if strings.Contains(reply, "abc123") || strings.Contains(reply, "hunter2") {
+			t.Fatalf("reply leaks a secret: %q", reply)
+		}
+	}
+	if !strings.Contains(sender.calls[0], "API_***") || !strings.Contains(sender.calls[0], "HOME=/root") {
+		t.Fatalf("expected only the secret masked, got %q", sender.calls[0])
+	}
+	logged := false
+	for _, e := range audit.events {
+		if strings.Contains(e.Message, "abc123") {
+			t.Fatalf("audit event leaks a secret: %+v", e)
+		}
+		if e.Type == "execution" && e.Message == "exit status 1 (***" {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Fatalf("expected masked execution event, got %+v", audit.events)
+	}
+}
+
+func TestCompileRedactPatternsRejectsInvalidRegex(t *testing.T) {
+	if _, err := compileRedactPatterns([]string{"ok", "("}); err == nil || !strings.Contains(err.Error(), "redact_patterns[1]") {
+		t.Fatalf("expected invalid pattern to be reported, got %v", err)
+	}
+}
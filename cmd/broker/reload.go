@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// config and executor return the broker's current config and executor.
+func (b *Broker) config() *BrokerConfig {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cfg
+}
+
+func (b *Broker) executor() Executor {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.exec
+}
+
+// newPipelineContext snapshots the broker's reloadable state so an update is
+// handled with one config from start to finish. The returned func releases
+// the request deadline and must be called when the update is done.
+func (b *Broker) newPipelineContext(clientIP string) (*pipelineContext, context.CancelFunc) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	reqCtx, done := b.cfg.Telegram.requestContext(context.Background())
+	return &pipelineContext{
+		cfg:       b.cfg,
+		rl:        b.rl,
+		llmRL:     b.llmRL,
+		adminRL:   b.adminRL,
+		exec:      b.exec,
+		sender:    b.sender,
+		llm:       b.llm,
+		audit:     b.audit,
+		confirm:   b.confirm,
+		clarify:   b.clarify,
+		running:   b.running,
+		history:   b.history,
+		redactor:  b.redactor,
+		requestID: randomHex(8),
+		clientIP:  clientIP,
+		reqCtx:    reqCtx,
+	}, done
+}
+
+// requestContext returns the context an update is handled under, derived from
+// parent with the telegram.request_timeout_sec deadline when one is set.
+func (t TelegramConfig) requestContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if t.RequestTimeoutSec <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, time.Duration(t.RequestTimeoutSec)*time.Second)
+}
+
+// apply swaps in a reloaded config, executor, and LLM client. Rate limiters
+// keep their history and only take the new limits.
+func (b *Broker) apply(cfg *BrokerConfig, exec Executor, llm LLMClient) {
+	// loadConfig has already rejected invalid patterns.
+	redactor, err := compileRedactPatterns(cfg.Policy.RedactPatterns)
+	if err != nil {
+		log.Printf("redact patterns: %v", err)
+	}
+	if b.rl != nil {
+		b.rl.setLimit(cfg.Policy.rateLimitWindow(), cfg.Policy.RateLimitPerMinute)
+	}
+	if b.llmRL != nil {
+		b.llmRL.setLimit(time.Minute, cfg.LLM.RateLimitPerMinute)
+	}
+	if b.adminRL != nil {
+		b.adminRL.setLimit(time.Minute, cfg.Telegram.adminNotifyPerMinute())
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cfg = cfg
+	b.exec = exec
+	b.llm = llm
+	b.redactor = redactor
+}
+
+// reloadConfig re-reads the config at path, with its overlays, and swaps the
+// executor, rate limits, and policy of the running brokers. Chat working
+// directories, the execution queue, rate-limit history, and poll offsets are
+// kept. A config that fails to load or validate, that changes how the bots
+// connect to Telegram, or that changes working directory settings or queue
+// limits leaves the brokers untouched.
+func reloadConfig(path string, overlays []string, brokers []*Broker) error {
+	cfg, err := loadConfig(path, overlays...)
+	if err != nil {
+		return err
+	}
+	if err := validateExecutionConfig(cfg); err != nil {
+		return err
+	}
+	tenants := tenantConfigs(cfg)
+	if len(tenants) != len(brokers) {
+		return fmt.Errorf("telegram.bots changed from %d to %d bots; restart to apply", len(brokers), len(tenants))
+	}
+	for i, b := range brokers {
+		cur, next := b.config().Telegram, tenants[i].Telegram
+		if cur.Mode != next.Mode || cur.BotToken != next.BotToken || cur.WebhookPath != next.WebhookPath ||
+			cur.WebhookPathPrefix != next.WebhookPathPrefix || b.config().ListenAddr != cfg.ListenAddr {
+			return fmt.Errorf("telegram connection settings changed; restart to apply")
+		}
+	}
+
+	var prev *localExecutor
+	if len(brokers) > 0 {
+		prev = localExecutorOf(brokers[0].executor())
+	}
+	if prev != nil {
+		cur, next := prev.cfg.Execution.Local, cfg.Execution.Local
+		if cur.SharedChatCWD != next.SharedChatCWD || cur.CWDStateFile != next.CWDStateFile ||
+			!reflect.DeepEqual(cur.ChatBaseDirs, next.ChatBaseDirs) {
+			return fmt.Errorf("working directory settings changed; restart to apply")
+		}
+		if cur.MaxConcurrent != next.MaxConcurrent || cur.MaxQueued != next.MaxQueued {
+			return fmt.Errorf("execution queue limits changed; restart to apply")
+		}
+	}
+	exec := buildExecutorFrom(cfg, prev)
+	llm := newOpenAIClient(cfg.LLM)
+	for i, b := range brokers {
+		b.apply(tenants[i], exec, llm)
+	}
+	return nil
+}
+
+// localExecutorOf returns the local executor behind exec, looking through
+// command routing, or nil in forward-only mode.
+func localExecutorOf(exec Executor) *localExecutor {
+	switch e := exec.(type) {
+	case *localExecutor:
+		return e
+	case *routingExecutor:
+		if l := localExecutorOf(e.fallback); l != nil {
+			return l
+		}
+		for _, route := range e.routes {
+			if l := localExecutorOf(route); l != nil {
+				return l
+			}
+		}
+	}
+	return nil
+}
+
+// reloadOnSIGHUP reloads the config whenever the process receives SIGHUP,
+// logging and keeping the running config when the new one is invalid.
+func reloadOnSIGHUP(path string, overlays []string, brokers []*Broker) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadConfig(path, overlays, brokers); err != nil {
+				log.Printf("reload config: %v; keeping the running config", err)
+				continue
+			}
+			log.Printf("reloaded config from %s", path)
+		}
+	}()
+}
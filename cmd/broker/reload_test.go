@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+func TestReloadConfigSwapsAllowlistAndKeepsState(t *testing.T) {
+	base := t.TempDir()
+	if err := os.Mkdir(filepath.Join(base, "notes"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "broker.json")
+	write := func(body string) {
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	configWith := func(dynamic string) string {
+		return fmt.Sprintf(`{"telegram":{"bot_token":"t","allowed_user_ids":[1]},"execution":{"local":{"base_dir":%q,"dynamic_allowlist":[%s]}}}`, base, dynamic)
+	}
+	write(configWith(`"cd","pwd"`))
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(cfg.Policy.rateLimitWindow(), cfg.Policy.RateLimitPerMinute), buildExecutor(cfg), sender, nil, nil)
+	send := func(text string) string {
+		sender.calls = nil
+		broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+			From: TelegramUser{ID: 1},
+			Chat: TelegramChat{ID: 99},
+			Text: text,
+		}})
+		return strings.Join(sender.calls, "\n")
+	}
+
+	send("cd notes")
+	if got := send("echo hi"); got != "Command not allowed." {
+		t.Fatalf("expected echo to be refused before reload, got %q", got)
+	}
+
+	write(configWith(`"cd","pwd","echo"`))
+	if err := reloadConfig(path, nil, []*Broker{broker}); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := send("echo hi"); !strings.Contains(got, "hi") || strings.Contains(got, "not allowed") {
+		t.Fatalf("expected reloaded allowlist to allow echo, got %q", got)
+	}
+	if got := send("pwd"); !strings.Contains(got, filepath.Join(base, "notes")) {
+		t.Fatalf("expected working directory to survive reload, got %q", got)
+	}
+
+	write(`{"telegram":`)
+	if err := reloadConfig(path, nil, []*Broker{broker}); err == nil {
+		t.Fatalf("expected invalid config to be rejected")
+	}
+	write(strings.Replace(configWith(`"echo"`), `"bot_token":"t"`, `"bot_token":"other"`, 1))
+	if err := reloadConfig(path, nil, []*Broker{broker}); err == nil || !strings.Contains(err.Error(), "restart to apply") {
+		t.Fatalf("expected a changed bot token to need a restart, got %v", err)
+	}
+	if got := send("echo still"); !strings.Contains(got, "still") {
+		t.Fatalf("expected a rejected reload to keep the running config, got %q", got)
+	}
+}
+
+func TestReloadConfigKeepsExecQueueAndCWDSettings(t *testing.T) {
+	base := t.TempDir()
+	path := filepath.Join(t.TempDir(), "broker.json")
+	configWith := func(rate int, shared bool) string {
+		return fmt.Sprintf(`{"telegram":{"bot_token":"t","allowed_user_ids":[1]},"policy":{"rate_limit_per_minute":%d},"execution":{"local":{"base_dir":%q,"shared_chat_cwd":%t,"max_concurrent":1,"dynamic_allowlist":["pwd"],"command_allowlist":{"nap":{"exec":"/bin/sh","args":["-c","sleep 1"]}}}}}`, rate, base, shared)
+	}
+	if err := os.WriteFile(path, []byte(configWith(10, false)), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	broker := newBroker(cfg, newRateLimiter(cfg.Policy.rateLimitWindow(), cfg.Policy.RateLimitPerMinute), buildExecutor(cfg), &senderStub{}, nil, nil)
+	queue := localExecutorOf(broker.executor()).queue
+
+	done := make(chan *api.CommandResponse)
+	go func() {
+		resp, _ := broker.executor().Execute(context.Background(), api.CommandRequest{Command: "nap", ChatID: 1})
+		done <- resp
+	}()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		queue.mu.Lock()
+		busy := queue.free == 0
+		queue.mu.Unlock()
+		if busy {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nap never took the execution slot")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := os.WriteFile(path, []byte(configWith(20, false)), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := reloadConfig(path, nil, []*Broker{broker}); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := localExecutorOf(broker.executor()).queue; got != queue {
+		t.Fatalf("expected the reloaded executor to keep the exec queue")
+	}
+	// With max_concurrent 1 a second command waits for the slot nap holds.
+	waitCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	resp, _ := broker.executor().Execute(waitCtx, api.CommandRequest{Command: "nap", ChatID: 1})
+	if resp.Ok || resp.Reason != api.ReasonBusy || !strings.Contains(resp.Error, "deadline exceeded") {
+		t.Fatalf("expected the running command to still hold the only slot, got %+v", resp)
+	}
+	if resp := <-done; !resp.Ok {
+		t.Fatalf("expected the command running across the reload to finish, got %+v", resp)
+	}
+
+	if err := os.WriteFile(path, []byte(configWith(20, true)), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := reloadConfig(path, nil, []*Broker{broker}); err == nil || !strings.Contains(err.Error(), "restart to apply") {
+		t.Fatalf("expected a shared_chat_cwd change to need a restart, got %v", err)
+	}
+}
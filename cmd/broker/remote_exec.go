@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -18,6 +19,7 @@ type remoteExecutor struct {
 	authToken    string
 	client       *http.Client
 	maxBodyBytes int64
+	gzipRequests bool
 }
 
 func newRemoteExecutor(cfg *BrokerConfig) *remoteExecutor {
@@ -26,32 +28,65 @@ func newRemoteExecutor(cfg *BrokerConfig) *remoteExecutor {
 		authToken:    cfg.Execution.ForwardAuthToken,
 		client:       &http.Client{Timeout: 15 * time.Second},
 		maxBodyBytes: 1 << 20,
+		gzipRequests: cfg.Execution.ForwardGzip,
 	}
 }
 
 func (e *remoteExecutor) Execute(ctx context.Context, req api.CommandRequest) (*api.CommandResponse, error) {
 	body, _ := json.Marshal(req)
+	if e.gzipRequests {
+		var err error
+		if body, err = gzipBytes(body); err != nil {
+			return nil, err
+		}
+	}
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.forwardURL, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
+	// Setting Accept-Encoding ourselves turns off the transport's transparent
+	// decompression, so the response is decoded explicitly below.
+	httpReq.Header.Set("Accept-Encoding", "gzip")
+	if e.gzipRequests {
+		httpReq.Header.Set("Content-Encoding", "gzip")
+	}
 	if e.authToken != "" {
 		httpReq.Header.Set("X-Auth-Token", e.authToken)
 	}
+	if req.RequestID != "" {
+		httpReq.Header.Set("X-Request-ID", req.RequestID)
+	}
 
 	resp, err := e.client.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("agent status %d", resp.StatusCode)
+	var respReader io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		respReader = zr
 	}
-	respBody, err := io.ReadAll(io.LimitReader(resp.Body, e.maxBodyBytes))
+	respBody, err := io.ReadAll(io.LimitReader(respReader, e.maxBodyBytes))
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		// A rejected command (bad request, forbidden, or a busy agent) carries
+		// a reason the user should see; anything else is an agent or
+		// transport problem.
+		var cr api.CommandResponse
+		if (resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusServiceUnavailable) &&
+			json.Unmarshal(respBody, &cr) == nil && cr.Reason != "" {
+			return &cr, nil
+		}
+		return nil, fmt.Errorf("agent status %d", resp.StatusCode)
+	}
 	var cr api.CommandResponse
 	if err := json.Unmarshal(respBody, &cr); err != nil {
 		return nil, err
@@ -61,3 +96,15 @@ func (e *remoteExecutor) Execute(ctx context.Context, req api.CommandRequest) (*
 	}
 	return &cr, nil
 }
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"personal_ai/internal/api"
 )
@@ -56,3 +59,117 @@ func TestRemoteExecutorNonOKStatusReturnsError(t *testing.T) {
 		t.Fatalf("expected error")
 	}
 }
+
+func TestRemoteExecutorPropagatesRequestID(t *testing.T) {
+	var gotHeader, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header.Get("X-Request-ID")
+		var req api.CommandRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		gotBody = req.RequestID
+		w.Header().Set("X-Request-ID", req.RequestID)
+		_ = json.NewEncoder(w).Encode(api.CommandResponse{Ok: true, RequestID: req.RequestID})
+	}))
+	defer server.Close()
+
+	cfg := &BrokerConfig{Execution: ExecutionConfig{ForwardURL: server.URL}}
+	exec := newRemoteExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "status", RequestID: "abc123"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotHeader != "abc123" || gotBody != "abc123" {
+		t.Fatalf("expected request id in header and body, got header=%q body=%q", gotHeader, gotBody)
+	}
+	if resp.RequestID != "abc123" {
+		t.Fatalf("expected request id echoed back, got %q", resp.RequestID)
+	}
+}
+
+func TestRemoteExecutorForwardsUserName(t *testing.T) {
+	var got api.CommandRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(api.CommandResponse{Ok: true, Stdout: "ok"})
+	}))
+	defer server.Close()
+
+	cfg := &BrokerConfig{
+		Telegram:  TelegramConfig{BotToken: "token", AllowedUserIDs: []int64{1}},
+		Execution: ExecutionConfig{ForwardURL: server.URL},
+		Policy:    PolicyConfig{CommandAllowlist: []string{"status"}},
+	}
+	audit := &auditStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), newRemoteExecutor(cfg), &senderStub{}, nil, audit)
+
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1, UserName: "wir"},
+		Chat: TelegramChat{ID: 99},
+		Text: "/status",
+	}})
+
+	if got.UserName != "wir" || got.Text != "/status" {
+		t.Fatalf("expected username and text forwarded, got %+v", got)
+	}
+	if len(audit.events) == 0 || audit.events[len(audit.events)-1].UserName != "wir" {
+		t.Fatalf("expected username in audit events, got %+v", audit.events)
+	}
+}
+
+func TestRemoteExecutorReturnsRejectedResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(api.CommandResponse{Ok: false, ExitCode: 1, Error: "command blocked", Reason: api.ReasonBlocked})
+	}))
+	defer server.Close()
+
+	exec := newRemoteExecutor(&BrokerConfig{Execution: ExecutionConfig{ForwardURL: server.URL}})
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "rm"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Ok || resp.Reason != api.ReasonBlocked || resp.Error != "command blocked" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
+
+func TestRemoteExecutorGzipRoundTrip(t *testing.T) {
+	large := strings.Repeat("line of file content\n", 20000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" || r.Header.Get("Accept-Encoding") != "gzip" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req api.CommandRequest
+		if err := json.NewDecoder(zr).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		_ = json.NewEncoder(zw).Encode(api.CommandResponse{Ok: true, Stdout: req.Text})
+		_ = zw.Close()
+	}))
+	defer server.Close()
+
+	exec := newRemoteExecutor(&BrokerConfig{Execution: ExecutionConfig{ForwardURL: server.URL, ForwardGzip: true}})
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "cat", Text: large})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !resp.Ok || resp.Stdout != large {
+		t.Fatalf("round-tripped output differs: got %d bytes, want %d", len(resp.Stdout), len(large))
+	}
+}
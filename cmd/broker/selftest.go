@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// selftestCommand is the admin-only builtin that checks every allowlisted
+// command.
+const selftestCommand = "selftest"
+
+// selftestTimeout bounds a whole selftest run and selftestProbeTimeout each
+// probe within it.
+const (
+	selftestTimeout      = 30 * time.Second
+	selftestProbeTimeout = 5 * time.Second
+)
+
+// replySelftest checks the exec path of every entry in
+// execution.local.command_allowlist and runs the entries that declare a
+// probe with those args, reporting one line per command. Entries without a
+// probe are never run.
+func replySelftest(ctx *pipelineContext) bool {
+	if !isAdmin(ctx.userID, ctx.cfg) {
+		logAudit(ctx, "selftest_denied", "not an admin", "denied")
+		return sendReply(ctx, "The selftest command is limited to admins.")
+	}
+	lines, failed := runSelftest(ctx.cfg, selftestTimeout)
+	if len(lines) == 0 {
+		logAudit(ctx, "selftest", "no commands", "ok")
+		return sendReply(ctx, "No allowlisted commands to check.")
+	}
+	status := "ok"
+	if failed > 0 {
+		status = "error"
+	}
+	logAudit(ctx, "selftest", fmt.Sprintf("%d of %d failed", failed, len(lines)), status)
+	header := fmt.Sprintf("selftest: %d ok, %d failed", len(lines)-failed, failed)
+	return sendReply(ctx, header+"\n"+strings.Join(lines, "\n"))
+}
+
+// runSelftest returns one status line per allowlisted command, sorted by
+// name, and how many failed. Commands left when timeout expires are reported
+// as skipped.
+func runSelftest(cfg *BrokerConfig, timeout time.Duration) ([]string, int) {
+	local := cfg.Execution.Local
+	names := make([]string, 0, len(local.CommandAllowlist))
+	for name := range local.CommandAllowlist {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	lines := make([]string, 0, len(names))
+	failed := 0
+	for _, name := range names {
+		allowed, _, _, _ := lookupAllowedCommand(local.CommandAllowlist, name)
+		if problem := checkExecPath(allowed.Exec); problem != "" {
+			lines = append(lines, fmt.Sprintf("FAIL %s: %s %s", name, allowed.Exec, problem))
+			failed++
+			continue
+		}
+		if len(allowed.Probe) == 0 {
+			lines = append(lines, fmt.Sprintf("ok %s: %s exists", name, allowed.Exec))
+			continue
+		}
+		if ctx.Err() != nil {
+			lines = append(lines, fmt.Sprintf("skip %s: selftest time limit reached", name))
+			continue
+		}
+		probe := allowed
+		probe.Args = allowed.Probe
+		probe.CombineOutput = true
+		probeCtx, probeCancel := context.WithTimeout(ctx, selftestProbeTimeout)
+		resp := runAllowedCommand(probeCtx, probe, "", local.ExecPath, local.EnvPassthrough, 1)
+		probeCancel()
+		first, _, _ := strings.Cut(strings.TrimSpace(resp.Stdout), "\n")
+		if !resp.Ok {
+			lines = append(lines, fmt.Sprintf("FAIL %s: probe exited %d: %s", name, resp.ExitCode, resp.Error))
+			failed++
+			continue
+		}
+		if first == "" {
+			first = "probe passed"
+		}
+		lines = append(lines, fmt.Sprintf("ok %s: %s", name, first))
+	}
+	return lines, failed
+}
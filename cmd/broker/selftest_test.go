@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+func TestSelftestReportsEachAllowlistedCommand(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1, 2}, AdminUserIDs: []int64{1}},
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				CommandAllowlist: map[string]api.AllowedCommand{
+					"version":  {Exec: "/bin/echo", Probe: []string{"v1.2.3"}},
+					"halt":     {Exec: "/bin/sh", Args: []string{"-c", "exit 1"}},
+					"broken":   {Exec: "/nonexistent/tool", Probe: []string{"--version"}},
+					"relative": {Exec: "echo"},
+					"failing":  {Exec: "/bin/false", Probe: []string{"--version"}},
+				},
+			},
+		},
+	}
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, sender, nil, nil)
+	send := func(userID int64) string {
+		sender.calls = nil
+		broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+			From: TelegramUser{ID: userID},
+			Chat: TelegramChat{ID: 99},
+			Text: "/selftest",
+		}})
+		return strings.Join(sender.calls, "\n")
+	}
+
+	if got := send(2); got != "The selftest command is limited to admins." {
+		t.Fatalf("expected non-admin to be refused, got %q", got)
+	}
+	got := send(1)
+	for _, want := range []string{
+		"selftest: 2 ok, 3 failed",
+		"FAIL broken: /nonexistent/tool does not exist",
+		"FAIL failing: probe exited 1",
+		"ok halt: /bin/sh exists",
+		"FAIL relative: echo is not an absolute path",
+		"ok version: v1.2.3",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in selftest reply, got %q", want, got)
+		}
+	}
+}
+
+func TestSelftestSkipsProbesAfterTimeLimit(t *testing.T) {
+	cfg := &BrokerConfig{Execution: ExecutionConfig{Local: LocalExecutionConfig{
+		CommandAllowlist: map[string]api.AllowedCommand{
+			"a": {Exec: "/bin/echo", Probe: []string{"hi"}},
+		},
+	}}}
+	lines, failed := runSelftest(cfg, 0)
+	if failed != 0 || len(lines) != 1 || !strings.HasPrefix(lines[0], "skip a:") {
+		t.Fatalf("expected the probe to be skipped, got %v failed=%d", lines, failed)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"personal_ai/internal/api"
+)
+
+// serviceCommand is the builtin that runs actions from ManagedServices.
+const serviceCommand = "service"
+
+// serviceActionPlaceholder in a managed service's args is replaced by the
+// requested action.
+const serviceActionPlaceholder = "{action}"
+
+var serviceActions = map[string]bool{"start": true, "stop": true, "restart": true, "status": true}
+
+// resolveManagedService maps `service <name> <action>` onto the pre-approved
+// command for that service. The action replaces {action} in its args, or is
+// appended when no placeholder is present.
+func resolveManagedService(services map[string]api.AllowedCommand, args []string) (api.AllowedCommand, error) {
+	if len(args) != 2 {
+		return api.AllowedCommand{}, fmt.Errorf("usage: service <name> <start|stop|restart|status>")
+	}
+	name := strings.ToLower(strings.TrimSpace(args[0]))
+	action := strings.ToLower(strings.TrimSpace(args[1]))
+	svc, ok := services[name]
+	if !ok {
+		for key, c := range services {
+			if strings.EqualFold(key, name) {
+				svc, ok = c, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return api.AllowedCommand{}, fmt.Errorf("unknown service: %s", name)
+	}
+	if !serviceActions[action] {
+		return api.AllowedCommand{}, fmt.Errorf("unsupported service action: %s", action)
+	}
+
+	resolved := svc
+	resolved.Args = make([]string, 0, len(svc.Args)+1)
+	substituted := false
+	for _, a := range svc.Args {
+		if a == serviceActionPlaceholder {
+			a = action
+			substituted = true
+		}
+		resolved.Args = append(resolved.Args, a)
+	}
+	if !substituted {
+		resolved.Args = append(resolved.Args, action)
+	}
+	return resolved, nil
+}
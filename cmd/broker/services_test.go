@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"personal_ai/internal/api"
+)
+
+func TestResolveManagedServiceMapsAction(t *testing.T) {
+	services := map[string]api.AllowedCommand{
+		"nginx":  {Exec: "/bin/systemctl", Args: []string{"{action}", "nginx.service"}},
+		"worker": {Exec: "/usr/local/bin/workerctl"},
+	}
+
+	got, err := resolveManagedService(services, []string{"nginx", "Restart"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Exec != "/bin/systemctl" || !reflect.DeepEqual(got.Args, []string{"restart", "nginx.service"}) {
+		t.Fatalf("unexpected mapping: %+v", got)
+	}
+	if services["nginx"].Args[0] != "{action}" {
+		t.Fatalf("expected configured args to be left untouched")
+	}
+
+	got, err = resolveManagedService(services, []string{"worker", "status"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got.Args, []string{"status"}) {
+		t.Fatalf("expected action appended, got %v", got.Args)
+	}
+}
+
+func TestResolveManagedServiceRejectsUnknown(t *testing.T) {
+	services := map[string]api.AllowedCommand{
+		"nginx": {Exec: "/bin/systemctl", Args: []string{"{action}", "nginx.service"}},
+	}
+	cases := [][]string{
+		{"sshd", "restart"},
+		{"nginx", "disable"},
+		{"nginx"},
+		{"nginx", "restart", "--now"},
+	}
+	for _, args := range cases {
+		if _, err := resolveManagedService(services, args); err == nil {
+			t.Fatalf("expected %v to be rejected", args)
+		}
+	}
+}
+
+func TestLocalExecutorRunsManagedService(t *testing.T) {
+	cfg := &BrokerConfig{
+		Execution: ExecutionConfig{
+			Mode: "local",
+			Local: LocalExecutionConfig{
+				DefaultTimeoutSec: 2,
+				MaxOutputKB:       8,
+				ManagedServices: map[string]api.AllowedCommand{
+					"web": {Exec: "/bin/echo", Args: []string{"systemctl", "{action}", "web"}},
+				},
+			},
+		},
+	}
+	exec := newLocalExecutor(cfg)
+
+	resp, err := exec.Execute(context.Background(), api.CommandRequest{Command: "service", Args: []string{"web", "restart"}})
+	if err != nil || !resp.Ok {
+		t.Fatalf("service failed: %+v err=%v", resp, err)
+	}
+	if resp.Stdout != "systemctl restart web\n" {
+		t.Fatalf("unexpected output: %q", resp.Stdout)
+	}
+
+	resp, _ = exec.Execute(context.Background(), api.CommandRequest{Command: "service", Args: []string{"db", "restart"}})
+	if resp.Ok || resp.Error != "unknown service: db" || resp.Reason != api.ReasonInvalidArgs {
+		t.Fatalf("expected unknown service rejection, got %+v", resp)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// suggestCommand returns the allowlisted command closest to cmd by edit
+// distance, or "" when none is close enough to be a likely typo. Longer names
+// tolerate more edits, up to two.
+func suggestCommand(cmd string, allowlist []string) string {
+	cmd = strings.ToLower(cmd)
+	candidates := append([]string{}, allowlist...)
+	sort.Strings(candidates)
+	best, bestDist := "", 0
+	for _, c := range candidates {
+		c = strings.ToLower(c)
+		if c == cmd || strings.ContainsAny(c, "*?[") {
+			continue
+		}
+		maxDist := len(c) / 3
+		if maxDist < 1 {
+			maxDist = 1
+		}
+		if maxDist > 2 {
+			maxDist = 2
+		}
+		if d := editDistance(cmd, c); d <= maxDist && (best == "" || d < bestDist) {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// editDistance counts the insertions, deletions, substitutions and adjacent
+// transpositions turning a into b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNotAllowedSuggestsNearestCommand(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}},
+		Policy:   PolicyConfig{CommandAllowlist: []string{"status", "disk", "ls", "deploy-*"}},
+	}
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, sender, nil, nil)
+
+	cases := map[string]string{
+		"stauts": "Command not allowed. Did you mean 'status'?",
+		"dsik":   "Command not allowed. Did you mean 'disk'?",
+		"xyzzy":  "Command not allowed.",
+		"rm":     "Command not allowed.",
+	}
+	for text, want := range cases {
+		sender.calls = nil
+		broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+			From: TelegramUser{ID: 1},
+			Chat: TelegramChat{ID: 99},
+			Text: text,
+		}})
+		if len(sender.calls) != 1 || sender.calls[0] != want {
+			t.Fatalf("%s: got %v, want %q", text, sender.calls, want)
+		}
+	}
+}
+
+func TestEditDistanceCountsTranspositions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"stauts", "status", 1},
+		{"status", "status", 0},
+		{"", "ls", 2},
+		{"kitten", "sitting", 3},
+	} {
+		if got := editDistance(tc.a, tc.b); got != tc.want {
+			t.Fatalf("editDistance(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
@@ -3,34 +3,192 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
 
+// defaultTelegramAPIBaseURL is used unless telegram.api_base_url is set.
+const defaultTelegramAPIBaseURL = "https://api.telegram.org"
+
+// maxRetryAfter caps how long a single retry waits, whatever Telegram asks.
+const maxRetryAfter = 30 * time.Second
+
 type telegramSender struct {
-	token  string
-	client *http.Client
+	baseURL     string
+	token       string
+	client      *http.Client
+	maxAttempts int
+	sleep       func(time.Duration)
+}
+
+// TelegramInlineButton is a single inline keyboard button whose press is
+// delivered back to the bot as a callback_query carrying CallbackData.
+type TelegramInlineButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
 }
 
-func newTelegramSender(token string) *telegramSender {
+func newTelegramSender(baseURL, token string, maxAttempts int) *telegramSender {
+	if baseURL == "" {
+		baseURL = defaultTelegramAPIBaseURL
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
 	return &telegramSender{
-		token:  token,
-		client: &http.Client{Timeout: 10 * time.Second},
+		baseURL:     baseURL,
+		token:       token,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: maxAttempts,
+		sleep:       time.Sleep,
 	}
 }
 
 func (s *telegramSender) Send(chatID int64, text string) error {
-	if s.token == "" {
-		return fmt.Errorf("telegram bot token missing")
-	}
-	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", s.token)
+	return s.call("sendMessage", messagePayload(chatID, text, nil))
+}
+
+// SendEntities sends text with formatting entities, such as pre blocks.
+func (s *telegramSender) SendEntities(chatID int64, text string, entities []messageEntity) error {
+	return s.call("sendMessage", messagePayload(chatID, text, entities))
+}
+
+// messagePayload builds a sendMessage payload. text is sent as is; only the
+// given entities format it.
+func messagePayload(chatID int64, text string, entities []messageEntity) map[string]any {
 	payload := map[string]any{
 		"chat_id": chatID,
 		"text":    text,
 	}
+	if len(entities) > 0 {
+		payload["entities"] = entities
+	}
+	return payload
+}
+
+// SendForEdit sends text and returns the new message's ID for EditMessage.
+func (s *telegramSender) SendForEdit(chatID int64, text string, entities []messageEntity) (int64, error) {
+	var msg struct {
+		MessageID int64 `json:"message_id"`
+	}
+	err := s.callInto("sendMessage", messagePayload(chatID, text, entities), &msg)
+	if err != nil {
+		return 0, err
+	}
+	if msg.MessageID == 0 {
+		return 0, fmt.Errorf("sendMessage returned no message_id")
+	}
+	return msg.MessageID, nil
+}
+
+// EditMessage replaces the text of a message the bot sent earlier.
+func (s *telegramSender) EditMessage(chatID, messageID int64, text string, entities []messageEntity) error {
+	payload := messagePayload(chatID, text, entities)
+	payload["message_id"] = messageID
+	return s.call("editMessageText", payload)
+}
+
+// SendKeyboard sends text with an inline keyboard attached as reply_markup.
+func (s *telegramSender) SendKeyboard(chatID int64, text string, keyboard [][]TelegramInlineButton) error {
+	return s.call("sendMessage", map[string]any{
+		"chat_id":      chatID,
+		"text":         text,
+		"reply_markup": map[string]any{"inline_keyboard": keyboard},
+	})
+}
+
+// AnswerCallback acknowledges a callback_query so the client stops showing a
+// progress indicator on the pressed button.
+func (s *telegramSender) AnswerCallback(callbackID string, text string) error {
+	payload := map[string]any{"callback_query_id": callbackID}
+	if text != "" {
+		payload["text"] = text
+	}
+	return s.call("answerCallbackQuery", payload)
+}
+
+// SendChatAction shows a status such as "typing" in the chat until the next
+// message arrives or a few seconds pass.
+func (s *telegramSender) SendChatAction(chatID int64, action string) error {
+	return s.call("sendChatAction", chatActionPayload(chatID, action))
+}
+
+func chatActionPayload(chatID int64, action string) map[string]any {
+	return map[string]any{
+		"chat_id": chatID,
+		"action":  action,
+	}
+}
+
+// SetMessageReaction replaces the bot's reaction on a message with emoji.
+func (s *telegramSender) SetMessageReaction(chatID, messageID int64, emoji string) error {
+	return s.call("setMessageReaction", reactionPayload(chatID, messageID, emoji))
+}
+
+func reactionPayload(chatID, messageID int64, emoji string) map[string]any {
+	return map[string]any{
+		"chat_id":    chatID,
+		"message_id": messageID,
+		"reaction":   []map[string]string{{"type": "emoji", "emoji": emoji}},
+	}
+}
+
+// telegramError is a failed Bot API call. RetryAfter is set from
+// parameters.retry_after when Telegram asks the bot to slow down.
+type telegramError struct {
+	Status     int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *telegramError) Error() string {
+	return fmt.Sprintf("telegram status %d: %s", e.Status, e.Body)
+}
+
+// call posts payload to method, retrying rate limits, server errors, and
+// network failures up to maxAttempts times in total.
+func (s *telegramSender) call(method string, payload map[string]any) error {
+	return s.callInto(method, payload, nil)
+}
+
+// callInto is call that also decodes the response's result into out when
+// out is non-nil.
+func (s *telegramSender) callInto(method string, payload map[string]any, out any) error {
+	if s.token == "" {
+		return fmt.Errorf("telegram bot token missing")
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = s.post(method, payload, out)
+		if err == nil || attempt >= s.maxAttempts {
+			return err
+		}
+		wait := time.Duration(attempt) * time.Second
+		var tgErr *telegramError
+		if errors.As(err, &tgErr) {
+			if tgErr.Status != http.StatusTooManyRequests && tgErr.Status < 500 {
+				return err
+			}
+			if tgErr.RetryAfter > 0 {
+				wait = tgErr.RetryAfter
+			}
+		}
+		if wait > maxRetryAfter {
+			wait = maxRetryAfter
+		}
+		log.Printf("telegram %s failed (attempt %d/%d): %v; retrying in %s", method, attempt, s.maxAttempts, err, wait)
+		s.sleep(wait)
+	}
+}
+
+func (s *telegramSender) post(method string, payload map[string]any, out any) error {
+	url := fmt.Sprintf("%s/bot%s/%s", s.baseURL, s.token, method)
 	body, _ := json.Marshal(payload)
 
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
@@ -41,12 +199,104 @@ func (s *telegramSender) Send(chatID int64, text string) error {
 
 	resp, err := s.client.Do(req)
 	if err != nil {
-		return err
+		return withoutURL(err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
-		return fmt.Errorf("telegram status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+		tgErr := &telegramError{Status: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+		var parsed struct {
+			Parameters struct {
+				RetryAfter int `json:"retry_after"`
+			} `json:"parameters"`
+		}
+		if json.Unmarshal(b, &parsed) == nil && parsed.Parameters.RetryAfter > 0 {
+			tgErr.RetryAfter = time.Duration(parsed.Parameters.RetryAfter) * time.Second
+		}
+		return tgErr
+	}
+	if out == nil {
+		return nil
+	}
+	var parsed struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&parsed); err != nil {
+		return fmt.Errorf("decode %s response: %v", method, err)
+	}
+	if err := json.Unmarshal(parsed.Result, out); err != nil {
+		return fmt.Errorf("decode %s result: %v", method, err)
 	}
 	return nil
 }
+
+// withoutURL drops the request URL from a transport error, since Telegram
+// URLs carry the bot token.
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("telegram %s: %w", strings.ToLower(urlErr.Op), urlErr.Err)
+	}
+	return err
+}
+
+// errFileTooLarge is returned by DownloadFile when a file exceeds maxBytes.
+var errFileTooLarge = errors.New("file too large")
+
+// DownloadFile resolves fileID with getFile and fetches the file's contents,
+// reading at most maxBytes.
+func (s *telegramSender) DownloadFile(fileID string, maxBytes int64) ([]byte, error) {
+	if s.token == "" {
+		return nil, fmt.Errorf("telegram bot token missing")
+	}
+	filePath, err := s.getFilePath(fileID)
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/file/bot%s/%s", s.baseURL, s.token, filePath)
+	resp, err := s.client.Get(url)
+	if err != nil {
+		return nil, withoutURL(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return nil, &telegramError{Status: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, errFileTooLarge
+	}
+	return data, nil
+}
+
+// getFilePath asks Telegram where fileID can be downloaded from.
+func (s *telegramSender) getFilePath(fileID string) (string, error) {
+	url := fmt.Sprintf("%s/bot%s/getFile", s.baseURL, s.token)
+	body, _ := json.Marshal(map[string]any{"file_id": fileID})
+	resp, err := s.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", withoutURL(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode != http.StatusOK {
+		return "", &telegramError{Status: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+	var parsed struct {
+		Ok     bool `json:"ok"`
+		Result struct {
+			FilePath string `json:"file_path"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(b, &parsed); err != nil {
+		return "", fmt.Errorf("decode getFile response: %v", err)
+	}
+	if !parsed.Ok || parsed.Result.FilePath == "" {
+		return "", fmt.Errorf("getFile returned no file_path")
+	}
+	return parsed.Result.FilePath, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatActionPayload(t *testing.T) {
+	b, err := json.Marshal(chatActionPayload(99, "typing"))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if want := `{"action":"typing","chat_id":99}`; string(b) != want {
+		t.Fatalf("unexpected payload %s, want %s", b, want)
+	}
+}
+
+func TestReactionPayload(t *testing.T) {
+	b, err := json.Marshal(reactionPayload(99, 42, "👍"))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if want := `{"chat_id":99,"message_id":42,"reaction":[{"emoji":"👍","type":"emoji"}]}`; string(b) != want {
+		t.Fatalf("unexpected payload %s, want %s", b, want)
+	}
+}
+
+func TestTelegramSenderUsesBaseURL(t *testing.T) {
+	var gotPath string
+	var got map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	sender := newTelegramSender(server.URL, "123:abc", 1)
+	if err := sender.Send(42, "hello"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if gotPath != "/bot123:abc/sendMessage" {
+		t.Fatalf("unexpected path %q", gotPath)
+	}
+	if got["chat_id"] != float64(42) || got["text"] != "hello" {
+		t.Fatalf("unexpected payload %v", got)
+	}
+}
+
+func TestTelegramSenderSendForEditAndEdit(t *testing.T) {
+	var paths []string
+	var edited map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path == "/bot123:abc/editMessageText" {
+			_ = json.NewDecoder(r.Body).Decode(&edited)
+			_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":77,"text":"first"}}`))
+	}))
+	defer server.Close()
+
+	sender := newTelegramSender(server.URL, "123:abc", 1)
+	id, err := sender.SendForEdit(42, "first", nil)
+	if err != nil || id != 77 {
+		t.Fatalf("expected message id 77, got %d err=%v", id, err)
+	}
+	if err := sender.EditMessage(42, id, "second", nil); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	if len(paths) != 2 || edited["message_id"] != float64(77) || edited["text"] != "second" {
+		t.Fatalf("unexpected calls %v payload %v", paths, edited)
+	}
+}
+
+func TestGetUpdatesUsesBaseURL(t *testing.T) {
+	var gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		_, _ = w.Write([]byte(`{"ok":true,"result":[{"update_id":5}]}`))
+	}))
+	defer server.Close()
+
+	updates, err := getUpdates(server.Client(), server.URL, "123:abc", 0, []string{"message"})
+	if err != nil {
+		t.Fatalf("getUpdates: %v", err)
+	}
+	if gotPath != "/bot123:abc/getUpdates" {
+		t.Fatalf("unexpected path %q", gotPath)
+	}
+	if len(updates) != 1 || updates[0].UpdateID != 5 {
+		t.Fatalf("unexpected updates %+v", updates)
+	}
+}
+
+func TestGetUpdatesSendsConfiguredUpdateTypes(t *testing.T) {
+	var got struct {
+		AllowedUpdates []string `json:"allowed_updates"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"result":[]}`))
+	}))
+	defer server.Close()
+
+	types := []string{"message", "edited_message", "callback_query"}
+	if _, err := getUpdates(server.Client(), server.URL, "123:abc", 0, types); err != nil {
+		t.Fatalf("getUpdates: %v", err)
+	}
+	if len(got.AllowedUpdates) != len(types) {
+		t.Fatalf("unexpected allowed_updates %v, want %v", got.AllowedUpdates, types)
+	}
+	for i, want := range types {
+		if got.AllowedUpdates[i] != want {
+			t.Fatalf("unexpected allowed_updates %v, want %v", got.AllowedUpdates, types)
+		}
+	}
+}
+
+func TestTelegramSenderRetriesAfterRateLimit(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 2","parameters":{"retry_after":2}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	sender := newTelegramSender(server.URL, "123:abc", 3)
+	var waits []time.Duration
+	sender.sleep = func(d time.Duration) { waits = append(waits, d) }
+	if err := sender.Send(42, "hello"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 attempts, got %d", calls)
+	}
+	if len(waits) != 1 || waits[0] != 2*time.Second {
+		t.Fatalf("expected one wait honoring retry_after, got %v", waits)
+	}
+}
+
+func TestTelegramSenderGivesUpAfterMaxAttempts(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	sender := newTelegramSender(server.URL, "123:abc", 2)
+	sender.sleep = func(time.Duration) {}
+	if err := sender.Send(42, "hello"); err == nil {
+		t.Fatalf("expected error after exhausting attempts")
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 attempts, got %d", calls)
+	}
+}
+
+func TestTelegramSenderDownloadFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bot123:abc/getFile":
+			var got map[string]any
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil || got["file_id"] != "doc-1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte(`{"ok":true,"result":{"file_id":"doc-1","file_path":"documents/file_1.txt"}}`))
+		case "/file/bot123:abc/documents/file_1.txt":
+			_, _ = w.Write([]byte("file contents"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	sender := newTelegramSender(server.URL, "123:abc", 1)
+	data, err := sender.DownloadFile("doc-1", 1024)
+	if err != nil || string(data) != "file contents" {
+		t.Fatalf("expected file contents, got %q err=%v", data, err)
+	}
+	if _, err := sender.DownloadFile("doc-1", 4); err != errFileTooLarge {
+		t.Fatalf("expected errFileTooLarge, got %v", err)
+	}
+
+	server.Close()
+	if _, err := sender.DownloadFile("doc-1", 1024); err == nil || strings.Contains(err.Error(), "123:abc") {
+		t.Fatalf("expected a transport error without the bot token, got %v", err)
+	}
+}
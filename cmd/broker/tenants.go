@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BotConfig describes one bot served by a multi-tenant broker. Unset fields
+// fall back to the top-level telegram settings.
+type BotConfig struct {
+	Name           string  `json:"name"`
+	BotToken       string  `json:"bot_token"`
+	WebhookPath    string  `json:"webhook_path"`
+	AllowedUserIDs []int64 `json:"allowed_user_ids"`
+	OffsetFile     string  `json:"offset_file"`
+}
+
+// normalizeBots fills in default webhook paths and rejects bots that would
+// collide on a token or path.
+func normalizeBots(bots []BotConfig) error {
+	tokens := map[string]bool{}
+	paths := map[string]bool{}
+	offsets := map[string]bool{}
+	for i := range bots {
+		bot := &bots[i]
+		bot.Name = strings.TrimSpace(bot.Name)
+		if bot.Name == "" {
+			return fmt.Errorf("telegram.bots[%d]: name is required", i)
+		}
+		if strings.TrimSpace(bot.BotToken) == "" {
+			return fmt.Errorf("telegram.bots.%s: bot_token is required", bot.Name)
+		}
+		if bot.WebhookPath == "" {
+			bot.WebhookPath = "/telegram/webhook/" + bot.Name
+		}
+		if tokens[bot.BotToken] {
+			return fmt.Errorf("telegram.bots.%s: duplicate bot_token", bot.Name)
+		}
+		if paths[bot.WebhookPath] {
+			return fmt.Errorf("telegram.bots.%s: duplicate webhook_path %q", bot.Name, bot.WebhookPath)
+		}
+		if bot.OffsetFile != "" && offsets[bot.OffsetFile] {
+			return fmt.Errorf("telegram.bots.%s: duplicate offset_file %q", bot.Name, bot.OffsetFile)
+		}
+		tokens[bot.BotToken] = true
+		paths[bot.WebhookPath] = true
+		offsets[bot.OffsetFile] = true
+	}
+	return nil
+}
+
+// tenantConfigs returns one config per bot, each a copy of cfg with that
+// bot's token, webhook path, and user allowlist. Without telegram.bots the
+// top-level settings form the only tenant.
+func tenantConfigs(cfg *BrokerConfig) []*BrokerConfig {
+	if len(cfg.Telegram.Bots) == 0 {
+		return []*BrokerConfig{cfg}
+	}
+	out := make([]*BrokerConfig, 0, len(cfg.Telegram.Bots))
+	for _, bot := range cfg.Telegram.Bots {
+		tenant := *cfg
+		tenant.Telegram.Bots = nil
+		tenant.Telegram.BotToken = bot.BotToken
+		tenant.Telegram.WebhookPath = bot.WebhookPath
+		tenant.Telegram.OffsetFile = bot.OffsetFile
+		if len(bot.AllowedUserIDs) > 0 {
+			tenant.Telegram.AllowedUserIDs = bot.AllowedUserIDs
+		}
+		out = append(out, &tenant)
+	}
+	return out
+}
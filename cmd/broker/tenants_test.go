@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+func TestWebhookRoutesTenantsByPath(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			AllowedUserIDs: []int64{1},
+			Bots: []BotConfig{
+				{Name: "home", BotToken: "home-token"},
+				{Name: "work", BotToken: "work-token", AllowedUserIDs: []int64{2}},
+			},
+		},
+		Policy: PolicyConfig{CommandAllowlist: []string{"status"}},
+	}
+	if err := normalizeBots(cfg.Telegram.Bots); err != nil {
+		t.Fatalf("normalize bots: %v", err)
+	}
+	tenants := tenantConfigs(cfg)
+	if len(tenants) != 2 || tenants[0].Telegram.BotToken != "home-token" || tenants[1].Telegram.BotToken != "work-token" {
+		t.Fatalf("unexpected tenants %+v", tenants)
+	}
+
+	executed := map[int64]int{}
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		executed[req.UserID]++
+		return &api.CommandResponse{Ok: true, Stdout: "ok"}, nil
+	})
+	senders := []*senderStub{{}, {}}
+	brokers := []*Broker{}
+	for i, tenant := range tenants {
+		brokers = append(brokers, newBroker(tenant, newRateLimiter(time.Minute, 0), exec, senders[i], nil, nil))
+	}
+	mux := newWebhookMux(brokers...)
+
+	post := func(path string, userID int64) {
+		body, _ := json.Marshal(TelegramUpdate{Message: &TelegramMessage{
+			From: TelegramUser{ID: userID},
+			Chat: TelegramChat{ID: userID},
+			Text: "status",
+		}})
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, w.Code)
+		}
+	}
+	// User 1 is allowed by the inherited top-level allowlist only on "home";
+	// user 2 only on "work".
+	post("/telegram/webhook/home", 1)
+	post("/telegram/webhook/home", 2)
+	post("/telegram/webhook/work", 2)
+	post("/telegram/webhook/work", 1)
+
+	if executed[1] != 1 || executed[2] != 1 {
+		t.Fatalf("expected one run per user on their own bot, got %v", executed)
+	}
+	for i, s := range senders {
+		if len(s.calls) != 2 || s.calls[1] != "Unauthorized user." {
+			t.Fatalf("tenant %d: unexpected replies %v", i, s.calls)
+		}
+	}
+}
+
+func TestNormalizeBotsRejectsDuplicatePaths(t *testing.T) {
+	bots := []BotConfig{
+		{Name: "a", BotToken: "one", WebhookPath: "/hook"},
+		{Name: "b", BotToken: "two", WebhookPath: "/hook"},
+	}
+	if err := normalizeBots(bots); err == nil {
+		t.Fatalf("expected duplicate webhook_path to be rejected")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultMaxUploadKB applies when execution.local.max_upload_kb is unset.
+const defaultMaxUploadKB = 1024
+
+// uploadSaver is implemented by executors that can store a file sent to the
+// bot in the chat's working directory.
+type uploadSaver interface {
+	SaveUpload(chatID, userID int64, name string, data []byte) (string, error)
+}
+
+// uploadCommand is the dynamic_allowlist entry that enables uploads.
+const uploadCommand = "upload"
+
+func (e *localExecutor) SaveUpload(chatID, userID int64, name string, data []byte) (string, error) {
+	if !isDynamicAllowed(uploadCommand, e.cfg.Execution.Local.DynamicAllowlist) {
+		return "", errUploadsDisabled
+	}
+	if isBlocked(uploadCommand, e.cfg.Execution.Local.DynamicBlocklist) {
+		return "", fmt.Errorf("uploads are blocked")
+	}
+	if e.cfg.Execution.Local.ReadOnly {
+		return "", fmt.Errorf("read-only mode: uploads are disabled")
+	}
+	base := strings.TrimSpace(e.cfg.Execution.Local.BaseDir)
+	if base == "" {
+		return "", fmt.Errorf("execution.local.base_dir not configured")
+	}
+	baseAbs, err := filepath.Abs(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid execution.local.base_dir")
+	}
+	return saveUpload(baseAbs, e.chatCWD.get(chatID, userID, baseAbs), name, data)
+}
+
+// SaveUpload stores uploads with the default executor, which owns the
+// working directory the user sees.
+func (e *routingExecutor) SaveUpload(chatID, userID int64, name string, data []byte) (string, error) {
+	saver, ok := e.fallback.(uploadSaver)
+	if !ok {
+		return "", errUploadsUnsupported
+	}
+	return saver.SaveUpload(chatID, userID, name, data)
+}
+
+var errUploadsUnsupported = errors.New("file uploads need local execution mode")
+
+var errUploadsDisabled = errors.New("uploads are disabled; add upload to execution.local.dynamic_allowlist")
+
+// checkUploadName accepts a plain file name; directories are chosen with cd.
+func checkUploadName(name string) error {
+	if strings.TrimSpace(name) == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	return nil
+}
+
+// saveUpload writes data as name in cwdAbs. Existing files are not replaced.
+func saveUpload(baseAbs, cwdAbs, name string, data []byte) (string, error) {
+	if err := checkUploadName(name); err != nil {
+		return "", err
+	}
+	target, err := sanitizePath(baseAbs, cwdAbs, name)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return "", fmt.Errorf("%s already exists", name)
+		}
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(target)
+		return "", err
+	}
+	return target, f.Close()
+}
+
+// uploadsEnabled reports whether local execution accepts uploads, so a
+// disabled deployment refuses them before downloading anything.
+func uploadsEnabled(cfg *BrokerConfig) bool {
+	local := cfg.Execution.Local
+	return isDynamicAllowed(uploadCommand, local.DynamicAllowlist) && !isBlocked(uploadCommand, local.DynamicBlocklist)
+}
+
+// stageUpload saves a document message into the chat's working directory.
+// Text messages pass through untouched.
+func stageUpload(ctx *pipelineContext) bool {
+	doc := ctx.msg.Document
+	if doc == nil {
+		return false
+	}
+	ctx.cmd = uploadCommand
+	saver, ok := ctx.exec.(uploadSaver)
+	if !ok {
+		logAudit(ctx, "upload_rejected", errUploadsUnsupported.Error(), "denied")
+		return sendReply(ctx, "File uploads need local execution mode.")
+	}
+	if !uploadsEnabled(ctx.cfg) {
+		logAudit(ctx, "upload_rejected", errUploadsDisabled.Error(), "denied")
+		return sendReply(ctx, "File uploads are disabled.")
+	}
+	if err := checkUploadName(doc.FileName); err != nil {
+		logAudit(ctx, "upload_rejected", err.Error(), "denied")
+		return sendReply(ctx, "Upload rejected: "+err.Error())
+	}
+	maxKB := ctx.cfg.Execution.Local.MaxUploadKB
+	maxBytes := int64(maxKB) * 1024
+	if doc.FileSize > maxBytes {
+		logAudit(ctx, "upload_rejected", fmt.Sprintf("size %d exceeds %d", doc.FileSize, maxBytes), "denied")
+		return sendReply(ctx, fmt.Sprintf("Upload rejected: file is larger than %d KB.", maxKB))
+	}
+	data, err := ctx.sender.DownloadFile(doc.FileID, maxBytes)
+	if errors.Is(err, errFileTooLarge) {
+		logAudit(ctx, "upload_rejected", err.Error(), "denied")
+		return sendReply(ctx, fmt.Sprintf("Upload rejected: file is larger than %d KB.", maxKB))
+	}
+	if err != nil {
+		log.Printf("download upload: %v", err)
+		logAudit(ctx, "upload_error", err.Error(), "error")
+		return sendReply(ctx, "Upload failed: could not download the file.")
+	}
+	target, err := saver.SaveUpload(ctx.chatID, ctx.userID, doc.FileName, data)
+	if err != nil {
+		logAudit(ctx, "upload_error", err.Error(), "error")
+		return sendReply(ctx, "Upload failed: "+err.Error())
+	}
+	logAudit(ctx, "upload", fmt.Sprintf("saved %d bytes", len(data)), "ok")
+	return sendReply(ctx, fmt.Sprintf("Saved %s (%d bytes).", target, len(data)))
+}
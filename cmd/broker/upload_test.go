@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStageUploadSavesDocumentInChatCWD(t *testing.T) {
+	base := t.TempDir()
+	if err := os.Mkdir(filepath.Join(base, "inbox"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}},
+		Execution: ExecutionConfig{Local: LocalExecutionConfig{
+			DefaultTimeoutSec: 2,
+			MaxOutputKB:       8,
+			MaxUploadKB:       1,
+			BaseDir:           base,
+			DynamicAllowlist:  []string{"cd", "upload"},
+		}},
+		Policy: PolicyConfig{CommandAllowlist: []string{"cd"}},
+	}
+	sender := &senderStub{files: map[string][]byte{
+		"small": []byte("hello"),
+		"big":   []byte(strings.Repeat("x", 2048)),
+	}}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), newLocalExecutor(cfg), sender, nil, nil)
+	send := func(msg *TelegramMessage) string {
+		msg.From = TelegramUser{ID: 1}
+		msg.Chat = TelegramChat{ID: 99}
+		broker.processUpdate(TelegramUpdate{Message: msg})
+		return sender.calls[len(sender.calls)-1]
+	}
+
+	send(&TelegramMessage{Text: "cd inbox"})
+	if reply := send(&TelegramMessage{Document: &TelegramDocument{FileID: "small", FileName: "notes.txt", FileSize: 5}}); !strings.HasPrefix(reply, "Saved ") {
+		t.Fatalf("expected upload to be saved, got %q", reply)
+	}
+	if b, err := os.ReadFile(filepath.Join(base, "inbox", "notes.txt")); err != nil || string(b) != "hello" {
+		t.Fatalf("expected file in chat cwd, got %q err=%v", b, err)
+	}
+	if reply := send(&TelegramMessage{Document: &TelegramDocument{FileID: "small", FileName: "notes.txt", FileSize: 5}}); !strings.Contains(reply, "already exists") {
+		t.Fatalf("expected existing file to be kept, got %q", reply)
+	}
+
+	for _, name := range []string{"../escape.txt", "..", "sub/name.txt", ""} {
+		if reply := send(&TelegramMessage{Document: &TelegramDocument{FileID: "small", FileName: name, FileSize: 5}}); !strings.HasPrefix(reply, "Upload rejected") {
+			t.Fatalf("%q: expected name to be rejected, got %q", name, reply)
+		}
+	}
+
+	// Oversized files are refused from the declared size without downloading,
+	// and from the downloaded size when Telegram omits it.
+	sender.downloads = nil
+	if reply := send(&TelegramMessage{Document: &TelegramDocument{FileID: "big", FileName: "big.txt", FileSize: 2048}}); !strings.Contains(reply, "larger than 1 KB") {
+		t.Fatalf("expected size rejection, got %q", reply)
+	}
+	if len(sender.downloads) != 0 {
+		t.Fatalf("expected no download for an oversized file, got %v", sender.downloads)
+	}
+	if reply := send(&TelegramMessage{Document: &TelegramDocument{FileID: "big", FileName: "big.txt"}}); !strings.Contains(reply, "larger than 1 KB") {
+		t.Fatalf("expected size rejection after download, got %q", reply)
+	}
+	if _, err := os.Stat(filepath.Join(base, "inbox", "big.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected oversized file not to be written, err=%v", err)
+	}
+
+	// Uploads need an upload entry in dynamic_allowlist and honour the blocklist.
+	cfg.Execution.Local.DynamicBlocklist = []string{"upload"}
+	if reply := send(&TelegramMessage{Document: &TelegramDocument{FileID: "small", FileName: "blocked.txt", FileSize: 5}}); reply != "File uploads are disabled." {
+		t.Fatalf("expected blocklisted uploads to be refused, got %q", reply)
+	}
+	cfg.Execution.Local.DynamicBlocklist = nil
+	cfg.Execution.Local.DynamicAllowlist = []string{"cd"}
+	if reply := send(&TelegramMessage{Document: &TelegramDocument{FileID: "small", FileName: "off.txt", FileSize: 5}}); reply != "File uploads are disabled." {
+		t.Fatalf("expected uploads off without an upload entry, got %q", reply)
+	}
+	if _, err := os.Stat(filepath.Join(base, "inbox", "off.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected disabled upload not to be written, err=%v", err)
+	}
+}
+
+func TestSaveUploadRejectsSymlinkEscape(t *testing.T) {
+	base := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(base, "link")); err != nil {
+		t.Skipf("symlink: %v", err)
+	}
+	if _, err := saveUpload(base, filepath.Join(base, "link"), "x.txt", []byte("x")); err == nil {
+		t.Fatalf("expected symlinked cwd outside base_dir to be rejected")
+	}
+}
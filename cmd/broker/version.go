@@ -0,0 +1,12 @@
+package main
+
+import "personal_ai/internal/version"
+
+// versionCommand is the builtin that reports the broker's build.
+const versionCommand = "version"
+
+func replyVersion(ctx *pipelineContext) bool {
+	info := version.Get()
+	logAudit(ctx, "version", info.Version, "ok")
+	return sendReply(ctx, "shelly "+info.String())
+}
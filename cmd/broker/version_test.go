@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"personal_ai/internal/version"
+)
+
+func TestVersionBuiltinReportsInjectedVersion(t *testing.T) {
+	saved := version.Version
+	version.Version = "1.4.0-test"
+	defer func() { version.Version = saved }()
+
+	cfg := &BrokerConfig{Telegram: TelegramConfig{AllowedUserIDs: []int64{1}, WebhookPath: "/telegram/webhook"}}
+	sender := &senderStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), nil, sender, nil, nil)
+	broker.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: "/version",
+	}})
+	if len(sender.calls) != 1 || !strings.Contains(sender.calls[0], "1.4.0-test") {
+		t.Fatalf("expected injected version in reply, got %v", sender.calls)
+	}
+
+	w := httptest.NewRecorder()
+	newWebhookMux(broker).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var info version.Info
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || info.Version != "1.4.0-test" || info.GoVersion == "" {
+		t.Fatalf("unexpected /version response %d %s", w.Code, w.Body.String())
+	}
+}
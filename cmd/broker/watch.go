@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+// watchCommand is the builtin that re-runs a command and edits one message
+// with each result.
+const watchCommand = "watch"
+
+// Defaults for policy.watch_min_interval_sec and policy.watch_max_duration_sec.
+const (
+	defaultWatchMinInterval = 5 * time.Second
+	defaultWatchMaxDuration = 5 * time.Minute
+)
+
+// watchNow, watchSleep, and watchStart drive the watch loop; tests replace
+// them. sleep reports false when ctx ends first, and start runs the loop in
+// the background.
+var (
+	watchStart = func(run func()) { go run() }
+	watchNow   = time.Now
+	watchSleep = func(ctx context.Context, d time.Duration) bool {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+)
+
+func (p PolicyConfig) watchLimits() (minInterval, maxDuration time.Duration) {
+	minInterval, maxDuration = defaultWatchMinInterval, defaultWatchMaxDuration
+	if p.WatchMinIntervalSec > 0 {
+		minInterval = time.Duration(p.WatchMinIntervalSec) * time.Second
+	}
+	if p.WatchMaxDurationSec > 0 {
+		maxDuration = time.Duration(p.WatchMaxDurationSec) * time.Second
+	}
+	return minInterval, maxDuration
+}
+
+// parseWatchInterval accepts whole seconds ("10") or a Go duration ("1m").
+func parseWatchInterval(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// replyWatch handles `watch <interval> <command> [args...]`. The command
+// passes the usual policy checks, then runs every interval until
+// policy.watch_max_duration_sec elapses or the user sends cancel. The loop
+// runs in the background, so the chat's queue and the webhook request are
+// released while it runs.
+func replyWatch(ctx *pipelineContext, args []string) bool {
+	minInterval, maxDuration := ctx.cfg.Policy.watchLimits()
+	if len(args) < 2 {
+		return sendReply(ctx, "Usage: watch <interval> <command> [args...]")
+	}
+	interval, err := parseWatchInterval(args[0])
+	if err != nil || interval < minInterval || interval > maxDuration {
+		return sendReply(ctx, fmt.Sprintf("The watch interval must be between %s and %s.", minInterval, maxDuration))
+	}
+	ctx.cmd = strings.ToLower(strings.TrimPrefix(args[1], "/"))
+	ctx.args = args[2:]
+	if ctx.cmd == watchCommand || isCommandAllowed(ctx.cmd, ctx.cfg.Policy.ConfirmCommands) {
+		logAudit(ctx, "watch_denied", "command cannot be watched", "denied")
+		return sendReply(ctx, ctx.cmd+" cannot be watched.")
+	}
+	if stagePolicy(ctx) {
+		return true
+	}
+
+	// The update's own context ends when this returns; the watch keeps its
+	// values and is bounded by the watch duration instead.
+	watchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx.reqCtx), maxDuration)
+	release := func() {}
+	if ctx.running != nil {
+		release = ctx.running.track(runningCommand{
+			chatID:  ctx.chatID,
+			userID:  ctx.userID,
+			command: watchCommand,
+			args:    args,
+			started: time.Now(),
+			cancel:  cancel,
+		})
+	}
+	logAudit(ctx, "watch", fmt.Sprintf("every %s for up to %s", interval, maxDuration), "ok")
+	watchStart(func() {
+		defer cancel()
+		defer release()
+		outcome := runWatch(watchCtx, ctx, interval, maxDuration)
+		recordHistory(ctx, outcome)
+	})
+	return true
+}
+
+// runWatch runs the command until maxDuration elapses or watchCtx is
+// cancelled, editing a single message with each result. It returns the
+// history outcome.
+func runWatch(watchCtx context.Context, ctx *pipelineContext, interval, maxDuration time.Duration) string {
+	line := strings.TrimSpace(ctx.cmd + " " + strings.Join(ctx.args, " "))
+	deadline := watchNow().Add(maxDuration)
+	var messageID int64
+	var last string
+	var lastEntities []messageEntity
+	for run := 1; ; run++ {
+		result, entities := runWatchOnce(watchCtx, ctx)
+		if watchCtx.Err() != nil {
+			break
+		}
+		last, lastEntities = result, entities
+		header := fmt.Sprintf("watch %s every %s (run %d, %s):\n", line, interval, run, watchNow().Format("15:04:05"))
+		text, entities := header+result, shiftEntities(header, entities)
+		if messageID == 0 {
+			id, err := ctx.sender.SendForEdit(ctx.chatID, text, entities)
+			if err != nil {
+				log.Printf("send telegram: %v", err)
+				logAudit(ctx, "send_failed", err.Error(), "error")
+				return "error"
+			}
+			messageID = id
+		} else if err := ctx.sender.EditMessage(ctx.chatID, messageID, text, entities); err != nil {
+			log.Printf("edit telegram message: %v", err)
+			logAudit(ctx, "send_failed", err.Error(), "error")
+		}
+		if !watchNow().Add(interval).Before(deadline) || !watchSleep(watchCtx, interval) {
+			break
+		}
+	}
+
+	outcome, status := "ok", "finished"
+	if errors.Is(watchCtx.Err(), context.Canceled) {
+		outcome, status = "cancelled", "cancelled"
+	}
+	logAudit(ctx, "watch_"+status, line, "ok")
+	header := fmt.Sprintf("watch %s %s:\n", line, status)
+	final, entities := header+last, shiftEntities(header, lastEntities)
+	if messageID == 0 {
+		sendFormattedReply(ctx, final, entities)
+	} else if err := ctx.sender.EditMessage(ctx.chatID, messageID, final, entities); err != nil {
+		log.Printf("edit telegram message: %v", err)
+	}
+	return outcome
+}
+
+// runWatchOnce executes the command under the request deadline, audits it,
+// and renders its redacted reply.
+func runWatchOnce(watchCtx context.Context, ctx *pipelineContext) (string, []messageEntity) {
+	runCtx, done := ctx.cfg.Telegram.requestContext(watchCtx)
+	defer done()
+	resp, err := ctx.exec.Execute(runCtx, api.CommandRequest{
+		Command:   ctx.cmd,
+		UserID:    ctx.userID,
+		UserName:  ctx.msg.From.UserName,
+		ChatID:    ctx.chatID,
+		Text:      ctx.msg.Text,
+		Args:      ctx.args,
+		RequestID: ctx.requestID,
+	})
+	if err != nil {
+		logAudit(ctx, "execution_error", err.Error(), "error")
+		return ctx.cfg.Policy.sanitizeReply("Agent error: " + ctx.redactor.apply(err.Error())), nil
+	}
+	resp.Stdout = ctx.redactor.apply(resp.Stdout)
+	resp.Stderr = ctx.redactor.apply(resp.Stderr)
+	resp.Error = ctx.redactor.apply(resp.Error)
+	if resp.Ok {
+		logExecutionAudit(ctx, resp, "watch", "ok")
+	} else {
+		logExecutionAudit(ctx, resp, resp.Error, "error")
+	}
+	return renderResponse(ctx.cmd, resp, ctx.cfg.Policy.outputFormat(ctx.cmd), ctx.cfg.Policy.sanitizeUTF8())
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+// fakeWatchClock makes watch sleeps advance a fake clock instantly.
+func fakeWatchClock(t *testing.T) *[]time.Duration {
+	t.Helper()
+	now := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	var slept []time.Duration
+	savedNow, savedSleep, savedStart := watchNow, watchSleep, watchStart
+	watchStart = func(run func()) { run() }
+	watchNow = func() time.Time { return now }
+	watchSleep = func(ctx context.Context, d time.Duration) bool {
+		slept = append(slept, d)
+		now = now.Add(d)
+		return ctx.Err() == nil
+	}
+	t.Cleanup(func() { watchNow, watchSleep, watchStart = savedNow, savedSleep, savedStart })
+	return &slept
+}
+
+func newWatchBroker(exec Executor) (*Broker, *senderStub) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{AllowedUserIDs: []int64{1}},
+		Policy: PolicyConfig{
+			CommandAllowlist:    []string{"status"},
+			WatchMinIntervalSec: 2,
+			WatchMaxDurationSec: 10,
+		},
+	}
+	sender := &senderStub{}
+	return newBroker(cfg, newRateLimiter(time.Minute, 0), exec, sender, nil, nil), sender
+}
+
+func sendWatch(b *Broker, text string) {
+	b.processUpdate(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: text,
+	}})
+}
+
+func TestWatchRerunsUntilMaxDuration(t *testing.T) {
+	slept := fakeWatchClock(t)
+	runs := 0
+	broker, sender := newWatchBroker(executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		runs++
+		return &api.CommandResponse{Ok: true, Stdout: fmt.Sprintf("load %d", runs)}, nil
+	}))
+
+	sendWatch(broker, "watch 3 status")
+	// Runs at 0s, 3s, 6s, and 9s; a fifth at 12s would pass the 10s limit.
+	if runs != 4 || len(*slept) != 3 {
+		t.Fatalf("expected 4 runs and 3 sleeps, got %d runs, sleeps %v", runs, *slept)
+	}
+	for _, d := range *slept {
+		if d != 3*time.Second {
+			t.Fatalf("expected 3s sleeps, got %v", *slept)
+		}
+	}
+	if len(sender.calls) != 1 || !strings.Contains(sender.calls[0], "run 1") || !strings.Contains(sender.calls[0], "load 1") {
+		t.Fatalf("expected one sent message for the first run, got %q", sender.calls)
+	}
+	if len(sender.edits) != 4 || !strings.Contains(sender.edits[2], "load 4") {
+		t.Fatalf("expected the message to be edited per run, got %q", sender.edits)
+	}
+	if last := sender.edits[3]; !strings.Contains(last, "finished") || !strings.Contains(last, "load 4") {
+		t.Fatalf("expected a final finished edit, got %q", last)
+	}
+}
+
+func TestWatchStopsOnCancelAndChecksBounds(t *testing.T) {
+	fakeWatchClock(t)
+	var broker *Broker
+	runs := 0
+	broker, sender := newWatchBroker(executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		runs++
+		if runs == 2 {
+			broker.running.cancel(99)
+		}
+		return &api.CommandResponse{Ok: true, Stdout: "up"}, nil
+	}))
+
+	sendWatch(broker, "watch 2 status")
+	if runs != 2 || len(sender.edits) != 1 || !strings.Contains(sender.edits[0], "cancelled") {
+		t.Fatalf("expected watch to stop after cancel, got %d runs, edits %q", runs, sender.edits)
+	}
+	if entries := broker.history.last(99, 1, 0); len(entries) != 1 || entries[0].outcome != "cancelled" {
+		t.Fatalf("expected a cancelled history entry, got %+v", entries)
+	}
+
+	for text, want := range map[string]string{
+		"watch 1 status":  "between 2s and 10s",
+		"watch 1m status": "between 2s and 10s",
+		"watch 5 disk":    "Command not allowed.",
+		"watch 5":         "Usage: watch",
+	} {
+		sendWatch(broker, text)
+		if got := sender.calls[len(sender.calls)-1]; !strings.Contains(got, want) {
+			t.Fatalf("%s: expected %q, got %q", text, want, got)
+		}
+	}
+	if runs != 2 {
+		t.Fatalf("expected rejected watches not to run, got %d runs", runs)
+	}
+}
+
+func TestWatchRunsInBackgroundAndAuditsEachRun(t *testing.T) {
+	fakeWatchClock(t)
+	finished := make(chan struct{})
+	watchStart = func(run func()) {
+		go func() {
+			defer close(finished)
+			run()
+		}()
+	}
+	release := make(chan struct{})
+	broker, _ := newWatchBroker(executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		<-release
+		return &api.CommandResponse{Ok: true, Stdout: "up"}, nil
+	}))
+	audit := &auditStub{}
+	broker.audit = audit
+
+	// sendWatch returns while the first run is still blocked.
+	sendWatch(broker, "watch 5 status")
+	close(release)
+	<-finished
+
+	runs := 0
+	for _, e := range audit.events {
+		if e.Type == "execution" && e.Command == "status" {
+			runs++
+		}
+	}
+	if runs != 2 {
+		t.Fatalf("expected an execution audit event per run, got %+v", audit.events)
+	}
+	if entries := broker.history.last(99, 1, 0); len(entries) != 1 || entries[0].outcome != "ok" {
+		t.Fatalf("expected a finished history entry, got %+v", entries)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"personal_ai/internal/version"
+)
+
+// newWebhookMux serves each broker's Telegram webhook at its configured path
+// and, when a proxy path prefix is configured, at the prefixed path as well.
+// Build information is served at /version.
+func newWebhookMux(brokers ...*Broker) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", version.Handler)
+	for _, broker := range brokers {
+		cfg := broker.config()
+		h := broker.webhookHandler()
+		mux.HandleFunc(cfg.Telegram.WebhookPath, h)
+		if prefix := strings.TrimRight(strings.TrimSpace(cfg.Telegram.WebhookPathPrefix), "/"); prefix != "" {
+			mux.HandleFunc(path.Join("/", prefix, cfg.Telegram.WebhookPath), h)
+		}
+	}
+	return mux
+}
+
+// defaultMaxWebhookBodyBytes is used when telegram.max_webhook_body_bytes is
+// unset.
+const defaultMaxWebhookBodyBytes = 1 << 20
+
+func (b *Broker) webhookHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		limit := b.config().Telegram.MaxWebhookBodyBytes
+		if limit <= 0 {
+			limit = defaultMaxWebhookBodyBytes
+		}
+		if r.ContentLength > limit {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		// Read one byte past the limit so an oversized body without a
+		// Content-Length is rejected instead of parsed truncated.
+		body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > limit {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		var update TelegramUpdate
+		if err := json.Unmarshal(body, &update); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		<-b.enqueueUpdate(update, clientIP(r, b.config().Telegram.TrustProxyHeaders))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// clientIP returns the request's remote IP. With trustProxy set, the first
+// X-Forwarded-For entry or X-Real-IP wins over the socket address.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			if ip := strings.TrimSpace(first); ip != "" {
+				return ip
+			}
+		}
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"personal_ai/internal/api"
+)
+
+func TestWebhookHandlerRecordsForwardedClientIP(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			BotToken:          "token",
+			WebhookPath:       "/telegram/webhook",
+			WebhookPathPrefix: "/bots/shelly/",
+			TrustProxyHeaders: true,
+			AllowedUserIDs:    []int64{1},
+		},
+		Policy: PolicyConfig{CommandAllowlist: []string{"status"}},
+	}
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		return &api.CommandResponse{Ok: true}, nil
+	})
+	audit := &auditStub{}
+	broker := newBroker(cfg, newRateLimiter(time.Minute, 0), exec, &senderStub{}, nil, audit)
+	mux := newWebhookMux(broker)
+
+	body, _ := json.Marshal(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: "status",
+	}})
+	req := httptest.NewRequest(http.MethodPost, "/bots/shelly/telegram/webhook", bytes.NewReader(body))
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if len(audit.events) == 0 {
+		t.Fatalf("expected audit events")
+	}
+	for _, e := range audit.events {
+		if e.ClientIP != "203.0.113.7" {
+			t.Fatalf("expected forwarded client IP, got %q", e.ClientIP)
+		}
+	}
+}
+
+func TestClientIPIgnoresProxyHeadersUnlessTrusted(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/telegram/webhook", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if got := clientIP(req, false); got != "10.0.0.1" {
+		t.Fatalf("expected socket address, got %q", got)
+	}
+	req.Header.Del("X-Forwarded-For")
+	req.Header.Set("X-Real-IP", "198.51.100.2")
+	if got := clientIP(req, true); got != "198.51.100.2" {
+		t.Fatalf("expected X-Real-IP, got %q", got)
+	}
+}
+
+func TestWebhookHandlerRejectsOversizedBody(t *testing.T) {
+	cfg := &BrokerConfig{
+		Telegram: TelegramConfig{
+			WebhookPath:         "/telegram/webhook",
+			AllowedUserIDs:      []int64{1},
+			MaxWebhookBodyBytes: 256,
+		},
+		Policy: PolicyConfig{CommandAllowlist: []string{"status"}},
+	}
+	executed := 0
+	exec := executorStub(func(req api.CommandRequest) (*api.CommandResponse, error) {
+		executed++
+		return &api.CommandResponse{Ok: true}, nil
+	})
+	mux := newWebhookMux(newBroker(cfg, newRateLimiter(time.Minute, 0), exec, &senderStub{}, nil, nil))
+
+	body, _ := json.Marshal(TelegramUpdate{Message: &TelegramMessage{
+		From: TelegramUser{ID: 1},
+		Chat: TelegramChat{ID: 99},
+		Text: "status " + strings.Repeat("x", 300),
+	}})
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/telegram/webhook", bytes.NewReader(body)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for oversized Content-Length, got %d", w.Code)
+	}
+
+	// Without a Content-Length the body is read one byte past the limit.
+	req := httptest.NewRequest(http.MethodPost, "/telegram/webhook", io.MultiReader(bytes.NewReader(body)))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for oversized streamed body, got %d", w.Code)
+	}
+	if executed != 0 {
+		t.Fatalf("expected oversized updates not to run, got %d", executed)
+	}
+}
@@ -0,0 +1,11 @@
+package api
+
+import "errors"
+
+// Path containment errors from the dynamic commands' path checks. Callers
+// match them with errors.Is; responses carry them as ReasonPathOutsideBase
+// and ReasonSymlinkEscape.
+var (
+	ErrPathOutsideBase = errors.New("path outside base_dir")
+	ErrSymlinkEscape   = errors.New("symlink points outside base_dir")
+)
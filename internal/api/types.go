@@ -1,16 +1,35 @@
 package api
 
 type AllowedCommand struct {
-	Exec string   `json:"exec"`
-	Args []string `json:"args"`
+	Exec          string   `json:"exec"`
+	Args          []string `json:"args"`
+	Priority      int      `json:"priority"`
+	Summarize     bool     `json:"summarize"`
+	CombineOutput bool     `json:"combine_output"`
+	AllowStdin    bool     `json:"allow_stdin"`
+	Description   string   `json:"description,omitempty"`
+	RunAsUser     string   `json:"run_as_user,omitempty"`
+	RunAsGroup    string   `json:"run_as_group,omitempty"`
+	// MaxOutputKB overrides the executor's max_output_kb when positive.
+	MaxOutputKB int `json:"max_output_kb,omitempty"`
+	// Mutating marks commands that change state; read-only mode refuses them.
+	Mutating bool `json:"mutating,omitempty"`
+	// WorkDir is the absolute directory the command runs in; empty keeps
+	// the process working directory.
+	WorkDir string `json:"work_dir,omitempty"`
+	// Probe holds args, such as ["--version"], that selftest may run the
+	// command with; commands without one only have their exec path checked.
+	Probe []string `json:"probe,omitempty"`
 }
 
 type CommandRequest struct {
-	Command string   `json:"command"`
-	UserID  int64    `json:"user_id"`
-	ChatID  int64    `json:"chat_id"`
-	Text    string   `json:"text"`
-	Args    []string `json:"args"`
+	Command   string   `json:"command"`
+	UserID    int64    `json:"user_id"`
+	UserName  string   `json:"user_name,omitempty"`
+	ChatID    int64    `json:"chat_id"`
+	Text      string   `json:"text"`
+	Args      []string `json:"args"`
+	RequestID string   `json:"request_id,omitempty"`
 }
 
 type CommandResponse struct {
@@ -19,8 +38,30 @@ type CommandResponse struct {
 	Stdout   string `json:"stdout"`
 	Stderr   string `json:"stderr"`
 	Error    string `json:"error"`
+	// Reason is a stable machine-readable code for requests rejected before
+	// running; Error stays human-readable.
+	Reason    string `json:"reason,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// Summarize carries the allowlist entry's summarize flag so the broker
+	// summarizes output from forwarded commands too.
+	Summarize bool `json:"summarize,omitempty"`
 }
 
+// Rejection reasons reported in CommandResponse.Reason.
+const (
+	ReasonEmptyCommand     = "empty_command"
+	ReasonInvalidArgs      = "invalid_args"
+	ReasonBlocked          = "blocked"
+	ReasonNotAllowed       = "not_allowed"
+	ReasonUnauthorized     = "unauthorized"
+	ReasonBadRequest       = "bad_request"
+	ReasonMethodNotAllowed = "method_not_allowed"
+	ReasonReadOnly         = "read_only"
+	ReasonPathOutsideBase  = "path_outside_base"
+	ReasonSymlinkEscape    = "symlink_escape"
+	ReasonBusy             = "busy"
+)
+
 type LLMDecision struct {
 	Type       string   `json:"type"`
 	Intent     string   `json:"intent"`
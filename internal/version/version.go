@@ -0,0 +1,47 @@
+// Package version reports build information injected at link time, e.g.
+//
+//	go build -ldflags "-X personal_ai/internal/version.Version=1.4.0 \
+//	  -X personal_ai/internal/version.Commit=$(git rev-parse --short HEAD) \
+//	  -X personal_ai/internal/version.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/broker
+package version
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+)
+
+// Set with -ldflags "-X"; the defaults mark an unversioned build.
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// Info is the build information served at /version.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the running binary's build information.
+func Get() Info {
+	return Info{Version: Version, Commit: Commit, BuildDate: BuildDate, GoVersion: runtime.Version()}
+}
+
+func (i Info) String() string {
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", i.Version, i.Commit, i.BuildDate, i.GoVersion)
+}
+
+// Handler serves Get as JSON to GET requests.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(Get())
+}